@@ -0,0 +1,1006 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/cloudopsy/ekssm/internal/agent"
+	"github.com/cloudopsy/ekssm/internal/config"
+	"github.com/cloudopsy/ekssm/internal/health"
+	"github.com/cloudopsy/ekssm/internal/hooks"
+	"github.com/cloudopsy/ekssm/internal/logging"
+	"github.com/cloudopsy/ekssm/internal/state"
+	"github.com/cloudopsy/ekssm/internal/util"
+	"github.com/cloudopsy/ekssm/pkg/api"
+	"github.com/cloudopsy/ekssm/pkg/proxy"
+)
+
+const (
+	// agentStartTimeout is how long the CLI waits for an agent it started
+	// to accept connections.
+	agentStartTimeout = 5 * time.Second
+
+	// sessionReadyTimeout is how long a new session's ports have to open.
+	sessionReadyTimeout = 30 * time.Second
+
+	// serveStopTimeout is how long a serve process has to exit after
+	// SIGTERM before it is killed.
+	serveStopTimeout = 5 * time.Second
+
+	// A serve process that exits unexpectedly is restarted after a backoff
+	// that doubles up to serveRestartMaxBackoff, and starts over once a
+	// process has run for that long.
+	serveRestartMinBackoff = time.Second
+	serveRestartMaxBackoff = time.Minute
+
+	// adoptedPollInterval is how often the agent checks that a serve process
+	// it did not start itself is still running.
+	adoptedPollInterval = time.Second
+
+	// serveOutputTailSize bounds the serve process output kept for reporting
+	// why a session failed to start.
+	serveOutputTailSize = 8 << 10
+)
+
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Run the agent that owns background sessions",
+	Long: `Runs the ekssm agent in the foreground. The agent starts, supervises and stops
+background sessions, restarting a session's tunnels if its process dies, and
+serves the 'ekssm session' commands over a Unix socket at ~/.ekssm/agent.sock.
+It logs to ~/.ekssm/logs/agent.log.
+
+The session commands start an agent in the background when none is running, so
+running it yourself is only needed to watch it or to run it under a service
+manager. Sessions keep running when the agent exits; the next agent takes them
+over.
+
+With --metrics-listen, or metrics_listen in the config file, the agent serves
+Prometheus metrics about its sessions at /metrics on that address.`,
+	RunE: runAgent,
+}
+
+var agentOpts struct {
+	MetricsListen string
+}
+
+var agentStopCmd = &cobra.Command{
+	Use:   "stop",
+	Short: "Stop the agent, leaving its sessions running",
+	RunE:  stopAgent,
+}
+
+func runAgent(cmd *cobra.Command, args []string) error {
+	debug, _ := cmd.Flags().GetBool("debug")
+	logging.SetDebug(debug)
+
+	logFile, err := logging.OpenRotatingFile(util.AgentLogPath(), logging.DefaultMaxLogSize, logging.DefaultLogBackups)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	logging.SetWriter(io.MultiWriter(logFile, os.Stderr))
+	defer logging.SetOutput("stderr")
+
+	stateManager, err := state.NewManager()
+	if err != nil {
+		return fmt.Errorf("failed to initialize state manager: %w", err)
+	}
+
+	metricsListen := agentOpts.MetricsListen
+	if !cmd.Flags().Changed("metrics-listen") {
+		cfg, err := config.Load()
+		if err != nil {
+			return err
+		}
+		metricsListen = cfg.MetricsListen
+	}
+
+	socketPath := util.AgentSocketPath()
+	listener, err := agent.Listen(socketPath)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancelCtx := util.SignalContext()
+	defer cancelCtx()
+
+	sessions := newSessionAgent(stateManager)
+	if metricsListen != "" {
+		metricsListener, err := net.Listen("tcp", metricsListen)
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("failed to listen for metrics on %s: %w", metricsListen, err)
+		}
+		logging.Infof("Serving metrics on http://%s/metrics", metricsListener.Addr())
+		go sessions.serveMetrics(ctx, metricsListener)
+	}
+	sessions.adopt()
+
+	server := agent.NewServer()
+	sessions.register(server, cancelCtx)
+	closed := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		closed <- server.Close()
+	}()
+
+	logging.Infof("ekssm agent listening on %s (PID %d)", socketPath, os.Getpid())
+	if err := server.Serve(listener); err != nil {
+		return fmt.Errorf("agent stopped serving: %w", err)
+	}
+	if err := <-closed; err != nil {
+		logging.Debugf("Closing agent listener: %v", err)
+	}
+	logging.Info("ekssm agent stopped; its sessions keep running")
+	return nil
+}
+
+func stopAgent(cmd *cobra.Command, args []string) error {
+	debug, _ := cmd.Flags().GetBool("debug")
+	logging.SetDebug(debug)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := api.Dial(ctx, util.AgentSocketPath())
+	if errors.Is(err, api.ErrUnsupportedVersion) {
+		return err
+	}
+	if err != nil {
+		fmt.Println("No ekssm agent is running.")
+		return nil
+	}
+	defer client.Close()
+
+	if err := client.Shutdown(ctx); err != nil {
+		return fmt.Errorf("failed to stop ekssm agent: %w", err)
+	}
+	fmt.Println("ekssm agent stopped. Sessions keep running; the next agent takes them over.")
+	return nil
+}
+
+// connectAgent connects to the running agent, starting one in the background
+// if there is none. The agent inherits this process's environment.
+func connectAgent(debug bool) (*api.Client, error) {
+	ctx := context.Background()
+	socketPath := util.AgentSocketPath()
+	client, err := api.Dial(ctx, socketPath)
+	if err == nil {
+		return client, nil
+	}
+	// An agent that answers but speaks another API version has to be
+	// stopped first; another agent could not take over its socket.
+	if errors.Is(err, api.ErrUnsupportedVersion) {
+		return nil, err
+	}
+	logging.Debugf("No ekssm agent on %s, starting one", socketPath)
+
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate ekssm executable: %w", err)
+	}
+	agentArgs := []string{"agent"}
+	if debug {
+		agentArgs = append(agentArgs, "--debug")
+	}
+	agentCmd := exec.Command(executable, agentArgs...)
+	if err := util.StartDetached(agentCmd); err != nil {
+		return nil, fmt.Errorf("failed to start ekssm agent: %w", err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- agentCmd.Wait()
+	}()
+
+	// Another agent started at the same moment wins the socket and ours
+	// exits, so keep dialing until the deadline either way.
+	deadline := time.Now().Add(agentStartTimeout)
+	for {
+		client, err := api.Dial(ctx, socketPath)
+		if err == nil {
+			return client, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("ekssm agent did not start listening on %s within %s; see %s", socketPath, agentStartTimeout, util.AgentLogPath())
+		}
+		select {
+		case err := <-exited:
+			logging.Debugf("Started ekssm agent exited: %v", err)
+			exited = nil
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// sessionAgent runs the agent's sessions: one 'ekssm session serve' process
+// each, restarted if it dies until the session is stopped or expires.
+type sessionAgent struct {
+	manager *state.Manager
+
+	mu      sync.Mutex
+	workers map[string]*sessionWorker
+
+	// starting is held for reading from preparing a session until it is
+	// saved, and for writing by prune, so that prune does not take the
+	// kubeconfig of a session being started for an orphan.
+	starting sync.RWMutex
+}
+
+// sessionWorker supervises the serve processes of one session.
+type sessionWorker struct {
+	sessionID string
+	env       []string
+	debug     bool
+	// adopted workers took over a session from a previous agent. They do not
+	// know the environment it was started with, so they do not restart it.
+	adopted bool
+
+	mu       sync.Mutex
+	proc     *serveProcess
+	stopping bool
+	stop     chan struct{}
+}
+
+// serveProcess is a running serve process, started by this agent or adopted
+// from a previous one.
+type serveProcess struct {
+	pid        int
+	executable string
+	done       chan struct{}
+	err        error // why the process exited, once done is closed
+	output     *outputTail
+}
+
+func newSessionAgent(manager *state.Manager) *sessionAgent {
+	return &sessionAgent{manager: manager, workers: make(map[string]*sessionWorker)}
+}
+
+func (a *sessionAgent) register(server *agent.Server, shutdown func()) {
+	server.Handle(api.MethodAgentVersion, func(context.Context, json.RawMessage) (any, error) {
+		return api.VersionInfo{EkssmVersion: version, APIVersions: []string{api.Version}, PID: os.Getpid()}, nil
+	})
+	server.Handle(api.MethodSessionStart, a.handleStart)
+	server.Handle(api.MethodSessionStop, a.handleStop)
+	server.Handle(api.MethodSessionList, a.handleList)
+	server.Handle(api.MethodSessionDescribe, a.handleDescribe)
+	server.Handle(api.MethodSessionHealth, a.handleHealth)
+	server.Handle(api.MethodSessionSwitch, a.handleSwitch)
+	server.Handle(api.MethodSessionPrune, a.handlePrune)
+	server.Handle(api.MethodAgentShutdown, func(context.Context, json.RawMessage) (any, error) {
+		logging.Info("ekssm agent asked to shut down")
+		shutdown()
+		return struct{}{}, nil
+	})
+}
+
+// adopt takes over the sessions whose serve process is still running, such
+// as those of a previous agent. Sessions whose process is gone are left for
+// 'session prune' to clean up. The environment a session was started with,
+// which usually holds AWS credentials, is not saved, so adopted sessions are
+// not restarted when their process dies.
+func (a *sessionAgent) adopt() {
+	sessions, err := a.manager.GetAllSessions()
+	if err != nil {
+		logging.Warnf("Cannot adopt running sessions: %v", err)
+		return
+	}
+	for id, session := range sessions {
+		if !session.Running() {
+			logging.Warnf("Session %s is not running (PID %d); 'ekssm session prune' cleans it up", id, session.PID)
+			continue
+		}
+		w := &sessionWorker{sessionID: id, adopted: true, stop: make(chan struct{}), proc: watchProcess(session.PID)}
+		a.mu.Lock()
+		a.workers[id] = w
+		a.mu.Unlock()
+		logging.Infof("Adopted session %s (PID %d)", id, session.PID)
+		go a.supervise(w)
+	}
+}
+
+func (a *sessionAgent) handleStart(ctx context.Context, raw json.RawMessage) (any, error) {
+	var req api.StartRequest
+	if err := agent.DecodeParams(raw, &req); err != nil {
+		return nil, err
+	}
+	session, err := a.start(ctx, req)
+	if err != nil {
+		return nil, &agent.Error{Code: api.CodeStartFailed, Message: err.Error()}
+	}
+	return a.describe(session), nil
+}
+
+// start prepares the requested session, then starts its serve process and
+// waits for its ports to serve, running the session's start hooks around
+// it.
+func (a *sessionAgent) start(ctx context.Context, req api.StartRequest) (state.SessionState, error) {
+	runner, err := hooks.Load(req.ClusterName, req.Env)
+	if err != nil {
+		return state.SessionState{}, err
+	}
+	session, err := a.save(ctx, req, runner)
+	if err != nil {
+		return state.SessionState{}, err
+	}
+	started, err := a.launch(ctx, req, session)
+	if err != nil {
+		_ = runner.Run(context.Background(), hooks.OnFailure, hookSession(session), err)
+		return state.SessionState{}, err
+	}
+	_ = runner.Run(ctx, hooks.PostStart, hookSession(started), nil)
+	return started, nil
+}
+
+// save prepares the requested session and, unless a pre_start hook aborts
+// it, saves it without a serve process.
+func (a *sessionAgent) save(ctx context.Context, req api.StartRequest, runner *hooks.Runner) (state.SessionState, error) {
+	a.starting.RLock()
+	defer a.starting.RUnlock()
+	session, err := prepare(ctx, req)
+	if err != nil {
+		return state.SessionState{}, err
+	}
+	if err := runner.Run(ctx, hooks.PreStart, hookSession(session), nil); err != nil {
+		_ = removeSessionFiles(a.manager, session)
+		return state.SessionState{}, err
+	}
+	if err := a.manager.AddSession(session); err != nil {
+		_ = removeSessionFiles(a.manager, session)
+		return state.SessionState{}, fmt.Errorf("failed to save session state: %w", err)
+	}
+	return session, nil
+}
+
+// launch starts the serve process of a saved session, removing the session
+// again if it does not come up.
+func (a *sessionAgent) launch(ctx context.Context, req api.StartRequest, session state.SessionState) (state.SessionState, error) {
+	cleanup := func() {
+		_ = removeSessionFiles(a.manager, session)
+		_ = a.manager.RemoveSession(session.SessionID)
+	}
+
+	w := &sessionWorker{sessionID: session.SessionID, env: req.Env, debug: req.Debug, stop: make(chan struct{})}
+	proc, err := a.spawn(w)
+	if err != nil {
+		cleanup()
+		return state.SessionState{}, err
+	}
+	session.PID, session.Executable = proc.pid, proc.executable
+	if err := a.manager.UpdateSession(session.SessionID, proc.record); err != nil {
+		logging.Errorf("Failed to save session state: %v. Attempting to terminate proxy process PID %d...", err, proc.pid)
+		proc.terminate()
+		cleanup()
+		return state.SessionState{}, fmt.Errorf("failed to save session state after starting proxy: %w", err)
+	}
+
+	if err := waitForSession(ctx, a.manager, session, proc); err != nil {
+		proc.terminate()
+		cleanup()
+		return state.SessionState{}, err
+	}
+	if !session.Lazy {
+		recordSessionInstance(a.manager, &session)
+	}
+
+	w.proc = proc
+	a.mu.Lock()
+	a.workers[session.SessionID] = w
+	a.mu.Unlock()
+	go a.supervise(w)
+
+	logging.Infof("Started session %s for cluster %s (PID %d)", session.SessionID, session.ClusterName, proc.pid)
+	return session, nil
+}
+
+// prepare resolves a start request into a session with 'ekssm session
+// prepare', which runs with the requester's environment so that AWS is
+// called with their profile and credentials.
+func prepare(ctx context.Context, req api.StartRequest) (state.SessionState, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return state.SessionState{}, fmt.Errorf("failed to locate ekssm executable: %w", err)
+	}
+	input, err := json.Marshal(req)
+	if err != nil {
+		return state.SessionState{}, fmt.Errorf("failed to encode start request: %w", err)
+	}
+	prepareArgs := []string{"session", "prepare"}
+	if req.Debug {
+		prepareArgs = append(prepareArgs, "--debug")
+	}
+	prepareCmd := exec.CommandContext(ctx, executable, prepareArgs...)
+	prepareCmd.Env = req.Env
+	prepareCmd.Stdin = bytes.NewReader(input)
+	var output bytes.Buffer
+	prepareCmd.Stdout = &output
+	prepareCmd.Stderr = logging.NewLineWriter(zapcore.InfoLevel, "session prepare: ")
+	if err := prepareCmd.Run(); err != nil {
+		return state.SessionState{}, fmt.Errorf("failed to prepare session: %w", err)
+	}
+
+	var result preparedSession
+	if err := json.Unmarshal(output.Bytes(), &result); err != nil {
+		return state.SessionState{}, fmt.Errorf("failed to decode prepared session: %w", err)
+	}
+	if result.Error != "" {
+		return state.SessionState{}, errors.New(result.Error)
+	}
+	if result.Session == nil || result.Session.SessionID == "" {
+		return state.SessionState{}, errors.New("session prepare returned no session")
+	}
+	return *result.Session, nil
+}
+
+// waitForSession waits until the session's ports serve, failing if its
+// serve process exits first.
+func waitForSession(ctx context.Context, manager *state.Manager, session state.SessionState, proc *serveProcess) error {
+	ready := make(chan error, 1)
+	go func() {
+		// Connecting to a lazy session would start its tunnel, so wait for
+		// the serve process to report its ports instead.
+		if session.Lazy {
+			ready <- waitForListening(manager, session.SessionID, sessionReadyTimeout)
+			return
+		}
+		for _, port := range sessionPorts(session) {
+			if err := util.WaitForPort(port, sessionReadyTimeout); err != nil {
+				ready <- err
+				return
+			}
+		}
+		ready <- nil
+	}()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			return fmt.Errorf("timed out waiting for session ports: %w - check permissions, network, and SSM agent status%s", err, proc.output.report())
+		}
+		return nil
+	case <-proc.done:
+		return fmt.Errorf("SSM proxy process exited before the tunnel was ready: %v%s", proc.err, proc.output.report())
+	case <-ctx.Done():
+		return fmt.Errorf("agent is shutting down: %w", ctx.Err())
+	}
+}
+
+// waitForListening waits for a session's serve process to record that its
+// local ports accept connections.
+func waitForListening(stateManager *state.Manager, sessionID string, timeout time.Duration) error {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); {
+		status, err := stateManager.ReadStatus(sessionID)
+		if err != nil {
+			logging.Debugf("Session %s status not readable yet: %v", sessionID, err)
+		} else if status.Listening {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("session %s did not start listening within %s", sessionID, timeout)
+}
+
+// recordSessionInstance stores the bastion the serve process connected
+// through, as published in the session's status file, in the session state.
+// The status is written as the tunnel comes up, so it may trail the ports
+// opening by a moment.
+func recordSessionInstance(stateManager *state.Manager, session *state.SessionState) {
+	if !proxy.RequiresInstance(session.Backend) {
+		return
+	}
+	var status state.SessionStatus
+	for deadline := time.Now().Add(2 * time.Second); status.InstanceID == "" && time.Now().Before(deadline); {
+		status, _ = stateManager.ReadStatus(session.SessionID)
+		if status.InstanceID == "" {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	if status.InstanceID == "" {
+		logging.Warnf("Could not determine which bastion session %s connected through", session.SessionID)
+		return
+	}
+	session.InstanceID = status.InstanceID
+	if err := stateManager.UpdateSession(session.SessionID, func(s *state.SessionState) {
+		s.InstanceID = status.InstanceID
+	}); err != nil {
+		logging.Warnf("Failed to record bastion for session %s: %v", session.SessionID, err)
+	}
+}
+
+// sessionPorts returns every local port served by the session.
+func sessionPorts(session state.SessionState) []string {
+	ports := []string{session.LocalPort}
+	for _, f := range session.Forwards {
+		ports = append(ports, f.LocalPort)
+	}
+	return ports
+}
+
+func (a *sessionAgent) handleStop(_ context.Context, raw json.RawMessage) (any, error) {
+	var req api.StopRequest
+	if err := agent.DecodeParams(raw, &req); err != nil {
+		return nil, err
+	}
+
+	if req.SessionID != "" {
+		session, err := a.session(req.SessionID)
+		if err != nil {
+			return nil, err
+		}
+		if err := a.stopSession(*session); err != nil {
+			return nil, err
+		}
+		return api.StopResult{Stopped: []string{session.SessionID}}, nil
+	}
+
+	sessions, err := a.manager.GetAllSessions()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load session states: %w", err)
+	}
+	result := api.StopResult{Stopped: []string{}}
+	var errs []error
+	for _, id := range sortedSessionIDs(sessions) {
+		logging.Infof("Stopping session %s (PID: %d)...", id, sessions[id].PID)
+		if err := a.stopSession(sessions[id]); err != nil {
+			errs = append(errs, fmt.Errorf("session %s: %w", id, err))
+			continue
+		}
+		result.Stopped = append(result.Stopped, id)
+	}
+	// Only the sessions stopped here leave the state: sessions started
+	// meanwhile and those a pre_stop hook kept running stay.
+	if err := a.manager.RemoveSessions(result.Stopped); err != nil {
+		errs = append(errs, fmt.Errorf("failed to remove stopped sessions from state: %w", err))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("encountered errors while stopping sessions (%d stopped): %w", len(result.Stopped), err)
+	}
+	return result, nil
+}
+
+// errStopAborted reports a session that a pre_stop hook kept running.
+var errStopAborted = errors.New("stop aborted")
+
+// stopSession stops the session's serve process and removes the session,
+// running the session's stop hooks around it. Sessions the agent does not
+// supervise are stopped through their PID.
+func (a *sessionAgent) stopSession(session state.SessionState) error {
+	a.mu.Lock()
+	w := a.workers[session.SessionID]
+	a.mu.Unlock()
+	var env []string
+	if w != nil {
+		env = w.env
+	}
+	runner := loadHooks(session.ClusterName, env)
+	if err := runner.Run(context.Background(), hooks.PreStop, hookSession(session), nil); err != nil {
+		return fmt.Errorf("%w: %w", errStopAborted, err)
+	}
+	defer func() {
+		_ = runner.Run(context.Background(), hooks.PostStop, hookSession(session), nil)
+	}()
+
+	a.mu.Lock()
+	delete(a.workers, session.SessionID)
+	a.mu.Unlock()
+	if w == nil {
+		return stopAndCleanupSession(a.manager, session, true)
+	}
+
+	w.mu.Lock()
+	w.stopping = true
+	close(w.stop)
+	proc := w.proc
+	w.mu.Unlock()
+	proc.terminate()
+
+	err := removeSessionFiles(a.manager, session)
+	if removeErr := a.manager.RemoveSession(session.SessionID); removeErr != nil && err == nil {
+		err = fmt.Errorf("failed to remove session %s from state: %w", session.SessionID, removeErr)
+	}
+	if err == nil {
+		logging.Infof("Stopped session %s", session.SessionID)
+	}
+	return err
+}
+
+func (a *sessionAgent) handleList(ctx context.Context, raw json.RawMessage) (any, error) {
+	var req api.ListRequest
+	if err := agent.DecodeParams(raw, &req); err != nil {
+		return nil, err
+	}
+	sessions, err := a.manager.GetAllSessions()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load session states: %w", err)
+	}
+	var results map[string]health.Result
+	if req.Health {
+		results = health.ProbeAll(ctx, sessions)
+	}
+	result := api.ListResult{Sessions: make([]api.Session, 0, len(sessions))}
+	for _, id := range sortedSessionIDs(sessions) {
+		session := a.describe(sessions[id])
+		if req.Health {
+			h := apiHealth(results[id])
+			session.Health = &h
+		}
+		result.Sessions = append(result.Sessions, session)
+	}
+	return result, nil
+}
+
+func (a *sessionAgent) handleDescribe(_ context.Context, raw json.RawMessage) (any, error) {
+	var req api.SessionRequest
+	if err := agent.DecodeParams(raw, &req); err != nil {
+		return nil, err
+	}
+	session, err := a.session(req.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	return a.describe(*session), nil
+}
+
+func (a *sessionAgent) handleHealth(ctx context.Context, raw json.RawMessage) (any, error) {
+	var req api.SessionRequest
+	if err := agent.DecodeParams(raw, &req); err != nil {
+		return nil, err
+	}
+	session, err := a.session(req.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	return apiHealth(health.Probe(ctx, *session)), nil
+}
+
+func (a *sessionAgent) handleSwitch(_ context.Context, raw json.RawMessage) (any, error) {
+	var req api.SessionRequest
+	if err := agent.DecodeParams(raw, &req); err != nil {
+		return nil, err
+	}
+	session, err := a.session(req.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	return api.SwitchTarget{
+		SessionID:      session.SessionID,
+		ClusterName:    session.ClusterName,
+		KubeconfigPath: session.KubeconfigPath,
+		Export:         fmt.Sprintf("export KUBECONFIG='%s'", session.KubeconfigPath),
+	}, nil
+}
+
+// handlePrune removes the sessions whose serve process has gone and that the
+// agent is not restarting, then the kubeconfig files no session owns. No
+// hooks run: the sessions have already ended.
+func (a *sessionAgent) handlePrune(_ context.Context, raw json.RawMessage) (any, error) {
+	var req api.PruneRequest
+	if err := agent.DecodeParams(raw, &req); err != nil {
+		return nil, err
+	}
+	a.starting.Lock()
+	defer a.starting.Unlock()
+
+	sessions, err := a.manager.GetAllSessions()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load session states: %w", err)
+	}
+	result := api.PruneResult{Sessions: []string{}, Files: []string{}}
+	var errs []error
+	for _, id := range sortedSessionIDs(sessions) {
+		session := sessions[id]
+		a.mu.Lock()
+		_, supervised := a.workers[id]
+		a.mu.Unlock()
+		if !session.Dead || supervised {
+			continue
+		}
+		result.Sessions = append(result.Sessions, id)
+		if req.DryRun {
+			continue
+		}
+		logging.Infof("Pruning session %s, whose serve process %d has gone", id, session.PID)
+		if err := removeSessionFiles(a.manager, session); err != nil {
+			errs = append(errs, fmt.Errorf("session %s: %w", id, err))
+		}
+		if err := a.manager.RemoveSession(id); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove session %s from state: %w", id, err))
+		}
+	}
+
+	files, err := pruneKubeconfigs(sessions, req.DryRun)
+	result.Files = append(result.Files, files...)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("encountered errors while pruning (%d sessions, %d files pruned): %w", len(result.Sessions), len(result.Files), err)
+	}
+	return result, nil
+}
+
+// session looks a session up, failing with CodeSessionNotFound.
+func (a *sessionAgent) session(sessionID string) (*state.SessionState, error) {
+	session, err := a.manager.GetSession(sessionID)
+	if err != nil {
+		return nil, &agent.Error{Code: api.CodeSessionNotFound, Message: err.Error()}
+	}
+	return session, nil
+}
+
+// describe returns the session as the API shows it, with the status its
+// serve process last recorded.
+func (a *sessionAgent) describe(session state.SessionState) api.Session {
+	result := api.Session{
+		SessionID:         session.SessionID,
+		ClusterName:       session.ClusterName,
+		PID:               session.PID,
+		Running:           session.Running(),
+		Backend:           session.Backend,
+		SOCKS:             session.SOCKS,
+		LocalPort:         session.LocalPort,
+		SocketPath:        session.SocketPath,
+		RemoteHost:        session.RemoteHost,
+		KubeconfigPath:    session.KubeconfigPath,
+		LogPath:           session.LogPath,
+		InstanceID:        session.InstanceID,
+		InstanceIDs:       session.InstanceIDs,
+		BastionTag:        session.BastionTag,
+		Document:          session.Document,
+		DocumentParams:    session.DocumentParams,
+		KeepaliveTarget:   session.KeepaliveTarget,
+		KeepaliveInterval: session.KeepaliveInterval,
+		Lazy:              session.Lazy,
+		IdleTimeout:       session.IdleTimeout,
+		ExpiresAt:         session.ExpiresAt,
+	}
+	for _, f := range session.Forwards {
+		result.Forwards = append(result.Forwards, api.Forward{LocalPort: f.LocalPort, RemoteHost: f.RemoteHost, RemotePort: f.RemotePort})
+	}
+	if status, err := a.manager.ReadStatus(session.SessionID); err == nil && !status.UpdatedAt.IsZero() {
+		result.Status = &api.Status{
+			InstanceID:    status.InstanceID,
+			Reconnects:    status.Reconnects,
+			LastError:     status.LastError,
+			LastKeepalive: status.LastKeepalive,
+			Listening:     status.Listening,
+			Idle:          status.Idle,
+			Traffic:       api.Traffic(status.Traffic),
+			UpdatedAt:     status.UpdatedAt,
+		}
+	}
+	return result
+}
+
+func apiHealth(result health.Result) api.Health {
+	h := api.Health{Status: string(result.Status), Checks: make([]api.Check, 0, len(result.Checks))}
+	for _, c := range result.Checks {
+		check := api.Check{Name: c.Name}
+		if c.Err != nil {
+			check.Error = c.Err.Error()
+		}
+		h.Checks = append(h.Checks, check)
+	}
+	return h
+}
+
+// spawn starts a serve process for the worker's session.
+func (a *sessionAgent) spawn(w *sessionWorker) (*serveProcess, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate ekssm executable: %w", err)
+	}
+	serveArgs := []string{"session", "serve", "--session-id", w.sessionID}
+	if w.debug {
+		serveArgs = append(serveArgs, "--debug")
+	}
+	serveCmd := exec.Command(executable, serveArgs...)
+	serveCmd.Env = w.env
+	// The serve process only writes to stderr until its tunnels are up,
+	// which is what explains a failed start.
+	output := newOutputTail()
+	serveCmd.Stderr = output
+	if err := util.StartDetached(serveCmd); err != nil {
+		return nil, fmt.Errorf("failed to start SSM proxy: %w", err)
+	}
+
+	proc := &serveProcess{pid: serveCmd.Process.Pid, executable: executable, done: make(chan struct{}), output: output}
+	go func() {
+		proc.err = serveCmd.Wait()
+		close(proc.done)
+	}()
+	return proc, nil
+}
+
+// watchProcess follows a serve process started by a previous agent, which
+// this one cannot wait for.
+func watchProcess(pid int) *serveProcess {
+	proc := &serveProcess{pid: pid, done: make(chan struct{}), output: newOutputTail()}
+	go func() {
+		for util.ProcessAlive(pid) {
+			time.Sleep(adoptedPollInterval)
+		}
+		proc.err = errors.New("process exited")
+		close(proc.done)
+	}()
+	return proc
+}
+
+// supervise restarts the worker's serve process whenever it exits, until the
+// session is stopped or has left the state, as an expired session does.
+func (a *sessionAgent) supervise(w *sessionWorker) {
+	backoff := serveRestartMinBackoff
+	for {
+		w.mu.Lock()
+		proc := w.proc
+		w.mu.Unlock()
+		started := time.Now()
+		<-proc.done
+
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+		session, err := a.manager.GetSession(w.sessionID)
+		if err != nil {
+			logging.Infof("Session %s has ended", w.sessionID)
+			a.forget(w)
+			return
+		}
+		if time.Since(started) >= serveRestartMaxBackoff {
+			backoff = serveRestartMinBackoff
+		}
+		if w.adopted {
+			logging.Warnf("Serve process %d of adopted session %s exited unexpectedly (%v); not restarting it without the environment it was started with. Start it again, and 'ekssm session prune' cleans it up", proc.pid, w.sessionID, proc.err)
+			_ = loadHooks(session.ClusterName, nil).Run(context.Background(), hooks.OnFailure, hookSession(*session), fmt.Errorf("serve process exited: %v", proc.err))
+			a.forget(w)
+			return
+		}
+		logging.Warnf("Serve process %d of session %s exited unexpectedly (%v), restarting it in %s%s", proc.pid, w.sessionID, proc.err, backoff, proc.output.report())
+		_ = loadHooks(session.ClusterName, w.env).Run(context.Background(), hooks.OnFailure, hookSession(*session), fmt.Errorf("serve process exited: %v", proc.err))
+
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, serveRestartMaxBackoff)
+
+			w.mu.Lock()
+			if w.stopping {
+				w.mu.Unlock()
+				return
+			}
+			next, err := a.spawn(w)
+			if err == nil {
+				w.proc = next
+			}
+			w.mu.Unlock()
+			if err != nil {
+				logging.Errorf("Failed to restart session %s, retrying in %s: %v", w.sessionID, backoff, err)
+				continue
+			}
+			if err := a.manager.UpdateSession(w.sessionID, next.record); err != nil {
+				logging.Warnf("Failed to record PID %d of session %s: %v", next.pid, w.sessionID, err)
+			}
+			logging.Infof("Restarted session %s (PID %d)", w.sessionID, next.pid)
+			break
+		}
+	}
+}
+
+// record saves the process as the session's serve process.
+func (p *serveProcess) record(session *state.SessionState) {
+	session.PID = p.pid
+	session.Executable = p.executable
+}
+
+// forget drops the worker unless it has already been replaced.
+func (a *sessionAgent) forget(w *sessionWorker) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.workers[w.sessionID] == w {
+		delete(a.workers, w.sessionID)
+	}
+}
+
+// terminate stops the process with SIGTERM, killing it if it has not exited
+// within serveStopTimeout.
+func (p *serveProcess) terminate() {
+	select {
+	case <-p.done:
+		return
+	default:
+	}
+	process, err := os.FindProcess(p.pid)
+	if err != nil {
+		logging.Warnf("Could not find process with PID %d: %v", p.pid, err)
+		return
+	}
+	logging.Debugf("Sending SIGTERM to process PID %d", p.pid)
+	if err := process.Signal(syscall.SIGTERM); err != nil {
+		logging.Debugf("Failed to send SIGTERM to PID %d: %v", p.pid, err)
+	}
+	select {
+	case <-p.done:
+		return
+	case <-time.After(serveStopTimeout):
+	}
+	logging.Warnf("Process PID %d did not exit within %s, killing it", p.pid, serveStopTimeout)
+	if err := process.Kill(); err != nil {
+		logging.Errorf("Failed to send SIGKILL to PID %d: %v", p.pid, err)
+	}
+	<-p.done
+}
+
+// outputTail keeps the last serveOutputTailSize bytes of a serve process's
+// output.
+type outputTail struct {
+	util.TailBuffer
+}
+
+func newOutputTail() *outputTail {
+	return &outputTail{util.TailBuffer{Size: serveOutputTailSize}}
+}
+
+// report returns the output as an indented block to append to an error, or
+// an empty string if there was none.
+func (t *outputTail) report() string {
+	output := strings.TrimSpace(t.String())
+	if output == "" {
+		return ""
+	}
+	return "\n  " + strings.ReplaceAll(output, "\n", "\n  ")
+}
+
+// hookSession returns what hooks are told about session.
+func hookSession(session state.SessionState) hooks.Session {
+	return hooks.Session{
+		ID:         session.SessionID,
+		Cluster:    session.ClusterName,
+		Kubeconfig: session.KubeconfigPath,
+		LocalPort:  session.LocalPort,
+	}
+}
+
+// loadHooks returns the hooks for cluster's sessions, as the configuration
+// file sets them now, or none if it cannot be read, so that a broken file
+// does not keep sessions from being stopped.
+func loadHooks(cluster string, env []string) *hooks.Runner {
+	runner, err := hooks.Load(cluster, env)
+	if err != nil {
+		logging.Warnf("Not running hooks for cluster %s: %v", cluster, err)
+	}
+	return runner
+}
+
+func sortedSessionIDs(sessions state.SessionMap) []string {
+	ids := make([]string, 0, len(sessions))
+	for id := range sessions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func init() {
+	rootCmd.AddCommand(agentCmd)
+	agentCmd.AddCommand(agentStopCmd)
+	agentCmd.Flags().StringVar(&agentOpts.MetricsListen, "metrics-listen", "", "Serve Prometheus metrics at /metrics on this address, e.g. 127.0.0.1:9464 (default: metrics_listen from the config file, if set)")
+}
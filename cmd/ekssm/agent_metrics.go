@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/cloudopsy/ekssm/internal/logging"
+	"github.com/cloudopsy/ekssm/internal/metrics"
+	"github.com/cloudopsy/ekssm/internal/state"
+)
+
+// serveMetrics serves the sessions' metrics at /metrics on listener until
+// ctx is done.
+func (a *sessionAgent) serveMetrics(ctx context.Context, listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		var body bytes.Buffer
+		if err := a.writeMetrics(&body); err != nil {
+			logging.Warnf("Failed to collect metrics: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", metrics.ContentType)
+		_, _ = w.Write(body.Bytes())
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logging.Errorf("Metrics endpoint stopped: %v", err)
+	}
+}
+
+// sessionMetrics is what the metrics report about one session.
+type sessionMetrics struct {
+	session state.SessionState
+	status  state.SessionStatus
+	running bool
+}
+
+// labels identify the session's samples. instance_id is left out for
+// sessions that did not start through a bastion, such as lazy sessions and
+// the direct backend's.
+func (m sessionMetrics) labels(extra ...metrics.Label) []metrics.Label {
+	labels := []metrics.Label{
+		{Name: "session_id", Value: m.session.SessionID},
+		{Name: "cluster", Value: m.session.ClusterName},
+	}
+	if m.session.InstanceID != "" {
+		labels = append(labels, metrics.Label{Name: "instance_id", Value: m.session.InstanceID})
+	}
+	return append(labels, extra...)
+}
+
+// tunnelUp reports whether the session's tunnel carries traffic as far as
+// its serve process knows: it runs, listens, is not idle and has not lost
+// its tunnel since it last connected.
+func (m sessionMetrics) tunnelUp() bool {
+	return m.running && m.status.Listening && !m.status.Idle && m.status.LastError == ""
+}
+
+// writeMetrics writes the metrics of every session, read from the session
+// state and the status files their serve processes keep.
+func (a *sessionAgent) writeMetrics(out io.Writer) error {
+	sessions, err := a.manager.GetAllSessions()
+	if err != nil {
+		return err
+	}
+	all := make([]sessionMetrics, 0, len(sessions))
+	perCluster := make(map[string]int)
+	for _, id := range sortedSessionIDs(sessions) {
+		session := sessions[id]
+		status, err := a.manager.ReadStatus(id)
+		if err != nil {
+			logging.Debugf("No status for session %s in metrics: %v", id, err)
+		}
+		m := sessionMetrics{session: session, status: status, running: session.Running()}
+		all = append(all, m)
+		// Clusters whose sessions have all died still report 0.
+		count := perCluster[session.ClusterName]
+		if m.running {
+			count++
+		}
+		perCluster[session.ClusterName] = count
+	}
+
+	w := metrics.NewWriter(out)
+
+	w.Family("ekssm_sessions", metrics.Gauge, "Background sessions whose serve process runs, by cluster.")
+	clusters := make([]string, 0, len(perCluster))
+	for cluster := range perCluster {
+		clusters = append(clusters, cluster)
+	}
+	sort.Strings(clusters)
+	for _, cluster := range clusters {
+		w.Sample("ekssm_sessions", []metrics.Label{{Name: "cluster", Value: cluster}}, float64(perCluster[cluster]))
+	}
+
+	w.Family("ekssm_tunnel_up", metrics.Gauge, "Whether the session's tunnel is up (1) or down (0); idle lazy sessions are down.")
+	for _, m := range all {
+		up := 0.0
+		if m.tunnelUp() {
+			up = 1
+		}
+		w.Sample("ekssm_tunnel_up", m.labels(), up)
+	}
+
+	w.Family("ekssm_tunnel_reconnects_total", metrics.Counter, "Reconnects of the session's tunnels since its serve process started.")
+	for _, m := range all {
+		w.Sample("ekssm_tunnel_reconnects_total", m.labels(), float64(m.status.Reconnects))
+	}
+
+	w.Family("ekssm_tunnel_connections_total", metrics.Counter, "Connections local clients made through the session.")
+	for _, m := range all {
+		w.Sample("ekssm_tunnel_connections_total", m.labels(), float64(m.status.Traffic.Connections))
+	}
+
+	w.Family("ekssm_tunnel_bytes_total", metrics.Counter, "Bytes relayed through the session, towards the cluster (in) and back (out).")
+	for _, m := range all {
+		w.Sample("ekssm_tunnel_bytes_total", m.labels(metrics.Label{Name: "direction", Value: "in"}), float64(m.status.Traffic.BytesIn))
+		w.Sample("ekssm_tunnel_bytes_total", m.labels(metrics.Label{Name: "direction", Value: "out"}), float64(m.status.Traffic.BytesOut))
+	}
+
+	w.Family("ekssm_ssm_start_session_duration_seconds", metrics.Histogram, "Latency of the SSM StartSession calls made for the session.")
+	for _, m := range all {
+		if m.status.StartSessionLatency != nil {
+			w.Histogram("ekssm_ssm_start_session_duration_seconds", m.labels(), *m.status.StartSessionLatency)
+		}
+	}
+
+	w.Family("ekssm_aws_api_calls_total", metrics.Counter, "AWS API calls made for the session, by service and operation.")
+	for _, m := range all {
+		for _, c := range m.status.APICalls {
+			w.Sample("ekssm_aws_api_calls_total", m.labels(apiLabels(c)...), float64(c.Calls))
+		}
+	}
+
+	w.Family("ekssm_aws_api_errors_total", metrics.Counter, "AWS API calls made for the session that failed, by service and operation.")
+	for _, m := range all {
+		for _, c := range m.status.APICalls {
+			w.Sample("ekssm_aws_api_errors_total", m.labels(apiLabels(c)...), float64(c.Errors))
+		}
+	}
+
+	return w.Err()
+}
+
+func apiLabels(c state.APICalls) []metrics.Label {
+	return []metrics.Label{{Name: "service", Value: c.Service}, {Name: "operation", Value: c.Operation}}
+}
@@ -1,23 +1,31 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"strings"
 
 	"github.com/spf13/cobra"
 
-	"github.com/cloudopsy/ekssm/internal/constants"
+	"github.com/cloudopsy/ekssm/internal/hooks"
 	"github.com/cloudopsy/ekssm/internal/logging"
 	"github.com/cloudopsy/ekssm/internal/util"
+	"github.com/cloudopsy/ekssm/pkg/ekssm"
 	"github.com/cloudopsy/ekssm/pkg/kubectl"
 	"github.com/cloudopsy/ekssm/pkg/proxy"
 )
 
 type runOptions struct {
 	ClusterName string
-	InstanceID  string
+	InstanceIDs []string
+	Targets     []string
+	BastionTag  string
 	LocalPort   string
+	Backend     string
+
+	Document       string
+	DocumentParams []string // key=value
 }
 
 var runOpts runOptions
@@ -44,80 +52,75 @@ func runCommand(cmd *cobra.Command, args []string) error {
 
 	logging.Debugf("Command to execute: %s", strings.Join(args, " "))
 
-	if runOpts.ClusterName == "" || runOpts.InstanceID == "" {
-		return fmt.Errorf("--cluster-name and --instance-id are required")
+	if runOpts.ClusterName == "" {
+		return fmt.Errorf("--cluster-name is required")
+	}
+	docParams, err := proxy.ParseDocumentParams(runOpts.DocumentParams)
+	if err != nil {
+		return err
 	}
 
 	ctx, cancelCtx := util.SignalContext()
 	defer cancelCtx()
 
-	eksHost, err := util.EKSClusterEndpoint(ctx, runOpts.ClusterName)
+	runner, err := hooks.Load(runOpts.ClusterName, nil)
 	if err != nil {
 		return err
 	}
 
-	localPort := runOpts.LocalPort
-	if localPort == "" || localPort == "0" {
-		logging.Debug("No local port specified or set to 0, finding an available port...")
-		foundPort, err := util.FindAvailablePort()
-		if err != nil {
-			return fmt.Errorf("failed to find an available local port: %w", err)
-		}
-		localPort = foundPort
-		logging.Infof("Using dynamically allocated local port: %s", localPort)
-	} else {
-		logging.Infof("Using user-specified local port: %s", localPort)
+	kubeconfigPath := util.KubeconfigPathForRun(runOpts.ClusterName)
+	runLock, err := util.LockRunKubeconfig(kubeconfigPath)
+	if err != nil {
+		return err
 	}
+	// Without the lock, another run for the cluster holds it, which keeps
+	// the kubeconfig from being pruned all the same.
+	if runLock != nil {
+		defer func() { _ = runLock.Remove() }()
+	}
+	opts := ekssm.Options{
+		ClusterName:    runOpts.ClusterName,
+		Targets:        append(runOpts.InstanceIDs, runOpts.Targets...),
+		BastionTag:     runOpts.BastionTag,
+		Backend:        runOpts.Backend,
+		LocalPort:      runOpts.LocalPort,
+		Document:       runOpts.Document,
+		DocumentParams: docParams,
+		UserConfig:     true,
+		KubeconfigPath: kubeconfigPath,
+	}
+	target, err := ekssm.Resolve(ctx, opts)
+	if err != nil {
+		return err
+	}
+	hookSession := hooks.Session{Cluster: target.ClusterName, Kubeconfig: kubeconfigPath, LocalPort: target.LocalPort}
+	opts.OnDisconnect = func(err error) { runner.Notify(hooks.OnFailure, hookSession, err) }
+	opts.OnReconnect = func() { runner.Notify(hooks.OnReconnect, hookSession, nil) }
 
-	ssmProxy := proxy.NewSSMProxy(runOpts.InstanceID, localPort, eksHost, constants.EKSApiPort)
-
-	proxyErrChan := make(chan error, 1)
-
-	go func() {
-		logging.Debug("Starting SSM proxy session in background...")
-		if _, err := ssmProxy.StartBackground(); err != nil {
-			proxyErrChan <- fmt.Errorf("failed to start SSM proxy: %w", err)
-		} else {
-			proxyErrChan <- nil
+	if err := runner.Run(ctx, hooks.PreStart, hookSession, nil); err != nil {
+		return err
+	}
+	session, err := ekssm.OpenTarget(ctx, target, opts)
+	if err != nil {
+		_ = runner.Run(context.Background(), hooks.OnFailure, hookSession, err)
+		if ctx.Err() != nil {
+			logging.Info("Operation canceled.")
+			return fmt.Errorf("operation cancelled by signal")
 		}
-	}()
-
+		return err
+	}
 	defer func() {
-		logging.Debug("Stopping SSM proxy session...")
-		if err := ssmProxy.Stop(); err != nil {
-			logging.Warnf("Failed to stop SSM proxy cleanly: %v", err)
+		// The command has finished, so a pre_stop hook cannot keep the
+		// session open.
+		if err := runner.Run(context.Background(), hooks.PreStop, hookSession, nil); err != nil {
+			logging.Warnf("%v; stopping the session anyway", err)
 		}
-	}()
-
-	kubeconfigPath := util.KubeconfigPathForRun(runOpts.ClusterName)
-
-	defer func() {
-		logging.Debugf("Removing temporary kubeconfig: %s", kubeconfigPath)
-		if err := os.Remove(kubeconfigPath); err != nil {
-			if !os.IsNotExist(err) {
-				logging.Warnf("Failed to remove temporary kubeconfig %s: %v", kubeconfigPath, err)
-			}
+		if err := session.Close(); err != nil {
+			logging.Warnf("Failed to clean up session: %v", err)
 		}
+		_ = runner.Run(context.Background(), hooks.PostStop, hookSession, nil)
 	}()
-
-	endpoint := fmt.Sprintf("https://localhost:%s", localPort)
-	kubeconfigContent := kubectl.GenerateKubeconfig(runOpts.ClusterName, endpoint)
-
-	if err := util.WriteKubeconfig(kubeconfigPath, kubeconfigContent); err != nil {
-		return fmt.Errorf("failed to write temporary kubeconfig: %w", err)
-	}
-	logging.Debugf("Temporary kubeconfig written to %s", kubeconfigPath)
-
-	select {
-	case err := <-proxyErrChan:
-		if err != nil {
-			return err
-		}
-		logging.Debug("SSM proxy started successfully.")
-	case <-ctx.Done():
-		logging.Info("Operation canceled.")
-		return fmt.Errorf("operation cancelled by signal")
-	}
+	_ = runner.Run(ctx, hooks.PostStart, hookSession, nil)
 
 	logging.Debugf("Executing command: %v with KUBECONFIG=%s", args, kubeconfigPath)
 	if err := kubectl.ExecuteCommand(args, kubeconfigPath); err != nil {
@@ -132,10 +135,16 @@ func init() {
 	rootCmd.AddCommand(runCmd)
 
 	runCmd.Flags().StringVar(&runOpts.ClusterName, "cluster-name", "", "Name of the EKS cluster (required)")
-	runCmd.Flags().StringVar(&runOpts.InstanceID, "instance-id", "", "EC2 instance ID of the bastion host (required)")
+	runCmd.Flags().StringSliceVar(&runOpts.InstanceIDs, "instance-id", nil, "EC2 instance ID of the bastion host (required unless --target, --bastion-tag, a cluster default or --backend direct); repeat to fail over across bastions in order")
+	runCmd.Flags().StringVar(&runOpts.BastionTag, "bastion-tag", "", "Use the Online SSM-managed instances with this key=value tag as bastions, newest agent first")
+	runCmd.Flags().StringSliceVar(&runOpts.Targets, "target", nil, "SSM target of the bastion: i-<id>, mi-<id> (hybrid managed node), ecs:<cluster>_<taskId>_<runtimeId> (ECS task container), or ecs:<cluster>/<service>/<container> to use a running task of an ECS service; repeat to fail over across bastions in order")
+	runCmd.MarkFlagsMutuallyExclusive("instance-id", "target", "bastion-tag")
 	runCmd.Flags().StringVar(&runOpts.LocalPort, "local-port", "", "Local port for forwarding EKS API access (default: dynamically allocated)")
+	runCmd.Flags().StringVar(&runOpts.Document, "document", "", "SSM document to start sessions with, such as a copy of "+proxy.PortForwardingDocument+" with session logging (default: the cluster default, or "+proxy.PortForwardingDocument+")")
+	runCmd.Flags().StringArrayVar(&runOpts.DocumentParams, "document-param", nil, "Extra parameter for the SSM document, as key=value (repeatable)")
+	runCmd.Flags().StringVar(&runOpts.Backend, "backend", proxy.DefaultBackend, "Tunnel backend: plugin (session-manager-plugin), ssm (built-in SSM client) or direct (no bastion)")
 
-	for _, flag := range []string{"cluster-name", "instance-id"} {
+	for _, flag := range []string{"cluster-name"} {
 		if err := runCmd.MarkFlagRequired(flag); err != nil {
 			fmt.Fprintf(os.Stderr, "Error marking %s flag required: %v\n", flag, err)
 			os.Exit(1)
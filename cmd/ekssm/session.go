@@ -9,12 +9,18 @@ var sessionCmd = &cobra.Command{
 	Short: "Manage background SSM proxy sessions for EKS access",
 	Long: `Allows starting, stopping, listing, and switching background SSM proxy sessions for EKS access.
 These sessions are useful for running multiple commands against a cluster without restarting the proxy each time.
+Sessions are owned by the ekssm agent, which these commands start when it is not running (see 'ekssm agent --help').
 
 Available subcommands:
   start       - Start a new background session
   stop        - Stop one or all sessions
   list        - List all active sessions
+  health      - Check whether a session's tunnel works
+  describe    - Show a session's configuration, status and traffic
+  logs        - Show or follow a session's log
+  extend      - Change when a session expires
   switch      - Get command to switch to a specific session
+  prune       - Remove dead sessions and orphaned kubeconfigs
 
 TIP: For automatic KUBECONFIG setting without manual export, use shell integration:
   eval "$(ekssm shell bash)"  # Add to ~/.bashrc or ~/.zshrc`,
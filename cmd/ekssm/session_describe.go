@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cloudopsy/ekssm/internal/constants"
+	"github.com/cloudopsy/ekssm/internal/logging"
+	"github.com/cloudopsy/ekssm/pkg/api"
+	"github.com/cloudopsy/ekssm/pkg/proxy"
+)
+
+var sessionDescribeCmd = &cobra.Command{
+	Use:   "describe <session_id>",
+	Short: "Show everything recorded about a session",
+	Long: `Asks the ekssm agent for a background session and shows its configuration together with what its serve process
+has recorded: the bastion in use, reconnects, keepalives, the last error and the
+traffic carried. Traffic counts the connections local clients made and the bytes
+they sent (in) and received (out), across the EKS tunnel and every forward.
+Counters are recorded every few seconds. Unlike 'session health', nothing is
+probed.`,
+	Args: cobra.ExactArgs(1),
+	RunE: describeSession,
+}
+
+func describeSession(cmd *cobra.Command, args []string) error {
+	debug, _ := cmd.Flags().GetBool("debug")
+	logging.SetDebug(debug)
+
+	client, err := connectAgent(debug)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	session, err := client.DescribeSession(context.Background(), args[0])
+	if err != nil {
+		return err
+	}
+	var status api.Status
+	if session.Status != nil {
+		status = *session.Status
+	}
+
+	process := "running"
+	if !session.Running {
+		process = "not running"
+	}
+	bastion := tunnelRoute(*session)
+	if status.InstanceID != "" {
+		bastion = status.InstanceID
+	}
+
+	fmt.Printf("Session:          %s\n", session.SessionID)
+	fmt.Printf("Cluster:          %s\n", session.ClusterName)
+	fmt.Printf("PID:              %d (%s)\n", session.PID, process)
+	fmt.Printf("Backend:          %s\n", valueOrDash(session.Backend))
+	fmt.Printf("Bastion:          %s\n", valueOrDash(bastion))
+	if session.BastionTag != "" {
+		fmt.Printf("Bastion Tag:      %s\n", session.BastionTag)
+	} else if len(session.InstanceIDs) > 1 {
+		fmt.Printf("Bastions:         %s\n", strings.Join(session.InstanceIDs, ", "))
+	}
+	switch {
+	case session.SOCKS:
+		fmt.Printf("Proxy:            socks5://127.0.0.1:%s\n", session.LocalPort)
+	case session.SocketPath != "":
+		fmt.Printf("Proxy:            %s -> %s:%s\n", session.SocketPath, session.RemoteHost, constants.EKSApiPort)
+		fmt.Printf("Kubectl Shim:     localhost:%s\n", session.LocalPort)
+	default:
+		fmt.Printf("Proxy:            localhost:%s -> %s:%s\n", session.LocalPort, session.RemoteHost, constants.EKSApiPort)
+	}
+	fmt.Printf("Forwards:         %s\n", formatForwards(session.Forwards))
+	if proxy.RequiresInstance(session.Backend) {
+		fmt.Printf("SSM Document:     %s\n", proxy.Document{Name: session.Document, Parameters: session.DocumentParams})
+	}
+	if session.Lazy {
+		tunnel := "up"
+		if status.Idle {
+			tunnel = "idle, starts on the next connection"
+		}
+		fmt.Printf("Lazy:             stops after %s idle (tunnel %s)\n", session.IdleTimeout, tunnel)
+	}
+	switch {
+	case session.ExpiresAt == nil:
+		fmt.Printf("Expires:          never\n")
+	case session.Expired():
+		fmt.Printf("Expires:          %s (expired)\n", session.ExpiresAt.Local().Format(time.DateTime))
+	default:
+		fmt.Printf("Expires:          %s (in %s)\n", session.ExpiresAt.Local().Format(time.DateTime), formatRemaining(session.ExpiresAt))
+	}
+	fmt.Printf("Kubeconfig:       %s\n", session.KubeconfigPath)
+	fmt.Printf("Last Keepalive:   %s\n", formatAgo(status.LastKeepalive))
+	fmt.Printf("Reconnects:       %d\n", status.Reconnects)
+	fmt.Printf("Last Error:       %s\n", valueOrDash(status.LastError))
+	fmt.Printf("Connections:      %d (%d open)\n", status.Traffic.Connections, status.Traffic.ActiveConnections)
+	fmt.Printf("Bytes In:         %s\n", formatBytes(status.Traffic.BytesIn))
+	fmt.Printf("Bytes Out:        %s\n", formatBytes(status.Traffic.BytesOut))
+	fmt.Printf("Last Activity:    %s\n", formatAgo(status.Traffic.LastActivity))
+	return nil
+}
+
+func init() {
+	sessionCmd.AddCommand(sessionDescribeCmd)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cloudopsy/ekssm/internal/logging"
+	"github.com/cloudopsy/ekssm/internal/state"
+)
+
+var extendOpts struct {
+	TTL time.Duration
+}
+
+var sessionExtendCmd = &cobra.Command{
+	Use:   "extend <session_id> --ttl <duration>",
+	Short: "Change when a session expires",
+	Long: `Sets a background session to expire --ttl from now, whether or not it had a TTL
+before. The session's serve process notices within a minute. --ttl 0 removes
+the expiry, so the session runs until it is stopped.
+
+Example: ekssm session extend <session_id> --ttl 2h`,
+	Args: cobra.ExactArgs(1),
+	RunE: extendSession,
+}
+
+func extendSession(cmd *cobra.Command, args []string) error {
+	sessionID := args[0]
+
+	debug, _ := cmd.Flags().GetBool("debug")
+	logging.SetDebug(debug)
+
+	if extendOpts.TTL < 0 {
+		return fmt.Errorf("--ttl cannot be negative")
+	}
+
+	stateManager, err := state.NewManager()
+	if err != nil {
+		return fmt.Errorf("failed to initialize state manager: %w", err)
+	}
+	session, err := stateManager.GetSession(sessionID)
+	if err != nil {
+		return err
+	}
+	// Once expired, the serve process is already cleaning the session up.
+	if session.Expired() || !session.Running() {
+		return fmt.Errorf("session %s is no longer running; start a new one", sessionID)
+	}
+
+	var expiresAt *time.Time
+	if extendOpts.TTL > 0 {
+		at := time.Now().Add(extendOpts.TTL)
+		expiresAt = &at
+	}
+	if err := stateManager.UpdateSession(sessionID, func(s *state.SessionState) { s.ExpiresAt = expiresAt }); err != nil {
+		return err
+	}
+
+	if expiresAt == nil {
+		fmt.Printf("Session %s no longer expires.\n", sessionID)
+	} else {
+		fmt.Printf("Session %s now expires at %s (in %s).\n", sessionID, expiresAt.Local().Format(time.DateTime), extendOpts.TTL)
+	}
+	return nil
+}
+
+func init() {
+	sessionCmd.AddCommand(sessionExtendCmd)
+	sessionExtendCmd.Flags().DurationVar(&extendOpts.TTL, "ttl", 0, "How long from now the session should run before it expires; 0 never expires (required)")
+	if err := sessionExtendCmd.MarkFlagRequired("ttl"); err != nil {
+		fmt.Fprintf(os.Stderr, "Error marking ttl flag required: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cloudopsy/ekssm/internal/logging"
+	"github.com/cloudopsy/ekssm/pkg/api"
+)
+
+var sessionHealthCmd = &cobra.Command{
+	Use:   "health <session_id>",
+	Short: "Check whether a session's tunnel works",
+	Long: `Has the ekssm agent probe a background session: its process must be running, its local ports must
+accept connections and the Kubernetes API must answer /livez or /version through
+the tunnel. Each check is printed, and the command exits with a non-zero status
+unless the session is healthy.
+
+Example: ekssm session health <session-id> || ekssm session start ...`,
+	Args: cobra.ExactArgs(1),
+	RunE: checkSessionHealth,
+}
+
+func checkSessionHealth(cmd *cobra.Command, args []string) error {
+	sessionID := args[0]
+
+	debug, _ := cmd.Flags().GetBool("debug")
+	logging.SetDebug(debug)
+
+	client, err := connectAgent(debug)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	result, err := client.SessionHealth(context.Background(), sessionID)
+	if err != nil {
+		return err
+	}
+	for _, check := range result.Checks {
+		if check.Error != "" {
+			fmt.Printf("  %-12s FAIL  %s\n", check.Name, check.Error)
+		} else {
+			fmt.Printf("  %-12s ok\n", check.Name)
+		}
+	}
+	fmt.Printf("Session %s is %s\n", sessionID, result.Status)
+
+	if result.Status != api.Healthy {
+		return fmt.Errorf("session %s is %s: %w", sessionID, result.Status, result.Err())
+	}
+	return nil
+}
+
+func init() {
+	sessionCmd.AddCommand(sessionHealthCmd)
+}
@@ -1,144 +1,251 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"net"
 	"os"
-	"sort"
 	"strings"
+	"time"
 
 	"github.com/olekukonko/tablewriter"
 	"github.com/spf13/cobra"
 
 	"github.com/cloudopsy/ekssm/internal/logging"
-	"github.com/cloudopsy/ekssm/internal/state"
+	"github.com/cloudopsy/ekssm/pkg/api"
 )
 
 var sessionListCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List all active ekssm sessions",
-	Long:  `Reads the session state and displays details of all currently running ekssm proxy sessions.`,
-	RunE:  listSessions,
+	Long: `Asks the ekssm agent for its sessions and displays details of all currently running ekssm proxy sessions.
+Each session is probed: its process must be running, its local ports must accept
+connections and the Kubernetes API must answer through the tunnel. The STATUS
+column shows healthy, degraded or dead. --wide adds the traffic each session has
+carried. EXPIRES IN shows how long sessions started with a TTL have left.
+
+-o json prints the sessions as the agent's v1.session.list returns them (see
+docs/api.md), for scripts.`,
+	RunE: listSessions,
+}
+
+var listOpts struct {
+	Wide   bool
+	Output string
 }
 
 func listSessions(cmd *cobra.Command, args []string) error {
 	debug, _ := cmd.Flags().GetBool("debug")
 	logging.SetDebug(debug)
 
-	stateManager, err := state.NewManager()
+	if listOpts.Output != "table" && listOpts.Output != "json" {
+		return fmt.Errorf("unsupported output format %q (supported: table, json)", listOpts.Output)
+	}
+
+	client, err := connectAgent(debug)
 	if err != nil {
-		return fmt.Errorf("failed to initialize state manager: %w", err)
+		return err
 	}
+	defer client.Close()
 
-	allSessions, err := stateManager.GetAllSessions()
+	sessions, err := client.ListSessions(context.Background(), api.ListRequest{Health: true})
 	if err != nil {
-		// Check if the error is because the file doesn't exist
-		if os.IsNotExist(err) {
-			fmt.Println("No active ekssm sessions found.")
-			return nil
-		}
-		return fmt.Errorf("failed to load session states: %w", err)
+		return fmt.Errorf("failed to list sessions: %w", err)
+	}
+
+	if listOpts.Output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(api.ListResult{Sessions: sessions})
 	}
 
-	if len(allSessions) == 0 {
+	if len(sessions) == 0 {
 		fmt.Println("No active ekssm sessions found.")
 		return nil
 	}
 
-	renderSessionTable(allSessions)
+	renderSessionTable(sessions, listOpts.Wide)
 	return nil
 }
 
-func renderSessionTable(sessions state.SessionMap) {
+var sessionTableHeader = []string{"Session ID", "Cluster", "Status", "PID", "Local Port", "Forwards", "Expires In", "Last Keepalive", "Reconnects", "Last Error", "Kubeconfig Path"}
+
+// wideTableHeader is appended to sessionTableHeader by --wide.
+var wideTableHeader = []string{"Connections", "Bytes In", "Bytes Out", "Last Activity"}
+
+func tableHeader(wide bool) []string {
+	if !wide {
+		return sessionTableHeader
+	}
+	return append(append([]string{}, sessionTableHeader...), wideTableHeader...)
+}
+
+// sessionRow renders a session. The last error is the failed health check
+// when the session is unhealthy, otherwise the last error its serve process
+// recorded.
+func sessionRow(session api.Session, wide bool) []string {
+	var status api.Status
+	if session.Status != nil {
+		status = *session.Status
+	} else {
+		logging.Debugf("No status for session %s", session.SessionID)
+	}
+	var result api.Health
+	if session.Health != nil {
+		result = *session.Health
+	}
+	lastError := status.LastError
+	if err := result.Err(); err != nil {
+		lastError = err.Error()
+	}
+	row := []string{
+		session.SessionID,
+		session.ClusterName,
+		valueOrDash(result.Status),
+		fmt.Sprintf("%d", session.PID),
+		session.LocalPort,
+		formatForwards(session.Forwards),
+		formatRemaining(session.ExpiresAt),
+		formatAgo(status.LastKeepalive),
+		fmt.Sprintf("%d", status.Reconnects),
+		valueOrDash(lastError),
+		session.KubeconfigPath,
+	}
+	if wide {
+		row = append(row,
+			fmt.Sprintf("%d (%d open)", status.Traffic.Connections, status.Traffic.ActiveConnections),
+			formatBytes(status.Traffic.BytesIn),
+			formatBytes(status.Traffic.BytesOut),
+			formatAgo(status.Traffic.LastActivity),
+		)
+	}
+	return row
+}
+
+func valueOrDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// columnColors returns colors for each of columns.
+func columnColors(columns int, colors ...int) []tablewriter.Colors {
+	all := make([]tablewriter.Colors, columns)
+	for i := range all {
+		all[i] = colors
+	}
+	return all
+}
+
+func formatForwards(forwards []api.Forward) string {
+	if len(forwards) == 0 {
+		return "-"
+	}
+	parts := make([]string, 0, len(forwards))
+	for _, f := range forwards {
+		parts = append(parts, fmt.Sprintf("%s->%s", f.LocalPort, net.JoinHostPort(f.RemoteHost, f.RemotePort)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatBytes renders a byte count in binary units, e.g. "1.5 MiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// formatAgo shows when something last happened, e.g.
+// "15:04:05 (2m ago)", or "-" if it has not yet.
+func formatAgo(at *time.Time) string {
+	if at == nil {
+		return "-"
+	}
+	ago := time.Since(*at).Round(time.Second)
+	return fmt.Sprintf("%s (%s ago)", at.Local().Format("15:04:05"), ago)
+}
+
+// formatRemaining shows how long is left until at, e.g. "1h59m", "expired",
+// or "-" if there is no deadline.
+func formatRemaining(at *time.Time) string {
+	if at == nil {
+		return "-"
+	}
+	left := time.Until(*at)
+	if left <= 0 {
+		return "expired"
+	}
+	if left < time.Minute {
+		return left.Round(time.Second).String()
+	}
+	return strings.TrimSuffix(left.Round(time.Minute).String(), "0s")
+}
+
+func renderSessionTable(sessions []api.Session, wide bool) {
+	header := tableHeader(wide)
+
 	// Prepare session data for display
 	data := [][]string{}
 
 	// Get current KUBECONFIG value to determine active session
 	currentKubeconfig := os.Getenv("KUBECONFIG")
-	
-	// Sort session IDs for consistent output
-	ids := make([]string, 0, len(sessions))
-	for id := range sessions {
-		ids = append(ids, id)
-	}
-	sort.Strings(ids)
 
 	// Build table rows
-	var activeSession *state.SessionState
-	for _, id := range ids {
-		session := sessions[id]
-		
+	var activeSession *api.Session
+	for _, session := range sessions {
+		session := session
+
 		// Check if this is the active session
 		isActive := currentKubeconfig != "" && strings.Contains(currentKubeconfig, session.SessionID)
 		if isActive {
 			activeSession = &session
 		}
-		
+
 		// Only add non-active sessions to the regular table
 		if !isActive {
-			data = append(data, []string{
-				session.SessionID,
-				session.ClusterName,
-				fmt.Sprintf("%d", session.PID),
-				session.LocalPort,
-				session.KubeconfigPath,
-			})
+			data = append(data, sessionRow(session, wide))
 		}
 	}
 
 	// Render table with custom styling
 	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"Session ID", "Cluster", "PID", "Local Port", "Kubeconfig Path"})
+	table.SetHeader(header)
 	table.SetBorder(true)
 	table.SetAutoWrapText(false)
 	table.SetRowLine(false)
 	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
 	table.SetAlignment(tablewriter.ALIGN_LEFT)
-	table.SetHeaderColor(
-		tablewriter.Colors{tablewriter.Bold, tablewriter.FgGreenColor},
-		tablewriter.Colors{tablewriter.Bold, tablewriter.FgGreenColor},
-		tablewriter.Colors{tablewriter.Bold, tablewriter.FgGreenColor},
-		tablewriter.Colors{tablewriter.Bold, tablewriter.FgGreenColor},
-		tablewriter.Colors{tablewriter.Bold, tablewriter.FgGreenColor},
-	)
-	
+	table.SetHeaderColor(columnColors(len(header), tablewriter.Bold, tablewriter.FgGreenColor)...)
+
 	// Render active session with highlight (if exists)
 	if activeSession != nil {
 		fmt.Println("🟢 Active Session:")
 		activeTable := tablewriter.NewWriter(os.Stdout)
-		activeTable.SetHeader([]string{"Session ID", "Cluster", "PID", "Local Port", "Kubeconfig Path"})
+		activeTable.SetHeader(header)
 		activeTable.SetBorder(true)
 		activeTable.SetAutoWrapText(false)
 		activeTable.SetRowLine(false)
 		activeTable.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
 		activeTable.SetAlignment(tablewriter.ALIGN_LEFT)
-		activeTable.SetHeaderColor(
-			tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor},
-			tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor},
-			tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor},
-			tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor},
-			tablewriter.Colors{tablewriter.Bold, tablewriter.FgCyanColor},
-		)
-		activeTable.SetColumnColor(
-			tablewriter.Colors{tablewriter.FgHiCyanColor},
-			tablewriter.Colors{tablewriter.FgHiCyanColor},
-			tablewriter.Colors{tablewriter.FgHiCyanColor},
-			tablewriter.Colors{tablewriter.FgHiCyanColor},
-			tablewriter.Colors{tablewriter.FgHiCyanColor},
-		)
-		activeTable.Append([]string{
-			activeSession.SessionID,
-			activeSession.ClusterName,
-			fmt.Sprintf("%d", activeSession.PID),
-			activeSession.LocalPort,
-			activeSession.KubeconfigPath,
-		})
+		activeTable.SetHeaderColor(columnColors(len(header), tablewriter.Bold, tablewriter.FgCyanColor)...)
+		activeTable.SetColumnColor(columnColors(len(header), tablewriter.FgHiCyanColor)...)
+		activeTable.Append(sessionRow(*activeSession, wide))
 		activeTable.Render()
-		
+
 		if len(data) > 0 {
 			fmt.Println("\n📋 Other Sessions:")
 		}
 	}
-	
+
 	// Only render the table if there are other sessions
 	if len(data) > 0 {
 		table.AppendBulk(data)
@@ -146,10 +253,16 @@ func renderSessionTable(sessions state.SessionMap) {
 	}
 
 	// If sessions exist, print helpful info
-	if len(ids) > 0 {
-		// Get the most recently added session (we'll use the last ID in the sorted list)
-		latestSessionID := ids[len(ids)-1]
+	if len(sessions) > 0 {
+		// Get the most recently added session (we'll use the last ID in the list,
+		// which the agent orders by ID)
+		latestSessionID := sessions[len(sessions)-1].SessionID
 		fmt.Printf("\n📝 Latest session created: %s\n", latestSessionID)
 		fmt.Printf("💡 Use 'ekssm session switch %s' to use this session\n", latestSessionID)
 	}
 }
+
+func init() {
+	sessionListCmd.Flags().BoolVar(&listOpts.Wide, "wide", false, "Also show connections, bytes in and out and last activity")
+	sessionListCmd.Flags().StringVarP(&listOpts.Output, "output", "o", "table", "Output format: table or json")
+}
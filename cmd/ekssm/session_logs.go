@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cloudopsy/ekssm/internal/logging"
+	"github.com/cloudopsy/ekssm/internal/state"
+	"github.com/cloudopsy/ekssm/internal/util"
+)
+
+var logsOpts struct {
+	Follow bool
+}
+
+// logsPollInterval is how often --follow checks the log for new output.
+const logsPollInterval = 500 * time.Millisecond
+
+var sessionLogsCmd = &cobra.Command{
+	Use:   "logs <session_id>",
+	Short: "Show a session's log",
+	Long: `Prints the log of a background session's serve process, which includes the
+output of the session-manager-plugin. Logs are kept in ~/.ekssm/logs/<session-id>.log
+and rotated at 10 MiB, keeping three older files (.1 is the most recent). They
+outlive the session, so the log of a stopped or crashed session can still be read.
+
+With --follow, new output is printed as it is written until interrupted.`,
+	Args: cobra.ExactArgs(1),
+	RunE: showSessionLogs,
+}
+
+func showSessionLogs(cmd *cobra.Command, args []string) error {
+	sessionID := args[0]
+
+	debug, _ := cmd.Flags().GetBool("debug")
+	logging.SetDebug(debug)
+
+	stateManager, err := state.NewManager()
+	if err != nil {
+		return fmt.Errorf("failed to initialize state manager: %w", err)
+	}
+
+	// A stopped session is no longer in the state, but its log remains.
+	logPath := util.LogPathForSession(sessionID)
+	if session, err := stateManager.GetSession(sessionID); err == nil && session.LogPath != "" {
+		logPath = session.LogPath
+	}
+
+	if !logsOpts.Follow {
+		file, err := os.Open(logPath)
+		if err != nil {
+			return fmt.Errorf("no log for session %s: %w", sessionID, err)
+		}
+		defer file.Close()
+		_, err = io.Copy(os.Stdout, file)
+		return err
+	}
+
+	ctx, cancel := util.SignalContext()
+	defer cancel()
+	return followLog(ctx, logPath, os.Stdout)
+}
+
+// followLog copies the log at path to w, then keeps copying what is
+// appended until ctx is done. When the log is rotated, the new file is
+// followed from its start.
+func followLog(ctx context.Context, path string, w io.Writer) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open log %s: %w", path, err)
+	}
+	defer func() { file.Close() }()
+
+	ticker := time.NewTicker(logsPollInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := io.Copy(w, file); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		// After a rotation the path names a new, shorter file.
+		current, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		opened, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		if os.SameFile(current, opened) {
+			continue
+		}
+		// Whatever was written to the old file before it was rotated.
+		if _, err := io.Copy(w, file); err != nil {
+			return err
+		}
+		next, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		file.Close()
+		file = next
+	}
+}
+
+func init() {
+	sessionCmd.AddCommand(sessionLogsCmd)
+	sessionLogsCmd.Flags().BoolVar(&logsOpts.Follow, "follow", false, "Keep printing new log output until interrupted")
+}
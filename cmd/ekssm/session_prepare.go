@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/spf13/cobra"
+
+	"github.com/cloudopsy/ekssm/internal/config"
+	"github.com/cloudopsy/ekssm/internal/logging"
+	"github.com/cloudopsy/ekssm/internal/state"
+	"github.com/cloudopsy/ekssm/internal/util"
+	"github.com/cloudopsy/ekssm/pkg/api"
+	"github.com/cloudopsy/ekssm/pkg/ekssm"
+	"github.com/cloudopsy/ekssm/pkg/kubectl"
+	"github.com/cloudopsy/ekssm/pkg/proxy"
+)
+
+// sessionPrepareCmd turns a start request into a session: it validates the
+// request, looks the cluster and bastions up in AWS and writes the session's
+// kubeconfig. The agent runs it with the environment of whoever asked for
+// the session, so AWS is called with their credentials. It reads an
+// api.StartRequest on stdin and writes a preparedSession to stdout.
+var sessionPrepareCmd = &cobra.Command{
+	Use:    "prepare",
+	Short:  "Resolve a session start request (internal)",
+	Hidden: true,
+	RunE:   runPrepareSession,
+}
+
+// preparedSession is the result of 'session prepare'.
+type preparedSession struct {
+	Session *state.SessionState `json:"session,omitempty"`
+	Error   string              `json:"error,omitempty"`
+}
+
+func runPrepareSession(cmd *cobra.Command, args []string) error {
+	debug, _ := cmd.Flags().GetBool("debug")
+	logging.SetDebug(debug)
+
+	var result preparedSession
+	var req api.StartRequest
+	if err := json.NewDecoder(os.Stdin).Decode(&req); err != nil {
+		result.Error = fmt.Sprintf("invalid start request: %v", err)
+	} else {
+		ctx, cancelCtx := util.SignalContext()
+		defer cancelCtx()
+		session, err := prepareSession(ctx, req)
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Session = &session
+		}
+	}
+	return json.NewEncoder(os.Stdout).Encode(result)
+}
+
+// prepareSession validates req, resolves everything a session needs and
+// writes its kubeconfig.
+func prepareSession(ctx context.Context, req api.StartRequest) (state.SessionState, error) {
+	logging.Infof("Preparing new ekssm session for cluster %s...", req.ClusterName)
+
+	if req.ClusterName == "" {
+		return state.SessionState{}, fmt.Errorf("--cluster-name is required")
+	}
+	if req.BastionTag != "" && len(req.InstanceIDs)+len(req.Targets) > 0 {
+		return state.SessionState{}, fmt.Errorf("--bastion-tag cannot be combined with --instance-id or --target")
+	}
+	if req.SOCKS && req.UnixSocket {
+		return state.SessionState{}, fmt.Errorf("--socks and --unix-socket cannot be combined")
+	}
+	if req.Lazy && req.SOCKS {
+		return state.SessionState{}, fmt.Errorf("--lazy and --socks cannot be combined")
+	}
+
+	backend := req.Backend
+	if backend == "" {
+		backend = proxy.DefaultBackend
+		// SOCKS and socket modes need the built-in client unless a backend
+		// was chosen.
+		if req.SOCKS || req.UnixSocket {
+			backend = proxy.BackendSSM
+		}
+	}
+	if err := proxy.ValidateBackend(backend); err != nil {
+		return state.SessionState{}, err
+	}
+	if req.SOCKS {
+		if err := proxy.ValidateSOCKSBackend(backend); err != nil {
+			return state.SessionState{}, err
+		}
+	}
+	if req.UnixSocket {
+		// Only the built-in client and direct mode can serve a socket.
+		if err := proxy.ValidateSocketBackend(backend); err != nil {
+			return state.SessionState{}, err
+		}
+	}
+
+	keepaliveTarget := req.KeepaliveTarget
+	if keepaliveTarget == "" {
+		keepaliveTarget = proxy.DefaultKeepaliveTarget
+	}
+	if err := proxy.ValidateKeepaliveTarget(keepaliveTarget); err != nil {
+		return state.SessionState{}, err
+	}
+	keepaliveInterval := time.Duration(req.KeepaliveInterval)
+	if keepaliveInterval == 0 {
+		keepaliveInterval = proxy.DefaultKeepaliveInterval
+	}
+	idleTimeout := time.Duration(req.IdleTimeout)
+	if idleTimeout == 0 {
+		idleTimeout = proxy.DefaultIdleTimeout
+	}
+	if req.Lazy && idleTimeout < 0 {
+		return state.SessionState{}, fmt.Errorf("--idle-timeout must be positive")
+	}
+	ttl, err := requestTTL(req)
+	if err != nil {
+		return state.SessionState{}, err
+	}
+
+	target, err := ekssm.Resolve(ctx, ekssm.Options{
+		ClusterName:    req.ClusterName,
+		Targets:        append(append([]string(nil), req.InstanceIDs...), req.Targets...),
+		BastionTag:     req.BastionTag,
+		Backend:        backend,
+		LocalPort:      req.LocalPort,
+		Document:       req.Document,
+		DocumentParams: req.DocumentParams,
+		UserConfig:     true,
+	})
+	if err != nil {
+		return state.SessionState{}, err
+	}
+	localPort := target.LocalPort
+
+	forwards, err := resolveForwards(req.Forwards, localPort)
+	if err != nil {
+		return state.SessionState{}, err
+	}
+
+	sessionID := uuid.New().String()
+	logging.Debugf("Generated Session ID: %s", sessionID)
+
+	kubeconfigPath := util.KubeconfigPathForSession(req.ClusterName, sessionID)
+	logging.Debugf("Session kubeconfig path: %s", kubeconfigPath)
+
+	var socketPath, proxyPassword string
+	endpoint := fmt.Sprintf("https://localhost:%s", localPort)
+	kubeconfigContent := kubectl.GenerateKubeconfig(req.ClusterName, endpoint, target.CAData, target.Host)
+	switch {
+	case req.SOCKS:
+		// kubectl reaches the endpoint by its real hostname through the proxy.
+		proxyURL := fmt.Sprintf("socks5://127.0.0.1:%s", localPort)
+		kubeconfigContent = kubectl.GenerateKubeconfigWithProxy(req.ClusterName, "https://"+target.Host, target.CAData, proxyURL)
+	case req.UnixSocket:
+		// kubectl cannot dial the socket, so it goes through the CONNECT
+		// shim on the local port, authenticating with credentials that only
+		// the session's 0600 kubeconfig holds.
+		socketPath = util.SocketPathForSession(sessionID)
+		if proxyPassword, err = util.RandomToken(); err != nil {
+			return state.SessionState{}, err
+		}
+		proxyURL := proxy.ConnectShimURL(localPort, proxy.ConnectShimUser, proxyPassword)
+		kubeconfigContent = kubectl.GenerateKubeconfigWithProxy(req.ClusterName, "https://"+target.Host, target.CAData, proxyURL)
+	}
+
+	if err := util.WriteKubeconfig(kubeconfigPath, kubeconfigContent); err != nil {
+		return state.SessionState{}, fmt.Errorf("failed to write session kubeconfig to %s: %w", kubeconfigPath, err)
+	}
+	logging.Debugf("Session kubeconfig written successfully.")
+
+	session := state.SessionState{
+		SessionID:      sessionID,
+		ClusterName:    req.ClusterName,
+		InstanceIDs:    target.Bastions.InstanceIDs,
+		BastionTag:     target.Bastions.Tag,
+		Backend:        backend,
+		SOCKS:          req.SOCKS,
+		LocalPort:      localPort,
+		RemoteHost:     target.Host,
+		KubeconfigPath: kubeconfigPath,
+		LogPath:        util.LogPathForSession(sessionID),
+		Forwards:       forwards,
+		SocketPath:     socketPath,
+		ProxyPassword:  proxyPassword,
+		Document:       target.Document.Name,
+		DocumentParams: target.Document.Parameters,
+
+		KeepaliveTarget:   keepaliveTarget,
+		KeepaliveInterval: keepaliveInterval.String(),
+	}
+	if req.Lazy {
+		session.Lazy = true
+		session.IdleTimeout = idleTimeout.String()
+	}
+	if ttl > 0 {
+		expiresAt := time.Now().Add(ttl)
+		session.ExpiresAt = &expiresAt
+	}
+	return session, nil
+}
+
+// requestTTL returns the TTL a new session gets: the requested one when
+// given, otherwise the default from the config file. Zero means no expiry.
+func requestTTL(req api.StartRequest) (time.Duration, error) {
+	if req.TTL != nil {
+		if *req.TTL < 0 {
+			return 0, fmt.Errorf("--ttl cannot be negative")
+		}
+		return time.Duration(*req.TTL), nil
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		return 0, err
+	}
+	return cfg.TTL(req.ClusterName)
+}
+
+// resolveForwards allocates local ports for forwards where 0 was given and
+// rejects ports used twice in the session.
+func resolveForwards(requested []api.Forward, sessionPort string) ([]state.Forward, error) {
+	used := map[string]bool{sessionPort: true}
+	forwards := make([]state.Forward, 0, len(requested))
+	for _, f := range requested {
+		if f.LocalPort == "" {
+			f.LocalPort = "0"
+		}
+		localPort, host, port, err := util.ParseForward(f.LocalPort + ":" + net.JoinHostPort(f.RemoteHost, f.RemotePort))
+		if err != nil {
+			return nil, err
+		}
+		if localPort == "0" {
+			if localPort, err = util.FindAvailablePort(); err != nil {
+				return nil, fmt.Errorf("failed to find an available local port for forward %s: %w", f, err)
+			}
+		}
+		if used[localPort] {
+			return nil, fmt.Errorf("local port %s is used more than once in this session", localPort)
+		}
+		used[localPort] = true
+		forwards = append(forwards, state.Forward{LocalPort: localPort, RemoteHost: host, RemotePort: port})
+	}
+	return forwards, nil
+}
+
+func init() {
+	sessionCmd.AddCommand(sessionPrepareCmd)
+}
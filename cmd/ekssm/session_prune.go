@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cloudopsy/ekssm/internal/logging"
+	"github.com/cloudopsy/ekssm/internal/state"
+	"github.com/cloudopsy/ekssm/internal/util"
+	"github.com/cloudopsy/ekssm/pkg/api"
+)
+
+var pruneOpts struct {
+	DryRun bool
+}
+
+var sessionPruneCmd = &cobra.Command{
+	Use:   "prune [--dry-run]",
+	Short: "Remove dead sessions and orphaned kubeconfig files",
+	Long: `Asks the ekssm agent to remove the sessions whose serve process has gone, as
+after a crash or reboot, with their kubeconfig files, and the kubeconfig files
+in ~/.ekssm/kubeconfigs that belong to no session, such as the run-temp.yaml
+of an 'ekssm run' that was killed. Sessions the agent is restarting are kept.
+
+A session is dead when its PID no longer exists or, on Linux and Windows, now
+runs a different executable. On macOS the executable cannot be checked, so a
+session whose PID was taken by another process after a reboot counts as
+running until that process exits. 'ekssm session list' shows dead sessions as
+not running.`,
+	Args: cobra.NoArgs,
+	RunE: pruneSessions,
+}
+
+func pruneSessions(cmd *cobra.Command, args []string) error {
+	debug, _ := cmd.Flags().GetBool("debug")
+	logging.SetDebug(debug)
+
+	client, err := connectAgent(debug)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	result, err := client.PruneSessions(context.Background(), api.PruneRequest{DryRun: pruneOpts.DryRun})
+	if err != nil {
+		return err
+	}
+
+	if len(result.Sessions) == 0 && len(result.Files) == 0 {
+		fmt.Println("Nothing to prune.")
+		return nil
+	}
+	verb := "Removed"
+	if pruneOpts.DryRun {
+		verb = "Would remove"
+	}
+	for _, id := range result.Sessions {
+		fmt.Printf("%s dead session %s\n", verb, id)
+	}
+	for _, path := range result.Files {
+		fmt.Printf("%s orphaned kubeconfig %s\n", verb, path)
+	}
+	return nil
+}
+
+// pruneKubeconfigs removes the kubeconfig files under util.KubeconfigBasePath
+// that belong to none of sessions and returns their paths, or only returns
+// them if dryRun is set. A run-temp.yaml is kept while 'ekssm run' holds its
+// lock.
+func pruneKubeconfigs(sessions state.SessionMap, dryRun bool) ([]string, error) {
+	owned := make(map[string]bool, len(sessions))
+	for _, session := range sessions {
+		owned[session.KubeconfigPath] = true
+	}
+
+	base := util.KubeconfigBasePath()
+	clusters, err := os.ReadDir(base)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read kubeconfig directory %s: %w", base, err)
+	}
+	var pruned []string
+	var errs []error
+	for _, cluster := range clusters {
+		if !cluster.IsDir() {
+			continue
+		}
+		dir := filepath.Join(base, cluster.Name())
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to read kubeconfig directory %s: %w", dir, err))
+			continue
+		}
+		for _, entry := range entries {
+			path := filepath.Join(dir, entry.Name())
+			if entry.IsDir() || filepath.Ext(path) != ".yaml" || owned[path] {
+				continue
+			}
+			removed, err := pruneKubeconfig(path, cluster.Name(), dryRun)
+			if err != nil {
+				errs = append(errs, err)
+			}
+			if removed {
+				pruned = append(pruned, path)
+			}
+		}
+	}
+	return pruned, errors.Join(errs...)
+}
+
+// pruneKubeconfig removes an orphaned kubeconfig file, unless it is the
+// kubeconfig of an 'ekssm run' that is still running, and reports whether it
+// was, or with dryRun would have been, removed.
+func pruneKubeconfig(path, clusterName string, dryRun bool) (bool, error) {
+	if path == util.KubeconfigPathForRun(clusterName) {
+		runLock, err := util.LockRunKubeconfig(path)
+		if err != nil {
+			return false, err
+		}
+		if runLock == nil {
+			logging.Debugf("Keeping %s, which 'ekssm run' is using", path)
+			return false, nil
+		}
+		defer func() { _ = runLock.Remove() }()
+	}
+	if dryRun {
+		return true, nil
+	}
+	logging.Infof("Removing orphaned kubeconfig %s", path)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return false, fmt.Errorf("failed to remove kubeconfig %s: %w", path, err)
+	}
+	return true, nil
+}
+
+func init() {
+	sessionCmd.AddCommand(sessionPruneCmd)
+	sessionPruneCmd.Flags().BoolVar(&pruneOpts.DryRun, "dry-run", false, "Only list what would be removed")
+}
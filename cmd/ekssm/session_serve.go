@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/cloudopsy/ekssm/internal/constants"
+	"github.com/cloudopsy/ekssm/internal/hooks"
+	"github.com/cloudopsy/ekssm/internal/logging"
+	"github.com/cloudopsy/ekssm/internal/metrics"
+	"github.com/cloudopsy/ekssm/internal/state"
+	"github.com/cloudopsy/ekssm/internal/util"
+	awsclient "github.com/cloudopsy/ekssm/pkg/aws"
+	"github.com/cloudopsy/ekssm/pkg/proxy"
+)
+
+var serveOpts struct {
+	SessionID string
+}
+
+// trafficRecordInterval is how often a session's traffic counters are
+// written to its status file.
+const trafficRecordInterval = 5 * time.Second
+
+// expiryCheckInterval is the longest a session waits before reading its
+// expiry again, so 'session extend' is noticed.
+const expiryCheckInterval = time.Minute
+
+// sessionServeCmd hosts the tunnel for a background session. The agent
+// launches it as a detached process and records its PID in the session state.
+var sessionServeCmd = &cobra.Command{
+	Use:    "serve --session-id <id>",
+	Short:  "Run the tunnel for a background session (internal)",
+	Hidden: true,
+	RunE:   serveSession,
+}
+
+func serveSession(cmd *cobra.Command, args []string) error {
+	debug, _ := cmd.Flags().GetBool("debug")
+	logging.SetDebug(debug)
+
+	if serveOpts.SessionID == "" {
+		return fmt.Errorf("--session-id is required")
+	}
+
+	stateManager, err := state.NewManager()
+	if err != nil {
+		return fmt.Errorf("failed to initialize state manager: %w", err)
+	}
+
+	session, err := stateManager.GetSession(serveOpts.SessionID)
+	if err != nil {
+		return err
+	}
+
+	// Until the tunnels are up, the agent keeps our output to explain a
+	// failed start.
+	logPath := session.LogPath
+	if logPath == "" {
+		logPath = util.LogPathForSession(session.SessionID)
+	}
+	logFile, err := logging.OpenRotatingFile(logPath, logging.DefaultMaxLogSize, logging.DefaultLogBackups)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	logging.SetWriter(io.MultiWriter(logFile, os.Stderr))
+	defer logging.SetOutput("stderr")
+	pluginStdout := logging.NewLineWriter(zapcore.InfoLevel, "session-manager-plugin: ")
+	pluginStderr := logging.NewLineWriter(zapcore.WarnLevel, "session-manager-plugin: ")
+	doc := proxy.Document{Name: session.Document, Parameters: session.DocumentParams}
+
+	ctx, cancelCtx := util.SignalContext()
+	defer cancelCtx()
+
+	// Hooks run in our environment, which is that of the session's
+	// requester.
+	runner := loadHooks(session.ClusterName, nil)
+	about := hookSession(*session)
+
+	// An expired session is cleaned up once everything else has stopped,
+	// as 'session stop' would.
+	var expired atomic.Bool
+	go watchExpiry(ctx, stateManager, session.SessionID, func() {
+		expired.Store(true)
+		if err := runner.Run(context.Background(), hooks.PreStop, about, nil); err != nil {
+			logging.Warnf("%v; stopping the expired session anyway", err)
+		}
+		cancelCtx()
+	})
+	defer func() {
+		if !expired.Load() {
+			return
+		}
+		_ = removeSessionFiles(stateManager, *session)
+		if err := stateManager.RemoveSession(session.SessionID); err != nil {
+			logging.Warnf("Failed to remove expired session %s from state: %v", session.SessionID, err)
+		}
+		_ = runner.Run(context.Background(), hooks.PostStop, about, nil)
+	}()
+
+	status := newStatusRecorder(stateManager, session.SessionID)
+	awsclient.ObserveCalls(status.recordAPICall)
+
+	// Every tunnel of the session shares the bastion list, so a reconnect of
+	// any of them may move to another bastion.
+	bastions := proxy.NewBastions(session.Bastions())
+	bastions.Tag = session.BastionTag
+	bastions.OnSelect = func(instanceID string) {
+		status.update(func(s *state.SessionStatus) { s.InstanceID = instanceID })
+	}
+
+	// The session's local port, or socket, belongs to a relay that counts the
+	// traffic; the tunnels behind it listen on internal addresses.
+	upstreamPort, upstreamSocket := "", ""
+	if session.SocketPath != "" {
+		upstreamSocket = util.UpstreamSocketPathForSession(session.SessionID)
+	} else if upstreamPort, err = util.FindAvailablePort(); err != nil {
+		return fmt.Errorf("failed to find an internal port for the tunnel: %w", err)
+	}
+	traffic := &proxy.TrafficStats{}
+
+	var idleTimeout time.Duration
+	if session.Lazy {
+		if idleTimeout, err = time.ParseDuration(session.IdleTimeout); err != nil {
+			return fmt.Errorf("invalid idle timeout %q: %w", session.IdleTimeout, err)
+		}
+		status.update(func(s *state.SessionStatus) { s.Idle = true })
+	}
+	// upstream returns the tunnel behind one of the session's relays: a
+	// supervisor that reconnects it, only started on demand in lazy sessions.
+	tunnelsUp := 0
+	upstream := func(build func(instanceID string) (proxy.Tunnel, error)) proxy.Tunnel {
+		supervise := func() (proxy.Tunnel, error) {
+			supervisor := proxy.NewSupervisor(func() (proxy.Tunnel, error) {
+				return proxy.NewBastionTunnel(session.Backend, bastions, func(instanceID string) (proxy.Tunnel, error) {
+					tunnel, err := build(instanceID)
+					if err != nil {
+						return nil, err
+					}
+					// The plugin's output goes to the session log.
+					if plugin, ok := tunnel.(*proxy.SSMProxy); ok {
+						plugin.Stdout, plugin.Stderr = pluginStdout, pluginStderr
+					}
+					return proxy.WithDocument(tunnel, doc), nil
+				})
+			})
+			status.watch(supervisor)
+			notifyHooks(supervisor, runner, about)
+			return supervisor, nil
+		}
+		if !session.Lazy {
+			supervisor, _ := supervise()
+			return supervisor
+		}
+		lazy := proxy.NewLazyTunnel(supervise, idleTimeout)
+		lazy.OnStart = func() {
+			status.update(func(s *state.SessionStatus) {
+				tunnelsUp++
+				s.Idle = false
+			})
+		}
+		lazy.OnIdle = func() {
+			status.update(func(s *state.SessionStatus) {
+				tunnelsUp--
+				s.Idle = tunnelsUp == 0
+			})
+		}
+		return lazy
+	}
+
+	tunnel := upstream(func(instanceID string) (proxy.Tunnel, error) {
+		switch {
+		case session.SOCKS:
+			return proxy.NewSOCKSProxy(session.Backend, instanceID, upstreamPort), nil
+		case upstreamSocket != "":
+			return proxy.NewSocketTunnel(session.Backend, instanceID, upstreamSocket, session.RemoteHost, constants.EKSApiPort)
+		}
+		return proxy.NewTunnel(session.Backend, instanceID, upstreamPort, session.RemoteHost, constants.EKSApiPort)
+	})
+
+	relay := proxy.NewRelay(session.LocalPort, session.SocketPath, tunnel, traffic)
+	if err := relay.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start %s tunnel: %w", session.Backend, err)
+	}
+	defer func() {
+		if err := relay.Stop(); err != nil {
+			logging.Warnf("Failed to stop tunnel cleanly: %v", err)
+		}
+	}()
+	logging.Infof("Serving session %s on %s", session.SessionID, relay.LocalAddr())
+
+	if session.SocketPath != "" {
+		shim := proxy.NewConnectShim(session.LocalPort, session.SocketPath, proxy.ConnectShimUser, session.ProxyPassword)
+		if err := shim.Start(ctx); err != nil {
+			return fmt.Errorf("failed to start kubectl shim: %w", err)
+		}
+		defer shim.Stop()
+		logging.Infof("Kubectl shim for session %s on %s", session.SessionID, shim.LocalAddr())
+	}
+
+	keepalive, keepaliveErr := sessionKeepalive(status, session, tunnel)
+	if keepaliveErr != nil {
+		logging.Warnf("Keepalive disabled for session %s: %v", session.SessionID, keepaliveErr)
+	}
+
+	// Each extra forward gets its own tunnel; they all stop with the session.
+	for _, f := range session.Forwards {
+		f := f
+		forwardPort, err := util.FindAvailablePort()
+		if err != nil {
+			return fmt.Errorf("failed to find an internal port for forward %s: %w", f, err)
+		}
+		forward := upstream(func(instanceID string) (proxy.Tunnel, error) {
+			return proxy.NewTunnel(session.Backend, instanceID, forwardPort, f.RemoteHost, f.RemotePort)
+		})
+		forwardRelay := proxy.NewRelay(f.LocalPort, "", forward, traffic)
+		if err := forwardRelay.Start(ctx); err != nil {
+			return fmt.Errorf("failed to start forward %s: %w", f, err)
+		}
+		defer func() {
+			if err := forwardRelay.Stop(); err != nil {
+				logging.Warnf("Failed to stop forward %s cleanly: %v", f, err)
+			}
+		}()
+		logging.Infof("Forwarding %s for session %s", f, session.SessionID)
+		if keepalive != nil {
+			go forwardKeepalive(keepalive, forward).Run(ctx)
+		}
+	}
+
+	// SOCKS sessions open SSM sessions per destination on demand, so there
+	// is no long-lived session for a keepalive to hold open.
+	if session.SOCKS {
+		logging.Debugf("Keepalive not used for SOCKS session %s", session.SessionID)
+	} else if keepalive != nil {
+		go keepalive.Run(ctx)
+	}
+
+	status.update(func(s *state.SessionStatus) { s.Listening = true })
+	go status.recordTraffic(ctx, traffic)
+
+	// The agent only reads our output until the tunnels are ready, and may
+	// exit and leave us running.
+	logging.SetWriter(logFile)
+
+	<-ctx.Done()
+	if expired.Load() {
+		logging.Infof("Session %s has expired, stopping it", session.SessionID)
+	} else {
+		logging.Infof("Stopping session %s", session.SessionID)
+	}
+	return nil
+}
+
+// watchExpiry calls expire once the session's TTL has run out. The session
+// is read again before every decision, so a TTL that 'session extend' added,
+// pushed out or shortened takes effect.
+func watchExpiry(ctx context.Context, stateManager *state.Manager, sessionID string, expire func()) {
+	for {
+		wait := expiryCheckInterval
+		session, err := stateManager.GetSession(sessionID)
+		if err != nil {
+			logging.Debugf("Cannot check expiry of session %s: %v", sessionID, err)
+		} else if session.ExpiresAt != nil {
+			if session.Expired() {
+				expire()
+				return
+			}
+			wait = min(time.Until(*session.ExpiresAt), expiryCheckInterval)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// sessionKeepalive builds the keepalive configured for the session, recording
+// each successful keepalive in the session status.
+func sessionKeepalive(status *statusRecorder, session *state.SessionState, tunnel proxy.Tunnel) (*proxy.Keepalive, error) {
+	target := session.KeepaliveTarget
+	if target == "" {
+		target = proxy.DefaultKeepaliveTarget
+	}
+	if err := proxy.ValidateKeepaliveTarget(target); err != nil {
+		return nil, err
+	}
+	interval := proxy.DefaultKeepaliveInterval
+	if session.KeepaliveInterval != "" {
+		parsed, err := time.ParseDuration(session.KeepaliveInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keepalive interval %q: %w", session.KeepaliveInterval, err)
+		}
+		interval = parsed
+	}
+
+	return &proxy.Keepalive{
+		Tunnel:     tunnel,
+		Target:     target,
+		Interval:   interval,
+		ServerName: session.RemoteHost,
+		OnSuccess: func(at time.Time) {
+			status.update(func(s *state.SessionStatus) { s.LastKeepalive = &at })
+		},
+	}, nil
+}
+
+// forwardKeepalive keeps a forward's SSM session open on the same interval as
+// the session's keepalive. Forwards can point at any TCP service, so they are
+// only ever connected to, never spoken TLS or HTTP to.
+func forwardKeepalive(session *proxy.Keepalive, tunnel proxy.Tunnel) *proxy.Keepalive {
+	target := proxy.KeepaliveTCP
+	if session.Target == proxy.KeepaliveNone {
+		target = proxy.KeepaliveNone
+	}
+	return &proxy.Keepalive{Tunnel: tunnel, Target: target, Interval: session.Interval}
+}
+
+// statusRecorder publishes the serve process's view of its tunnels to the
+// session's status file. The serve process is the only writer of that file
+// and never writes session.json.
+type statusRecorder struct {
+	manager   *state.Manager
+	sessionID string
+
+	mu     sync.Mutex
+	status state.SessionStatus
+}
+
+func newStatusRecorder(manager *state.Manager, sessionID string) *statusRecorder {
+	r := &statusRecorder{manager: manager, sessionID: sessionID}
+	r.update(func(*state.SessionStatus) {})
+	return r
+}
+
+func (r *statusRecorder) update(change func(*state.SessionStatus)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	change(&r.status)
+	r.status.UpdatedAt = time.Now()
+	if err := r.manager.WriteStatus(r.sessionID, r.status); err != nil {
+		logging.Warnf("Failed to record status for session %s: %v", r.sessionID, err)
+	}
+}
+
+// recordTraffic publishes the relays' counters every trafficRecordInterval
+// while they change, until ctx is done.
+func (r *statusRecorder) recordTraffic(ctx context.Context, stats *proxy.TrafficStats) {
+	ticker := time.NewTicker(trafficRecordInterval)
+	defer ticker.Stop()
+
+	var last proxy.Traffic
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		traffic := stats.Snapshot()
+		if traffic == last {
+			continue
+		}
+		last = traffic
+		r.update(func(s *state.SessionStatus) {
+			s.Traffic = state.Traffic{
+				Connections:       traffic.Connections,
+				ActiveConnections: traffic.ActiveConnections,
+				BytesIn:           traffic.BytesIn,
+				BytesOut:          traffic.BytesOut,
+			}
+			if !traffic.LastActivity.IsZero() {
+				at := traffic.LastActivity
+				s.Traffic.LastActivity = &at
+			}
+		})
+	}
+}
+
+// recordAPICall counts an AWS API call made by the session's tunnels, and
+// how long SSM StartSession took.
+func (r *statusRecorder) recordAPICall(service, operation string, duration time.Duration, err error) {
+	r.update(func(s *state.SessionStatus) {
+		s.RecordAPICall(service, operation, err != nil)
+		if service == ssm.ServiceID && operation == "StartSession" {
+			if s.StartSessionLatency == nil {
+				s.StartSessionLatency = metrics.NewBuckets(metrics.LatencyBuckets)
+			}
+			s.StartSessionLatency.Observe(duration.Seconds())
+		}
+	})
+}
+
+// watch records the supervisor's disconnects, failed reconnect attempts and
+// reconnects. A successful reconnect clears the last error.
+func (r *statusRecorder) watch(supervisor *proxy.Supervisor) {
+	supervisor.OnDisconnect = func(err error) {
+		r.update(func(s *state.SessionStatus) { s.LastError = err.Error() })
+	}
+	supervisor.OnReconnectError = func(_ int, err error, _ time.Duration) {
+		r.update(func(s *state.SessionStatus) { s.LastError = err.Error() })
+	}
+	supervisor.OnReconnect = func(int) {
+		r.update(func(s *state.SessionStatus) {
+			s.Reconnects++
+			s.LastError = ""
+		})
+	}
+}
+
+// notifyHooks runs the session's on_failure hooks when the supervisor's
+// tunnel goes down and its on_reconnect hooks when it is back, after the
+// callbacks already set.
+func notifyHooks(supervisor *proxy.Supervisor, runner *hooks.Runner, session hooks.Session) {
+	onDisconnect, onReconnect := supervisor.OnDisconnect, supervisor.OnReconnect
+	supervisor.OnDisconnect = func(err error) {
+		if onDisconnect != nil {
+			onDisconnect(err)
+		}
+		runner.Notify(hooks.OnFailure, session, err)
+	}
+	supervisor.OnReconnect = func(reconnects int) {
+		if onReconnect != nil {
+			onReconnect(reconnects)
+		}
+		runner.Notify(hooks.OnReconnect, session, nil)
+	}
+}
+
+func init() {
+	sessionCmd.AddCommand(sessionServeCmd)
+	sessionServeCmd.Flags().StringVar(&serveOpts.SessionID, "session-id", "", "ID of the session to serve")
+}
@@ -1,33 +1,46 @@
 package main
 
 import (
-	"context"
 	"fmt"
 	"os"
-	"syscall"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/spf13/cobra"
 
 	"github.com/cloudopsy/ekssm/internal/constants"
 	"github.com/cloudopsy/ekssm/internal/logging"
-	"github.com/cloudopsy/ekssm/internal/state"
 	"github.com/cloudopsy/ekssm/internal/util"
-	"github.com/cloudopsy/ekssm/pkg/kubectl"
+	"github.com/cloudopsy/ekssm/pkg/api"
 	"github.com/cloudopsy/ekssm/pkg/proxy"
 )
 
 var startOpts struct {
 	ClusterName string
-	InstanceID  string
+	InstanceIDs []string
+	Targets     []string
+	BastionTag  string
 	LocalPort   string // Optional, leave empty or "0" for dynamic port allocation
+	Backend     string
+	SOCKS       bool
+	UnixSocket  bool
+	Forwards    []string // localPort:host:port
+
+	Document       string
+	DocumentParams []string // key=value
+
+	KeepaliveTarget   string
+	KeepaliveInterval time.Duration
+
+	Lazy        bool
+	IdleTimeout time.Duration
+
+	TTL time.Duration
 }
 
 var sessionStartCmd = &cobra.Command{
 	Use:   "start",
 	Short: "Start a background SSM proxy session for EKS access",
-	Long: `Starts an SSM port forwarding session in the background to the specified EKS cluster endpoint via an EC2 instance.
+	Long: `Starts an SSM port forwarding session in the background to the specified EKS cluster endpoint via a bastion: an EC2 instance, hybrid managed node or ECS task.
 It automatically finds an available local port unless one is specified with --local-port.
 It generates a dedicated kubeconfig file for this session and saves the session details.
 Multiple sessions can be started concurrently.`,
@@ -39,111 +52,115 @@ func startSession(cmd *cobra.Command, args []string) error {
 	logging.SetDebug(debug)
 	logging.Info("Starting new ekssm session...")
 
-	if startOpts.ClusterName == "" || startOpts.InstanceID == "" {
-		return fmt.Errorf("--cluster-name and --instance-id are required")
+	req, err := startRequest(cmd, debug)
+	if err != nil {
+		return err
 	}
 
-	stateManager, err := state.NewManager()
+	client, err := connectAgent(debug)
 	if err != nil {
-		return fmt.Errorf("failed to initialize state manager: %w", err)
+		return err
 	}
+	defer client.Close()
 
-	ctx, cancelCtx := context.WithCancel(context.Background())
+	ctx, cancelCtx := util.SignalContext()
 	defer cancelCtx()
 
-	eksHost, err := util.EKSClusterEndpoint(ctx, startOpts.ClusterName)
+	// The agent resolves and starts the session with our environment, so
+	// AWS credentials apply as if we started it ourselves.
+	session, err := client.StartSession(ctx, req)
 	if err != nil {
 		return err
 	}
 
-	localPort := startOpts.LocalPort
-	if localPort == "" || localPort == "0" {
-		logging.Debug("No local port specified or set to 0, finding an available port...")
-		foundPort, err := util.FindAvailablePort()
-		if err != nil {
-			return fmt.Errorf("failed to find an available local port: %w", err)
-		}
-		localPort = foundPort
-		logging.Infof("Using dynamically allocated local port: %s", localPort)
-	} else {
-		logging.Infof("Using user-specified local port: %s", localPort)
-	}
-
-	ssmProxy := proxy.NewSSMProxy(startOpts.InstanceID, localPort, eksHost, constants.EKSApiPort)
-
-	sessionID := uuid.New().String()
-	logging.Debugf("Generated Session ID: %s", sessionID)
-
-	kubeconfigPath := util.KubeconfigPathForSession(startOpts.ClusterName, sessionID)
-	logging.Debugf("Session kubeconfig path: %s", kubeconfigPath)
-
-	endpoint := fmt.Sprintf("https://localhost:%s", localPort)
-	kubeconfigContent := kubectl.GenerateKubeconfig(startOpts.ClusterName, endpoint)
+	logging.Infof("SSM proxy started successfully in background (PID: %d)", session.PID)
+	printSessionInfo(*session)
+	return nil
+}
 
-	if err := util.WriteKubeconfig(kubeconfigPath, kubeconfigContent); err != nil {
-		return fmt.Errorf("failed to write session kubeconfig to %s: %w", kubeconfigPath, err)
+// startRequest turns the flags of 'session start' into a request for the
+// agent. Flags left at their defaults are left unset, so the agent applies
+// the same defaults, including those from the config file.
+func startRequest(cmd *cobra.Command, debug bool) (api.StartRequest, error) {
+	flags := cmd.Flags()
+	req := api.StartRequest{
+		ClusterName:       startOpts.ClusterName,
+		InstanceIDs:       startOpts.InstanceIDs,
+		Targets:           startOpts.Targets,
+		BastionTag:        startOpts.BastionTag,
+		LocalPort:         startOpts.LocalPort,
+		SOCKS:             startOpts.SOCKS,
+		UnixSocket:        startOpts.UnixSocket,
+		Document:          startOpts.Document,
+		KeepaliveTarget:   startOpts.KeepaliveTarget,
+		KeepaliveInterval: api.Duration(startOpts.KeepaliveInterval),
+		Lazy:              startOpts.Lazy,
+		Env:               os.Environ(),
+		Debug:             debug,
 	}
-	logging.Debugf("Session kubeconfig written successfully.")
-
-	pid, err := ssmProxy.StartBackground()
-	if err != nil {
-		// Attempt cleanup if proxy fails to start
-		_ = os.Remove(kubeconfigPath)
-		return fmt.Errorf("failed to start SSM proxy: %w", err)
-	}
-	logging.Infof("SSM proxy started successfully in background (PID: %d)", pid)
-
-	newState := state.SessionState{
-		PID:            pid,
-		SessionID:      sessionID,
-		ClusterName:    startOpts.ClusterName,
-		InstanceID:     startOpts.InstanceID,
-		LocalPort:      localPort,
-		KubeconfigPath: kubeconfigPath,
-	}
-
-	if err := stateManager.AddSession(newState); err != nil {
-		// Attempt to kill the orphaned proxy process if state saving fails
-		logging.Errorf("Failed to save session state: %v. Attempting to terminate proxy process PID %d...", err, pid)
-		process, findErr := os.FindProcess(pid)
-		if findErr == nil {
-			if killErr := process.Signal(syscall.SIGTERM); killErr != nil {
-				logging.Warnf("Failed to send SIGTERM to proxy process PID %d: %v", pid, killErr)
-			}
-		} else {
-			logging.Warnf("Could not find proxy process PID %d to terminate: %v", pid, findErr)
-		}
-		// Also attempt cleanup of kubeconfig file
-		_ = os.Remove(kubeconfigPath)
-		return fmt.Errorf("failed to save session state after starting proxy: %w", err)
+	if flags.Changed("backend") {
+		req.Backend = startOpts.Backend
 	}
-
-	printSessionInfo(pid, sessionID, startOpts.ClusterName, localPort, eksHost, startOpts.InstanceID, kubeconfigPath)
-
-	cleanup := func() {
-		logging.Warnf("Attempting cleanup for session %s...", sessionID)
-		if stopErr := ssmProxy.Stop(); stopErr != nil {
-			logging.Warnf("Error stopping proxy during signal cleanup: %v", stopErr)
+	if startOpts.Lazy {
+		if startOpts.IdleTimeout <= 0 {
+			return api.StartRequest{}, fmt.Errorf("--idle-timeout must be positive")
 		}
-		if removeErr := os.Remove(kubeconfigPath); removeErr != nil && !os.IsNotExist(removeErr) {
-			logging.Warnf("Error removing kubeconfig during signal cleanup: %v", removeErr)
+		req.IdleTimeout = api.Duration(startOpts.IdleTimeout)
+	}
+	if flags.Changed("ttl") {
+		ttl := api.Duration(startOpts.TTL)
+		req.TTL = &ttl
+	}
+	for _, spec := range startOpts.Forwards {
+		localPort, host, port, err := util.ParseForward(spec)
+		if err != nil {
+			return api.StartRequest{}, err
 		}
-		_ = stateManager.RemoveSession(sessionID)
+		req.Forwards = append(req.Forwards, api.Forward{LocalPort: localPort, RemoteHost: host, RemotePort: port})
 	}
+	params, err := proxy.ParseDocumentParams(startOpts.DocumentParams)
+	if err != nil {
+		return api.StartRequest{}, err
+	}
+	req.DocumentParams = params
+	return req, nil
+}
 
-	time.Sleep(1 * time.Second)
-
-	util.HandleSignalCustom(cleanup)
-
-	return nil
+// tunnelRoute describes how a session reaches the cluster, for display.
+func tunnelRoute(session api.Session) string {
+	if !proxy.RequiresInstance(session.Backend) {
+		return session.Backend
+	}
+	if session.InstanceID == "" && session.Lazy {
+		return "a bastion, on first connection"
+	}
+	return session.InstanceID
 }
 
-func printSessionInfo(pid int, sessionID, clusterName, localPort, eksHost, instanceID, kubeconfigPath string) {
+func printSessionInfo(session api.Session) {
+	kubeconfigPath := session.KubeconfigPath
+
 	fmt.Println("Successfully started ekssm session in background.")
-	fmt.Printf("  PID: %d\n", pid)
-	fmt.Printf("  SessionID: %s\n", sessionID)
-	fmt.Printf("  Cluster: %s\n", clusterName)
-	fmt.Printf("  Proxy: localhost:%s -> %s:%s (via %s)\n", localPort, eksHost, constants.EKSApiPort, instanceID)
+	fmt.Printf("  PID: %d\n", session.PID)
+	fmt.Printf("  SessionID: %s\n", session.SessionID)
+	fmt.Printf("  Cluster: %s\n", session.ClusterName)
+	if session.SOCKS {
+		fmt.Printf("  Proxy: socks5://127.0.0.1:%s (via %s)\n", session.LocalPort, tunnelRoute(session))
+	} else if session.SocketPath != "" {
+		fmt.Printf("  Proxy: %s -> %s:%s (via %s)\n", session.SocketPath, session.RemoteHost, constants.EKSApiPort, tunnelRoute(session))
+		fmt.Printf("  Kubectl shim: localhost:%s (authenticated HTTP CONNECT)\n", session.LocalPort)
+	} else {
+		fmt.Printf("  Proxy: localhost:%s -> %s:%s (via %s)\n", session.LocalPort, session.RemoteHost, constants.EKSApiPort, tunnelRoute(session))
+	}
+	for _, f := range session.Forwards {
+		fmt.Printf("  Forward: localhost:%s -> %s:%s\n", f.LocalPort, f.RemoteHost, f.RemotePort)
+	}
+	if session.Lazy {
+		fmt.Printf("  Lazy: tunnels start on first connection and stop after %s idle\n", session.IdleTimeout)
+	}
+	if session.ExpiresAt != nil {
+		fmt.Printf("  Expires: %s (in %s)\n", session.ExpiresAt.Local().Format(time.DateTime), formatRemaining(session.ExpiresAt))
+	}
 	fmt.Printf("  Session Kubeconfig: %s\n\n", kubeconfigPath)
 	fmt.Println("To use this session, export the KUBECONFIG environment variable:")
 	fmt.Printf("  export KUBECONFIG='%s'\n\n", kubeconfigPath)
@@ -159,10 +176,26 @@ func init() {
 	sessionCmd.AddCommand(sessionStartCmd)
 
 	sessionStartCmd.Flags().StringVar(&startOpts.ClusterName, "cluster-name", "", "Name of the EKS cluster (required)")
-	sessionStartCmd.Flags().StringVar(&startOpts.InstanceID, "instance-id", "", "EC2 instance ID of the bastion host (required)")
+	sessionStartCmd.Flags().StringSliceVar(&startOpts.InstanceIDs, "instance-id", nil, "EC2 instance ID of the bastion host (required unless --target, --bastion-tag, a cluster default or --backend direct); repeat to fail over across bastions in order")
+	sessionStartCmd.Flags().StringVar(&startOpts.BastionTag, "bastion-tag", "", "Use the Online SSM-managed instances with this key=value tag as bastions, newest agent first")
+	sessionStartCmd.Flags().StringSliceVar(&startOpts.Targets, "target", nil, "SSM target of the bastion: i-<id>, mi-<id> (hybrid managed node), ecs:<cluster>_<taskId>_<runtimeId> (ECS task container), or ecs:<cluster>/<service>/<container> to use a running task of an ECS service; repeat to fail over across bastions in order")
+	sessionStartCmd.MarkFlagsMutuallyExclusive("instance-id", "target", "bastion-tag")
 	sessionStartCmd.Flags().StringVar(&startOpts.LocalPort, "local-port", "", "Local port for forwarding EKS API access (default: dynamically allocated)")
-
-	for _, flag := range []string{"cluster-name", "instance-id"} {
+	sessionStartCmd.Flags().StringArrayVar(&startOpts.Forwards, "forward", nil, "Additional port to forward through the bastion, as localPort:host:port (repeatable; localPort 0 allocates one)")
+	sessionStartCmd.Flags().BoolVar(&startOpts.SOCKS, "socks", false, "Run a SOCKS5 proxy that can reach any host from the bastion instead of forwarding only the EKS endpoint")
+	sessionStartCmd.Flags().BoolVar(&startOpts.UnixSocket, "unix-socket", false, "Serve the EKS tunnel on a Unix socket under ~/.ekssm/sockets readable only by you; kubectl reaches it through an authenticated proxy on the local port")
+	sessionStartCmd.MarkFlagsMutuallyExclusive("socks", "unix-socket")
+	sessionStartCmd.Flags().StringVar(&startOpts.Document, "document", "", "SSM document to start sessions with, such as a copy of "+proxy.PortForwardingDocument+" with session logging (default: the cluster default, or "+proxy.PortForwardingDocument+")")
+	sessionStartCmd.Flags().StringArrayVar(&startOpts.DocumentParams, "document-param", nil, "Extra parameter for the SSM document, as key=value (repeatable)")
+	sessionStartCmd.Flags().StringVar(&startOpts.KeepaliveTarget, "keepalive-target", proxy.DefaultKeepaliveTarget, "Keepalive traffic sent through the tunnel: tls (TLS handshake), livez (GET /livez), tcp (TCP connect) or none; forwards always use tcp")
+	sessionStartCmd.Flags().DurationVar(&startOpts.KeepaliveInterval, "keepalive-interval", proxy.DefaultKeepaliveInterval, "Interval between keepalives; keep it below the Session Manager idle timeout")
+	sessionStartCmd.Flags().BoolVar(&startOpts.Lazy, "lazy", false, "Bind the local ports now but only start SSM sessions when a client connects, stopping them again once idle")
+	sessionStartCmd.Flags().DurationVar(&startOpts.TTL, "ttl", 0, "Stop and clean up the session automatically after this long, e.g. 8h; 0 never expires (default: session_ttl from the config file, if set)")
+	sessionStartCmd.Flags().DurationVar(&startOpts.IdleTimeout, "idle-timeout", proxy.DefaultIdleTimeout, "With --lazy, how long tunnels stay up after their last connection closes")
+	sessionStartCmd.MarkFlagsMutuallyExclusive("lazy", "socks")
+	sessionStartCmd.Flags().StringVar(&startOpts.Backend, "backend", proxy.DefaultBackend, "Tunnel backend: plugin (session-manager-plugin), ssm (built-in SSM client) or direct (no bastion)")
+
+	for _, flag := range []string{"cluster-name"} {
 		if err := sessionStartCmd.MarkFlagRequired(flag); err != nil {
 			fmt.Fprintf(os.Stderr, "Error marking %s flag required: %v\n", flag, err)
 			os.Exit(1)
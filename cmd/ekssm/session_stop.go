@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"syscall"
@@ -10,6 +11,7 @@ import (
 
 	"github.com/cloudopsy/ekssm/internal/logging"
 	"github.com/cloudopsy/ekssm/internal/state"
+	"github.com/cloudopsy/ekssm/internal/util"
 )
 
 type sessionStopOptions struct {
@@ -21,8 +23,9 @@ var stopOpts sessionStopOptions
 var sessionStopCmd = &cobra.Command{
 	Use:   "stop [--session-id <id>]",
 	Short: "Stop background SSM proxy session(s)",
-	Long: `Terminates running SSM proxy process(es) identified by the session state file(s).
-Removes the generated kubeconfig file(s) for the session(s).
+	Long: `Asks the ekssm agent to terminate the SSM proxy process(es) of the session(s)
+and remove the generated kubeconfig file(s). An agent is started if none is
+running.
 
 If --session-id is provided, only that specific session is stopped.
 If no --session-id is provided, all active sessions are stopped.`,
@@ -33,71 +36,42 @@ func stopSession(cmd *cobra.Command, args []string) error {
 	debug, _ := cmd.Flags().GetBool("debug")
 	logging.SetDebug(debug)
 
-	stateManager, err := state.NewManager()
+	client, err := connectAgent(debug)
 	if err != nil {
-		return fmt.Errorf("failed to initialize state manager: %w", err)
+		return err
 	}
+	defer client.Close()
 
 	if stopOpts.SessionID != "" {
 		logging.Infof("Attempting to stop session with ID: %s", stopOpts.SessionID)
-		session, err := stateManager.GetSession(stopOpts.SessionID)
-		if err != nil {
-			logging.Errorf("Failed to find session with ID '%s': %v", stopOpts.SessionID, err)
-			return err
-		}
-		return stopAndCleanupSession(stateManager, *session, true)
+	} else {
+		logging.Info("Attempting to stop all active sessions...")
 	}
-
-	logging.Info("Attempting to stop all active sessions...")
-	allSessions, err := stateManager.GetAllSessions()
+	stopped, err := client.StopSession(context.Background(), stopOpts.SessionID)
 	if err != nil {
-		return fmt.Errorf("failed to load session states: %w", err)
+		return err
 	}
 
-	if len(allSessions) == 0 {
+	if stopOpts.SessionID != "" {
+		logging.Infof("Successfully cleaned up session %s", stopOpts.SessionID)
+	} else if len(stopped) == 0 {
 		logging.Info("No active sessions found to stop.")
-		if clearErr := stateManager.ClearAllSessions(); clearErr != nil {
-			logging.Warnf("Failed to ensure state file is cleared: %v", clearErr)
-		}
-		return nil
-	}
-
-	stoppedCount := 0
-	var firstErr error
-
-	for id, session := range allSessions {
-		logging.Infof("Stopping session %s (PID: %d)...", id, session.PID)
-		err := stopAndCleanupSession(stateManager, session, false)
-		if err != nil {
-			logging.Errorf("Failed to fully stop session %s: %v", id, err)
-			if firstErr == nil {
-				firstErr = err
-			}
-		} else {
-			stoppedCount++
-		}
-	}
-
-	if clearErr := stateManager.ClearAllSessions(); clearErr != nil {
-		logging.Warnf("Failed to clear session state file after stopping sessions: %v", clearErr)
-		if firstErr == nil {
-			firstErr = fmt.Errorf("failed to clear session state: %w", clearErr)
-		}
-	}
-
-	logging.Infof("Finished stopping sessions. %d sessions were stopped.", stoppedCount)
-	if firstErr != nil {
-		return fmt.Errorf("encountered errors while stopping sessions: %w", firstErr)
+	} else {
+		logging.Infof("Finished stopping sessions. %d sessions were stopped.", len(stopped))
 	}
-
 	return nil
 }
 
+// stopAndCleanupSession stops a session's serve process through its PID and
+// removes the session. The agent uses it for sessions it does not supervise.
 func stopAndCleanupSession(manager *state.Manager, session state.SessionState, removeFromState bool) error {
 	var combinedErr error
 
+	// A dead session's PID may since have been taken by another process.
 	process, err := os.FindProcess(session.PID)
-	if err != nil {
+	if !session.Running() {
+		logging.Debugf("Process %d of session %s is no longer running", session.PID, session.SessionID)
+	} else if err != nil {
 		logging.Warnf("Could not find process with PID %d for session %s (already stopped?): %v", session.PID, session.SessionID, err)
 	} else {
 		logging.Debugf("Sending SIGTERM to process PID %d for session %s", session.PID, session.SessionID)
@@ -120,6 +94,33 @@ func stopAndCleanupSession(manager *state.Manager, session state.SessionState, r
 		}
 	}
 
+	if err := removeSessionFiles(manager, session); err != nil && combinedErr == nil {
+		combinedErr = err
+	}
+
+	if removeFromState {
+		logging.Debugf("Removing session %s from state file.", session.SessionID)
+		if err := manager.RemoveSession(session.SessionID); err != nil {
+			logging.Errorf("Failed to remove session %s from state: %v", session.SessionID, err)
+			if combinedErr == nil {
+				combinedErr = fmt.Errorf("failed to remove session %s from state: %w", session.SessionID, err)
+			}
+		}
+	}
+
+	if combinedErr == nil {
+		logging.Infof("Successfully cleaned up session %s", session.SessionID)
+	}
+
+	return combinedErr
+}
+
+// removeSessionFiles removes what a session leaves behind once its serve
+// process has gone: the kubeconfig, any sockets and the status file. Only a
+// failure to remove the kubeconfig is returned.
+func removeSessionFiles(manager *state.Manager, session state.SessionState) error {
+	var combinedErr error
+
 	if session.KubeconfigPath != "" {
 		logging.Debugf("Removing kubeconfig file: %s", session.KubeconfigPath)
 		if err := os.Remove(session.KubeconfigPath); err != nil {
@@ -138,18 +139,17 @@ func stopAndCleanupSession(manager *state.Manager, session state.SessionState, r
 		logging.Warnf("No kubeconfig path found in state for session %s, skipping removal.", session.SessionID)
 	}
 
-	if removeFromState {
-		logging.Debugf("Removing session %s from state file.", session.SessionID)
-		if err := manager.RemoveSession(session.SessionID); err != nil {
-			logging.Errorf("Failed to remove session %s from state: %v", session.SessionID, err)
-			if combinedErr == nil {
-				combinedErr = fmt.Errorf("failed to remove session %s from state: %w", session.SessionID, err)
+	// The serve process removes its socket on a clean exit, but not when killed.
+	if session.SocketPath != "" {
+		for _, path := range []string{session.SocketPath, util.UpstreamSocketPathForSession(session.SessionID)} {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				logging.Warnf("Failed to remove socket %s: %v", path, err)
 			}
 		}
 	}
 
-	if combinedErr == nil {
-		logging.Infof("Successfully cleaned up session %s", session.SessionID)
+	if err := manager.RemoveStatus(session.SessionID); err != nil {
+		logging.Warnf("%v", err)
 	}
 
 	return combinedErr
@@ -1,12 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/spf13/cobra"
 
 	"github.com/cloudopsy/ekssm/internal/logging"
-	"github.com/cloudopsy/ekssm/internal/state"
+	"github.com/cloudopsy/ekssm/pkg/api"
 )
 
 var sessionSwitchCmd = &cobra.Command{
@@ -33,17 +34,22 @@ func switchSession(cmd *cobra.Command, args []string) error {
 	debug, _ := cmd.Flags().GetBool("debug")
 	logging.SetDebug(debug)
 
-	stateManager, err := state.NewManager()
+	client, err := connectAgent(debug)
 	if err != nil {
-		return fmt.Errorf("failed to initialize state manager: %w", err)
+		return err
 	}
+	defer client.Close()
 
-	session, err := stateManager.GetSession(sessionID)
+	ctx := context.Background()
+	target, err := client.SwitchTarget(ctx, sessionID)
 	if err != nil {
-		logging.Errorf("Session ID '%s' not found or error reading state: %v", sessionID, err)
+		if !api.IsNotFound(err) {
+			return err
+		}
+		logging.Errorf("Session ID '%s' not found: %v", sessionID, err)
 
-		allSessions, _ := stateManager.GetAllSessions()
-		if len(allSessions) == 0 {
+		sessions, _ := client.ListSessions(ctx, api.ListRequest{})
+		if len(sessions) == 0 {
 			fmt.Println("Hint: No active sessions found. Use 'ekssm session start' to create one.")
 		} else {
 			fmt.Println("Hint: Use 'ekssm session list' to see available session IDs.")
@@ -52,13 +58,13 @@ func switchSession(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("active session with ID '%s' not found", sessionID)
 	}
 
-	if session.KubeconfigPath == "" {
+	if target.KubeconfigPath == "" {
 		return fmt.Errorf("session '%s' exists but has no associated kubeconfig path in state", sessionID)
 	}
 
-	fmt.Printf("export KUBECONFIG='%s'\n", session.KubeconfigPath)
+	fmt.Println(target.Export)
 	logging.Infof("Use the above command in your shell to switch KUBECONFIG for session %s (Cluster: %s)",
-		session.SessionID, session.ClusterName)
+		target.SessionID, target.ClusterName)
 
 	return nil
 }
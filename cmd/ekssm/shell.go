@@ -24,6 +24,12 @@ This enables automatic setting of KUBECONFIG when using 'ekssm session switch'.`
 		case "bash", "zsh":
 			fmt.Print(`
 # ekssm shell integration
+
+# _ekssm_session_ids prints the IDs in 'ekssm session list -o json' output.
+_ekssm_session_ids() {
+  grep -o '"session_id": *"[^"]*"' | sed 's/.*"\([^"]*\)"$/\1/'
+}
+
 ekssm() {
   # Parse first argument
   local cmd="$1"
@@ -49,11 +55,18 @@ ekssm() {
     elif [ "$subcmd" = "start" ]; then
       # Remove the first two arguments to pass the rest to the command
       shift 2
+      # The new session is the one that was not listed before it started.
+      local before_ids=$(command ekssm session list -o json | _ekssm_session_ids)
       command ekssm session start "$@"
       local exit_code=$?
       
       if [ $exit_code -eq 0 ]; then
-        local session_id=$(command ekssm session list | grep "Latest session created:" | awk '{print $NF}')
+        local session_id
+        if [ -n "$before_ids" ]; then
+          session_id=$(command ekssm session list -o json | _ekssm_session_ids | grep -vxF "$before_ids" | head -n 1)
+        else
+          session_id=$(command ekssm session list -o json | _ekssm_session_ids | head -n 1)
+        fi
         if [ -n "$session_id" ]; then
           local kubeconfig_cmd=$(command ekssm session switch "$session_id")
           eval "$kubeconfig_cmd"
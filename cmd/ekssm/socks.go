@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cloudopsy/ekssm/internal/logging"
+	"github.com/cloudopsy/ekssm/internal/util"
+	"github.com/cloudopsy/ekssm/pkg/ekssm"
+	"github.com/cloudopsy/ekssm/pkg/proxy"
+)
+
+type socksOptions struct {
+	InstanceIDs []string
+	Targets     []string
+	LocalPort   string
+	Backend     string
+
+	Document       string
+	DocumentParams []string // key=value
+}
+
+var socksOpts socksOptions
+
+var socksCmd = &cobra.Command{
+	Use:   "socks --instance-id <id> [--local-port 1080]",
+	Short: "Run a local SOCKS5 proxy that reaches hosts from the bastion",
+	Long: `Runs a SOCKS5 proxy on localhost until interrupted. Each destination requested
+through the proxy is reached from the bastion over its own SSM port forwarding
+session, opened on demand. This gives access to internal load balancers,
+databases and other services in the bastion's VPC.
+
+Example: ekssm socks --instance-id i-12345 --local-port 1080
+         curl --socks5-hostname 127.0.0.1:1080 https://argocd.internal.example.com`,
+	Args: cobra.NoArgs,
+	RunE: runSOCKS,
+}
+
+func runSOCKS(cmd *cobra.Command, args []string) error {
+	debug, _ := cmd.Flags().GetBool("debug")
+	logging.SetDebug(debug)
+
+	if err := proxy.ValidateSOCKSBackend(socksOpts.Backend); err != nil {
+		return err
+	}
+	targets := append(socksOpts.InstanceIDs, socksOpts.Targets...)
+	if len(targets) == 0 && proxy.RequiresInstance(socksOpts.Backend) {
+		return fmt.Errorf("--target or --instance-id is required for the %s backend", socksOpts.Backend)
+	}
+	for _, target := range targets {
+		if err := proxy.ValidateTarget(target); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancelCtx := util.SignalContext()
+	defer cancelCtx()
+
+	docParams, err := proxy.ParseDocumentParams(socksOpts.DocumentParams)
+	if err != nil {
+		return err
+	}
+	doc, err := ekssm.ResolveDocument(ctx, ekssm.Options{
+		Backend:        socksOpts.Backend,
+		Document:       socksOpts.Document,
+		DocumentParams: docParams,
+		UserConfig:     true,
+	})
+	if err != nil {
+		return err
+	}
+
+	socks, err := proxy.NewBastionTunnel(socksOpts.Backend, proxy.NewBastions(targets), func(instanceID string) (proxy.Tunnel, error) {
+		return proxy.WithDocument(proxy.NewSOCKSProxy(socksOpts.Backend, instanceID, socksOpts.LocalPort), doc), nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := socks.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start SOCKS proxy: %w", err)
+	}
+	defer func() {
+		if err := socks.Stop(); err != nil {
+			logging.Warnf("Failed to stop SOCKS proxy cleanly: %v", err)
+		}
+	}()
+
+	fmt.Printf("SOCKS5 proxy listening on socks5://%s. Press Ctrl+C to stop.\n", socks.LocalAddr())
+	<-ctx.Done()
+	logging.Info("Stopping SOCKS proxy...")
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(socksCmd)
+
+	socksCmd.Flags().StringSliceVar(&socksOpts.InstanceIDs, "instance-id", nil, "EC2 instance ID of the bastion host (required unless --target or --backend direct); repeat to fail over across bastions in order")
+	socksCmd.Flags().StringSliceVar(&socksOpts.Targets, "target", nil, "SSM target of the bastion: i-<id>, mi-<id> (hybrid managed node), ecs:<cluster>_<taskId>_<runtimeId> (ECS task container), or ecs:<cluster>/<service>/<container> to use a running task of an ECS service; repeat to fail over across bastions in order")
+	socksCmd.MarkFlagsMutuallyExclusive("instance-id", "target")
+	socksCmd.Flags().StringVar(&socksOpts.LocalPort, "local-port", "1080", "Local port for the SOCKS5 proxy")
+	socksCmd.Flags().StringVar(&socksOpts.Document, "document", "", "SSM document to start sessions with, such as a copy of "+proxy.PortForwardingDocument+" with session logging")
+	socksCmd.Flags().StringArrayVar(&socksOpts.DocumentParams, "document-param", nil, "Extra parameter for the SSM document, as key=value (repeatable)")
+	socksCmd.Flags().StringVar(&socksOpts.Backend, "backend", proxy.BackendSSM, "Tunnel backend: ssm (built-in SSM client) or direct (no bastion)")
+}
@@ -0,0 +1,342 @@
+// Package agent is the protocol between the ekssm CLI and the agent that owns
+// background sessions: JSON-RPC 2.0 over a Unix socket, one JSON object per
+// line in each direction.
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudopsy/ekssm/internal/logging"
+)
+
+const jsonrpcVersion = "2.0"
+
+// JSON-RPC 2.0 error codes.
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+)
+
+// maxMessageSize bounds a single request or response line.
+const maxMessageSize = 16 << 20
+
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+// Error is a JSON-RPC error returned by a method.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Method handles one JSON-RPC method. Its result is encoded as JSON; an
+// error that is not an *Error is reported as an internal error. ctx is done
+// when the client closes the connection or the server is closed.
+type Method func(ctx context.Context, params json.RawMessage) (any, error)
+
+// Server answers JSON-RPC requests on a Unix socket. Requests on one
+// connection are answered in order; connections are served concurrently.
+type Server struct {
+	methods map[string]Method
+
+	listener net.Listener
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// NewServer returns a server without methods.
+func NewServer() *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		methods: make(map[string]Method),
+		ctx:     ctx,
+		cancel:  cancel,
+		conns:   make(map[net.Conn]struct{}),
+	}
+}
+
+// Handle registers method under name.
+func (s *Server) Handle(name string, method Method) {
+	s.methods[name] = method
+}
+
+// Listen listens on the Unix socket at path, readable only by the current
+// user, replacing a stale socket left by an agent that did not shut down.
+func Listen(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create agent socket directory: %w", err)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("an ekssm agent is already listening on %s", path)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale agent socket %s: %w", path, err)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict agent socket %s: %w", path, err)
+	}
+	return listener, nil
+}
+
+// Serve accepts connections on listener until Close is called.
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.ctx.Err() != nil {
+		s.mu.Unlock()
+		listener.Close()
+		return nil
+	}
+	s.listener = listener
+	s.mu.Unlock()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+				conn.Close()
+			}()
+			s.serveConn(conn)
+		}()
+	}
+}
+
+// Close stops accepting connections, cancels the requests in progress and
+// waits for them to be answered. It must not be called from a Method.
+func (s *Server) Close() error {
+	s.cancel()
+	s.mu.Lock()
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	// Unblock reads only, so requests in progress still get their response.
+	for conn := range s.conns {
+		_ = conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// serveConn answers the requests on conn in order. Requests run with a
+// context that is cancelled once the client closes the connection, so that
+// work nobody waits for any more, such as starting a session, is abandoned.
+func (s *Server) serveConn(conn net.Conn) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	// Lines are read ahead of the request being served, which is how the
+	// connection is noticed to close while a request runs.
+	lines := make(chan []byte)
+	go func() {
+		defer close(lines)
+		defer cancel()
+		scanner := bufio.NewScanner(conn)
+		scanner.Buffer(make([]byte, 64<<10), maxMessageSize)
+		for scanner.Scan() {
+			select {
+			case lines <- append([]byte(nil), scanner.Bytes()...):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	encoder := json.NewEncoder(conn)
+	for line := range lines {
+		resp := s.call(ctx, line)
+		if resp == nil {
+			continue
+		}
+		if err := encoder.Encode(resp); err != nil {
+			logging.Debugf("Agent client went away: %v", err)
+			return
+		}
+	}
+}
+
+// call runs one request and returns its response, or nil for a notification.
+func (s *Server) call(ctx context.Context, line []byte) *response {
+	var req request
+	if err := json.Unmarshal(line, &req); err != nil {
+		return &response{JSONRPC: jsonrpcVersion, ID: json.RawMessage("null"), Error: &Error{Code: CodeParseError, Message: err.Error()}}
+	}
+	resp := &response{JSONRPC: jsonrpcVersion, ID: req.ID}
+	if resp.ID == nil {
+		resp.ID = json.RawMessage("null")
+	}
+	if req.JSONRPC != jsonrpcVersion || req.Method == "" {
+		resp.Error = &Error{Code: CodeInvalidRequest, Message: "invalid JSON-RPC 2.0 request"}
+		return resp
+	}
+
+	method, ok := s.methods[req.Method]
+	if !ok {
+		resp.Error = &Error{Code: CodeMethodNotFound, Message: fmt.Sprintf("method %s not found", req.Method)}
+		return resp
+	}
+	logging.Debugf("Agent request %s", req.Method)
+	result, err := method(ctx, req.Params)
+	if req.ID == nil {
+		return nil
+	}
+	if err != nil {
+		var rpcErr *Error
+		if !errors.As(err, &rpcErr) {
+			rpcErr = &Error{Code: CodeInternalError, Message: err.Error()}
+		}
+		resp.Error = rpcErr
+		return resp
+	}
+	if resp.Result, err = json.Marshal(result); err != nil {
+		resp.Error = &Error{Code: CodeInternalError, Message: fmt.Sprintf("failed to encode result: %v", err)}
+	}
+	return resp
+}
+
+// DecodeParams decodes a method's params into v, reporting malformed params
+// as CodeInvalidParams.
+func DecodeParams(params json.RawMessage, v any) error {
+	if len(params) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return &Error{Code: CodeInvalidParams, Message: fmt.Sprintf("invalid params: %v", err)}
+	}
+	return nil
+}
+
+// Client calls methods on an agent. Calls are serialized over one
+// connection. It is safe for concurrent use.
+type Client struct {
+	conn    net.Conn
+	scanner *bufio.Scanner
+	mu      sync.Mutex
+	nextID  atomic.Int64
+}
+
+// Dial connects to the agent listening on the Unix socket at path.
+func Dial(path string) (*Client, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64<<10), maxMessageSize)
+	return &Client{conn: conn, scanner: scanner}, nil
+}
+
+// Call invokes method with params and decodes its result into result, which
+// may be nil. It gives up when ctx is done.
+func (c *Client) Call(ctx context.Context, method string, params, result any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	req := request{JSONRPC: jsonrpcVersion, Method: method}
+	id, _ := json.Marshal(c.nextID.Add(1))
+	req.ID = id
+	if params != nil {
+		data, err := json.Marshal(params)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s params: %w", method, err)
+		}
+		req.Params = data
+	}
+
+	// A cancelled call leaves the connection unusable: the response would
+	// answer the next call.
+	stop := context.AfterFunc(ctx, func() { c.conn.Close() })
+	defer stop()
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if _, err := c.conn.Write(append(data, '\n')); err != nil {
+		return c.callError(ctx, method, err)
+	}
+	if !c.scanner.Scan() {
+		err := c.scanner.Err()
+		if err == nil {
+			err = errors.New("agent closed the connection")
+		}
+		return c.callError(ctx, method, err)
+	}
+	var resp response
+	if err := json.Unmarshal(c.scanner.Bytes(), &resp); err != nil {
+		return fmt.Errorf("invalid response to %s: %w", method, err)
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if result != nil && len(resp.Result) > 0 {
+		if err := json.Unmarshal(resp.Result, result); err != nil {
+			return fmt.Errorf("invalid result of %s: %w", method, err)
+		}
+	}
+	return nil
+}
+
+func (c *Client) callError(ctx context.Context, method string, err error) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("%s: %w", method, ctx.Err())
+	}
+	return fmt.Errorf("%s: %w", method, err)
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,222 @@
+package agent_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudopsy/ekssm/internal/agent"
+)
+
+// startServer serves methods on a socket in a temporary directory and
+// returns the socket's path.
+func startServer(t *testing.T, methods map[string]agent.Method) (*agent.Server, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := agent.Listen(path)
+	require.NoError(t, err)
+
+	server := agent.NewServer()
+	for name, method := range methods {
+		server.Handle(name, method)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	t.Cleanup(func() {
+		_ = server.Close()
+		assert.NoError(t, <-served)
+	})
+	return server, path
+}
+
+func dial(t *testing.T, path string) *agent.Client {
+	t.Helper()
+	client, err := agent.Dial(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// getParams and session stand in for the agent's request and result types.
+type getParams struct {
+	SessionID string `json:"session_id"`
+}
+
+type session struct {
+	SessionID   string `json:"session_id"`
+	ClusterName string `json:"cluster_name"`
+	Reconnects  int    `json:"reconnects"`
+}
+
+const codeNotFound = -32001
+
+func TestCallRoundTrip(t *testing.T) {
+	_, path := startServer(t, map[string]agent.Method{
+		"session.get": func(_ context.Context, raw json.RawMessage) (any, error) {
+			var params getParams
+			if err := agent.DecodeParams(raw, &params); err != nil {
+				return nil, err
+			}
+			if params.SessionID != "abc" {
+				return nil, &agent.Error{Code: codeNotFound, Message: "session with ID '" + params.SessionID + "' not found"}
+			}
+			return session{SessionID: "abc", ClusterName: "prod", Reconnects: 2}, nil
+		},
+		"fail": func(context.Context, json.RawMessage) (any, error) {
+			return nil, errors.New("boom")
+		},
+	})
+	client := dial(t, path)
+	ctx := context.Background()
+
+	var got session
+	require.NoError(t, client.Call(ctx, "session.get", getParams{SessionID: "abc"}, &got))
+	assert.Equal(t, session{SessionID: "abc", ClusterName: "prod", Reconnects: 2}, got)
+
+	err := client.Call(ctx, "session.get", getParams{SessionID: "missing"}, &got)
+	var rpcErr *agent.Error
+	require.ErrorAs(t, err, &rpcErr)
+	assert.Equal(t, codeNotFound, rpcErr.Code)
+	assert.Contains(t, rpcErr.Message, "missing")
+
+	err = client.Call(ctx, "session.get", map[string]int{"session_id": 1}, nil)
+	require.ErrorAs(t, err, &rpcErr)
+	assert.Equal(t, agent.CodeInvalidParams, rpcErr.Code)
+
+	err = client.Call(ctx, "fail", nil, nil)
+	require.ErrorAs(t, err, &rpcErr)
+	assert.Equal(t, agent.CodeInternalError, rpcErr.Code)
+	assert.Equal(t, "boom", rpcErr.Message)
+
+	err = client.Call(ctx, "session.unknown", nil, nil)
+	require.ErrorAs(t, err, &rpcErr)
+	assert.Equal(t, agent.CodeMethodNotFound, rpcErr.Code)
+
+	// The connection is still usable after errors.
+	assert.NoError(t, client.Call(ctx, "session.get", getParams{SessionID: "abc"}, &got))
+}
+
+func TestServerSpeaksJSONRPC(t *testing.T) {
+	_, path := startServer(t, map[string]agent.Method{
+		"echo": func(_ context.Context, raw json.RawMessage) (any, error) {
+			return raw, nil
+		},
+	})
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// A notification has no ID and gets no response, so the first line
+	// read answers the request after it.
+	_, err = conn.Write([]byte(`{"jsonrpc":"2.0","method":"echo","params":[0]}` + "\n" +
+		`{"jsonrpc":"2.0","id":"a","method":"echo","params":[1]}` + "\n" +
+		`not json` + "\n"))
+	require.NoError(t, err)
+
+	decoder := json.NewDecoder(conn)
+	var resp map[string]any
+	require.NoError(t, decoder.Decode(&resp))
+	assert.Equal(t, map[string]any{"jsonrpc": "2.0", "id": "a", "result": []any{1.0}}, resp)
+
+	resp = nil
+	require.NoError(t, decoder.Decode(&resp))
+	assert.Nil(t, resp["id"])
+	assert.Equal(t, float64(agent.CodeParseError), resp["error"].(map[string]any)["code"])
+}
+
+func TestCloseAnswersRequestsInProgress(t *testing.T) {
+	started := make(chan struct{})
+	server, path := startServer(t, map[string]agent.Method{
+		"wait": func(ctx context.Context, _ json.RawMessage) (any, error) {
+			close(started)
+			<-ctx.Done()
+			return "cancelled", nil
+		},
+	})
+	client := dial(t, path)
+
+	result := make(chan error, 1)
+	var answer string
+	go func() {
+		result <- client.Call(context.Background(), "wait", nil, &answer)
+	}()
+	<-started
+	require.NoError(t, server.Close())
+
+	select {
+	case err := <-result:
+		require.NoError(t, err)
+		assert.Equal(t, "cancelled", answer)
+	case <-time.After(5 * time.Second):
+		t.Fatal("request in progress was not answered")
+	}
+}
+
+func TestCallGivesUpWithContext(t *testing.T) {
+	_, path := startServer(t, map[string]agent.Method{
+		"wait": func(ctx context.Context, _ json.RawMessage) (any, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	})
+	client := dial(t, path)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := client.Call(ctx, "wait", nil, nil)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestListen(t *testing.T) {
+	_, path := startServer(t, nil)
+
+	_, err := agent.Listen(path)
+	assert.ErrorContains(t, err, "already listening")
+
+	// A socket file nobody listens on is left by an agent that was killed.
+	stale := filepath.Join(t.TempDir(), "agent.sock")
+	require.NoError(t, os.WriteFile(stale, nil, 0600))
+	listener, err := agent.Listen(stale)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	info, err := os.Stat(stale)
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeSocket, info.Mode().Type())
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestDisconnectCancelsRequest(t *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	_, path := startServer(t, map[string]agent.Method{
+		"wait": func(ctx context.Context, _ json.RawMessage) (any, error) {
+			close(started)
+			<-ctx.Done()
+			close(cancelled)
+			return nil, ctx.Err()
+		},
+	})
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte(`{"jsonrpc":"2.0","id":1,"method":"wait"}` + "\n"))
+	require.NoError(t, err)
+	<-started
+	require.NoError(t, conn.Close())
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was not cancelled when its client went away")
+	}
+}
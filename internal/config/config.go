@@ -0,0 +1,111 @@
+// Package config reads ekssm's optional user configuration from
+// $HOME/.ekssm/config.json.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Config is the user configuration. Every setting is optional.
+type Config struct {
+	// SessionTTL, as a duration such as "8h", is how long background
+	// sessions run before they are stopped, unless a cluster sets its own.
+	SessionTTL string `json:"session_ttl,omitempty"`
+	// MetricsListen, as host:port, is where the agent serves Prometheus
+	// metrics unless --metrics-listen is given.
+	MetricsListen string `json:"metrics_listen,omitempty"`
+	// Hooks run for every session, before the cluster's own.
+	Hooks Hooks `json:"hooks,omitempty"`
+	// Clusters holds per-cluster defaults, keyed by EKS cluster name.
+	Clusters map[string]Cluster `json:"clusters,omitempty"`
+}
+
+// Cluster holds defaults for one cluster, used when the matching flag is not
+// given on the command line.
+type Cluster struct {
+	InstanceIDs []string `json:"instance_ids,omitempty"`
+	// Targets are bastions other than EC2 instances, such as ECS tasks and
+	// hybrid managed nodes, tried after InstanceIDs.
+	Targets    []string `json:"targets,omitempty"`
+	BastionTag string   `json:"bastion_tag,omitempty"`
+
+	// Document is the SSM document sessions are started with, and
+	// DocumentParams the extra parameters passed to it.
+	Document       string            `json:"document,omitempty"`
+	DocumentParams map[string]string `json:"document_params,omitempty"`
+
+	SessionTTL string `json:"session_ttl,omitempty"`
+
+	// Hooks run for the cluster's sessions, after the global ones.
+	Hooks Hooks `json:"hooks,omitempty"`
+}
+
+// Hooks are the executables to run on session lifecycle events, keyed by
+// event name, such as "post_start", in the order they are listed.
+type Hooks map[string][]Hook
+
+// Hook is an executable run on a session lifecycle event.
+type Hook struct {
+	// Command is the executable and its arguments. It is not run through a
+	// shell.
+	Command []string `json:"command"`
+	// Timeout, as a duration such as "10s", is how long the hook may run
+	// before it is killed.
+	Timeout string `json:"timeout,omitempty"`
+	// FailurePolicy is what a failed hook does: "warn" logs a warning,
+	// "ignore" only logs at debug level, and "abort" fails the start or stop
+	// it ran before.
+	FailurePolicy string `json:"failure_policy,omitempty"`
+}
+
+// Path returns the location of the configuration file.
+func Path() string {
+	return filepath.Join(os.Getenv("HOME"), ".ekssm", "config.json")
+}
+
+// Load reads the configuration file. A missing file is an empty configuration.
+func Load() (*Config, error) {
+	return LoadFile(Path())
+}
+
+// LoadFile reads the configuration from path.
+func LoadFile(path string) (*Config, error) {
+	cfg := &Config{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Cluster returns the defaults for the named cluster.
+func (c *Config) Cluster(name string) Cluster {
+	return c.Clusters[name]
+}
+
+// TTL returns the session TTL for the named cluster: its own, or the global
+// one. Zero means sessions do not expire.
+func (c *Config) TTL(cluster string) (time.Duration, error) {
+	ttl := c.Cluster(cluster).SessionTTL
+	if ttl == "" {
+		ttl = c.SessionTTL
+	}
+	if ttl == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid session_ttl %q in %s", ttl, Path())
+	}
+	return d, nil
+}
@@ -0,0 +1,75 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudopsy/ekssm/internal/config"
+)
+
+func TestLoadFileReadsClusterDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+  "clusters": {
+    "prod": {"bastion_tag": "Role=bastion"},
+    "staging": {"instance_ids": ["i-aaaaaaaaaaaaaaaaa", "i-bbbbbbbbbbbbbbbbb"]}
+  }
+}`), 0600))
+
+	cfg, err := config.LoadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, config.Cluster{BastionTag: "Role=bastion"}, cfg.Cluster("prod"))
+	assert.Equal(t, []string{"i-aaaaaaaaaaaaaaaaa", "i-bbbbbbbbbbbbbbbbb"}, cfg.Cluster("staging").InstanceIDs)
+	assert.Equal(t, config.Cluster{}, cfg.Cluster("dev"))
+}
+
+func TestLoadFileMissingIsEmpty(t *testing.T) {
+	cfg, err := config.LoadFile(filepath.Join(t.TempDir(), "missing.json"))
+	require.NoError(t, err)
+	assert.Equal(t, config.Cluster{}, cfg.Cluster("prod"))
+}
+
+func TestLoadFileReadsDocumentDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+  "clusters": {
+    "prod": {"document": "Org-PortForwarding", "document_params": {"s3BucketName": "audit-logs"}}
+  }
+}`), 0600))
+
+	cfg, err := config.LoadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "Org-PortForwarding", cfg.Cluster("prod").Document)
+	assert.Equal(t, map[string]string{"s3BucketName": "audit-logs"}, cfg.Cluster("prod").DocumentParams)
+}
+
+func TestTTL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+  "session_ttl": "8h",
+  "clusters": {
+    "prod": {"session_ttl": "2h"},
+    "broken": {"session_ttl": "soon"}
+  }
+}`), 0600))
+
+	cfg, err := config.LoadFile(path)
+	require.NoError(t, err)
+	ttl, err := cfg.TTL("prod")
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Hour, ttl)
+	ttl, err = cfg.TTL("staging")
+	require.NoError(t, err)
+	assert.Equal(t, 8*time.Hour, ttl)
+	_, err = cfg.TTL("broken")
+	assert.Error(t, err)
+
+	ttl, err = (&config.Config{}).TTL("prod")
+	require.NoError(t, err)
+	assert.Zero(t, ttl)
+}
@@ -0,0 +1,188 @@
+// Package health probes background sessions: whether the serve process is
+// alive, whether its local ports accept connections and whether the
+// Kubernetes API answers through the tunnel.
+package health
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/cloudopsy/ekssm/internal/constants"
+	"github.com/cloudopsy/ekssm/internal/state"
+	"github.com/cloudopsy/ekssm/internal/util"
+	"github.com/cloudopsy/ekssm/pkg/proxy"
+)
+
+// Status summarises a session's health.
+type Status string
+
+const (
+	Healthy  Status = "healthy"  // every check passed
+	Degraded Status = "degraded" // the process runs but the tunnel does not carry traffic
+	Dead     Status = "dead"     // the serve process is gone
+)
+
+// probeTimeout bounds each individual check.
+const probeTimeout = 5 * time.Second
+
+// apiPaths are tried in order; an answer on any of them is enough.
+var apiPaths = []string{"/livez", "/version"}
+
+// Check is the outcome of one probe.
+type Check struct {
+	Name string
+	Err  error
+}
+
+// Result is the outcome of probing a session.
+type Result struct {
+	Status Status
+	Checks []Check
+}
+
+// Err returns the first failed check's error, or nil if the session is healthy.
+func (r Result) Err() error {
+	for _, c := range r.Checks {
+		if c.Err != nil {
+			return fmt.Errorf("%s: %w", c.Name, c.Err)
+		}
+	}
+	return nil
+}
+
+// Probe checks a session. Later checks are skipped once the process is
+// found dead, since they cannot pass. Only the process of a lazy session is
+// checked: connecting to it would start its tunnels.
+func Probe(ctx context.Context, session state.SessionState) Result {
+	result := Result{Status: Healthy}
+
+	if !util.ProcessAlive(session.PID) {
+		result.Status = Dead
+		result.Checks = append(result.Checks, Check{Name: "process", Err: fmt.Errorf("process %d is not running", session.PID)})
+		return result
+	}
+	if session.Dead {
+		result.Status = Dead
+		result.Checks = append(result.Checks, Check{Name: "process", Err: fmt.Errorf("process %d is no longer ekssm", session.PID)})
+		return result
+	}
+	result.add(Check{Name: "process"})
+	if session.Lazy {
+		return result
+	}
+
+	ports := []string{session.LocalPort}
+	for _, f := range session.Forwards {
+		ports = append(ports, f.LocalPort)
+	}
+	for _, port := range ports {
+		result.add(Check{Name: "port " + port, Err: probePort(ctx, port)})
+	}
+	if session.SocketPath != "" {
+		result.add(Check{Name: "socket", Err: probeSocket(ctx, session.SocketPath)})
+	}
+	result.add(Check{Name: "api", Err: probeAPI(ctx, session)})
+	return result
+}
+
+func (r *Result) add(check Check) {
+	if check.Err != nil {
+		r.Status = Degraded
+	}
+	r.Checks = append(r.Checks, check)
+}
+
+// ProbeAll checks sessions concurrently and returns results keyed by session ID.
+func ProbeAll(ctx context.Context, sessions state.SessionMap) map[string]Result {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[string]Result, len(sessions))
+	)
+	for id, session := range sessions {
+		wg.Add(1)
+		go func(id string, session state.SessionState) {
+			defer wg.Done()
+			result := Probe(ctx, session)
+			mu.Lock()
+			results[id] = result
+			mu.Unlock()
+		}(id, session)
+	}
+	wg.Wait()
+	return results
+}
+
+func probePort(ctx context.Context, port string) error {
+	return probeDial(ctx, "tcp", net.JoinHostPort("127.0.0.1", port))
+}
+
+func probeSocket(ctx context.Context, path string) error {
+	return probeDial(ctx, "unix", path)
+}
+
+func probeDial(ctx context.Context, network, addr string) error {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probeAPI asks the Kubernetes API for /livez, then /version, through the
+// session's tunnel. Any HTTP response counts: anonymous requests may
+// legitimately be refused, and a refusal still comes from the API server.
+func probeAPI(ctx context.Context, session state.SessionState) error {
+	// This only proves the tunnel reaches an API server; the certificate is
+	// verified by kubectl through the session's kubeconfig.
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			ServerName:         session.RemoteHost,
+			InsecureSkipVerify: true, //nolint:gosec
+		},
+		DisableKeepAlives: true,
+	}
+	base := "https://" + net.JoinHostPort("localhost", session.LocalPort)
+	switch {
+	case session.SOCKS:
+		transport.Proxy = http.ProxyURL(&url.URL{Scheme: "socks5", Host: net.JoinHostPort("127.0.0.1", session.LocalPort)})
+		base = "https://" + net.JoinHostPort(session.RemoteHost, constants.EKSApiPort)
+	case session.SocketPath != "":
+		// Go through the kubectl shim, the way kubectl does.
+		transport.Proxy = http.ProxyURL(&url.URL{
+			Scheme: "http",
+			User:   url.UserPassword(proxy.ConnectShimUser, session.ProxyPassword),
+			Host:   net.JoinHostPort("127.0.0.1", session.LocalPort),
+		})
+		base = "https://" + net.JoinHostPort(session.RemoteHost, constants.EKSApiPort)
+	}
+	client := &http.Client{Transport: transport, Timeout: probeTimeout}
+
+	var lastErr error
+	for _, path := range apiPaths {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+path, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			lastErr = fmt.Errorf("GET %s failed: %w", path, err)
+			continue
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return nil
+	}
+	return lastErr
+}
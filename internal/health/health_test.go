@@ -0,0 +1,65 @@
+package health_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudopsy/ekssm/internal/health"
+	"github.com/cloudopsy/ekssm/internal/state"
+	"github.com/cloudopsy/ekssm/internal/util"
+)
+
+func TestProbe(t *testing.T) {
+	// Anonymous requests are refused, as on most clusters; the answer is
+	// still proof that the API server is reachable.
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(t, err)
+
+	closedPort, err := util.FindAvailablePort()
+	require.NoError(t, err)
+
+	session := state.SessionState{PID: os.Getpid(), LocalPort: port, RemoteHost: "ABCDEF.gr7.eu-west-1.eks.amazonaws.com"}
+
+	result := health.Probe(context.Background(), session)
+	assert.Equal(t, health.Healthy, result.Status)
+	assert.NoError(t, result.Err())
+
+	session.Forwards = []state.Forward{{LocalPort: closedPort, RemoteHost: "db.internal", RemotePort: "5432"}}
+	result = health.Probe(context.Background(), session)
+	assert.Equal(t, health.Degraded, result.Status)
+	assert.ErrorContains(t, result.Err(), "port "+closedPort)
+
+	session.Forwards = nil
+	session.LocalPort = closedPort
+	result = health.Probe(context.Background(), session)
+	assert.Equal(t, health.Degraded, result.Status)
+
+	session.PID = 0
+	result = health.Probe(context.Background(), session)
+	assert.Equal(t, health.Dead, result.Status)
+	assert.ErrorContains(t, result.Err(), "process 0 is not running")
+}
+
+func TestProbeLazySessionOnlyChecksProcess(t *testing.T) {
+	closedPort, err := util.FindAvailablePort()
+	require.NoError(t, err)
+
+	// Connecting would start a lazy session's tunnel, so its closed port is
+	// not probed.
+	session := state.SessionState{PID: os.Getpid(), LocalPort: closedPort, Lazy: true, IdleTimeout: "15m0s"}
+	result := health.Probe(context.Background(), session)
+	assert.Equal(t, health.Healthy, result.Status)
+	require.Len(t, result.Checks, 1)
+	assert.Equal(t, "process", result.Checks[0].Name)
+}
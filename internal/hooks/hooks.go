@@ -0,0 +1,223 @@
+// Package hooks runs the user's session lifecycle hooks: executables set in
+// the configuration file that run when a session starts, stops, reconnects
+// or fails, told about the session in EKSSM_ environment variables.
+package hooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+
+	"github.com/cloudopsy/ekssm/internal/config"
+	"github.com/cloudopsy/ekssm/internal/logging"
+)
+
+// Lifecycle events hooks run on.
+const (
+	PreStart    = "pre_start"
+	PostStart   = "post_start"
+	PreStop     = "pre_stop"
+	PostStop    = "post_stop"
+	OnReconnect = "on_reconnect"
+	OnFailure   = "on_failure"
+)
+
+// Events lists every lifecycle event, in the order they can occur.
+var Events = []string{PreStart, PostStart, OnFailure, OnReconnect, PreStop, PostStop}
+
+// Failure policies.
+const (
+	PolicyWarn   = "warn"
+	PolicyIgnore = "ignore"
+	PolicyAbort  = "abort"
+)
+
+// DefaultTimeout is how long a hook may run when it sets no timeout.
+const DefaultTimeout = 30 * time.Second
+
+// notifyQueue is how many events Notify holds while earlier hooks run.
+const notifyQueue = 16
+
+// Session is what hooks are told about the session they run for.
+type Session struct {
+	// ID is empty for 'ekssm run', which has no session ID.
+	ID         string
+	Cluster    string
+	Kubeconfig string
+	LocalPort  string
+}
+
+// environ returns the EKSSM_ variables hooks run with.
+func (s Session) environ(event string, cause error) []string {
+	env := []string{
+		"EKSSM_EVENT=" + event,
+		"EKSSM_SESSION_ID=" + s.ID,
+		"EKSSM_CLUSTER=" + s.Cluster,
+		"EKSSM_KUBECONFIG=" + s.Kubeconfig,
+		"EKSSM_LOCAL_PORT=" + s.LocalPort,
+	}
+	if cause != nil {
+		env = append(env, "EKSSM_ERROR="+cause.Error())
+	}
+	return env
+}
+
+type hook struct {
+	command []string
+	timeout time.Duration
+	policy  string
+}
+
+// Runner runs the hooks configured for a cluster. A nil Runner runs none.
+type Runner struct {
+	hooks map[string][]hook
+	env   []string
+
+	startQueue sync.Once
+	queue      chan func()
+}
+
+// Load returns a Runner for the hooks the configuration file sets for
+// cluster's sessions. Hooks run in env, or in this process's environment if
+// env is nil, with the EKSSM_ variables added.
+func Load(cluster string, env []string) (*Runner, error) {
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, err
+	}
+	return New(cfg, cluster, env)
+}
+
+// New returns a Runner for the hooks cfg sets for cluster's sessions: the
+// global ones followed by the cluster's own.
+func New(cfg *config.Config, cluster string, env []string) (*Runner, error) {
+	r := &Runner{hooks: make(map[string][]hook), env: env}
+	for _, hooks := range []config.Hooks{cfg.Hooks, cfg.Cluster(cluster).Hooks} {
+		for event, configured := range hooks {
+			if !knownEvent(event) {
+				return nil, fmt.Errorf("unknown hook event %q in %s (expected one of %v)", event, config.Path(), Events)
+			}
+			for _, c := range configured {
+				h, err := parseHook(event, c)
+				if err != nil {
+					return nil, fmt.Errorf("invalid %s hook in %s: %w", event, config.Path(), err)
+				}
+				r.hooks[event] = append(r.hooks[event], h)
+			}
+		}
+	}
+	return r, nil
+}
+
+func knownEvent(event string) bool {
+	for _, e := range Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func parseHook(event string, c config.Hook) (hook, error) {
+	h := hook{command: c.Command, timeout: DefaultTimeout, policy: c.FailurePolicy}
+	if len(c.Command) == 0 || c.Command[0] == "" {
+		return hook{}, errors.New("command is required")
+	}
+	if c.Timeout != "" {
+		timeout, err := time.ParseDuration(c.Timeout)
+		if err != nil || timeout <= 0 {
+			return hook{}, fmt.Errorf("invalid timeout %q", c.Timeout)
+		}
+		h.timeout = timeout
+	}
+	switch h.policy {
+	case "":
+		h.policy = PolicyWarn
+	case PolicyWarn, PolicyIgnore:
+	case PolicyAbort:
+		if event != PreStart && event != PreStop {
+			return hook{}, fmt.Errorf("failure_policy %q is only allowed for %s and %s hooks", PolicyAbort, PreStart, PreStop)
+		}
+	default:
+		return hook{}, fmt.Errorf("invalid failure_policy %q (expected %s, %s or %s)", h.policy, PolicyWarn, PolicyIgnore, PolicyAbort)
+	}
+	return h, nil
+}
+
+// Run runs the hooks for event in order, with cause, if any, in
+// EKSSM_ERROR. It returns an error when a hook with the abort policy fails,
+// without running the hooks after it; other failures are only logged.
+func (r *Runner) Run(ctx context.Context, event string, session Session, cause error) error {
+	if r == nil {
+		return nil
+	}
+	for _, h := range r.hooks[event] {
+		err := h.run(ctx, r.env, event, session, cause)
+		if err == nil {
+			continue
+		}
+		name := filepath.Base(h.command[0])
+		switch h.policy {
+		case PolicyAbort:
+			return fmt.Errorf("%s hook %s failed: %w", event, name, err)
+		case PolicyIgnore:
+			logging.Debugf("%s hook %s failed: %v", event, name, err)
+		default:
+			logging.Warnf("%s hook %s failed: %v", event, name, err)
+		}
+	}
+	return nil
+}
+
+// Notify runs the hooks for event in the background, after those of the
+// events notified before it, so that a tunnel is not held up by its hooks.
+// Events are dropped while too many are waiting.
+func (r *Runner) Notify(event string, session Session, cause error) {
+	if r == nil || len(r.hooks[event]) == 0 {
+		return
+	}
+	r.startQueue.Do(func() {
+		r.queue = make(chan func(), notifyQueue)
+		go func() {
+			for run := range r.queue {
+				run()
+			}
+		}()
+	})
+	select {
+	case r.queue <- func() { _ = r.Run(context.Background(), event, session, cause) }:
+	default:
+		logging.Warnf("Too many hooks waiting to run, skipping the %s hooks", event)
+	}
+}
+
+func (h hook) run(ctx context.Context, env []string, event string, session Session, cause error) error {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	logging.Debugf("Running %s hook %v", event, h.command)
+	cmd := exec.CommandContext(ctx, h.command[0], h.command[1:]...)
+	if env == nil {
+		env = os.Environ()
+	}
+	cmd.Env = append(append([]string(nil), env...), session.environ(event, cause)...)
+	prefix := fmt.Sprintf("%s hook %s: ", event, filepath.Base(h.command[0]))
+	cmd.Stdout = logging.NewLineWriter(zapcore.InfoLevel, prefix)
+	cmd.Stderr = logging.NewLineWriter(zapcore.WarnLevel, prefix)
+	// Children the hook leaves behind must not keep Run waiting for the
+	// output they inherited.
+	cmd.WaitDelay = time.Second
+
+	err := cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %s", h.timeout)
+	}
+	return err
+}
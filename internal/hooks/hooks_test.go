@@ -0,0 +1,127 @@
+package hooks_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudopsy/ekssm/internal/config"
+	"github.com/cloudopsy/ekssm/internal/hooks"
+)
+
+var session = hooks.Session{ID: "3f7c", Cluster: "prod", Kubeconfig: "/tmp/prod.yaml", LocalPort: "51234"}
+
+// shell returns a hook running script with sh.
+func shell(script string) config.Hook {
+	return config.Hook{Command: []string{"sh", "-c", script}}
+}
+
+func TestRunPassesSession(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	cfg := &config.Config{
+		Hooks: config.Hooks{hooks.OnFailure: {shell(`echo "$EKSSM_EVENT $EKSSM_SESSION_ID $EKSSM_CLUSTER $EKSSM_KUBECONFIG $EKSSM_LOCAL_PORT $EKSSM_ERROR $EXTRA" >> ` + out)}},
+		Clusters: map[string]config.Cluster{
+			"prod": {Hooks: config.Hooks{hooks.OnFailure: {shell(`echo cluster >> ` + out)}}},
+		},
+	}
+	r, err := hooks.New(cfg, "prod", []string{"EXTRA=extra", "PATH=" + os.Getenv("PATH")})
+	require.NoError(t, err)
+
+	require.NoError(t, r.Run(context.Background(), hooks.OnFailure, session, errors.New("tunnel down")))
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, "on_failure 3f7c prod /tmp/prod.yaml 51234 tunnel down extra\ncluster\n", string(data))
+
+	// Other clusters only get the global hooks, and other events none.
+	r, err = hooks.New(cfg, "staging", nil)
+	require.NoError(t, err)
+	require.NoError(t, r.Run(context.Background(), hooks.PostStart, session, nil))
+	require.NoError(t, r.Run(context.Background(), hooks.OnFailure, session, nil))
+	data, err = os.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(string(data), "\n"))
+}
+
+func TestRunFailurePolicies(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	abort := shell("exit 3")
+	abort.FailurePolicy = hooks.PolicyAbort
+	cfg := &config.Config{Hooks: config.Hooks{
+		hooks.PreStart: {shell("exit 1"), abort, shell("touch " + out)},
+		hooks.PreStop:  {{Command: []string{"sh", "-c", "exit 1"}, FailurePolicy: hooks.PolicyIgnore}, shell("touch " + out)},
+	}}
+	r, err := hooks.New(cfg, "prod", nil)
+	require.NoError(t, err)
+
+	err = r.Run(context.Background(), hooks.PreStart, session, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "pre_start hook sh failed: exit status 3")
+	assert.NoFileExists(t, out)
+
+	require.NoError(t, r.Run(context.Background(), hooks.PreStop, session, nil))
+	assert.FileExists(t, out)
+}
+
+func TestRunTimeout(t *testing.T) {
+	slow := shell("sleep 10")
+	slow.Timeout = "100ms"
+	slow.FailurePolicy = hooks.PolicyAbort
+	r, err := hooks.New(&config.Config{Hooks: config.Hooks{hooks.PreStop: {slow}}}, "prod", nil)
+	require.NoError(t, err)
+
+	started := time.Now()
+	err = r.Run(context.Background(), hooks.PreStop, session, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "timed out after 100ms")
+	assert.Less(t, time.Since(started), 5*time.Second)
+}
+
+func TestNotifyRunsInOrder(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	cfg := &config.Config{Hooks: config.Hooks{
+		hooks.OnFailure:   {shell("sleep 0.1; echo failure >> " + out)},
+		hooks.OnReconnect: {shell("echo reconnect >> " + out)},
+	}}
+	r, err := hooks.New(cfg, "prod", nil)
+	require.NoError(t, err)
+
+	r.Notify(hooks.OnFailure, session, errors.New("tunnel down"))
+	r.Notify(hooks.OnReconnect, session, nil)
+	assert.Eventually(t, func() bool {
+		data, _ := os.ReadFile(out)
+		return string(data) == "failure\nreconnect\n"
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+func TestNewRejectsInvalidHooks(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		hooks config.Hooks
+		err   string
+	}{
+		{"unknown event", config.Hooks{"post-start": {shell("true")}}, `unknown hook event "post-start"`},
+		{"no command", config.Hooks{hooks.PostStart: {{}}}, "command is required"},
+		{"bad timeout", config.Hooks{hooks.PostStart: {{Command: []string{"true"}, Timeout: "soon"}}}, `invalid timeout "soon"`},
+		{"bad policy", config.Hooks{hooks.PostStart: {{Command: []string{"true"}, FailurePolicy: "retry"}}}, `invalid failure_policy "retry"`},
+		{"abort after start", config.Hooks{hooks.PostStart: {{Command: []string{"true"}, FailurePolicy: hooks.PolicyAbort}}}, "only allowed for pre_start and pre_stop"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := hooks.New(&config.Config{Hooks: tc.hooks}, "prod", nil)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.err)
+		})
+	}
+}
+
+func TestNilRunner(t *testing.T) {
+	var r *hooks.Runner
+	assert.NoError(t, r.Run(context.Background(), hooks.PreStart, session, nil))
+	r.Notify(hooks.OnFailure, session, nil)
+}
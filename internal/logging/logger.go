@@ -1,20 +1,51 @@
 package logging
 
 import (
+	"io"
+
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
-var log *zap.SugaredLogger
+var (
+	log *zap.SugaredLogger
+
+	debugEnabled bool
+	outputPath   = "stderr"
+	// outputWriter, when set, replaces outputPath.
+	outputWriter io.Writer
+)
 
 func init() {
+	build()
+}
+
+// build replaces the logger using the current level and output settings.
+func build() {
 	config := zap.NewProductionConfig()
 	config.Encoding = "console"
 	config.EncoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
 	config.EncoderConfig.TimeKey = "time"
 	config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	config.OutputPaths = []string{outputPath}
+	config.ErrorOutputPaths = []string{outputPath}
 
-	logger, _ := config.Build()
+	if debugEnabled {
+		config.Level = zap.NewAtomicLevelAt(zap.DebugLevel)
+	}
+
+	var opts []zap.Option
+	if outputWriter != nil {
+		sink := zapcore.AddSync(outputWriter)
+		opts = append(opts, zap.WrapCore(func(zapcore.Core) zapcore.Core {
+			return zapcore.NewCore(zapcore.NewConsoleEncoder(config.EncoderConfig), sink, config.Level)
+		}), zap.ErrorOutput(sink))
+	}
+
+	logger, err := config.Build(opts...)
+	if err != nil {
+		return
+	}
 	log = logger.Sugar()
 }
 
@@ -68,16 +99,30 @@ func Sync() {
 }
 
 func SetDebug(debug bool) {
-	config := zap.NewProductionConfig()
-	config.Encoding = "console"
-	config.EncoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
-	config.EncoderConfig.TimeKey = "time"
-	config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	debugEnabled = debug
+	build()
+}
 
-	if debug {
-		config.Level = zap.NewAtomicLevelAt(zap.DebugLevel)
-	}
+// SetOutput sends log output to path, which may be a file path, "stderr",
+// "stdout" or os.DevNull. Files are appended to.
+func SetOutput(path string) {
+	_ = log.Sync()
+	outputPath = path
+	outputWriter = nil
+	build()
+}
 
-	logger, _ := config.Build()
+// SetLogger replaces the logger with logger, such as one given by a program
+// embedding ekssm, until the next SetDebug, SetOutput or SetWriter.
+func SetLogger(logger *zap.Logger) {
+	_ = log.Sync()
 	log = logger.Sugar()
 }
+
+// SetWriter sends log output to w, such as a RotatingFile, until the next
+// SetWriter or SetOutput.
+func SetWriter(w io.Writer) {
+	_ = log.Sync()
+	outputWriter = w
+	build()
+}
@@ -0,0 +1,151 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	// DefaultMaxLogSize is the size at which a RotatingFile is rotated.
+	DefaultMaxLogSize = 10 << 20
+	// DefaultLogBackups is how many rotated files a RotatingFile keeps.
+	DefaultLogBackups = 3
+)
+
+// RotatingFile is an append-only log file that is renamed to path.1 once it
+// would grow past MaxSize, shifting older files up to path.<Backups> and
+// dropping the oldest. It is safe for concurrent use.
+type RotatingFile struct {
+	Path    string
+	MaxSize int64
+	Backups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// OpenRotatingFile opens path for appending, creating it and its directory
+// with owner-only permissions if needed.
+func OpenRotatingFile(path string, maxSize int64, backups int) (*RotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+	r := &RotatingFile{Path: path, MaxSize: maxSize, Backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	file, err := os.OpenFile(r.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open log file %s: %w", r.Path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file %s: %w", r.Path, err)
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return 0, os.ErrClosed
+	}
+	if r.MaxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.MaxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups up by one and starts a new file.
+func (r *RotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return fmt.Errorf("failed to close log file %s: %w", r.Path, err)
+	}
+	r.file = nil
+	if r.Backups > 0 {
+		for i := r.Backups - 1; i > 0; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", r.Path, i), fmt.Sprintf("%s.%d", r.Path, i+1))
+		}
+		if err := os.Rename(r.Path, r.Path+".1"); err != nil {
+			return fmt.Errorf("failed to rotate log file %s: %w", r.Path, err)
+		}
+	} else if err := os.Remove(r.Path); err != nil {
+		return fmt.Errorf("failed to truncate log file %s: %w", r.Path, err)
+	}
+	return r.open()
+}
+
+// Sync flushes the file to disk.
+func (r *RotatingFile) Sync() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Sync()
+}
+
+// Close closes the file. Later writes fail.
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// LineWriter logs every line written to it, with a prefix, at a fixed level.
+// It captures the output of child processes in the log.
+type LineWriter struct {
+	Prefix string
+	Level  zapcore.Level
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+// NewLineWriter returns a LineWriter logging at level.
+func NewLineWriter(level zapcore.Level, prefix string) *LineWriter {
+	return &LineWriter{Prefix: prefix, Level: level}
+}
+
+func (w *LineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := bytes.TrimRight(w.buf[:i], "\r")
+		if len(line) > 0 {
+			log.Logf(w.Level, "%s%s", w.Prefix, line)
+		}
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
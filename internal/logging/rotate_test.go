@@ -0,0 +1,73 @@
+package logging_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/cloudopsy/ekssm/internal/logging"
+)
+
+func TestRotatingFileRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "session.log")
+	file, err := logging.OpenRotatingFile(path, 10, 2)
+	require.NoError(t, err)
+	defer file.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := file.Write([]byte(line))
+		require.NoError(t, err)
+	}
+
+	read := func(name string) string {
+		data, err := os.ReadFile(name)
+		require.NoError(t, err)
+		return string(data)
+	}
+	assert.Equal(t, "fourth\n", read(path))
+	assert.Equal(t, "third\n", read(path+".1"))
+	assert.Equal(t, "second\n", read(path+".2"))
+	assert.NoFileExists(t, path+".3")
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestRotatingFileAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.log")
+	require.NoError(t, os.WriteFile(path, []byte("earlier\n"), 0600))
+
+	file, err := logging.OpenRotatingFile(path, logging.DefaultMaxLogSize, logging.DefaultLogBackups)
+	require.NoError(t, err)
+	_, err = file.Write([]byte("later\n"))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "earlier\nlater\n", string(data))
+}
+
+func TestLineWriterLogsCompleteLines(t *testing.T) {
+	var buf bytes.Buffer
+	logging.SetWriter(&buf)
+	defer logging.SetOutput("stderr")
+
+	w := logging.NewLineWriter(zapcore.WarnLevel, "plugin: ")
+	_, _ = w.Write([]byte("Starting session with Session"))
+	assert.Empty(t, buf.String())
+	_, _ = w.Write([]byte("Id: abc\r\n\nWaiting for connections...\n"))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[0], "WARN")
+	assert.Contains(t, lines[0], "plugin: Starting session with SessionId: abc")
+	assert.Contains(t, lines[1], "plugin: Waiting for connections...")
+}
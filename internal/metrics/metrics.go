@@ -0,0 +1,147 @@
+// Package metrics writes metrics in the Prometheus text exposition format,
+// and keeps the histograms that serve processes publish in their status
+// files for the agent to expose.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Metric types.
+const (
+	Gauge     = "gauge"
+	Counter   = "counter"
+	Histogram = "histogram"
+)
+
+// ContentType is the content type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// LatencyBuckets are the upper bounds, in seconds, of the buckets AWS API
+// call latencies are counted in.
+var LatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Buckets counts observations into buckets, as a Prometheus histogram does.
+// It is encoded in JSON so that it can be stored in a status file. It is not
+// safe for concurrent use.
+type Buckets struct {
+	// Bounds are the buckets' upper bounds, in increasing order; a last
+	// +Inf bucket is implied.
+	Bounds []float64 `json:"bounds"`
+	// Counts holds the observations in each bucket, not cumulative, with
+	// one more entry than Bounds for the +Inf bucket.
+	Counts []uint64 `json:"counts"`
+	Sum    float64  `json:"sum"`
+	Count  uint64   `json:"count"`
+}
+
+// NewBuckets returns empty buckets with the given upper bounds.
+func NewBuckets(bounds []float64) *Buckets {
+	return &Buckets{
+		Bounds: append([]float64(nil), bounds...),
+		Counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+// Observe counts v.
+func (b *Buckets) Observe(v float64) {
+	i := 0
+	for i < len(b.Bounds) && v > b.Bounds[i] {
+		i++
+	}
+	b.Counts[i]++
+	b.Sum += v
+	b.Count++
+}
+
+// Label is a metric label.
+type Label struct {
+	Name, Value string
+}
+
+// Writer writes metric families in the text exposition format. Every
+// sample of a family must be written right after the family.
+type Writer struct {
+	w   io.Writer
+	err error
+}
+
+// NewWriter returns a Writer writing to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Family starts a metric family with its help text and type.
+func (w *Writer) Family(name, typ, help string) {
+	w.printf("# HELP %s %s\n", name, escapeHelp(help))
+	w.printf("# TYPE %s %s\n", name, typ)
+}
+
+// Sample writes one sample of a gauge or counter.
+func (w *Writer) Sample(name string, labels []Label, value float64) {
+	w.printf("%s%s %s\n", name, formatLabels(labels), formatValue(value))
+}
+
+// Histogram writes the samples of a histogram: its cumulative buckets, sum
+// and count.
+func (w *Writer) Histogram(name string, labels []Label, b Buckets) {
+	var cumulative uint64
+	for i, count := range b.Counts {
+		cumulative += count
+		le := math.Inf(1)
+		if i < len(b.Bounds) {
+			le = b.Bounds[i]
+		}
+		bucketLabels := append(append([]Label(nil), labels...), Label{"le", formatValue(le)})
+		w.Sample(name+"_bucket", bucketLabels, float64(cumulative))
+	}
+	w.Sample(name+"_sum", labels, b.Sum)
+	w.Sample(name+"_count", labels, float64(b.Count))
+}
+
+// Err returns the first error writing failed with.
+func (w *Writer) Err() error {
+	return w.err
+}
+
+func (w *Writer) printf(format string, args ...any) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = fmt.Fprintf(w.w, format, args...)
+}
+
+func formatLabels(labels []Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(labels))
+	for _, l := range labels {
+		parts = append(parts, l.Name+`="`+escapeLabel(l.Value)+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
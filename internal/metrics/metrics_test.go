@@ -0,0 +1,56 @@
+package metrics_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudopsy/ekssm/internal/metrics"
+)
+
+func TestWriter(t *testing.T) {
+	var out strings.Builder
+	w := metrics.NewWriter(&out)
+	w.Family("ekssm_sessions", metrics.Gauge, "Background sessions.\nBy cluster.")
+	w.Sample("ekssm_sessions", []metrics.Label{{"cluster", `prod "eu"`}}, 2)
+	w.Sample("ekssm_sessions", nil, 0.5)
+	require.NoError(t, w.Err())
+
+	assert.Equal(t, `# HELP ekssm_sessions Background sessions.\nBy cluster.
+# TYPE ekssm_sessions gauge
+ekssm_sessions{cluster="prod \"eu\""} 2
+ekssm_sessions 0.5
+`, out.String())
+}
+
+func TestHistogram(t *testing.T) {
+	b := metrics.NewBuckets([]float64{0.1, 1})
+	for _, v := range []float64{0.05, 0.1, 0.5, 3} {
+		b.Observe(v)
+	}
+	assert.Equal(t, []uint64{2, 1, 1}, b.Counts)
+
+	// Buckets survive the status file.
+	data, err := json.Marshal(b)
+	require.NoError(t, err)
+	var decoded metrics.Buckets
+	require.NoError(t, json.Unmarshal(data, &decoded))
+
+	var out strings.Builder
+	w := metrics.NewWriter(&out)
+	w.Family("latency_seconds", metrics.Histogram, "Latency.")
+	w.Histogram("latency_seconds", []metrics.Label{{"op", "StartSession"}}, decoded)
+	require.NoError(t, w.Err())
+
+	assert.Equal(t, `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{op="StartSession",le="0.1"} 2
+latency_seconds_bucket{op="StartSession",le="1"} 3
+latency_seconds_bucket{op="StartSession",le="+Inf"} 4
+latency_seconds_sum{op="StartSession"} 3.65
+latency_seconds_count{op="StartSession"} 4
+`, out.String())
+}
@@ -0,0 +1,423 @@
+// Package smux implements version 1 of the smux stream multiplexing protocol
+// (github.com/xtaci/smux), which the SSM agent and session-manager-plugin use
+// to carry many TCP connections over a single port forwarding session.
+//
+// Each frame is an 8 byte header followed by its payload:
+//
+//	version(1) cmd(1) length(2, little endian) streamID(4, little endian)
+//
+// Only the parts of the protocol the agent relies on are implemented: stream
+// open (SYN), data (PSH), close (FIN) and keepalive (NOP) frames. Keepalive
+// frames are accepted but never sent, matching the agent and plugin, which
+// both disable smux keepalives.
+package smux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	protocolVersion = 1
+
+	cmdSYN = 0 // open a stream
+	cmdFIN = 1 // close the sending side of a stream
+	cmdPSH = 2 // stream data
+	cmdNOP = 3 // keepalive
+
+	headerSize = 8
+
+	// MaxFrameSize is the largest payload sent in a single frame.
+	MaxFrameSize = 32768
+	// maxReceiveBuffer caps the data buffered for unread streams before the
+	// session stops reading from the underlying connection.
+	maxReceiveBuffer = 4 << 20
+	acceptBacklog    = 1024
+)
+
+var (
+	// ErrSessionClosed is returned once the session has been closed.
+	ErrSessionClosed = errors.New("smux: session closed")
+	// ErrStreamClosed is returned when using a stream after Close.
+	ErrStreamClosed = errors.New("smux: stream closed")
+)
+
+// Session multiplexes streams over a single connection.
+type Session struct {
+	conn io.ReadWriteCloser
+
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	cond     *sync.Cond // signalled when buffered data is consumed
+	streams  map[uint32]*Stream
+	nextID   uint32
+	buffered int
+
+	accept    chan *Stream
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// Client starts the client side of a session over conn. Client streams use
+// odd IDs.
+func Client(conn io.ReadWriteCloser) *Session {
+	return newSession(conn, 1)
+}
+
+// Server starts the server side of a session over conn. Server streams use
+// even IDs.
+func Server(conn io.ReadWriteCloser) *Session {
+	return newSession(conn, 0)
+}
+
+func newSession(conn io.ReadWriteCloser, firstID uint32) *Session {
+	s := &Session{
+		conn:    conn,
+		streams: make(map[uint32]*Stream),
+		nextID:  firstID,
+		accept:  make(chan *Stream, acceptBacklog),
+		done:    make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	go s.recvLoop()
+	return s
+}
+
+// OpenStream opens a new stream to the peer.
+func (s *Session) OpenStream() (*Stream, error) {
+	s.mu.Lock()
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		return nil, s.Err()
+	default:
+	}
+	s.nextID += 2
+	stream := newStream(s, s.nextID)
+	s.streams[stream.id] = stream
+	s.mu.Unlock()
+
+	if err := s.writeFrame(cmdSYN, stream.id, nil); err != nil {
+		s.removeStream(stream.id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// AcceptStream waits for the peer to open a stream.
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case stream := <-s.accept:
+		return stream, nil
+	case <-s.done:
+		return nil, s.Err()
+	}
+}
+
+// NumStreams returns the number of open streams.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// Done is closed when the session stops.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the session stopped, or nil while it is open.
+func (s *Session) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// Close closes every stream and the underlying connection.
+func (s *Session) Close() error {
+	s.fail(ErrSessionClosed)
+	return nil
+}
+
+func (s *Session) fail(err error) {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		close(s.done)
+		streams := s.streams
+		s.streams = make(map[uint32]*Stream)
+		s.cond.Broadcast()
+		s.mu.Unlock()
+
+		for _, stream := range streams {
+			stream.notify()
+		}
+		_ = s.conn.Close()
+	})
+}
+
+func (s *Session) writeFrame(cmd byte, id uint32, payload []byte) error {
+	frame := make([]byte, headerSize+len(payload))
+	frame[0] = protocolVersion
+	frame[1] = cmd
+	binary.LittleEndian.PutUint16(frame[2:], uint16(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:], id)
+	copy(frame[headerSize:], payload)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	select {
+	case <-s.done:
+		return s.Err()
+	default:
+	}
+	if _, err := s.conn.Write(frame); err != nil {
+		s.fail(fmt.Errorf("smux: write failed: %w", err))
+		return s.Err()
+	}
+	return nil
+}
+
+func (s *Session) recvLoop() {
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			s.fail(fmt.Errorf("smux: read failed: %w", err))
+			return
+		}
+		if header[0] != protocolVersion {
+			s.fail(fmt.Errorf("smux: unsupported protocol version %d", header[0]))
+			return
+		}
+		length := binary.LittleEndian.Uint16(header[2:])
+		id := binary.LittleEndian.Uint32(header[4:])
+
+		switch header[1] {
+		case cmdNOP:
+		case cmdSYN:
+			s.mu.Lock()
+			if _, exists := s.streams[id]; !exists {
+				stream := newStream(s, id)
+				s.streams[id] = stream
+				select {
+				case s.accept <- stream:
+				default:
+					delete(s.streams, id)
+				}
+			}
+			s.mu.Unlock()
+		case cmdFIN:
+			s.mu.Lock()
+			stream := s.streams[id]
+			s.mu.Unlock()
+			if stream != nil {
+				stream.remoteClose()
+			}
+		case cmdPSH:
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(s.conn, payload); err != nil {
+				s.fail(fmt.Errorf("smux: read failed: %w", err))
+				return
+			}
+			s.mu.Lock()
+			for s.buffered >= maxReceiveBuffer && s.err == nil {
+				s.cond.Wait()
+			}
+			stream := s.streams[id]
+			if stream != nil && length > 0 {
+				s.buffered += int(length)
+			}
+			s.mu.Unlock()
+			if stream != nil && length > 0 {
+				stream.push(payload)
+			}
+		default:
+			s.fail(fmt.Errorf("smux: invalid command %d", header[1]))
+			return
+		}
+	}
+}
+
+// consumed returns n bytes of buffer space once a stream has read them.
+func (s *Session) consumed(n int) {
+	s.mu.Lock()
+	s.buffered -= n
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// Stream is a single bidirectional stream within a session.
+type Stream struct {
+	id      uint32
+	session *Session
+
+	mu         sync.Mutex
+	buf        [][]byte
+	readable   chan struct{} // signalled when data arrives or the stream closes
+	remoteFin  bool
+	localFin   bool
+	closed     bool
+	closeOnce  sync.Once
+	finOnce    sync.Once
+	finWritten error
+}
+
+func newStream(session *Session, id uint32) *Stream {
+	return &Stream{id: id, session: session, readable: make(chan struct{}, 1)}
+}
+
+// ID returns the stream's identifier within its session.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Read reads stream data, returning io.EOF once the peer has closed its side.
+func (st *Stream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.closed {
+			st.mu.Unlock()
+			return 0, ErrStreamClosed
+		}
+		if len(st.buf) > 0 {
+			n := copy(p, st.buf[0])
+			st.buf[0] = st.buf[0][n:]
+			if len(st.buf[0]) == 0 {
+				st.buf = st.buf[1:]
+			}
+			st.mu.Unlock()
+			st.session.consumed(n)
+			return n, nil
+		}
+		if st.remoteFin {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		st.mu.Unlock()
+
+		select {
+		case <-st.readable:
+		case <-st.session.done:
+			st.mu.Lock()
+			empty := len(st.buf) == 0
+			st.mu.Unlock()
+			if empty {
+				return 0, st.session.Err()
+			}
+		}
+	}
+}
+
+// Write sends p to the peer, split into frames of at most MaxFrameSize bytes.
+func (st *Stream) Write(p []byte) (int, error) {
+	st.mu.Lock()
+	finished := st.closed || st.localFin
+	st.mu.Unlock()
+	if finished {
+		return 0, ErrStreamClosed
+	}
+
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > MaxFrameSize {
+			chunk = chunk[:MaxFrameSize]
+		}
+		if err := st.session.writeFrame(cmdPSH, st.id, chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// CloseWrite tells the peer no more data will be sent, while still allowing
+// data to be read.
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	st.localFin = true
+	remoteFin := st.remoteFin
+	st.mu.Unlock()
+
+	err := st.sendFIN()
+	if remoteFin {
+		st.session.removeStream(st.id)
+	}
+	return err
+}
+
+// Close closes both directions of the stream.
+func (st *Stream) Close() error {
+	var err error
+	st.closeOnce.Do(func() {
+		st.mu.Lock()
+		st.closed = true
+		st.localFin = true
+		unread := 0
+		for _, b := range st.buf {
+			unread += len(b)
+		}
+		st.buf = nil
+		st.mu.Unlock()
+
+		if unread > 0 {
+			st.session.consumed(unread)
+		}
+		st.notify()
+		err = st.sendFIN()
+		st.session.removeStream(st.id)
+	})
+	return err
+}
+
+func (st *Stream) sendFIN() error {
+	st.finOnce.Do(func() {
+		st.finWritten = st.session.writeFrame(cmdFIN, st.id, nil)
+	})
+	return st.finWritten
+}
+
+func (st *Stream) push(data []byte) {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		st.session.consumed(len(data))
+		return
+	}
+	st.buf = append(st.buf, data)
+	st.mu.Unlock()
+	st.notify()
+}
+
+func (st *Stream) remoteClose() {
+	st.mu.Lock()
+	st.remoteFin = true
+	localFin := st.localFin
+	st.mu.Unlock()
+	if localFin {
+		st.session.removeStream(st.id)
+	}
+	st.notify()
+}
+
+func (st *Stream) notify() {
+	select {
+	case st.readable <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,227 @@
+package smux_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudopsy/ekssm/internal/smux"
+)
+
+const (
+	cmdSYN = 0
+	cmdFIN = 1
+	cmdPSH = 2
+	cmdNOP = 3
+)
+
+type rawFrame struct {
+	cmd     byte
+	id      uint32
+	payload []byte
+}
+
+// encode builds a version 1 frame the way the SSM agent writes it.
+func encode(cmd byte, id uint32, payload []byte) []byte {
+	frame := []byte{1, cmd, 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint16(frame[2:], uint16(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:], id)
+	return append(frame, payload...)
+}
+
+func readRawFrame(t *testing.T, r io.Reader) rawFrame {
+	t.Helper()
+	header := make([]byte, 8)
+	_, err := io.ReadFull(r, header)
+	require.NoError(t, err)
+	require.Equal(t, byte(1), header[0], "protocol version")
+
+	payload := make([]byte, binary.LittleEndian.Uint16(header[2:]))
+	_, err = io.ReadFull(r, payload)
+	require.NoError(t, err)
+	return rawFrame{cmd: header[1], id: binary.LittleEndian.Uint32(header[4:]), payload: payload}
+}
+
+// rawPeer returns a session over one end of a pipe and the other end, which
+// the test drives frame by frame.
+func rawPeer(t *testing.T, newSession func(io.ReadWriteCloser) *smux.Session) (*smux.Session, net.Conn) {
+	t.Helper()
+	local, remote := net.Pipe()
+	session := newSession(local)
+	t.Cleanup(func() {
+		session.Close()
+		remote.Close()
+	})
+	return session, remote
+}
+
+func TestClientSplitsWritesIntoFrames(t *testing.T) {
+	session, remote := rawPeer(t, smux.Client)
+
+	data := bytes.Repeat([]byte("0123456789"), 4000) // 40000 bytes, two frames
+	errs := make(chan error, 1)
+	go func() {
+		stream, err := session.OpenStream()
+		if err == nil {
+			_, err = stream.Write(data)
+		}
+		if err == nil {
+			err = stream.CloseWrite()
+		}
+		errs <- err
+	}()
+
+	syn := readRawFrame(t, remote)
+	assert.Equal(t, rawFrame{cmd: cmdSYN, id: 3, payload: []byte{}}, syn, "client streams use odd IDs")
+
+	first := readRawFrame(t, remote)
+	assert.Equal(t, byte(cmdPSH), first.cmd)
+	assert.Len(t, first.payload, smux.MaxFrameSize)
+	second := readRawFrame(t, remote)
+	assert.Equal(t, byte(cmdPSH), second.cmd)
+	assert.Equal(t, data, append(first.payload, second.payload...))
+
+	fin := readRawFrame(t, remote)
+	assert.Equal(t, rawFrame{cmd: cmdFIN, id: 3, payload: []byte{}}, fin)
+	require.NoError(t, <-errs)
+}
+
+func TestServerReassemblesStreamData(t *testing.T) {
+	session, remote := rawPeer(t, smux.Server)
+
+	go func() {
+		var out []byte
+		out = append(out, encode(cmdNOP, 0, nil)...)
+		out = append(out, encode(cmdSYN, 3, nil)...)
+		out = append(out, encode(cmdPSH, 3, []byte("hello "))...)
+		out = append(out, encode(cmdPSH, 3, []byte("world"))...)
+		// Data for an unknown stream is dropped without breaking the session.
+		out = append(out, encode(cmdPSH, 99, []byte("stray"))...)
+		out = append(out, encode(cmdFIN, 3, nil)...)
+		_, _ = remote.Write(out)
+	}()
+
+	stream, err := session.AcceptStream()
+	require.NoError(t, err)
+	assert.Equal(t, uint32(3), stream.ID())
+
+	// A small buffer forces reads that stop part way through a frame.
+	var got []byte
+	buf := make([]byte, 4)
+	for {
+		n, err := stream.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+	}
+	assert.Equal(t, "hello world", string(got))
+}
+
+func TestCloseReleasesStream(t *testing.T) {
+	session, remote := rawPeer(t, smux.Server)
+
+	go func() { _, _ = remote.Write(encode(cmdSYN, 5, nil)) }()
+	stream, err := session.AcceptStream()
+	require.NoError(t, err)
+	assert.Equal(t, 1, session.NumStreams())
+
+	go func() { _, _ = remote.Write(encode(cmdFIN, 5, nil)) }()
+	_, err = stream.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	closed := make(chan error, 1)
+	go func() { closed <- stream.Close() }()
+	assert.Equal(t, rawFrame{cmd: cmdFIN, id: 5, payload: []byte{}}, readRawFrame(t, remote))
+	require.NoError(t, <-closed)
+	assert.Equal(t, 0, session.NumStreams())
+
+	_, err = stream.Write([]byte("late"))
+	assert.ErrorIs(t, err, smux.ErrStreamClosed)
+	_, err = stream.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, smux.ErrStreamClosed)
+}
+
+func TestInvalidFramesFailTheSession(t *testing.T) {
+	for name, frame := range map[string][]byte{
+		"version": {2, cmdNOP, 0, 0, 0, 0, 0, 0},
+		"command": encode(7, 0, nil),
+	} {
+		t.Run(name, func(t *testing.T) {
+			session, remote := rawPeer(t, smux.Server)
+			go func() { _, _ = remote.Write(frame) }()
+
+			select {
+			case <-session.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatal("session did not stop")
+			}
+			assert.Error(t, session.Err())
+			_, err := session.OpenStream()
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestSessionsTalkToEachOther(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	client := smux.Client(clientConn)
+	server := smux.Server(serverConn)
+	defer client.Close()
+	defer server.Close()
+
+	// Echo every accepted stream back to its sender.
+	go func() {
+		for {
+			stream, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(stream, stream)
+				_ = stream.CloseWrite()
+			}()
+		}
+	}()
+
+	payloads := [][]byte{
+		[]byte("short"),
+		bytes.Repeat([]byte{0xab}, 3*smux.MaxFrameSize+17),
+	}
+	results := make(chan error, len(payloads))
+	for _, payload := range payloads {
+		go func(payload []byte) {
+			stream, err := client.OpenStream()
+			if err != nil {
+				results <- err
+				return
+			}
+			defer stream.Close()
+			go func() {
+				_, _ = stream.Write(payload)
+				_ = stream.CloseWrite()
+			}()
+			got, err := io.ReadAll(stream)
+			if err == nil && !bytes.Equal(payload, got) {
+				err = fmt.Errorf("stream %d echoed %d bytes, want %d", stream.ID(), len(got), len(payload))
+			}
+			results <- err
+		}(payload)
+	}
+	for range payloads {
+		require.NoError(t, <-results)
+	}
+
+	client.Close()
+	<-server.Done()
+	_, err := server.AcceptStream()
+	assert.Error(t, err)
+}
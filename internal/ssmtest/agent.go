@@ -0,0 +1,580 @@
+// Package ssmtest provides a local stand-in for the SSM message gateway and
+// agent so the built-in data channel client can be tested without AWS.
+package ssmtest
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/google/uuid"
+
+	"github.com/cloudopsy/ekssm/internal/smux"
+	"github.com/cloudopsy/ekssm/internal/websocket"
+	"github.com/cloudopsy/ekssm/pkg/datachannel"
+)
+
+// Token is the session token the stand-in expects clients to present.
+const Token = "ssmtest-token"
+
+// Agent versions reported by the stand-in. Agents before
+// datachannel.MultiplexingAgentVersion only speak the basic port protocol.
+const (
+	DefaultAgentVersion = "3.2.0.0"
+	BasicAgentVersion   = "3.0.161.0"
+)
+
+// Agent accepts data channel connections and forwards port session traffic to
+// a TCP address, the way the SSM agent on a bastion would. Like the real
+// agent it multiplexes connections as smux streams when both its own version
+// and the client's support it.
+type Agent struct {
+	// Target is the host:port that stream data is forwarded to.
+	Target string
+	// AgentVersion is reported in the handshake; it defaults to
+	// DefaultAgentVersion.
+	AgentVersion string
+	// DuplicateOutput sends every output message twice to exercise
+	// duplicate detection on the client.
+	DuplicateOutput bool
+	// DropFirstInput ignores the first stream data message from the client,
+	// forcing it to retransmit.
+	DropFirstInput bool
+	// Offline lists instances that refuse StartSession with
+	// TargetNotConnected and are reported ConnectionLost by
+	// DescribeInstanceInformation. Every other instance is Online.
+	Offline []string
+	// Instances are the SSM-managed instances matched by tag filters in
+	// DescribeInstanceInformation.
+	Instances []Instance
+	// Documents are the SSM documents known to DescribeDocument besides
+	// the AWS port forwarding document, keyed by name.
+	Documents map[string]*types.DocumentDescription
+
+	server *httptest.Server
+
+	mu          sync.Mutex
+	sessions    int
+	terminated  []string
+	lastInput   *ssm.StartSessionInput
+	acked       map[int64]bool
+	flagsSeen   []datachannel.PortFlag
+	handshakeOK bool
+	streams     int
+}
+
+// Instance is an SSM-managed instance known to the stand-in.
+type Instance struct {
+	ID           string
+	AgentVersion string
+	Tags         map[string]string
+}
+
+// NewAgent starts a stand-in agent forwarding to target. It is shut down when
+// the test finishes.
+func NewAgent(t testing.TB, target string) *Agent {
+	t.Helper()
+
+	a := &Agent{Target: target, acked: make(map[int64]bool)}
+	a.server = httptest.NewServer(http.HandlerFunc(a.serveDataChannel))
+	t.Cleanup(a.server.Close)
+	return a
+}
+
+// StreamURL returns the websocket URL clients should connect to.
+func (a *Agent) StreamURL() string {
+	return "ws" + strings.TrimPrefix(a.server.URL, "http") + "/v1/data-channel/test-session"
+}
+
+// StartSession implements the SSM StartSession call against the stand-in.
+func (a *Agent) StartSession(_ context.Context, params *ssm.StartSessionInput, _ ...func(*ssm.Options)) (*ssm.StartSessionOutput, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.offline(aws.ToString(params.Target)) {
+		return nil, &types.TargetNotConnected{Message: aws.String(aws.ToString(params.Target) + " is not connected.")}
+	}
+	a.sessions++
+	a.lastInput = params
+	return &ssm.StartSessionOutput{
+		SessionId:  aws.String(fmt.Sprintf("ssmtest-%d", a.sessions)),
+		StreamUrl:  aws.String(a.StreamURL()),
+		TokenValue: aws.String(Token),
+	}, nil
+}
+
+// DescribeInstanceInformation reports the ping status of the instances named
+// in an InstanceIds filter.
+func (a *Agent) DescribeInstanceInformation(_ context.Context, params *ssm.DescribeInstanceInformationInput, _ ...func(*ssm.Options)) (*ssm.DescribeInstanceInformationOutput, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	output := &ssm.DescribeInstanceInformationOutput{}
+	for _, filter := range params.Filters {
+		key := aws.ToString(filter.Key)
+		switch {
+		case key == "InstanceIds":
+			for _, id := range filter.Values {
+				output.InstanceInformationList = append(output.InstanceInformationList, a.instanceInformation(Instance{ID: id}))
+			}
+		case strings.HasPrefix(key, "tag:"):
+			for _, instance := range a.Instances {
+				for _, value := range filter.Values {
+					if instance.Tags[strings.TrimPrefix(key, "tag:")] == value {
+						output.InstanceInformationList = append(output.InstanceInformationList, a.instanceInformation(instance))
+						break
+					}
+				}
+			}
+		}
+	}
+	return output, nil
+}
+
+func (a *Agent) instanceInformation(instance Instance) types.InstanceInformation {
+	status := types.PingStatusOnline
+	if a.offline(instance.ID) {
+		status = types.PingStatusConnectionLost
+	}
+	return types.InstanceInformation{
+		InstanceId:   aws.String(instance.ID),
+		AgentVersion: aws.String(instance.AgentVersion),
+		PingStatus:   status,
+	}
+}
+
+func (a *Agent) offline(instanceID string) bool {
+	for _, id := range a.Offline {
+		if id == instanceID {
+			return true
+		}
+	}
+	return false
+}
+
+// DescribeDocument describes the AWS port forwarding document or one of
+// Documents.
+func (a *Agent) DescribeDocument(_ context.Context, params *ssm.DescribeDocumentInput, _ ...func(*ssm.Options)) (*ssm.DescribeDocumentOutput, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	name := aws.ToString(params.Name)
+	if document, ok := a.Documents[name]; ok {
+		return &ssm.DescribeDocumentOutput{Document: document}, nil
+	}
+	if name == aws.ToString(PortForwardingDocument.Name) {
+		return &ssm.DescribeDocumentOutput{Document: PortForwardingDocument}, nil
+	}
+	return nil, &types.InvalidDocument{Message: aws.String("document " + name + " does not exist")}
+}
+
+// PortForwardingDocument describes AWS-StartPortForwardingSessionToRemoteHost.
+var PortForwardingDocument = &types.DocumentDescription{
+	Name:         aws.String("AWS-StartPortForwardingSessionToRemoteHost"),
+	DocumentType: types.DocumentTypeSession,
+	Parameters: []types.DocumentParameter{
+		{Name: aws.String("host"), Type: types.DocumentParameterTypeString},
+		{Name: aws.String("portNumber"), Type: types.DocumentParameterTypeString, DefaultValue: aws.String("80")},
+		{Name: aws.String("localPortNumber"), Type: types.DocumentParameterTypeString, DefaultValue: aws.String("0")},
+	},
+}
+
+// TerminateSession implements the SSM TerminateSession call against the stand-in.
+func (a *Agent) TerminateSession(_ context.Context, params *ssm.TerminateSessionInput, _ ...func(*ssm.Options)) (*ssm.TerminateSessionOutput, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.terminated = append(a.terminated, aws.ToString(params.SessionId))
+	return &ssm.TerminateSessionOutput{SessionId: params.SessionId}, nil
+}
+
+// LastStartSessionInput returns the most recent StartSession request.
+func (a *Agent) LastStartSessionInput() *ssm.StartSessionInput {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.lastInput
+}
+
+// TerminatedSessions returns the IDs passed to TerminateSession.
+func (a *Agent) TerminatedSessions() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string(nil), a.terminated...)
+}
+
+// Flags returns the port flags received from clients.
+func (a *Agent) Flags() []datachannel.PortFlag {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]datachannel.PortFlag(nil), a.flagsSeen...)
+}
+
+// Acknowledged reports whether the client acknowledged the agent's message
+// with the given sequence number.
+func (a *Agent) Acknowledged(sequence int64) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.acked[sequence]
+}
+
+// Streams returns how many multiplexed streams clients have opened.
+func (a *Agent) Streams() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.streams
+}
+
+// HandshakeCompleted reports whether a client answered the handshake request.
+func (a *Agent) HandshakeCompleted() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.handshakeOK
+}
+
+type agentSession struct {
+	agent *Agent
+	ws    *websocket.Conn
+
+	mu       sync.Mutex
+	sequence int64
+	remote   net.Conn
+	dropped  bool
+	expected int64
+	pending  map[int64]*datachannel.Message
+
+	// Set once the handshake completes on a multiplexed session.
+	mux      *smux.Session
+	muxInput *io.PipeWriter
+	version  string
+	client   string
+}
+
+func (a *Agent) serveDataChannel(w http.ResponseWriter, r *http.Request) {
+	ws, err := websocket.Upgrade(w, r)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	messageType, data, err := ws.ReadMessage()
+	if err != nil || messageType != websocket.TextMessage {
+		return
+	}
+	var open datachannel.OpenDataChannelInput
+	if err := json.Unmarshal(data, &open); err != nil || open.TokenValue != Token {
+		return
+	}
+	version := a.AgentVersion
+	if version == "" {
+		version = DefaultAgentVersion
+	}
+	s := &agentSession{agent: a, ws: ws, pending: make(map[int64]*datachannel.Message), version: version, client: open.ClientVersion}
+	defer s.closeRemote()
+
+	request, _ := json.Marshal(datachannel.HandshakeRequestPayload{
+		AgentVersion: version,
+		RequestedClientActions: []datachannel.RequestedClientAction{{
+			ActionType:       datachannel.ActionSessionType,
+			ActionParameters: json.RawMessage(`{"SessionType":"Port","Properties":{"type":"LocalPortForwarding"}}`),
+		}},
+	})
+	if err := s.send(datachannel.HandshakeRequest, request); err != nil {
+		return
+	}
+
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		msg := &datachannel.Message{}
+		if err := msg.UnmarshalBinary(data); err != nil {
+			return
+		}
+		if err := s.handle(msg); err != nil {
+			return
+		}
+	}
+}
+
+func (s *agentSession) handle(msg *datachannel.Message) error {
+	a := s.agent
+
+	switch msg.MessageType {
+	case datachannel.AcknowledgeMessage:
+		var content datachannel.AcknowledgeContent
+		if err := json.Unmarshal(msg.Payload, &content); err != nil {
+			return err
+		}
+		a.mu.Lock()
+		a.acked[content.SequenceNumber] = true
+		a.mu.Unlock()
+		return nil
+	case datachannel.InputStreamMessage:
+	default:
+		return nil
+	}
+
+	if msg.PayloadType == datachannel.Output && a.DropFirstInput {
+		s.mu.Lock()
+		drop := !s.dropped
+		s.dropped = true
+		s.mu.Unlock()
+		if drop {
+			return nil
+		}
+	}
+
+	if err := s.acknowledge(msg); err != nil {
+		return err
+	}
+
+	// Process client messages in sequence order, holding early arrivals
+	// until the gap is filled by a retransmission.
+	s.mu.Lock()
+	if msg.SequenceNumber < s.expected {
+		s.mu.Unlock()
+		return nil
+	}
+	s.pending[msg.SequenceNumber] = msg
+	var ready []*datachannel.Message
+	for {
+		next, ok := s.pending[s.expected]
+		if !ok {
+			break
+		}
+		delete(s.pending, s.expected)
+		ready = append(ready, next)
+		s.expected++
+	}
+	s.mu.Unlock()
+
+	for _, next := range ready {
+		if err := s.process(next); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *agentSession) process(msg *datachannel.Message) error {
+	a := s.agent
+
+	switch msg.PayloadType {
+	case datachannel.HandshakeResponse:
+		var response datachannel.HandshakeResponsePayload
+		if err := json.Unmarshal(msg.Payload, &response); err != nil {
+			return err
+		}
+		a.mu.Lock()
+		a.handshakeOK = len(response.ProcessedClientActions) == 1 &&
+			response.ProcessedClientActions[0].ActionStatus == datachannel.ActionSuccess
+		a.mu.Unlock()
+		if datachannel.CompareVersions(s.version, datachannel.MultiplexingAgentVersion) >= 0 &&
+			datachannel.CompareVersions(s.client, "1.1.70") >= 0 {
+			s.startMux()
+		}
+		complete, _ := json.Marshal(datachannel.HandshakeCompletePayload{HandshakeTimeToComplete: time.Millisecond})
+		return s.send(datachannel.HandshakeComplete, complete)
+	case datachannel.Flag:
+		flag := datachannel.PortFlag(binary.BigEndian.Uint32(msg.Payload))
+		a.mu.Lock()
+		a.flagsSeen = append(a.flagsSeen, flag)
+		a.mu.Unlock()
+		if flag == datachannel.DisconnectToPort {
+			s.closeRemote()
+		}
+		return nil
+	case datachannel.Output:
+		if s.mux != nil {
+			_, err := s.muxInput.Write(msg.Payload)
+			return err
+		}
+		remote, err := s.remoteConn()
+		if err != nil {
+			flag := make([]byte, 4)
+			binary.BigEndian.PutUint32(flag, uint32(datachannel.ConnectToPortError))
+			return s.send(datachannel.Flag, flag)
+		}
+		_, err = remote.Write(msg.Payload)
+		return err
+	}
+	return nil
+}
+
+func (s *agentSession) remoteConn() (net.Conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.remote != nil {
+		return s.remote, nil
+	}
+	conn, err := net.Dial("tcp", s.agent.Target)
+	if err != nil {
+		return nil, err
+	}
+	s.remote = conn
+
+	go func() {
+		buf := make([]byte, datachannel.StreamDataPayloadSize)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				if sendErr := s.send(datachannel.Output, append([]byte(nil), buf[:n]...)); sendErr != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return conn, nil
+}
+
+// startMux serves smux streams carried in the session's stream data,
+// connecting each one to the target.
+func (s *agentSession) startMux() {
+	reader, writer := io.Pipe()
+	s.muxInput = writer
+	s.mux = smux.Server(&muxConn{session: s, reader: reader})
+
+	go func() {
+		for {
+			stream, err := s.mux.AcceptStream()
+			if err != nil {
+				return
+			}
+			s.agent.mu.Lock()
+			s.agent.streams++
+			s.agent.mu.Unlock()
+
+			go func() {
+				remote, err := net.Dial("tcp", s.agent.Target)
+				if err != nil {
+					stream.Close()
+					flag := make([]byte, 4)
+					binary.BigEndian.PutUint32(flag, uint32(datachannel.ConnectToPortError))
+					_ = s.send(datachannel.Flag, flag)
+					return
+				}
+				done := make(chan struct{}, 2)
+				go func() {
+					_, _ = io.Copy(remote, stream)
+					done <- struct{}{}
+				}()
+				go func() {
+					_, _ = io.Copy(stream, remote)
+					done <- struct{}{}
+				}()
+				<-done
+				remote.Close()
+				stream.Close()
+			}()
+		}
+	}()
+}
+
+// muxConn feeds client stream data to the smux server and sends its frames
+// back as output stream data.
+type muxConn struct {
+	session *agentSession
+	reader  *io.PipeReader
+}
+
+func (c *muxConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *muxConn) Write(p []byte) (int, error) {
+	for sent := 0; sent < len(p); {
+		end := sent + datachannel.StreamDataPayloadSize
+		if end > len(p) {
+			end = len(p)
+		}
+		if err := c.session.send(datachannel.Output, append([]byte(nil), p[sent:end]...)); err != nil {
+			return sent, err
+		}
+		sent = end
+	}
+	return len(p), nil
+}
+
+func (c *muxConn) Close() error {
+	return c.reader.Close()
+}
+
+func (s *agentSession) closeRemote() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mux != nil {
+		_ = s.mux.Close()
+		_ = s.muxInput.Close()
+	}
+	if s.remote != nil {
+		s.remote.Close()
+		s.remote = nil
+	}
+}
+
+func (s *agentSession) send(payloadType datachannel.PayloadType, payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg := &datachannel.Message{
+		MessageType:    datachannel.OutputStreamMessage,
+		SchemaVersion:  1,
+		CreatedDate:    time.Now(),
+		SequenceNumber: s.sequence,
+		MessageID:      uuid.New(),
+		PayloadType:    payloadType,
+		Payload:        payload,
+	}
+	s.sequence++
+
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if err := s.ws.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		return err
+	}
+	if s.agent.DuplicateOutput && payloadType == datachannel.Output {
+		return s.ws.WriteMessage(websocket.BinaryMessage, data)
+	}
+	return nil
+}
+
+func (s *agentSession) acknowledge(msg *datachannel.Message) error {
+	content, _ := json.Marshal(datachannel.AcknowledgeContent{
+		MessageType:         msg.MessageType,
+		MessageID:           msg.MessageID.String(),
+		SequenceNumber:      msg.SequenceNumber,
+		IsSequentialMessage: true,
+	})
+	ack := &datachannel.Message{
+		MessageType:   datachannel.AcknowledgeMessage,
+		SchemaVersion: 1,
+		CreatedDate:   time.Now(),
+		Flags:         3,
+		MessageID:     uuid.New(),
+		Payload:       content,
+	}
+	data, err := ack.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return s.ws.WriteMessage(websocket.BinaryMessage, data)
+}
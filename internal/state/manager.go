@@ -3,27 +3,140 @@ package state
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/cloudopsy/ekssm/internal/logging"
+	"github.com/cloudopsy/ekssm/internal/util"
 )
 
 type SessionState struct {
 	PID            int    `json:"pid"`
 	SessionID      string `json:"session_id"`
 	ClusterName    string `json:"cluster_name"`
-	InstanceID     string `json:"instance_id"`
+	InstanceID     string `json:"instance_id"` // bastion the session started through
+	Backend        string `json:"backend,omitempty"`
+	SOCKS          bool   `json:"socks,omitempty"`
 	LocalPort      string `json:"local_port"`
+	RemoteHost     string `json:"remote_host,omitempty"`
 	KubeconfigPath string `json:"kubeconfig_path"`
+	// LogPath is the serve process's log, which also holds the output of
+	// the session-manager-plugin.
+	LogPath string `json:"log_path,omitempty"`
+
+	// InstanceIDs are the bastions the session may fail over across, in
+	// order of preference.
+	InstanceIDs []string `json:"instance_ids,omitempty"`
+	// BastionTag, as key=value, discovers the bastions instead when set.
+	BastionTag string `json:"bastion_tag,omitempty"`
+
+	// Forwards are additional ports tunnelled alongside the EKS endpoint.
+	Forwards []Forward `json:"forwards,omitempty"`
+
+	// SocketPath is the Unix socket the EKS tunnel listens on, if any. The
+	// local port is then an authenticated CONNECT shim in front of it,
+	// using ProxyPassword.
+	SocketPath    string `json:"socket_path,omitempty"`
+	ProxyPassword string `json:"proxy_password,omitempty"`
+
+	// Document is the SSM document the session's tunnels are started with
+	// when not the default, with DocumentParams passed to it.
+	Document       string            `json:"document,omitempty"`
+	DocumentParams map[string]string `json:"document_params,omitempty"`
+
+	KeepaliveTarget   string `json:"keepalive_target,omitempty"`
+	KeepaliveInterval string `json:"keepalive_interval,omitempty"`
+
+	// Lazy sessions only connect while clients use them, and disconnect
+	// after IdleTimeout without connections.
+	Lazy        bool   `json:"lazy,omitempty"`
+	IdleTimeout string `json:"idle_timeout,omitempty"`
+
+	// ExpiresAt is when the serve process stops the session and cleans it
+	// up, if the session has a TTL.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// Executable is the ekssm executable the serve process runs, so that a
+	// process that took over its PID after it died is not mistaken for it.
+	Executable string `json:"executable,omitempty"`
+	// Dead is set when the session is loaded if its serve process has gone,
+	// as after a crash or reboot. 'ekssm session prune' removes such
+	// sessions.
+	Dead bool `json:"-"`
+}
+
+// Running reports whether the session's serve process was running when the
+// session was loaded.
+func (s SessionState) Running() bool {
+	return s.PID > 0 && !s.Dead
+}
+
+// reconcile marks the session dead if its PID is gone or now belongs to a
+// different executable. Sessions still being started have no PID yet.
+func (s *SessionState) reconcile() {
+	if s.PID <= 0 {
+		return
+	}
+	if !util.ProcessAlive(s.PID) {
+		s.Dead = true
+		return
+	}
+	if s.Executable == "" {
+		return
+	}
+	if executable, ok := util.ProcessExecutable(s.PID); ok && executable != s.Executable {
+		s.Dead = true
+	}
+}
+
+// Expired reports whether the session's TTL has run out.
+func (s SessionState) Expired() bool {
+	return s.ExpiresAt != nil && !time.Now().Before(*s.ExpiresAt)
+}
+
+// Bastions returns the bastions the session may use, in order of preference.
+// Sessions recorded before failover was supported have only InstanceID.
+func (s SessionState) Bastions() []string {
+	if len(s.InstanceIDs) > 0 {
+		return s.InstanceIDs
+	}
+	if s.InstanceID != "" {
+		return []string{s.InstanceID}
+	}
+	return nil
+}
+
+// Forward maps a local port to host:port on the far side of the tunnel.
+type Forward struct {
+	LocalPort  string `json:"local_port"`
+	RemoteHost string `json:"remote_host"`
+	RemotePort string `json:"remote_port"`
+}
+
+func (f Forward) String() string {
+	return fmt.Sprintf("%s->%s", f.LocalPort, net.JoinHostPort(f.RemoteHost, f.RemotePort))
 }
 
 type SessionMap map[string]SessionState
 
+const (
+	// lockTimeout is how long an operation waits for other ekssm processes
+	// to release the state file.
+	lockTimeout       = 10 * time.Second
+	lockRetryInterval = 10 * time.Millisecond
+)
+
+// Manager keeps the sessions in session.json. Every operation holds an
+// advisory lock on session.json.lock, which other ekssm processes honour,
+// from reading the file to writing it back.
 type Manager struct {
+	stateDir      string
 	stateFilePath string
-	mu            sync.Mutex // Protects access to the state file
+	lockFilePath  string
+	mu            sync.Mutex // Serializes this process's operations
 }
 
 func NewManager() (*Manager, error) {
@@ -36,13 +149,64 @@ func NewManager() (*Manager, error) {
 		return nil, fmt.Errorf("failed to create state directory %s: %w", stateDir, err)
 	}
 	stateFilePath := filepath.Join(stateDir, "session.json")
-	return &Manager{stateFilePath: stateFilePath}, nil
+	return &Manager{stateDir: stateDir, stateFilePath: stateFilePath, lockFilePath: stateFilePath + ".lock"}, nil
 }
 
-func (m *Manager) loadState() (SessionMap, error) {
+// lock takes the state lock and returns the function that releases it.
+func (m *Manager) lock() (func(), error) {
 	m.mu.Lock()
-	defer m.mu.Unlock()
+	for deadline := time.Now().Add(lockTimeout); ; {
+		fileLock, err := util.TryLockFile(m.lockFilePath)
+		if fileLock != nil {
+			return func() {
+				_ = fileLock.Unlock()
+				m.mu.Unlock()
+			}, nil
+		}
+		if err == nil && time.Now().After(deadline) {
+			err = fmt.Errorf("another ekssm process has held it for over %s", lockTimeout)
+		}
+		if err != nil {
+			m.mu.Unlock()
+			return nil, fmt.Errorf("failed to lock %s: %w", m.stateFilePath, err)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+// view returns the stored sessions.
+func (m *Manager) view() (SessionMap, error) {
+	release, err := m.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return m.loadState()
+}
+
+// update applies change to the stored sessions and saves the result, all
+// under the state lock. Nothing is saved if change fails.
+func (m *Manager) update(change func(SessionMap) error) error {
+	release, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer release()
+	sessions, err := m.loadState()
+	if err != nil {
+		return err
+	}
+	if err := change(sessions); err != nil {
+		return err
+	}
+	return m.saveState(sessions)
+}
 
+// loadState reads the state file and marks the sessions whose serve process
+// has gone as dead. A file that cannot be parsed is moved aside as a backup
+// and the state starts empty, so that one bad write does not keep every
+// command from working. The caller holds the state lock.
+func (m *Manager) loadState() (SessionMap, error) {
 	data, err := os.ReadFile(m.stateFilePath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -57,60 +221,105 @@ func (m *Manager) loadState() (SessionMap, error) {
 
 	var sessions SessionMap
 	if err := json.Unmarshal(data, &sessions); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal state file %s: %w", m.stateFilePath, err)
+		backup := fmt.Sprintf("%s.corrupt-%s", m.stateFilePath, time.Now().Format("20060102T150405"))
+		if renameErr := os.Rename(m.stateFilePath, backup); renameErr != nil {
+			return nil, fmt.Errorf("failed to unmarshal state file %s: %w (and failed to back it up: %v)", m.stateFilePath, err, renameErr)
+		}
+		logging.Warnf("State file %s is corrupt (%v); moved it to %s and starting with no sessions", m.stateFilePath, err, backup)
+		return make(SessionMap), nil
+	}
+	if sessions == nil {
+		sessions = make(SessionMap)
+	}
+	for id, session := range sessions {
+		session.reconcile()
+		sessions[id] = session
 	}
 	return sessions, nil
 }
 
+// saveState replaces the state file. The caller holds the state lock.
 func (m *Manager) saveState(sessions SessionMap) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
 	data, err := json.MarshalIndent(sessions, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal session state: %w", err)
 	}
 
-	if err := os.WriteFile(m.stateFilePath, data, 0600); err != nil {
+	if err := writeFileAtomic(m.stateFilePath, data); err != nil {
 		return fmt.Errorf("failed to write state file %s: %w", m.stateFilePath, err)
 	}
 	logging.Debugf("Session state saved to %s", m.stateFilePath)
 	return nil
 }
 
+// writeFileAtomic replaces path with data. The data is written and synced
+// to a temporary file next to path, which is then renamed over it, so that
+// neither readers nor a crash midway see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
 func (m *Manager) AddSession(session SessionState) error {
 	if session.SessionID == "" {
 		return fmt.Errorf("cannot add session with empty SessionID")
 	}
-	sessions, err := m.loadState()
-	if err != nil {
-		return fmt.Errorf("failed to load state before adding session: %w", err)
+	return m.update(func(sessions SessionMap) error {
+		sessions[session.SessionID] = session
+		return nil
+	})
+}
+
+// UpdateSession applies update to the stored session and saves the result.
+func (m *Manager) UpdateSession(sessionID string, update func(*SessionState)) error {
+	if sessionID == "" {
+		return fmt.Errorf("cannot update session with empty SessionID")
 	}
-	sessions[session.SessionID] = session
-	return m.saveState(sessions)
+	return m.update(func(sessions SessionMap) error {
+		session, exists := sessions[sessionID]
+		if !exists {
+			return fmt.Errorf("session with ID '%s' not found", sessionID)
+		}
+		update(&session)
+		sessions[sessionID] = session
+		return nil
+	})
 }
 
 func (m *Manager) RemoveSession(sessionID string) error {
 	if sessionID == "" {
 		return fmt.Errorf("cannot remove session with empty SessionID")
 	}
-	sessions, err := m.loadState()
-	if err != nil {
-		return fmt.Errorf("failed to load state before removing session: %w", err)
-	}
-	if _, exists := sessions[sessionID]; !exists {
-		logging.Warnf("Attempted to remove non-existent session ID: %s", sessionID)
+	return m.update(func(sessions SessionMap) error {
+		if _, exists := sessions[sessionID]; !exists {
+			logging.Warnf("Attempted to remove non-existent session ID: %s", sessionID)
+		}
+		delete(sessions, sessionID)
 		return nil
-	}
-	delete(sessions, sessionID)
-	return m.saveState(sessions)
+	})
 }
 
 func (m *Manager) GetSession(sessionID string) (*SessionState, error) {
 	if sessionID == "" {
 		return nil, fmt.Errorf("cannot get session with empty SessionID")
 	}
-	sessions, err := m.loadState()
+	sessions, err := m.view()
 	if err != nil {
 		return nil, fmt.Errorf("failed to load state before getting session: %w", err)
 	}
@@ -121,9 +330,16 @@ func (m *Manager) GetSession(sessionID string) (*SessionState, error) {
 }
 
 func (m *Manager) GetAllSessions() (SessionMap, error) {
-	return m.loadState()
+	return m.view()
 }
 
-func (m *Manager) ClearAllSessions() error {
-	return m.saveState(make(SessionMap))
+// RemoveSessions removes the given sessions in one update, leaving any
+// others, such as sessions started meanwhile, in place.
+func (m *Manager) RemoveSessions(sessionIDs []string) error {
+	return m.update(func(sessions SessionMap) error {
+		for _, id := range sessionIDs {
+			delete(sessions, id)
+		}
+		return nil
+	})
 }
@@ -0,0 +1,125 @@
+package state_test
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudopsy/ekssm/internal/state"
+)
+
+func TestConcurrentWritersKeepEverySession(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	// Each manager stands in for a separate ekssm process: they share
+	// nothing but the lock file.
+	const writers, sessionsEach = 8, 10
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		manager, err := state.NewManager()
+		require.NoError(t, err)
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < sessionsEach; i++ {
+				id := fmt.Sprintf("session-%d-%d", w, i)
+				assert.NoError(t, manager.AddSession(state.SessionState{SessionID: id, ClusterName: "prod"}))
+				assert.NoError(t, manager.UpdateSession(id, func(s *state.SessionState) { s.PID = w + 1 }))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	manager, err := state.NewManager()
+	require.NoError(t, err)
+	sessions, err := manager.GetAllSessions()
+	require.NoError(t, err)
+	assert.Len(t, sessions, writers*sessionsEach)
+	for _, session := range sessions {
+		assert.NotZero(t, session.PID, session.SessionID)
+	}
+}
+
+func TestCorruptStateIsBackedUp(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	manager, err := state.NewManager()
+	require.NoError(t, err)
+
+	path := filepath.Join(home, ".ekssm", "session.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"3f7c": {"session_id": "3f7c", `), 0600))
+
+	sessions, err := manager.GetAllSessions()
+	require.NoError(t, err)
+	assert.Empty(t, sessions)
+	backups, err := filepath.Glob(path + ".corrupt-*")
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	data, err := os.ReadFile(backups[0])
+	require.NoError(t, err)
+	assert.Equal(t, `{"3f7c": {"session_id": "3f7c", `, string(data))
+
+	require.NoError(t, manager.AddSession(state.SessionState{SessionID: "a1"}))
+	session, err := manager.GetSession("a1")
+	require.NoError(t, err)
+	assert.Equal(t, "a1", session.SessionID)
+
+	// Nothing is left behind by the atomic writes.
+	leftovers, err := filepath.Glob(path + ".*.tmp")
+	require.NoError(t, err)
+	assert.Empty(t, leftovers)
+}
+
+func TestLoadMarksDeadSessions(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	manager, err := state.NewManager()
+	require.NoError(t, err)
+
+	exited := exec.Command(os.Args[0], "-test.run=^$")
+	require.NoError(t, exited.Run())
+	executable, err := os.Executable()
+	require.NoError(t, err)
+
+	for _, session := range []state.SessionState{
+		{SessionID: "starting"},
+		{SessionID: "running", PID: os.Getpid(), Executable: executable},
+		{SessionID: "legacy", PID: os.Getpid()},
+		{SessionID: "exited", PID: exited.Process.Pid, Executable: executable},
+	} {
+		require.NoError(t, manager.AddSession(session))
+	}
+	if runtime.GOOS == "linux" {
+		// After a reboot, the PID may belong to something else entirely.
+		require.NoError(t, manager.AddSession(state.SessionState{SessionID: "reused", PID: os.Getpid(), Executable: "/usr/local/bin/ekssm"}))
+	}
+
+	sessions, err := manager.GetAllSessions()
+	require.NoError(t, err)
+	for id, session := range sessions {
+		dead := id == "exited" || id == "reused"
+		assert.Equal(t, dead, session.Dead, id)
+		assert.Equal(t, !dead && id != "starting", session.Running(), id)
+	}
+}
+
+func TestRemoveSessionsKeepsOthers(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	manager, err := state.NewManager()
+	require.NoError(t, err)
+	for _, id := range []string{"a1", "b2", "c3"} {
+		require.NoError(t, manager.AddSession(state.SessionState{SessionID: id}))
+	}
+
+	require.NoError(t, manager.RemoveSessions([]string{"a1", "c3", "gone"}))
+	sessions, err := manager.GetAllSessions()
+	require.NoError(t, err)
+	assert.Len(t, sessions, 1)
+	assert.Contains(t, sessions, "b2")
+}
@@ -0,0 +1,117 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cloudopsy/ekssm/internal/metrics"
+)
+
+// SessionStatus is runtime information about a session's tunnels. It is
+// written only by the session's serve process, to a file of its own, so that
+// background updates never race with commands rewriting session.json.
+type SessionStatus struct {
+	// InstanceID is the bastion the latest tunnel went through.
+	InstanceID    string     `json:"instance_id,omitempty"`
+	Reconnects    int        `json:"reconnects,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastKeepalive *time.Time `json:"last_keepalive,omitempty"`
+	// Listening is set once the session's local ports accept connections.
+	Listening bool `json:"listening,omitempty"`
+	// Idle is set while a lazy session's tunnels are down for want of use.
+	Idle    bool    `json:"idle,omitempty"`
+	Traffic Traffic `json:"traffic"`
+	// APICalls counts the AWS API calls the serve process made, and
+	// StartSessionLatency how long its SSM StartSession calls took, in
+	// seconds.
+	APICalls            []APICalls       `json:"api_calls,omitempty"`
+	StartSessionLatency *metrics.Buckets `json:"start_session_latency,omitempty"`
+	UpdatedAt           time.Time        `json:"updated_at"`
+}
+
+// APICalls counts the calls of one AWS API operation.
+type APICalls struct {
+	Service   string `json:"service"`
+	Operation string `json:"operation"`
+	Calls     int64  `json:"calls"`
+	Errors    int64  `json:"errors"`
+}
+
+// RecordAPICall counts a call of service's operation, and whether it failed.
+func (s *SessionStatus) RecordAPICall(service, operation string, failed bool) {
+	i := 0
+	for i < len(s.APICalls) && (s.APICalls[i].Service != service || s.APICalls[i].Operation != operation) {
+		i++
+	}
+	if i == len(s.APICalls) {
+		s.APICalls = append(s.APICalls, APICalls{Service: service, Operation: operation})
+	}
+	s.APICalls[i].Calls++
+	if failed {
+		s.APICalls[i].Errors++
+	}
+}
+
+// Traffic is what local clients have sent through a session's tunnels, as
+// counted by its relay. BytesIn is sent towards the cluster, BytesOut back.
+type Traffic struct {
+	Connections       int64      `json:"connections"`
+	ActiveConnections int64      `json:"active_connections"`
+	BytesIn           int64      `json:"bytes_in"`
+	BytesOut          int64      `json:"bytes_out"`
+	LastActivity      *time.Time `json:"last_activity,omitempty"`
+}
+
+// StatusPath returns the path of the status file for a session.
+func (m *Manager) StatusPath(sessionID string) string {
+	return filepath.Join(m.stateDir, "status", sessionID+".json")
+}
+
+// WriteStatus replaces the status file for a session, atomically so readers
+// never see a partial write.
+func (m *Manager) WriteStatus(sessionID string, status SessionStatus) error {
+	if sessionID == "" {
+		return fmt.Errorf("cannot write status for empty SessionID")
+	}
+	path := m.StatusPath(sessionID)
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return fmt.Errorf("failed to create status directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal session status: %w", err)
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("failed to write status file %s: %w", path, err)
+	}
+	return nil
+}
+
+// ReadStatus returns the status last written for a session, or an empty
+// status if none has been written.
+func (m *Manager) ReadStatus(sessionID string) (SessionStatus, error) {
+	var status SessionStatus
+	data, err := os.ReadFile(m.StatusPath(sessionID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return status, nil
+		}
+		return status, fmt.Errorf("failed to read status for session %s: %w", sessionID, err)
+	}
+	if err := json.Unmarshal(data, &status); err != nil {
+		return status, fmt.Errorf("failed to parse status for session %s: %w", sessionID, err)
+	}
+	return status, nil
+}
+
+// RemoveStatus deletes the status file for a session, if there is one.
+func (m *Manager) RemoveStatus(sessionID string) error {
+	if err := os.Remove(m.StatusPath(sessionID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove status for session %s: %w", sessionID, err)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ParseForward parses a "localPort:host:port" forward specification. The host
+// may be a bracketed IPv6 address. A local port of 0 asks for a dynamically
+// allocated port.
+func ParseForward(spec string) (localPort, host, port string, err error) {
+	localPort, rest, ok := strings.Cut(spec, ":")
+	if !ok {
+		return "", "", "", fmt.Errorf("invalid forward %q: expected localPort:host:port", spec)
+	}
+	host, port, err = net.SplitHostPort(rest)
+	if err != nil || host == "" {
+		return "", "", "", fmt.Errorf("invalid forward %q: expected localPort:host:port", spec)
+	}
+	for _, p := range []string{localPort, port} {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || n > 65535 {
+			return "", "", "", fmt.Errorf("invalid forward %q: %q is not a valid port", spec, p)
+		}
+	}
+	if port == "0" {
+		return "", "", "", fmt.Errorf("invalid forward %q: remote port must not be 0", spec)
+	}
+	return localPort, host, port, nil
+}
@@ -0,0 +1,25 @@
+package util_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudopsy/ekssm/internal/util"
+)
+
+func TestParseForward(t *testing.T) {
+	localPort, host, port, err := util.ParseForward("9090:prometheus.internal:9090")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"9090", "prometheus.internal", "9090"}, []string{localPort, host, port})
+
+	localPort, host, port, err = util.ParseForward("0:[fd00::10]:5000")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0", "fd00::10", "5000"}, []string{localPort, host, port})
+
+	for _, spec := range []string{"9090", "9090:host", "x:host:80", "80:host:0", "80::443", "70000:host:80"} {
+		_, _, _, err := util.ParseForward(spec)
+		assert.Error(t, err, spec)
+	}
+}
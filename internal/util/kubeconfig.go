@@ -26,6 +26,38 @@ func KubeconfigPathForRun(clusterName string) string {
 	return filepath.Join(clusterDir, "run-temp.yaml")
 }
 
+// LockRunKubeconfig locks the kubeconfig of an 'ekssm run', which keeps
+// 'ekssm session prune' from removing it while it is in use. It returns a
+// nil lock if another process holds it.
+func LockRunKubeconfig(path string) (*FileLock, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create kubeconfig directory %s: %w", dir, err)
+	}
+	lock, err := TryLockFile(path + ".lock")
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock kubeconfig %s: %w", path, err)
+	}
+	return lock, nil
+}
+
+// SocketPathForSession returns the Unix socket a session's tunnel listens on
+// in --unix-socket mode.
+func SocketPathForSession(sessionID string) string {
+	return filepath.Join(os.Getenv("HOME"), ".ekssm", "sockets", sessionID+".sock")
+}
+
+// LogPathForSession returns the log file of a session's serve process.
+func LogPathForSession(sessionID string) string {
+	return filepath.Join(os.Getenv("HOME"), ".ekssm", "logs", sessionID+".log")
+}
+
+// UpstreamSocketPathForSession returns the internal Unix socket a
+// --unix-socket session's relay forwards to.
+func UpstreamSocketPathForSession(sessionID string) string {
+	return filepath.Join(os.Getenv("HOME"), ".ekssm", "sockets", sessionID+".upstream.sock")
+}
+
 func WriteKubeconfig(path string, content string) error {
 	logging.Debugf("Writing kubeconfig to %s", path)
 	dir := filepath.Dir(path)
@@ -37,3 +69,13 @@ func WriteKubeconfig(path string, content string) error {
 	}
 	return nil
 }
+
+// AgentSocketPath returns the Unix socket the ekssm agent serves its API on.
+func AgentSocketPath() string {
+	return filepath.Join(os.Getenv("HOME"), ".ekssm", "agent.sock")
+}
+
+// AgentLogPath returns the log file of the ekssm agent.
+func AgentLogPath() string {
+	return filepath.Join(os.Getenv("HOME"), ".ekssm", "logs", "agent.log")
+}
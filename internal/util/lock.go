@@ -0,0 +1,44 @@
+package util
+
+import "os"
+
+// FileLock is an exclusive advisory lock on a file, which other ekssm
+// processes honour by locking the same file.
+type FileLock struct {
+	f    *os.File
+	path string
+}
+
+// TryLockFile locks path, creating it if needed, without waiting. It returns
+// a nil lock if another process holds it.
+func TryLockFile(path string) (*FileLock, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	locked, err := tryLock(f)
+	if !locked {
+		f.Close()
+		return nil, err
+	}
+	return &FileLock{f: f, path: path}, nil
+}
+
+// Unlock releases the lock.
+func (l *FileLock) Unlock() error {
+	err := unlock(l.f)
+	if closeErr := l.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Remove removes the lock file and releases the lock, for locks that guard
+// something which is gone with it.
+func (l *FileLock) Remove() error {
+	err := os.Remove(l.path)
+	if unlockErr := l.Unlock(); err == nil {
+		err = unlockErr
+	}
+	return err
+}
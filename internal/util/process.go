@@ -0,0 +1,16 @@
+package util
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// StartDetached starts cmd in its own session so that it keeps running after
+// ekssm exits and is not interrupted by signals sent to the terminal.
+func StartDetached(cmd *exec.Cmd) error {
+	detach(cmd)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start detached process %s: %w", cmd.Path, err)
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+package util
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ProcessExecutable returns the path of the executable a process runs, and
+// false if it cannot be told.
+func ProcessExecutable(pid int) (string, bool) {
+	path, err := os.Readlink("/proc/" + strconv.Itoa(pid) + "/exe")
+	if err != nil {
+		return "", false
+	}
+	// The executable may have been replaced since, as by an upgrade.
+	return strings.TrimSuffix(path, " (deleted)"), true
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !windows
+
+package util
+
+// ProcessExecutable returns the path of the executable a process runs, and
+// false if it cannot be told. Without cgo it cannot be told on macOS and the
+// BSDs, so a session whose PID was reused there is only found dead once that
+// process exits too.
+func ProcessExecutable(pid int) (string, bool) {
+	return "", false
+}
@@ -0,0 +1,51 @@
+//go:build windows
+
+package util
+
+import (
+	"os/exec"
+	"syscall"
+	"unsafe"
+)
+
+var procQueryFullProcessImageNameW = kernel32.NewProc("QueryFullProcessImageNameW")
+
+const processQueryLimitedInformation = 0x1000
+
+func detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// ProcessAlive reports whether a process with the given PID exists.
+func ProcessAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	handle, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer syscall.CloseHandle(handle)
+
+	var code uint32
+	const stillActive = 259
+	return syscall.GetExitCodeProcess(handle, &code) == nil && code == stillActive
+}
+
+// ProcessExecutable returns the path of the executable a process runs, and
+// false if it cannot be told.
+func ProcessExecutable(pid int) (string, bool) {
+	handle, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return "", false
+	}
+	defer syscall.CloseHandle(handle)
+
+	buf := make([]uint16, syscall.MAX_LONG_PATH)
+	size := uint32(len(buf))
+	r, _, _ := procQueryFullProcessImageNameW.Call(uintptr(handle), 0, uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)))
+	if r == 0 {
+		return "", false
+	}
+	return syscall.UTF16ToString(buf[:size]), true
+}
@@ -0,0 +1,30 @@
+package util
+
+import "sync"
+
+// TailBuffer keeps the last Size bytes written to it, for reporting the end
+// of a process's output without holding all of it. It is safe for
+// concurrent use.
+type TailBuffer struct {
+	Size int
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (t *TailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if over := len(t.buf) - t.Size; over > 0 {
+		t.buf = append(t.buf[:0], t.buf[over:]...)
+	}
+	return len(p), nil
+}
+
+// String returns the bytes kept.
+func (t *TailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return string(t.buf)
+}
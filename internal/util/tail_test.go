@@ -0,0 +1,24 @@
+package util_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cloudopsy/ekssm/internal/util"
+)
+
+func TestTailBufferKeepsTheEnd(t *testing.T) {
+	tail := &util.TailBuffer{Size: 8}
+	for i := 0; i < 1000; i++ {
+		_, _ = tail.Write([]byte("noise "))
+	}
+	n, err := tail.Write([]byte("failed!\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 8, n)
+	assert.Equal(t, "failed!\n", tail.String())
+
+	_, _ = tail.Write([]byte(strings.Repeat("x", 20)))
+	assert.Equal(t, strings.Repeat("x", 8), tail.String())
+}
@@ -0,0 +1,324 @@
+package websocket_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudopsy/ekssm/internal/websocket"
+)
+
+func echoServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(messageType, data); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func wsURL(server *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func TestEchoUsesEveryLengthEncoding(t *testing.T) {
+	server := echoServer(t)
+	conn, err := websocket.Dial(context.Background(), wsURL(server))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// 125 fits the 7 bit length, 126 and 65535 need the 16 bit extension and
+	// 65536 the 64 bit one.
+	for _, size := range []int{0, 1, 125, 126, 65535, 65536, 200000} {
+		data := bytes.Repeat([]byte{byte(size)}, size)
+		require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, data))
+		messageType, got, err := conn.ReadMessage()
+		require.NoError(t, err, size)
+		assert.Equal(t, websocket.BinaryMessage, messageType)
+		assert.True(t, bytes.Equal(data, got), size)
+	}
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("hello")))
+	messageType, got, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, websocket.TextMessage, messageType)
+	assert.Equal(t, "hello", string(got))
+
+	assert.Error(t, conn.WriteMessage(websocket.PingMessage, nil))
+}
+
+// rawServer accepts one websocket handshake and hands the raw connection to
+// handle, so tests can write frames the Conn API never produces.
+func rawServer(t *testing.T, handle func(conn net.Conn, br *bufio.Reader)) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		h := sha1.New()
+		h.Write([]byte(req.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+		_, _ = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: "+base64.StdEncoding.EncodeToString(h.Sum(nil))+"\r\n\r\n")
+		handle(conn, br)
+	}()
+	return "ws://" + listener.Addr().String()
+}
+
+// frame encodes an unmasked server frame.
+func frame(fin bool, opcode byte, payload []byte) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	if len(payload) >= 126 {
+		panic("test frames must be short")
+	}
+	return append([]byte{first, byte(len(payload))}, payload...)
+}
+
+// readClientFrame reads one frame sent by the client, checking it is masked.
+func readClientFrame(t *testing.T, r io.Reader) (byte, []byte) {
+	t.Helper()
+	var header [2]byte
+	_, err := io.ReadFull(r, header[:])
+	require.NoError(t, err)
+	require.NotZero(t, header[1]&0x80, "client frames must be masked")
+	length := int(header[1] & 0x7f)
+	require.Less(t, length, 126)
+
+	var mask [4]byte
+	_, err = io.ReadFull(r, mask[:])
+	require.NoError(t, err)
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	require.NoError(t, err)
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return header[0], payload
+}
+
+func TestReassemblesFragmentedMessages(t *testing.T) {
+	pong := make(chan []byte, 1)
+	url := rawServer(t, func(conn net.Conn, br *bufio.Reader) {
+		var out []byte
+		out = append(out, frame(false, websocket.TextMessage, []byte("hel"))...)
+		// Control frames may arrive between the fragments of a message.
+		out = append(out, frame(true, websocket.PingMessage, []byte("p"))...)
+		out = append(out, frame(false, 0, []byte("lo "))...)
+		out = append(out, frame(true, 0, []byte("world"))...)
+		out = append(out, frame(true, websocket.BinaryMessage, []byte{1, 2, 3})...)
+		_, _ = conn.Write(out)
+
+		first, payload := readClientFrame(t, br)
+		if first == 0x80|websocket.PongMessage {
+			pong <- payload
+		}
+		_, _ = io.Copy(io.Discard, br)
+	})
+
+	conn, err := websocket.Dial(context.Background(), url)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	messageType, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, websocket.TextMessage, messageType)
+	assert.Equal(t, "hello world", string(data))
+
+	messageType, data, err = conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, websocket.BinaryMessage, messageType)
+	assert.Equal(t, []byte{1, 2, 3}, data)
+
+	select {
+	case payload := <-pong:
+		assert.Equal(t, "p", string(payload))
+	case <-time.After(5 * time.Second):
+		t.Fatal("ping was not answered with a pong")
+	}
+}
+
+func TestRejectsBadFragmentation(t *testing.T) {
+	for name, frames := range map[string][]byte{
+		"continuation without a message": frame(true, 0, []byte("x")),
+		"message inside a message": append(frame(false, websocket.TextMessage, []byte("a")),
+			frame(true, websocket.TextMessage, []byte("b"))...),
+		"unknown opcode": frame(true, 3, nil),
+	} {
+		t.Run(name, func(t *testing.T) {
+			url := rawServer(t, func(conn net.Conn, br *bufio.Reader) {
+				_, _ = conn.Write(frames)
+				_, _ = io.Copy(io.Discard, br)
+			})
+			conn, err := websocket.Dial(context.Background(), url)
+			require.NoError(t, err)
+			defer conn.Close()
+
+			_, _, err = conn.ReadMessage()
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestRejectsOversizedFrames(t *testing.T) {
+	url := rawServer(t, func(conn net.Conn, br *bufio.Reader) {
+		header := []byte{0x80 | websocket.BinaryMessage, 127}
+		header = binary.BigEndian.AppendUint64(header, 1<<40)
+		_, _ = conn.Write(header)
+		_, _ = io.Copy(io.Discard, br)
+	})
+	conn, err := websocket.Dial(context.Background(), url)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, _, err = conn.ReadMessage()
+	assert.ErrorContains(t, err, "exceeds limit")
+}
+
+func TestAnswersCloseFrame(t *testing.T) {
+	echoed := make(chan []byte, 1)
+	url := rawServer(t, func(conn net.Conn, br *bufio.Reader) {
+		_, _ = conn.Write(frame(true, websocket.CloseMessage, []byte{0x03, 0xe8}))
+		first, payload := readClientFrame(t, br)
+		if first == 0x80|websocket.CloseMessage {
+			echoed <- payload
+		}
+	})
+	conn, err := websocket.Dial(context.Background(), url)
+	require.NoError(t, err)
+
+	_, _, err = conn.ReadMessage()
+	assert.ErrorIs(t, err, websocket.ErrClosed)
+	select {
+	case payload := <-echoed:
+		assert.Equal(t, []byte{0x03, 0xe8}, payload)
+	case <-time.After(5 * time.Second):
+		t.Fatal("close frame was not echoed")
+	}
+	assert.ErrorIs(t, conn.WriteMessage(websocket.TextMessage, []byte("late")), websocket.ErrClosed)
+}
+
+func TestDialRejectsBadHandshake(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	_, err := websocket.Dial(context.Background(), wsURL(server))
+	assert.ErrorContains(t, err, "403")
+
+	_, err = websocket.Dial(context.Background(), "http://example.com")
+	assert.ErrorContains(t, err, "unsupported websocket scheme")
+}
+
+// connectProxy is a minimal HTTP CONNECT proxy that records the tunnels it
+// was asked to open.
+func connectProxy(t *testing.T, status int) (*url.URL, <-chan *http.Request) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	requests := make(chan *http.Request, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				requests <- req
+				if req.Method != http.MethodConnect || status != http.StatusOK {
+					_, _ = fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n\r\n", status, http.StatusText(status))
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					return
+				}
+				defer target.Close()
+				_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go func() { _, _ = io.Copy(target, br) }()
+				_, _ = io.Copy(conn, target)
+			}()
+		}
+	}()
+
+	return &url.URL{Scheme: "http", User: url.UserPassword("user", "secret"), Host: listener.Addr().String()}, requests
+}
+
+func TestDialThroughProxy(t *testing.T) {
+	server := echoServer(t)
+	proxyURL, requests := connectProxy(t, http.StatusOK)
+
+	dialer := &websocket.Dialer{Proxy: http.ProxyURL(proxyURL)}
+	conn, err := dialer.Dial(context.Background(), wsURL(server))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	req := <-requests
+	assert.Equal(t, http.MethodConnect, req.Method)
+	assert.Equal(t, strings.TrimPrefix(server.URL, "http://"), req.Host)
+	assert.Equal(t, "Basic "+base64.StdEncoding.EncodeToString([]byte("user:secret")), req.Header.Get("Proxy-Authorization"))
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("tunnelled")))
+	_, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "tunnelled", string(data))
+}
+
+func TestDialReportsProxyRefusal(t *testing.T) {
+	server := echoServer(t)
+	proxyURL, _ := connectProxy(t, http.StatusProxyAuthRequired)
+
+	dialer := &websocket.Dialer{Proxy: http.ProxyURL(proxyURL)}
+	_, err := dialer.Dial(context.Background(), wsURL(server))
+	assert.ErrorContains(t, err, "refused CONNECT")
+}
@@ -0,0 +1,271 @@
+// Package api is the versioned JSON API of the ekssm agent, and a Go client
+// for it. The agent serves JSON-RPC 2.0 on a Unix socket, one JSON object per
+// line; docs/api.md documents the methods and their JSON.
+//
+// Methods are named after the API version that defines them, e.g.
+// v1.session.list. Within a version, fields are only ever added: clients
+// must ignore fields they do not know, and the agent treats missing fields
+// as their zero value.
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Version is the API version this package speaks.
+const Version = "v1"
+
+// Methods of API version v1.
+const (
+	MethodSessionStart    = "v1.session.start"
+	MethodSessionStop     = "v1.session.stop"
+	MethodSessionList     = "v1.session.list"
+	MethodSessionDescribe = "v1.session.describe"
+	MethodSessionHealth   = "v1.session.health"
+	MethodSessionSwitch   = "v1.session.switch"
+	MethodSessionPrune    = "v1.session.prune"
+	MethodAgentShutdown   = "v1.agent.shutdown"
+)
+
+// MethodAgentVersion is not versioned, so that any client can find out which
+// versions an agent speaks.
+const MethodAgentVersion = "agent.version"
+
+// Error codes returned by the agent besides the JSON-RPC 2.0 ones.
+const (
+	// CodeSessionNotFound is returned for a session ID the agent does not know.
+	CodeSessionNotFound = -32001
+	// CodeStartFailed is returned when a session could not be set up or its
+	// tunnels did not come up.
+	CodeStartFailed = -32002
+)
+
+// Duration is a time.Duration that is encoded in JSON as a Go duration
+// string, e.g. "1h30m".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"1h30m\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Forward is an additional port tunnelled alongside the EKS endpoint.
+type Forward struct {
+	// LocalPort "0" or "" asks for a free port when starting a session.
+	LocalPort  string `json:"local_port"`
+	RemoteHost string `json:"remote_host"`
+	RemotePort string `json:"remote_port"`
+}
+
+func (f Forward) String() string {
+	return fmt.Sprintf("%s:%s:%s", f.LocalPort, f.RemoteHost, f.RemotePort)
+}
+
+// StartRequest describes a session to start, as the flags of
+// 'ekssm session start' do. Unset fields take the same defaults, including
+// those from the ekssm config file.
+type StartRequest struct {
+	ClusterName string `json:"cluster_name"`
+	// InstanceIDs and Targets are bastions to fail over across, in order;
+	// BastionTag discovers them instead and excludes both.
+	InstanceIDs []string `json:"instance_ids,omitempty"`
+	Targets     []string `json:"targets,omitempty"`
+	BastionTag  string   `json:"bastion_tag,omitempty"`
+	// LocalPort of the EKS endpoint; empty allocates a free port.
+	LocalPort string `json:"local_port,omitempty"`
+	// Backend is plugin, ssm or direct. Empty means plugin, or ssm for
+	// SOCKS and Unix socket sessions.
+	Backend    string    `json:"backend,omitempty"`
+	SOCKS      bool      `json:"socks,omitempty"`
+	UnixSocket bool      `json:"unix_socket,omitempty"`
+	Forwards   []Forward `json:"forwards,omitempty"`
+
+	Document       string            `json:"document,omitempty"`
+	DocumentParams map[string]string `json:"document_params,omitempty"`
+
+	KeepaliveTarget   string   `json:"keepalive_target,omitempty"`
+	KeepaliveInterval Duration `json:"keepalive_interval,omitempty"`
+
+	Lazy        bool     `json:"lazy,omitempty"`
+	IdleTimeout Duration `json:"idle_timeout,omitempty"`
+
+	// TTL stops the session after this long. Null takes the default from
+	// the config file; "0s" never expires.
+	TTL *Duration `json:"ttl,omitempty"`
+
+	// Env is the environment, as KEY=value, that AWS is called with and the
+	// session's tunnels run in, so AWS_PROFILE and credentials apply.
+	// Empty means the agent's own environment.
+	Env []string `json:"env,omitempty"`
+	// Debug enables debug logging in the session's log.
+	Debug bool `json:"debug,omitempty"`
+}
+
+// SessionRequest names a session.
+type SessionRequest struct {
+	SessionID string `json:"session_id"`
+}
+
+// StopRequest names the session to stop; an empty SessionID stops them all.
+type StopRequest struct {
+	SessionID string `json:"session_id,omitempty"`
+}
+
+// StopResult lists the sessions that were stopped.
+type StopResult struct {
+	Stopped []string `json:"stopped"`
+}
+
+// ListRequest selects what v1.session.list returns.
+type ListRequest struct {
+	// Health probes every session, which takes up to a few seconds.
+	Health bool `json:"health,omitempty"`
+}
+
+// ListResult holds every session, ordered by ID.
+type ListResult struct {
+	Sessions []Session `json:"sessions"`
+}
+
+// Session is a background session: its configuration, whether its serve
+// process runs, and what that process last recorded.
+type Session struct {
+	SessionID   string `json:"session_id"`
+	ClusterName string `json:"cluster_name"`
+	PID         int    `json:"pid"`
+	// Running is whether the session's serve process is running.
+	Running bool   `json:"running"`
+	Backend string `json:"backend"`
+	SOCKS   bool   `json:"socks,omitempty"`
+	// LocalPort serves the EKS endpoint, the SOCKS proxy, or with a
+	// SocketPath the authenticated HTTP CONNECT proxy kubectl uses.
+	LocalPort      string `json:"local_port"`
+	SocketPath     string `json:"socket_path,omitempty"`
+	RemoteHost     string `json:"remote_host,omitempty"`
+	KubeconfigPath string `json:"kubeconfig_path"`
+	LogPath        string `json:"log_path,omitempty"`
+
+	// InstanceID is the bastion the session started through.
+	InstanceID  string    `json:"instance_id,omitempty"`
+	InstanceIDs []string  `json:"instance_ids,omitempty"`
+	BastionTag  string    `json:"bastion_tag,omitempty"`
+	Forwards    []Forward `json:"forwards,omitempty"`
+
+	Document       string            `json:"document,omitempty"`
+	DocumentParams map[string]string `json:"document_params,omitempty"`
+
+	KeepaliveTarget   string `json:"keepalive_target,omitempty"`
+	KeepaliveInterval string `json:"keepalive_interval,omitempty"`
+	Lazy              bool   `json:"lazy,omitempty"`
+	IdleTimeout       string `json:"idle_timeout,omitempty"`
+
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// Status is absent until the serve process has recorded one.
+	Status *Status `json:"status,omitempty"`
+	// Health is only set when it was asked for.
+	Health *Health `json:"health,omitempty"`
+}
+
+// Expired reports whether the session's TTL has run out.
+func (s Session) Expired() bool {
+	return s.ExpiresAt != nil && !time.Now().Before(*s.ExpiresAt)
+}
+
+// Status is what a session's serve process has recorded about its tunnels.
+type Status struct {
+	// InstanceID is the bastion the latest tunnel went through.
+	InstanceID    string     `json:"instance_id,omitempty"`
+	Reconnects    int        `json:"reconnects"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastKeepalive *time.Time `json:"last_keepalive,omitempty"`
+	Listening     bool       `json:"listening"`
+	// Idle is set while a lazy session's tunnels are down for want of use.
+	Idle      bool      `json:"idle"`
+	Traffic   Traffic   `json:"traffic"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Traffic is what local clients have sent through a session's tunnels.
+// BytesIn is sent towards the cluster, BytesOut back.
+type Traffic struct {
+	Connections       int64      `json:"connections"`
+	ActiveConnections int64      `json:"active_connections"`
+	BytesIn           int64      `json:"bytes_in"`
+	BytesOut          int64      `json:"bytes_out"`
+	LastActivity      *time.Time `json:"last_activity,omitempty"`
+}
+
+// Health statuses.
+const (
+	Healthy  = "healthy"  // every check passed
+	Degraded = "degraded" // the process runs but the tunnel does not carry traffic
+	Dead     = "dead"     // the serve process is gone
+)
+
+// Health is the outcome of probing a session.
+type Health struct {
+	Status string  `json:"status"`
+	Checks []Check `json:"checks"`
+}
+
+// Check is the outcome of one probe; Error is empty if it passed.
+type Check struct {
+	Name  string `json:"name"`
+	Error string `json:"error,omitempty"`
+}
+
+// Err returns the first failed check as an error, or nil.
+func (h Health) Err() error {
+	for _, c := range h.Checks {
+		if c.Error != "" {
+			return fmt.Errorf("%s: %s", c.Name, c.Error)
+		}
+	}
+	return nil
+}
+
+// SwitchTarget is what to point KUBECONFIG at to use a session.
+type SwitchTarget struct {
+	SessionID      string `json:"session_id"`
+	ClusterName    string `json:"cluster_name"`
+	KubeconfigPath string `json:"kubeconfig_path"`
+	// Export is a POSIX shell command that sets KUBECONFIG.
+	Export string `json:"export"`
+}
+
+// PruneRequest selects what v1.session.prune does.
+type PruneRequest struct {
+	// DryRun only reports what would be removed.
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// PruneResult lists what was removed: the sessions whose serve process had
+// gone, with their files, and the kubeconfig files left by no session.
+type PruneResult struct {
+	Sessions []string `json:"sessions"`
+	Files    []string `json:"files"`
+}
+
+// VersionInfo identifies an agent.
+type VersionInfo struct {
+	// EkssmVersion is the version of the ekssm binary the agent runs.
+	EkssmVersion string `json:"ekssm_version"`
+	// APIVersions are the API versions the agent serves, e.g. ["v1"].
+	APIVersions []string `json:"api_versions"`
+	PID         int      `json:"pid"`
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/cloudopsy/ekssm/internal/agent"
+	"github.com/cloudopsy/ekssm/internal/util"
+)
+
+// Error is an error returned by the agent, with its JSON-RPC error code.
+type Error = agent.Error
+
+// ErrUnsupportedVersion is returned by Dial when the agent does not serve this
+// version of the API, as when it runs an older ekssm.
+var ErrUnsupportedVersion = errors.New("ekssm agent does not serve API " + Version)
+
+// IsNotFound reports whether err is the agent saying a session does not exist.
+func IsNotFound(err error) bool {
+	var rpcErr *Error
+	return errors.As(err, &rpcErr) && rpcErr.Code == CodeSessionNotFound
+}
+
+// DefaultSocketPath returns the socket the agent listens on,
+// ~/.ekssm/agent.sock.
+func DefaultSocketPath() string {
+	return util.AgentSocketPath()
+}
+
+// Client calls the agent's API. It is safe for concurrent use; calls are
+// made one at a time over a single connection.
+type Client struct {
+	rpc *agent.Client
+}
+
+// Dial connects to the agent listening on the Unix socket at path, and checks
+// that it serves this version of the API.
+func Dial(ctx context.Context, path string) (*Client, error) {
+	rpc, err := agent.Dial(path)
+	if err != nil {
+		return nil, fmt.Errorf("no ekssm agent on %s: %w", path, err)
+	}
+	c := &Client{rpc: rpc}
+	info, err := c.Version(ctx)
+	if err != nil {
+		rpc.Close()
+		// Agents from before the versioned API have no agent.version.
+		var rpcErr *Error
+		if errors.As(err, &rpcErr) && rpcErr.Code == agent.CodeMethodNotFound {
+			return nil, fmt.Errorf("%w; stop it with 'ekssm agent stop' or by ending its process", ErrUnsupportedVersion)
+		}
+		return nil, err
+	}
+	if !slices.Contains(info.APIVersions, Version) {
+		rpc.Close()
+		return nil, fmt.Errorf("%w: ekssm %s (PID %d) serves %v; stop it with 'ekssm agent stop'", ErrUnsupportedVersion, info.EkssmVersion, info.PID, info.APIVersions)
+	}
+	return c, nil
+}
+
+// Close closes the connection to the agent.
+func (c *Client) Close() error {
+	return c.rpc.Close()
+}
+
+// Call invokes any method, for methods this package has no wrapper for.
+func (c *Client) Call(ctx context.Context, method string, params, result any) error {
+	return c.rpc.Call(ctx, method, params, result)
+}
+
+// Version returns which ekssm and API versions the agent runs.
+func (c *Client) Version(ctx context.Context) (*VersionInfo, error) {
+	var info VersionInfo
+	if err := c.rpc.Call(ctx, MethodAgentVersion, nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// StartSession starts a session and returns it once its ports serve.
+func (c *Client) StartSession(ctx context.Context, req StartRequest) (*Session, error) {
+	var session Session
+	if err := c.rpc.Call(ctx, MethodSessionStart, req, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// StopSession stops one session, or every session if sessionID is empty, and
+// returns the IDs of those stopped.
+func (c *Client) StopSession(ctx context.Context, sessionID string) ([]string, error) {
+	var result StopResult
+	if err := c.rpc.Call(ctx, MethodSessionStop, StopRequest{SessionID: sessionID}, &result); err != nil {
+		return nil, err
+	}
+	return result.Stopped, nil
+}
+
+// ListSessions returns every session ordered by ID, probing their health if
+// asked to.
+func (c *Client) ListSessions(ctx context.Context, req ListRequest) ([]Session, error) {
+	var result ListResult
+	if err := c.rpc.Call(ctx, MethodSessionList, req, &result); err != nil {
+		return nil, err
+	}
+	return result.Sessions, nil
+}
+
+// DescribeSession returns one session without probing it.
+func (c *Client) DescribeSession(ctx context.Context, sessionID string) (*Session, error) {
+	var session Session
+	if err := c.rpc.Call(ctx, MethodSessionDescribe, SessionRequest{SessionID: sessionID}, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// SessionHealth probes one session.
+func (c *Client) SessionHealth(ctx context.Context, sessionID string) (*Health, error) {
+	var health Health
+	if err := c.rpc.Call(ctx, MethodSessionHealth, SessionRequest{SessionID: sessionID}, &health); err != nil {
+		return nil, err
+	}
+	return &health, nil
+}
+
+// SwitchTarget returns the kubeconfig to use a session with.
+func (c *Client) SwitchTarget(ctx context.Context, sessionID string) (*SwitchTarget, error) {
+	var target SwitchTarget
+	if err := c.rpc.Call(ctx, MethodSessionSwitch, SessionRequest{SessionID: sessionID}, &target); err != nil {
+		return nil, err
+	}
+	return &target, nil
+}
+
+// PruneSessions removes dead sessions and orphaned kubeconfig files, or only
+// reports them if req.DryRun is set.
+func (c *Client) PruneSessions(ctx context.Context, req PruneRequest) (*PruneResult, error) {
+	var result PruneResult
+	if err := c.rpc.Call(ctx, MethodSessionPrune, req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Shutdown stops the agent. Sessions keep running and are taken over by the
+// next agent.
+func (c *Client) Shutdown(ctx context.Context) error {
+	return c.rpc.Call(ctx, MethodAgentShutdown, nil, nil)
+}
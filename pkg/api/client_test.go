@@ -0,0 +1,121 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudopsy/ekssm/internal/agent"
+	"github.com/cloudopsy/ekssm/pkg/api"
+)
+
+// serve runs an agent answering with methods on a socket in a temporary
+// directory and returns the socket's path.
+func serve(t *testing.T, methods map[string]agent.Method) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := agent.Listen(path)
+	require.NoError(t, err)
+
+	server := agent.NewServer()
+	for name, method := range methods {
+		server.Handle(name, method)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	t.Cleanup(func() {
+		_ = server.Close()
+		assert.NoError(t, <-served)
+	})
+	return path
+}
+
+func version(versions ...string) agent.Method {
+	return func(context.Context, json.RawMessage) (any, error) {
+		return api.VersionInfo{EkssmVersion: "test", APIVersions: versions, PID: 42}, nil
+	}
+}
+
+func TestClient(t *testing.T) {
+	var start api.StartRequest
+	path := serve(t, map[string]agent.Method{
+		api.MethodAgentVersion: version("v1"),
+		api.MethodSessionStart: func(_ context.Context, raw json.RawMessage) (any, error) {
+			if err := agent.DecodeParams(raw, &start); err != nil {
+				return nil, err
+			}
+			return api.Session{SessionID: "abc", ClusterName: start.ClusterName, Running: true}, nil
+		},
+		api.MethodSessionDescribe: func(_ context.Context, raw json.RawMessage) (any, error) {
+			var req api.SessionRequest
+			if err := agent.DecodeParams(raw, &req); err != nil {
+				return nil, err
+			}
+			return nil, &agent.Error{Code: api.CodeSessionNotFound, Message: "session with ID '" + req.SessionID + "' not found"}
+		},
+		api.MethodSessionStop: func(_ context.Context, raw json.RawMessage) (any, error) {
+			var req api.StopRequest
+			if err := agent.DecodeParams(raw, &req); err != nil {
+				return nil, err
+			}
+			return api.StopResult{Stopped: []string{req.SessionID}}, nil
+		},
+	})
+	ctx := context.Background()
+	client, err := api.Dial(ctx, path)
+	require.NoError(t, err)
+	defer client.Close()
+
+	ttl := api.Duration(8 * time.Hour)
+	session, err := client.StartSession(ctx, api.StartRequest{ClusterName: "prod", TTL: &ttl})
+	require.NoError(t, err)
+	assert.Equal(t, &api.Session{SessionID: "abc", ClusterName: "prod", Running: true}, session)
+	require.NotNil(t, start.TTL)
+	assert.Equal(t, ttl, *start.TTL)
+
+	_, err = client.DescribeSession(ctx, "missing")
+	assert.True(t, api.IsNotFound(err))
+
+	stopped, err := client.StopSession(ctx, "abc")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"abc"}, stopped)
+}
+
+func TestDialChecksVersion(t *testing.T) {
+	ctx := context.Background()
+
+	path := serve(t, map[string]agent.Method{api.MethodAgentVersion: version("v2")})
+	_, err := api.Dial(ctx, path)
+	assert.ErrorIs(t, err, api.ErrUnsupportedVersion)
+
+	// Agents from before the versioned API do not know agent.version.
+	path = serve(t, nil)
+	_, err = api.Dial(ctx, path)
+	assert.ErrorIs(t, err, api.ErrUnsupportedVersion)
+
+	_, err = api.Dial(ctx, filepath.Join(t.TempDir(), "none.sock"))
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, api.ErrUnsupportedVersion)
+}
+
+func TestDurationJSON(t *testing.T) {
+	data, err := json.Marshal(api.StartRequest{ClusterName: "prod", IdleTimeout: api.Duration(90 * time.Minute)})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"cluster_name":"prod","idle_timeout":"1h30m0s"}`, string(data))
+
+	var req api.StartRequest
+	require.NoError(t, json.Unmarshal([]byte(`{"ttl":"8h","keepalive_interval":"45s"}`), &req))
+	require.NotNil(t, req.TTL)
+	assert.Equal(t, api.Duration(8*time.Hour), *req.TTL)
+	assert.Equal(t, api.Duration(45*time.Second), req.KeepaliveInterval)
+
+	assert.Error(t, json.Unmarshal([]byte(`{"ttl":3600}`), &req))
+	assert.Error(t, json.Unmarshal([]byte(`{"ttl":"soon"}`), &req))
+}
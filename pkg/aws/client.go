@@ -3,11 +3,16 @@ package aws
 import (
 	"context"
 	"fmt"
+	"sync/atomic"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
 	"github.com/aws/aws-sdk-go-v2/service/eks"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/smithy-go/middleware"
 
 	"github.com/cloudopsy/ekssm/internal/logging"
 )
@@ -15,9 +20,46 @@ import (
 type Client struct {
 	EKS    *eks.Client
 	SSM    *ssm.Client
+	ECS    *ecs.Client
 	Region string
 }
 
+// CallObserver is told about every AWS API call made by a Client: the
+// service and operation called, how long the call took including retries,
+// and the error it failed with, if any.
+type CallObserver func(service, operation string, duration time.Duration, err error)
+
+var callObserver atomic.Pointer[CallObserver]
+
+// ObserveCalls makes every Client report its calls to observe; nil stops
+// reporting.
+func ObserveCalls(observe CallObserver) {
+	if observe == nil {
+		callObserver.Store(nil)
+		return
+	}
+	callObserver.Store(&observe)
+}
+
+// observeCalls adds the middleware reporting calls to the CallObserver. It
+// runs after the operation's metadata is set, so it can name the call.
+func observeCalls(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("ekssmObserveCalls", func(
+		ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler,
+	) (middleware.InitializeOutput, middleware.Metadata, error) {
+		observe := callObserver.Load()
+		if observe == nil {
+			return next.HandleInitialize(ctx, in)
+		}
+		start := time.Now()
+		out, metadata, err := next.HandleInitialize(ctx, in)
+		(*observe)(awsmiddleware.GetServiceID(ctx), awsmiddleware.GetOperationName(ctx), time.Since(start), err)
+		return out, metadata, err
+	}), middleware.After)
+}
+
+// NewClient returns a Client using the default AWS configuration: the
+// environment, shared config files and instance roles.
 func NewClient(ctx context.Context) (*Client, error) {
 	logging.Debug("Initializing AWS client")
 
@@ -25,12 +67,20 @@ func NewClient(ctx context.Context) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
+	return NewClientFromConfig(cfg), nil
+}
 
+// NewClientFromConfig returns a Client using cfg, such as a configuration a
+// program embedding ekssm loaded with its own credentials.
+func NewClientFromConfig(cfg aws.Config) *Client {
+	// Append to a copy, so cfg's own APIOptions are left alone.
+	cfg.APIOptions = append(append([]func(*middleware.Stack) error(nil), cfg.APIOptions...), observeCalls)
 	return &Client{
 		EKS:    eks.NewFromConfig(cfg),
 		SSM:    ssm.NewFromConfig(cfg),
+		ECS:    ecs.NewFromConfig(cfg),
 		Region: cfg.Region,
-	}, nil
+	}
 }
 
 func (c *Client) DescribeEKSCluster(ctx context.Context, clusterName string) (*eks.DescribeClusterOutput, error) {
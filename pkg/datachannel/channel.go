@@ -0,0 +1,530 @@
+package datachannel
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/cloudopsy/ekssm/internal/logging"
+	"github.com/cloudopsy/ekssm/internal/websocket"
+)
+
+const (
+	// ClientVersion is reported to the agent during the handshake. Agents
+	// switch port sessions to smux-multiplexed streams for clients at 1.1.70 or
+	// later, which lets one session carry concurrent connections.
+	ClientVersion = "1.1.70.0"
+
+	// MultiplexingAgentVersion is the first agent version that multiplexes
+	// port sessions. Older agents stay on the basic protocol, which carries one
+	// connection at a time.
+	MultiplexingAgentVersion = "3.0.196.0"
+
+	messageSchemaVersion = "1.0"
+	schemaVersion        = 1
+
+	// StreamDataPayloadSize is the largest payload sent in a single message.
+	StreamDataPayloadSize = 1024
+
+	acknowledgeFlags      = 3
+	outgoingBufferSize    = 10000
+	incomingBufferSize    = 10000
+	outputQueueSize       = 256
+	resendCheckInterval   = 100 * time.Millisecond
+	retransmissionTimeout = 1 * time.Second
+	maxResendAttempts     = 60
+	pingInterval          = 5 * time.Minute
+)
+
+// ErrChannelClosed is returned once the channel has been closed locally.
+var ErrChannelClosed = errors.New("data channel closed")
+
+type pendingMessage struct {
+	data     []byte
+	sentAt   time.Time
+	attempts int
+}
+
+// Channel is an open data channel to an SSM agent.
+type Channel struct {
+	ws       *websocket.Conn
+	clientID string
+
+	mu           sync.Mutex
+	nextSequence int64
+	unacked      map[int64]*pendingMessage
+	agentVersion string
+	sessionType  string
+
+	// Only touched by the read loop.
+	expectedSequence int64
+	incoming         map[int64]*Message
+
+	ready     chan struct{}
+	readyOnce sync.Once
+	output    chan []byte
+	flags     chan PortFlag
+
+	// Only touched by Read.
+	readMu  sync.Mutex
+	pending []byte
+
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// Open connects to the stream URL returned by SSM StartSession, authenticates
+// with the session token and waits for the agent to complete the handshake.
+func Open(ctx context.Context, streamURL, token string) (*Channel, error) {
+	logging.Debugf("Opening SSM data channel")
+
+	ws, err := websocket.Dial(ctx, streamURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SSM data channel: %w", err)
+	}
+
+	c := &Channel{
+		ws:       ws,
+		clientID: uuid.NewString(),
+		unacked:  make(map[int64]*pendingMessage),
+		incoming: make(map[int64]*Message),
+		ready:    make(chan struct{}),
+		output:   make(chan []byte, outputQueueSize),
+		flags:    make(chan PortFlag, 16),
+		done:     make(chan struct{}),
+	}
+
+	openInput, err := json.Marshal(OpenDataChannelInput{
+		MessageSchemaVersion: messageSchemaVersion,
+		RequestID:            uuid.NewString(),
+		TokenValue:           token,
+		ClientID:             c.clientID,
+		ClientVersion:        ClientVersion,
+	})
+	if err != nil {
+		ws.Close()
+		return nil, fmt.Errorf("failed to marshal open data channel input: %w", err)
+	}
+	if err := ws.WriteMessage(websocket.TextMessage, openInput); err != nil {
+		ws.Close()
+		return nil, fmt.Errorf("failed to send data channel token: %w", err)
+	}
+
+	go c.readLoop()
+	go c.maintain()
+
+	select {
+	case <-c.ready:
+		logging.Debugf("SSM data channel handshake complete (agent version %s)", c.AgentVersion())
+		return c, nil
+	case <-c.done:
+		return nil, fmt.Errorf("data channel closed during handshake: %w", c.Err())
+	case <-ctx.Done():
+		c.Close()
+		return nil, fmt.Errorf("data channel handshake aborted: %w", ctx.Err())
+	}
+}
+
+// Output delivers the stream data received from the agent, in order.
+func (c *Channel) Output() <-chan []byte {
+	return c.output
+}
+
+// Read reads stream data received from the agent, making the channel usable
+// as an io.Reader. It consumes the same data as Output, so a caller must use
+// one or the other.
+func (c *Channel) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if len(c.pending) == 0 {
+		select {
+		case data := <-c.output:
+			c.pending = data
+		case <-c.done:
+			// Deliver anything that arrived before the channel closed.
+			select {
+			case data := <-c.output:
+				c.pending = data
+			default:
+				return 0, c.err
+			}
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Flags delivers the port flags received from the agent.
+func (c *Channel) Flags() <-chan PortFlag {
+	return c.flags
+}
+
+// Done is closed when the channel stops, either locally or because the agent
+// or the network closed it.
+func (c *Channel) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the reason the channel stopped, or nil while it is open.
+func (c *Channel) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// AgentVersion returns the SSM agent version reported in the handshake.
+func (c *Channel) AgentVersion() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.agentVersion
+}
+
+// SessionType returns the session type requested by the agent, e.g. "Port".
+func (c *Channel) SessionType() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sessionType
+}
+
+// Multiplexed reports whether the agent carries the port session as smux
+// streams rather than a single raw connection.
+func (c *Channel) Multiplexed() bool {
+	return c.SessionType() == "Port" && CompareVersions(c.AgentVersion(), MultiplexingAgentVersion) >= 0
+}
+
+// Write sends p to the agent as stream data, split into protocol-sized chunks.
+func (c *Channel) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > StreamDataPayloadSize {
+			chunk = chunk[:StreamDataPayloadSize]
+		}
+		if err := c.sendStream(Output, chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// SendFlag sends a port flag such as DisconnectToPort to the agent.
+func (c *Channel) SendFlag(flag PortFlag) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(flag))
+	return c.sendStream(Flag, payload)
+}
+
+// Close closes the websocket. It does not terminate the SSM session itself;
+// that is done through the TerminateSession API.
+func (c *Channel) Close() error {
+	c.fail(ErrChannelClosed)
+	return nil
+}
+
+func (c *Channel) fail(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		close(c.done)
+		_ = c.ws.Close()
+	})
+}
+
+func (c *Channel) sendStream(payloadType PayloadType, payload []byte) error {
+	for {
+		select {
+		case <-c.done:
+			return c.err
+		default:
+		}
+
+		c.mu.Lock()
+		if len(c.unacked) < outgoingBufferSize {
+			break
+		}
+		c.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer c.mu.Unlock()
+
+	msg := &Message{
+		MessageType:    InputStreamMessage,
+		SchemaVersion:  schemaVersion,
+		CreatedDate:    time.Now(),
+		SequenceNumber: c.nextSequence,
+		MessageID:      uuid.New(),
+		PayloadType:    payloadType,
+		Payload:        payload,
+	}
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("failed to marshal stream message: %w", err)
+	}
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		c.fail(fmt.Errorf("failed to send stream message: %w", err))
+		return c.err
+	}
+
+	c.unacked[c.nextSequence] = &pendingMessage{data: data, sentAt: time.Now()}
+	c.nextSequence++
+	return nil
+}
+
+func (c *Channel) acknowledge(msg *Message) error {
+	content, err := json.Marshal(AcknowledgeContent{
+		MessageType:         msg.MessageType,
+		MessageID:           msg.MessageID.String(),
+		SequenceNumber:      msg.SequenceNumber,
+		IsSequentialMessage: true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal acknowledge content: %w", err)
+	}
+
+	ack := &Message{
+		MessageType:   AcknowledgeMessage,
+		SchemaVersion: schemaVersion,
+		CreatedDate:   time.Now(),
+		Flags:         acknowledgeFlags,
+		MessageID:     uuid.New(),
+		Payload:       content,
+	}
+	data, err := ack.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("failed to marshal acknowledge message: %w", err)
+	}
+	return c.ws.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func (c *Channel) readLoop() {
+	for {
+		_, data, err := c.ws.ReadMessage()
+		if err != nil {
+			c.fail(fmt.Errorf("data channel connection lost: %w", err))
+			return
+		}
+
+		msg := &Message{}
+		if err := msg.UnmarshalBinary(data); err != nil {
+			logging.Warnf("Ignoring malformed data channel message: %v", err)
+			continue
+		}
+
+		if err := c.handleMessage(msg); err != nil {
+			c.fail(err)
+			return
+		}
+	}
+}
+
+func (c *Channel) handleMessage(msg *Message) error {
+	switch msg.MessageType {
+	case OutputStreamMessage:
+		return c.handleOutputStream(msg)
+	case AcknowledgeMessage:
+		var content AcknowledgeContent
+		if err := json.Unmarshal(msg.Payload, &content); err != nil {
+			logging.Warnf("Ignoring malformed acknowledge message: %v", err)
+			return nil
+		}
+		c.mu.Lock()
+		delete(c.unacked, content.SequenceNumber)
+		c.mu.Unlock()
+	case ChannelClosedMessage:
+		var closed ChannelClosed
+		if err := json.Unmarshal(msg.Payload, &closed); err == nil && closed.Output != "" {
+			return fmt.Errorf("SSM session closed by agent: %s", closed.Output)
+		}
+		return fmt.Errorf("SSM session closed by agent")
+	case StartPublicationMessage, PausePublicationMessage:
+		logging.Debugf("Received %s message", msg.MessageType)
+	default:
+		logging.Debugf("Ignoring data channel message of type %q", msg.MessageType)
+	}
+	return nil
+}
+
+// handleOutputStream acknowledges stream data and processes it strictly in
+// sequence order, buffering messages that arrive early and dropping duplicates.
+func (c *Channel) handleOutputStream(msg *Message) error {
+	switch {
+	case msg.SequenceNumber < c.expectedSequence:
+		return c.acknowledge(msg)
+	case msg.SequenceNumber > c.expectedSequence:
+		if len(c.incoming) >= incomingBufferSize {
+			return nil
+		}
+		c.incoming[msg.SequenceNumber] = msg
+		return c.acknowledge(msg)
+	}
+
+	if err := c.acknowledge(msg); err != nil {
+		return err
+	}
+	if err := c.process(msg); err != nil {
+		return err
+	}
+	c.expectedSequence++
+
+	for {
+		next, ok := c.incoming[c.expectedSequence]
+		if !ok {
+			return nil
+		}
+		delete(c.incoming, c.expectedSequence)
+		if err := c.process(next); err != nil {
+			return err
+		}
+		c.expectedSequence++
+	}
+}
+
+func (c *Channel) process(msg *Message) error {
+	switch msg.PayloadType {
+	case HandshakeRequest:
+		return c.handleHandshakeRequest(msg)
+	case HandshakeComplete:
+		var complete HandshakeCompletePayload
+		if err := json.Unmarshal(msg.Payload, &complete); err != nil {
+			return fmt.Errorf("failed to parse handshake complete payload: %w", err)
+		}
+		if complete.CustomerMessage != "" {
+			logging.Info(complete.CustomerMessage)
+		}
+		c.readyOnce.Do(func() { close(c.ready) })
+	case EncChallengeRequest:
+		return fmt.Errorf("KMS-encrypted sessions are not supported by the built-in SSM client")
+	case Output:
+		select {
+		case c.output <- msg.Payload:
+		case <-c.done:
+		}
+	case Flag:
+		if len(msg.Payload) < 4 {
+			logging.Warnf("Ignoring short flag payload of %d bytes", len(msg.Payload))
+			return nil
+		}
+		select {
+		case c.flags <- PortFlag(binary.BigEndian.Uint32(msg.Payload)):
+		case <-c.done:
+		}
+	default:
+		logging.Debugf("Ignoring stream payload of type %d", msg.PayloadType)
+	}
+	return nil
+}
+
+func (c *Channel) handleHandshakeRequest(msg *Message) error {
+	var request HandshakeRequestPayload
+	if err := json.Unmarshal(msg.Payload, &request); err != nil {
+		return fmt.Errorf("failed to parse handshake request: %w", err)
+	}
+
+	c.mu.Lock()
+	c.agentVersion = request.AgentVersion
+	c.mu.Unlock()
+
+	response := HandshakeResponsePayload{
+		ClientVersion:          ClientVersion,
+		ProcessedClientActions: []ProcessedClientAction{},
+		Errors:                 []string{},
+	}
+
+	var unsupported error
+	for _, action := range request.RequestedClientActions {
+		processed := ProcessedClientAction{ActionType: action.ActionType}
+		switch action.ActionType {
+		case ActionSessionType:
+			var sessionType SessionTypeRequest
+			if err := json.Unmarshal(action.ActionParameters, &sessionType); err != nil {
+				processed.ActionStatus = ActionFailed
+				processed.Error = fmt.Sprintf("Failed to process action %s: %v", action.ActionType, err)
+			} else {
+				c.mu.Lock()
+				c.sessionType = sessionType.SessionType
+				c.mu.Unlock()
+				processed.ActionStatus = ActionSuccess
+			}
+		case ActionKMSEncryption:
+			processed.ActionStatus = ActionFailed
+			processed.Error = "KMS encryption is not supported by this client"
+			unsupported = fmt.Errorf("the SSM session requires KMS encryption, which the built-in SSM client does not support; use the session-manager-plugin backend instead")
+		default:
+			processed.ActionStatus = ActionUnsupported
+			processed.Error = fmt.Sprintf("Unsupported action %s", action.ActionType)
+		}
+		if processed.Error != "" {
+			response.Errors = append(response.Errors, processed.Error)
+		}
+		response.ProcessedClientActions = append(response.ProcessedClientActions, processed)
+	}
+
+	payload, err := json.Marshal(response)
+	if err != nil {
+		return fmt.Errorf("failed to marshal handshake response: %w", err)
+	}
+	if err := c.sendStream(HandshakeResponse, payload); err != nil {
+		return err
+	}
+	return unsupported
+}
+
+// maintain retransmits unacknowledged messages and keeps the websocket alive.
+func (c *Channel) maintain() {
+	resend := time.NewTicker(resendCheckInterval)
+	defer resend.Stop()
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ping.C:
+			if err := c.ws.Ping([]byte("keepalive")); err != nil {
+				c.fail(fmt.Errorf("failed to ping data channel: %w", err))
+				return
+			}
+		case <-resend.C:
+			if err := c.resendUnacknowledged(); err != nil {
+				c.fail(err)
+				return
+			}
+		}
+	}
+}
+
+func (c *Channel) resendUnacknowledged() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for sequence, pending := range c.unacked {
+		if now.Sub(pending.sentAt) < retransmissionTimeout {
+			continue
+		}
+		if pending.attempts >= maxResendAttempts {
+			return fmt.Errorf("message %d was not acknowledged after %d attempts", sequence, pending.attempts)
+		}
+		pending.attempts++
+		pending.sentAt = now
+		logging.Debugf("Resending stream message %d (attempt %d)", sequence, pending.attempts)
+		if err := c.ws.WriteMessage(websocket.BinaryMessage, pending.data); err != nil {
+			return fmt.Errorf("failed to resend stream message %d: %w", sequence, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package datachannel_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudopsy/ekssm/internal/ssmtest"
+	"github.com/cloudopsy/ekssm/pkg/datachannel"
+)
+
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// newBasicAgent starts a stand-in agent that does not multiplex, so stream
+// data is forwarded to target as-is.
+func newBasicAgent(t *testing.T, target string) *ssmtest.Agent {
+	agent := ssmtest.NewAgent(t, target)
+	agent.AgentVersion = ssmtest.BasicAgentVersion
+	return agent
+}
+
+func openChannel(t *testing.T, agent *ssmtest.Agent) *datachannel.Channel {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	channel, err := datachannel.Open(ctx, agent.StreamURL(), ssmtest.Token)
+	require.NoError(t, err)
+	t.Cleanup(func() { channel.Close() })
+	return channel
+}
+
+func readOutput(t *testing.T, channel *datachannel.Channel, size int) []byte {
+	t.Helper()
+	var received []byte
+	timeout := time.After(5 * time.Second)
+	for len(received) < size {
+		select {
+		case data := <-channel.Output():
+			received = append(received, data...)
+		case <-timeout:
+			t.Fatalf("timed out after receiving %d of %d bytes", len(received), size)
+		}
+	}
+	return received
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	original := &datachannel.Message{
+		MessageType:    datachannel.InputStreamMessage,
+		SchemaVersion:  1,
+		CreatedDate:    time.UnixMilli(1700000000123),
+		SequenceNumber: 42,
+		Flags:          1,
+		MessageID:      uuid.New(),
+		PayloadType:    datachannel.Output,
+		Payload:        []byte("hello"),
+	}
+
+	data, err := original.MarshalBinary()
+	require.NoError(t, err)
+	assert.Len(t, data, 120+len(original.Payload))
+
+	decoded := &datachannel.Message{}
+	require.NoError(t, decoded.UnmarshalBinary(data))
+	assert.Equal(t, original.MessageType, decoded.MessageType)
+	assert.Equal(t, original.SequenceNumber, decoded.SequenceNumber)
+	assert.Equal(t, original.MessageID, decoded.MessageID)
+	assert.Equal(t, original.PayloadType, decoded.PayloadType)
+	assert.Equal(t, original.Payload, decoded.Payload)
+	assert.True(t, original.CreatedDate.Equal(decoded.CreatedDate))
+
+	// Corrupting the payload must be caught by the digest check.
+	data[len(data)-1] ^= 0xff
+	assert.Error(t, decoded.UnmarshalBinary(data))
+}
+
+func TestChannelHandshakeAndStreamData(t *testing.T) {
+	agent := newBasicAgent(t, startEchoServer(t))
+	channel := openChannel(t, agent)
+
+	assert.True(t, agent.HandshakeCompleted())
+	assert.Equal(t, "Port", channel.SessionType())
+	assert.Equal(t, ssmtest.BasicAgentVersion, channel.AgentVersion())
+	assert.False(t, channel.Multiplexed())
+
+	payload := make([]byte, 3*datachannel.StreamDataPayloadSize+17)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	n, err := channel.Write(payload)
+	require.NoError(t, err)
+	assert.Equal(t, len(payload), n)
+
+	assert.Equal(t, payload, readOutput(t, channel, len(payload)))
+
+	// Sequence 0 (handshake request) and 1 (handshake complete) must have been acknowledged.
+	assert.Eventually(t, func() bool { return agent.Acknowledged(0) && agent.Acknowledged(1) }, time.Second, 10*time.Millisecond)
+}
+
+func TestChannelDropsDuplicateOutput(t *testing.T) {
+	agent := newBasicAgent(t, startEchoServer(t))
+	agent.DuplicateOutput = true
+	channel := openChannel(t, agent)
+
+	_, err := channel.Write([]byte("once"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("once"), readOutput(t, channel, 4))
+
+	select {
+	case data := <-channel.Output():
+		t.Fatalf("received duplicate output %q", data)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestChannelRetransmitsUnacknowledgedInput(t *testing.T) {
+	agent := newBasicAgent(t, startEchoServer(t))
+	agent.DropFirstInput = true
+	channel := openChannel(t, agent)
+
+	_, err := channel.Write([]byte("first"))
+	require.NoError(t, err)
+	_, err = channel.Write([]byte("second"))
+	require.NoError(t, err)
+
+	assert.Equal(t, []byte("firstsecond"), readOutput(t, channel, len("firstsecond")))
+}
+
+func TestChannelMultiplexedWithNewAgents(t *testing.T) {
+	channel := openChannel(t, ssmtest.NewAgent(t, startEchoServer(t)))
+	assert.True(t, channel.Multiplexed())
+}
+
+func TestCompareVersions(t *testing.T) {
+	assert.Equal(t, 0, datachannel.CompareVersions("3.0.196.0", "3.0.196.0"))
+	assert.Equal(t, -1, datachannel.CompareVersions("3.0.161.0", "3.0.196.0"))
+	assert.Equal(t, 1, datachannel.CompareVersions("3.10.0.0", "3.9.0.0"))
+	assert.Equal(t, 0, datachannel.CompareVersions("1.1.70", "1.1.70.0"))
+}
@@ -0,0 +1,248 @@
+// Package datachannel implements the client side of the SSM Session Manager
+// data channel protocol: the binary message framing, the open/handshake
+// exchange, sequence numbering, acknowledgements and retransmission.
+package datachannel
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Message types carried in the MessageType header field.
+const (
+	InputStreamMessage      = "input_stream_data"
+	OutputStreamMessage     = "output_stream_data"
+	AcknowledgeMessage      = "acknowledge"
+	ChannelClosedMessage    = "channel_closed"
+	StartPublicationMessage = "start_publication"
+	PausePublicationMessage = "pause_publication"
+)
+
+// PayloadType identifies how the payload of a stream message is interpreted.
+type PayloadType uint32
+
+const (
+	Output               PayloadType = 1
+	Error                PayloadType = 2
+	Size                 PayloadType = 3
+	Parameter            PayloadType = 4
+	HandshakeRequest     PayloadType = 5
+	HandshakeResponse    PayloadType = 6
+	HandshakeComplete    PayloadType = 7
+	EncChallengeRequest  PayloadType = 8
+	EncChallengeResponse PayloadType = 9
+	Flag                 PayloadType = 10
+	StdErr               PayloadType = 11
+	ExitCode             PayloadType = 12
+)
+
+// PortFlag is the payload of a Flag message in a port forwarding session.
+type PortFlag uint32
+
+const (
+	DisconnectToPort   PortFlag = 1
+	TerminateSession   PortFlag = 2
+	ConnectToPortError PortFlag = 3
+)
+
+// Binary layout of a message header. All integers are big endian and the
+// header length field holds the offset of the payload length field.
+const (
+	messageTypeLength   = 32
+	headerLengthOffset  = 0
+	messageTypeOffset   = 4
+	schemaVersionOffset = messageTypeOffset + messageTypeLength
+	createdDateOffset   = schemaVersionOffset + 4
+	sequenceOffset      = createdDateOffset + 8
+	flagsOffset         = sequenceOffset + 8
+	messageIDOffset     = flagsOffset + 8
+	payloadDigestOffset = messageIDOffset + 16
+	payloadTypeOffset   = payloadDigestOffset + sha256.Size
+	payloadLengthOffset = payloadTypeOffset + 4
+	payloadOffset       = payloadLengthOffset + 4
+)
+
+// Message is a single data channel message.
+type Message struct {
+	MessageType    string
+	SchemaVersion  uint32
+	CreatedDate    time.Time
+	SequenceNumber int64
+	Flags          uint64
+	MessageID      uuid.UUID
+	PayloadType    PayloadType
+	Payload        []byte
+}
+
+// MarshalBinary encodes the message in the wire format used by the SSM message gateway.
+func (m *Message) MarshalBinary() ([]byte, error) {
+	if len(m.MessageType) > messageTypeLength {
+		return nil, fmt.Errorf("message type %q exceeds %d bytes", m.MessageType, messageTypeLength)
+	}
+
+	buf := make([]byte, payloadOffset+len(m.Payload))
+	binary.BigEndian.PutUint32(buf[headerLengthOffset:], payloadLengthOffset)
+	copy(buf[messageTypeOffset:], m.MessageType)
+	for i := messageTypeOffset + len(m.MessageType); i < schemaVersionOffset; i++ {
+		buf[i] = ' '
+	}
+	binary.BigEndian.PutUint32(buf[schemaVersionOffset:], m.SchemaVersion)
+	binary.BigEndian.PutUint64(buf[createdDateOffset:], uint64(m.CreatedDate.UnixMilli()))
+	binary.BigEndian.PutUint64(buf[sequenceOffset:], uint64(m.SequenceNumber))
+	binary.BigEndian.PutUint64(buf[flagsOffset:], m.Flags)
+
+	// The gateway stores UUIDs as two longs, least significant half first.
+	copy(buf[messageIDOffset:], m.MessageID[8:16])
+	copy(buf[messageIDOffset+8:], m.MessageID[0:8])
+
+	digest := sha256.Sum256(m.Payload)
+	copy(buf[payloadDigestOffset:], digest[:])
+	binary.BigEndian.PutUint32(buf[payloadTypeOffset:], uint32(m.PayloadType))
+	binary.BigEndian.PutUint32(buf[payloadLengthOffset:], uint32(len(m.Payload)))
+	copy(buf[payloadOffset:], m.Payload)
+
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a message and verifies its payload digest.
+func (m *Message) UnmarshalBinary(data []byte) error {
+	if len(data) < payloadOffset {
+		return fmt.Errorf("message too short: %d bytes", len(data))
+	}
+
+	headerLength := binary.BigEndian.Uint32(data[headerLengthOffset:])
+	if headerLength != payloadLengthOffset {
+		return fmt.Errorf("unexpected header length %d", headerLength)
+	}
+
+	payloadLength := binary.BigEndian.Uint32(data[payloadLengthOffset:])
+	if int(payloadLength) > len(data)-payloadOffset {
+		return fmt.Errorf("payload length %d exceeds message size", payloadLength)
+	}
+	payload := data[payloadOffset : payloadOffset+int(payloadLength)]
+
+	digest := sha256.Sum256(payload)
+	if !bytes.Equal(digest[:], data[payloadDigestOffset:payloadTypeOffset]) {
+		return fmt.Errorf("payload digest mismatch")
+	}
+
+	m.MessageType = strings.TrimRight(string(data[messageTypeOffset:schemaVersionOffset]), " \x00")
+	m.SchemaVersion = binary.BigEndian.Uint32(data[schemaVersionOffset:])
+	m.CreatedDate = time.UnixMilli(int64(binary.BigEndian.Uint64(data[createdDateOffset:])))
+	m.SequenceNumber = int64(binary.BigEndian.Uint64(data[sequenceOffset:]))
+	m.Flags = binary.BigEndian.Uint64(data[flagsOffset:])
+	copy(m.MessageID[8:16], data[messageIDOffset:messageIDOffset+8])
+	copy(m.MessageID[0:8], data[messageIDOffset+8:payloadDigestOffset])
+	m.PayloadType = PayloadType(binary.BigEndian.Uint32(data[payloadTypeOffset:]))
+	m.Payload = append([]byte(nil), payload...)
+
+	return nil
+}
+
+// OpenDataChannelInput is the first (text) frame sent on a new data channel.
+type OpenDataChannelInput struct {
+	MessageSchemaVersion string `json:"MessageSchemaVersion"`
+	RequestID            string `json:"RequestId"`
+	TokenValue           string `json:"TokenValue"`
+	ClientID             string `json:"ClientId"`
+	ClientVersion        string `json:"ClientVersion"`
+}
+
+// AcknowledgeContent is the payload of an acknowledge message.
+type AcknowledgeContent struct {
+	MessageType         string `json:"AcknowledgedMessageType"`
+	MessageID           string `json:"AcknowledgedMessageId"`
+	SequenceNumber      int64  `json:"AcknowledgedMessageSequenceNumber"`
+	IsSequentialMessage bool   `json:"IsSequentialMessage"`
+}
+
+// ChannelClosed is the payload of a channel_closed message.
+type ChannelClosed struct {
+	MessageID     string `json:"MessageId"`
+	CreatedDate   string `json:"CreatedDate"`
+	DestinationID string `json:"DestinationId"`
+	SessionID     string `json:"SessionId"`
+	MessageType   string `json:"MessageType"`
+	SchemaVersion int    `json:"SchemaVersion"`
+	Output        string `json:"Output"`
+}
+
+// Handshake action types and statuses.
+const (
+	ActionKMSEncryption = "KMSEncryption"
+	ActionSessionType   = "SessionType"
+
+	ActionSuccess     = 1
+	ActionFailed      = 2
+	ActionUnsupported = 3
+)
+
+// HandshakeRequestPayload is sent by the agent once the channel is open.
+type HandshakeRequestPayload struct {
+	AgentVersion           string                  `json:"AgentVersion"`
+	RequestedClientActions []RequestedClientAction `json:"RequestedClientActions"`
+}
+
+// RequestedClientAction is a single action the agent asks the client to perform.
+type RequestedClientAction struct {
+	ActionType       string          `json:"ActionType"`
+	ActionParameters json.RawMessage `json:"ActionParameters"`
+}
+
+// SessionTypeRequest holds the parameters of a SessionType action.
+type SessionTypeRequest struct {
+	SessionType string          `json:"SessionType"`
+	Properties  json.RawMessage `json:"Properties"`
+}
+
+// ProcessedClientAction reports the outcome of a requested action.
+type ProcessedClientAction struct {
+	ActionType   string      `json:"ActionType"`
+	ActionStatus int         `json:"ActionStatus"`
+	ActionResult interface{} `json:"ActionResult"`
+	Error        string      `json:"Error"`
+}
+
+// HandshakeResponsePayload is the client's answer to a handshake request.
+type HandshakeResponsePayload struct {
+	ClientVersion          string                  `json:"ClientVersion"`
+	ProcessedClientActions []ProcessedClientAction `json:"ProcessedClientActions"`
+	Errors                 []string                `json:"Errors"`
+}
+
+// HandshakeCompletePayload is sent by the agent when the session is ready.
+type HandshakeCompletePayload struct {
+	HandshakeTimeToComplete time.Duration `json:"HandshakeTimeToComplete"`
+	CustomerMessage         string        `json:"CustomerMessage"`
+}
+
+// CompareVersions compares dotted version strings such as "3.0.196.0"
+// numerically, returning -1, 0 or 1. Missing or non-numeric components count
+// as zero.
+func CompareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,289 @@
+// Package ekssm opens tunnels to private EKS API servers through SSM
+// bastions in-process, for Go programs that need cluster access without
+// running the ekssm command. The ekssm command is built on it.
+//
+//	session, err := ekssm.Open(ctx, ekssm.Options{
+//		ClusterName: "prod",
+//		Targets:     []string{"i-0123456789abcdef0"},
+//		AWSConfig:   &cfg,
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	defer session.Close()
+//	endpoint := session.RESTConfigEndpoint()
+package ekssm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"go.uber.org/zap"
+
+	"github.com/cloudopsy/ekssm/internal/config"
+	"github.com/cloudopsy/ekssm/internal/logging"
+	"github.com/cloudopsy/ekssm/internal/util"
+	awsclient "github.com/cloudopsy/ekssm/pkg/aws"
+	"github.com/cloudopsy/ekssm/pkg/proxy"
+)
+
+// Options configure a session. ClusterName is always required. The plugin and
+// ssm backends also need bastions: Targets or BastionTag, or, with
+// UserConfig, the cluster's defaults from the ekssm config file. The direct
+// backend needs none.
+type Options struct {
+	ClusterName string
+	// Targets are the bastions to fail over across, in order, in any form
+	// proxy.ValidateTarget accepts.
+	Targets []string
+	// BastionTag, as key=value, discovers the bastions instead of Targets.
+	BastionTag string
+	// Backend is proxy.BackendPlugin, proxy.BackendSSM or
+	// proxy.BackendDirect; the default is proxy.DefaultBackend.
+	Backend string
+	// LocalPort is the port the EKS API server is served on locally; empty
+	// or "0" picks a free one.
+	LocalPort string
+	// Document and DocumentParams start the SSM sessions with a document
+	// other than proxy.PortForwardingDocument.
+	Document       string
+	DocumentParams map[string]string
+
+	// UserConfig applies the defaults for the cluster from the user's
+	// ekssm config file, as the ekssm command does.
+	UserConfig bool
+	// AWSConfig is the AWS configuration to call AWS with. The default AWS
+	// configuration is loaded when it is nil.
+	AWSConfig *aws.Config
+	// Logger receives ekssm's logs. ekssm has a single, process-wide
+	// logger: setting Logger replaces it for good, for every session in the
+	// process and for any other use of ekssm's packages, and Close does not
+	// restore it. Leave it nil to keep the current logger.
+	Logger *zap.Logger
+	// KubeconfigPath, when set, is where Open writes the session's
+	// kubeconfig. Close removes it.
+	KubeconfigPath string
+	// OnDisconnect is called when the session's tunnel is found to be down,
+	// and OnReconnect once it has been re-established.
+	OnDisconnect func(err error)
+	OnReconnect  func()
+}
+
+// Target is everything a session needs to reach a cluster, resolved from
+// Options by looking the cluster and bastions up in AWS.
+type Target struct {
+	ClusterName string
+	Backend     string
+	Bastions    *proxy.Bastions
+	Document    proxy.Document
+	// Host is the EKS API server hostname, without scheme.
+	Host string
+	// CAData is the base64 encoded cluster CA bundle.
+	CAData    string
+	LocalPort string
+	// AWS is the client the session calls AWS with.
+	AWS *awsclient.Client
+}
+
+// Resolve validates opts and resolves the cluster, bastions, SSM document and
+// local port of a session without starting anything.
+func Resolve(ctx context.Context, opts Options) (*Target, error) {
+	if opts.Logger != nil {
+		logging.SetLogger(opts.Logger)
+	}
+	if opts.ClusterName == "" {
+		return nil, fmt.Errorf("ClusterName is required")
+	}
+
+	backend := opts.Backend
+	if backend == "" {
+		backend = proxy.DefaultBackend
+	}
+	if err := proxy.ValidateBackend(backend); err != nil {
+		return nil, err
+	}
+	if err := checkBackend(backend); err != nil {
+		return nil, err
+	}
+
+	cfg, err := opts.config()
+	if err != nil {
+		return nil, err
+	}
+	bastions, err := resolveBastions(cfg, opts.ClusterName, backend, opts.Targets, opts.BastionTag)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := opts.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	bastions.API = client.SSM
+	bastions.ECS = client.ECS
+
+	doc, err := resolveDocument(ctx, cfg, client, opts.ClusterName, backend, opts.Document, opts.DocumentParams)
+	if err != nil {
+		return nil, err
+	}
+
+	cluster, err := client.DescribeEKSCluster(ctx, opts.ClusterName)
+	if err != nil {
+		return nil, err
+	}
+	host := strings.TrimPrefix(*cluster.Cluster.Endpoint, "https://")
+	logging.Debugf("EKS API server endpoint: %s", host)
+
+	localPort := opts.LocalPort
+	if localPort == "" || localPort == "0" {
+		logging.Debug("No local port specified or set to 0, finding an available port...")
+		foundPort, err := util.FindAvailablePort()
+		if err != nil {
+			return nil, fmt.Errorf("failed to find an available local port: %w", err)
+		}
+		localPort = foundPort
+		logging.Infof("Using dynamically allocated local port: %s", localPort)
+	} else {
+		logging.Infof("Using user-specified local port: %s", localPort)
+	}
+
+	return &Target{
+		ClusterName: opts.ClusterName,
+		Backend:     backend,
+		Bastions:    bastions,
+		Document:    doc,
+		Host:        host,
+		CAData:      *cluster.Cluster.CertificateAuthority.Data,
+		LocalPort:   localPort,
+		AWS:         client,
+	}, nil
+}
+
+// ResolveDocument returns the SSM document sessions for opts start with. It
+// is the zero Document for the default one. Options other than the cluster,
+// backend, document, config file and AWS configuration are ignored.
+func ResolveDocument(ctx context.Context, opts Options) (proxy.Document, error) {
+	cfg, err := opts.config()
+	if err != nil {
+		return proxy.Document{}, err
+	}
+	backend := opts.Backend
+	if backend == "" {
+		backend = proxy.DefaultBackend
+	}
+	// Only a custom document needs AWS, so the default configuration is
+	// loaded there if at all.
+	var client *awsclient.Client
+	if opts.AWSConfig != nil {
+		client = awsclient.NewClientFromConfig(*opts.AWSConfig)
+	}
+	return resolveDocument(ctx, cfg, client, opts.ClusterName, backend, opts.Document, opts.DocumentParams)
+}
+
+// config returns the ekssm config whose cluster defaults apply: the user's,
+// or an empty one.
+func (opts Options) config() (*config.Config, error) {
+	if !opts.UserConfig {
+		return &config.Config{}, nil
+	}
+	return config.Load()
+}
+
+// client returns an AWS client for opts.AWSConfig, or for the default AWS
+// configuration.
+func (opts Options) client(ctx context.Context) (*awsclient.Client, error) {
+	if opts.AWSConfig != nil {
+		return awsclient.NewClientFromConfig(*opts.AWSConfig), nil
+	}
+	client, err := awsclient.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AWS client: %w", err)
+	}
+	return client, nil
+}
+
+// checkBackend reports a missing or outdated session-manager-plugin before
+// anything is started for the plugin backend.
+func checkBackend(backend string) error {
+	if backend != proxy.BackendPlugin {
+		return nil
+	}
+	_, err := proxy.CheckPlugin(context.Background())
+	return err
+}
+
+// resolveBastions picks the bastions for a cluster: the given targets or
+// bastion tag, otherwise the cluster's defaults from cfg. It returns an error
+// if the backend needs a bastion and none is set.
+func resolveBastions(cfg *config.Config, clusterName, backend string, targets []string, bastionTag string) (*proxy.Bastions, error) {
+	if len(targets) == 0 && bastionTag == "" {
+		defaults := cfg.Cluster(clusterName)
+		targets = append(append([]string(nil), defaults.InstanceIDs...), defaults.Targets...)
+		bastionTag = defaults.BastionTag
+	}
+
+	for _, target := range targets {
+		if err := proxy.ValidateTarget(target); err != nil {
+			return nil, err
+		}
+	}
+	if bastionTag != "" {
+		if _, _, err := proxy.ParseBastionTag(bastionTag); err != nil {
+			return nil, err
+		}
+	}
+	if len(targets) == 0 && bastionTag == "" && proxy.RequiresInstance(backend) {
+		return nil, fmt.Errorf("--target, --instance-id or --bastion-tag is required for the %s backend (or set a default for cluster %s in %s)", backend, clusterName, config.Path())
+	}
+
+	bastions := proxy.NewBastions(append([]string(nil), targets...))
+	if len(targets) == 0 {
+		bastions.Tag = bastionTag
+	}
+	return bastions, nil
+}
+
+// resolveDocument picks the SSM document sessions start with: name when
+// given, otherwise the cluster's default from cfg, with the configured
+// parameters overridden by params. A document other than the default is
+// checked against SSM before anything is started, with client or, when it is
+// nil, a client for the default AWS configuration.
+func resolveDocument(ctx context.Context, cfg *config.Config, client *awsclient.Client, clusterName, backend, name string, params map[string]string) (proxy.Document, error) {
+	defaults := cfg.Cluster(clusterName)
+	doc := proxy.Document{Name: name, Parameters: params}
+	if doc.Name == "" {
+		doc.Name = defaults.Document
+	}
+	if len(defaults.DocumentParams) > 0 {
+		doc.Parameters = make(map[string]string, len(defaults.DocumentParams)+len(params))
+		for key, value := range defaults.DocumentParams {
+			doc.Parameters[key] = value
+		}
+		for key, value := range params {
+			doc.Parameters[key] = value
+		}
+	}
+
+	if !doc.Custom() {
+		return proxy.Document{}, nil
+	}
+	if !proxy.RequiresInstance(backend) {
+		if name != "" || len(params) > 0 {
+			return proxy.Document{}, fmt.Errorf("--document and --document-param need an SSM backend, not %s", backend)
+		}
+		return proxy.Document{}, nil
+	}
+	if client == nil {
+		var err error
+		if client, err = awsclient.NewClient(ctx); err != nil {
+			return proxy.Document{}, fmt.Errorf("failed to create AWS client: %w", err)
+		}
+	}
+	if err := proxy.ValidateDocument(ctx, client.SSM, doc); err != nil {
+		return proxy.Document{}, err
+	}
+	logging.Debugf("Using SSM document %s", doc)
+	return doc, nil
+}
@@ -0,0 +1,92 @@
+package ekssm_test
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudopsy/ekssm/pkg/ekssm"
+	"github.com/cloudopsy/ekssm/pkg/proxy"
+)
+
+const testCA = "-----BEGIN CERTIFICATE-----\ntest\n-----END CERTIFICATE-----\n"
+
+// fakeEKS serves DescribeCluster for the cluster "prod".
+func fakeEKS(t *testing.T) aws.Config {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/clusters/prod" {
+			http.Error(w, `{"message":"not found"}`, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"cluster":{"name":"prod","endpoint":"https://ABC123.gr7.eu-west-1.eks.amazonaws.com","certificateAuthority":{"data":"` +
+			base64.StdEncoding.EncodeToString([]byte(testCA)) + `"}}}`))
+	}))
+	t.Cleanup(server.Close)
+	return aws.Config{
+		Region:       "eu-west-1",
+		Credentials:  aws.AnonymousCredentials{},
+		BaseEndpoint: aws.String(server.URL),
+	}
+}
+
+func TestOpen(t *testing.T) {
+	cfg := fakeEKS(t)
+	kubeconfigPath := filepath.Join(t.TempDir(), "kubeconfig.yaml")
+
+	session, err := ekssm.Open(context.Background(), ekssm.Options{
+		ClusterName:    "prod",
+		Backend:        proxy.BackendDirect,
+		AWSConfig:      &cfg,
+		KubeconfigPath: kubeconfigPath,
+	})
+	require.NoError(t, err)
+
+	target := session.Target()
+	assert.Equal(t, "ABC123.gr7.eu-west-1.eks.amazonaws.com", target.Host)
+	endpoint := session.RESTConfigEndpoint()
+	assert.Equal(t, "https://localhost:"+target.LocalPort, endpoint.Host)
+	assert.Equal(t, target.Host, endpoint.ServerName)
+	assert.Equal(t, testCA, string(endpoint.CAData))
+
+	written, err := os.ReadFile(kubeconfigPath)
+	require.NoError(t, err)
+	assert.Equal(t, session.Kubeconfig(), written)
+	assert.Contains(t, string(written), "server: "+endpoint.Host)
+	assert.Contains(t, string(written), "tls-server-name: "+target.Host)
+
+	require.NoError(t, session.Close())
+	assert.NoFileExists(t, kubeconfigPath)
+}
+
+func TestResolveErrors(t *testing.T) {
+	cfg := fakeEKS(t)
+	for _, tc := range []struct {
+		name string
+		opts ekssm.Options
+		err  string
+	}{
+		{"no cluster", ekssm.Options{Backend: proxy.BackendSSM}, "ClusterName is required"},
+		{"unknown backend", ekssm.Options{ClusterName: "prod", Backend: "carrier-pigeon"}, "carrier-pigeon"},
+		{"no bastion", ekssm.Options{ClusterName: "prod", Backend: proxy.BackendSSM}, "is required for the ssm backend"},
+		{"invalid target", ekssm.Options{ClusterName: "prod", Backend: proxy.BackendSSM, Targets: []string{"bastion"}}, "bastion"},
+		{"invalid tag", ekssm.Options{ClusterName: "prod", Backend: proxy.BackendSSM, BastionTag: "role"}, "invalid bastion tag"},
+		{"document without SSM", ekssm.Options{ClusterName: "prod", Backend: proxy.BackendDirect, Document: "Logged"}, "need an SSM backend"},
+		{"unknown cluster", ekssm.Options{ClusterName: "staging", Backend: proxy.BackendDirect}, "staging"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.opts.AWSConfig = &cfg
+			_, err := ekssm.Resolve(context.Background(), tc.opts)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.err)
+		})
+	}
+}
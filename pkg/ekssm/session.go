@@ -0,0 +1,129 @@
+package ekssm
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+
+	"github.com/cloudopsy/ekssm/internal/constants"
+	"github.com/cloudopsy/ekssm/internal/logging"
+	"github.com/cloudopsy/ekssm/internal/util"
+	"github.com/cloudopsy/ekssm/pkg/kubectl"
+	"github.com/cloudopsy/ekssm/pkg/proxy"
+)
+
+// Session is an open tunnel to a cluster's API server. Its tunnel reconnects,
+// failing over across the bastions, until the session is closed.
+type Session struct {
+	target         *Target
+	tunnel         *proxy.Supervisor
+	kubeconfig     string
+	kubeconfigPath string
+}
+
+// RESTEndpoint is what a Kubernetes client needs to reach the cluster through
+// a session, such as the Host, TLSClientConfig.ServerName and
+// TLSClientConfig.CAData of a client-go rest.Config.
+type RESTEndpoint struct {
+	// Host is the session's local URL, https://localhost:<port>.
+	Host string
+	// ServerName is the API server's hostname, which its certificate is
+	// verified against.
+	ServerName string
+	// CAData is the PEM encoded cluster CA bundle.
+	CAData []byte
+}
+
+// Open resolves opts, as Resolve does, and opens a session, returning once
+// its tunnel is up. ctx bounds opening only; the session stays open until
+// Close.
+func Open(ctx context.Context, opts Options) (*Session, error) {
+	target, err := Resolve(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return OpenTarget(ctx, target, opts)
+}
+
+// OpenTarget opens a session to target, which Resolve returned for opts, so
+// that the target can be looked at before anything starts.
+func OpenTarget(ctx context.Context, target *Target, opts Options) (*Session, error) {
+	tunnel := proxy.NewSupervisor(func() (proxy.Tunnel, error) {
+		return proxy.NewBastionTunnel(target.Backend, target.Bastions, func(instanceID string) (proxy.Tunnel, error) {
+			tunnel, err := proxy.NewTunnel(target.Backend, instanceID, target.LocalPort, target.Host, constants.EKSApiPort)
+			if err != nil {
+				return nil, err
+			}
+			return proxy.WithDocument(proxy.WithAWS(tunnel, target.AWS), target.Document), nil
+		})
+	})
+	tunnel.OnDisconnect = opts.OnDisconnect
+	if opts.OnReconnect != nil {
+		tunnel.OnReconnect = func(int) { opts.OnReconnect() }
+	}
+	logging.Debug("Starting SSM proxy session...")
+	if err := tunnel.Start(ctx); err != nil {
+		return nil, fmt.Errorf("failed to start SSM proxy: %w", err)
+	}
+	logging.Debug("SSM proxy started successfully.")
+
+	endpoint := fmt.Sprintf("https://localhost:%s", target.LocalPort)
+	s := &Session{
+		target:     target,
+		tunnel:     tunnel,
+		kubeconfig: kubectl.GenerateKubeconfig(target.ClusterName, endpoint, target.CAData, target.Host),
+	}
+	if opts.KubeconfigPath != "" {
+		if err := util.WriteKubeconfig(opts.KubeconfigPath, s.kubeconfig); err != nil {
+			_ = s.Close()
+			return nil, fmt.Errorf("failed to write kubeconfig: %w", err)
+		}
+		s.kubeconfigPath = opts.KubeconfigPath
+		logging.Debugf("Kubeconfig written to %s", s.kubeconfigPath)
+	}
+	return s, nil
+}
+
+// Target returns what the session was resolved to.
+func (s *Session) Target() *Target {
+	return s.target
+}
+
+// Kubeconfig returns a kubeconfig that reaches the cluster through the
+// session. Its user authenticates with an exec plugin running 'aws eks
+// get-token', so the AWS CLI must be installed where it is used.
+func (s *Session) Kubeconfig() []byte {
+	return []byte(s.kubeconfig)
+}
+
+// RESTConfigEndpoint returns where and how to reach the cluster through the
+// session.
+func (s *Session) RESTConfigEndpoint() RESTEndpoint {
+	// Resolve got the CA from EKS, which base64 encodes it.
+	caData, err := base64.StdEncoding.DecodeString(s.target.CAData)
+	if err != nil {
+		logging.Warnf("Invalid certificate authority data for cluster %s: %v", s.target.ClusterName, err)
+	}
+	return RESTEndpoint{
+		Host:       fmt.Sprintf("https://localhost:%s", s.target.LocalPort),
+		ServerName: s.target.Host,
+		CAData:     caData,
+	}
+}
+
+// Close stops the session's tunnel and removes the kubeconfig Open wrote.
+func (s *Session) Close() error {
+	logging.Debug("Stopping SSM proxy session...")
+	err := s.tunnel.Stop()
+	if err != nil {
+		err = fmt.Errorf("failed to stop SSM proxy: %w", err)
+	}
+	if s.kubeconfigPath != "" {
+		logging.Debugf("Removing kubeconfig: %s", s.kubeconfigPath)
+		if removeErr := os.Remove(s.kubeconfigPath); removeErr != nil && !os.IsNotExist(removeErr) && err == nil {
+			err = fmt.Errorf("failed to remove kubeconfig %s: %w", s.kubeconfigPath, removeErr)
+		}
+	}
+	return err
+}
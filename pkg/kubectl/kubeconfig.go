@@ -6,14 +6,39 @@ import (
 	"github.com/cloudopsy/ekssm/internal/logging"
 )
 
-func GenerateKubeconfig(clusterName, endpoint string) string {
+// GenerateKubeconfig generates a kubeconfig for a cluster reached through a
+// local tunnel at endpoint, e.g. https://localhost:9443. The API server
+// certificate is verified against caData (the base64 encoded cluster CA) using
+// serverName, the real EKS endpoint hostname, since the certificate is not
+// issued for localhost.
+func GenerateKubeconfig(clusterName, endpoint, caData, serverName string) string {
+	return generateKubeconfig(clusterName, endpoint, caData, serverName, "")
+}
+
+// GenerateKubeconfigWithProxy generates a kubeconfig whose cluster is reached
+// through proxyURL, e.g. socks5://127.0.0.1:1080. The endpoint is the real
+// EKS endpoint, so the certificate is verified against caData without a
+// server name override.
+func GenerateKubeconfigWithProxy(clusterName, endpoint, caData, proxyURL string) string {
+	return generateKubeconfig(clusterName, endpoint, caData, "", proxyURL)
+}
+
+func generateKubeconfig(clusterName, endpoint, caData, serverName, proxyURL string) string {
 	logging.Debugf("Generating kubeconfig for cluster %s with endpoint %s", clusterName, endpoint)
 
+	extraLines := ""
+	if serverName != "" {
+		extraLines += fmt.Sprintf("\n    tls-server-name: %s", serverName)
+	}
+	if proxyURL != "" {
+		extraLines += fmt.Sprintf("\n    proxy-url: %s", proxyURL)
+	}
+
 	return fmt.Sprintf(`apiVersion: v1
 clusters:
 - cluster:
     server: %s
-    insecure-skip-tls-verify: true
+    certificate-authority-data: %s%s
   name: %s
 contexts:
 - context:
@@ -34,5 +59,5 @@ users:
         - get-token
         - --cluster-name
         - %s
-`, endpoint, clusterName, clusterName, clusterName, clusterName, clusterName)
+`, endpoint, caData, extraLines, clusterName, clusterName, clusterName, clusterName, clusterName)
 }
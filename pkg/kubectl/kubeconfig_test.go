@@ -13,7 +13,7 @@ func TestGenerateKubeconfig(t *testing.T) {
 	expectedEndpoint := "https://localhost:9443"
 
 	// Act
-	kubeconfig := kubectl.GenerateKubeconfig(expectedClusterName, expectedEndpoint)
+	kubeconfig := kubectl.GenerateKubeconfig(expectedClusterName, expectedEndpoint, "Q0EtREFUQQ==", "ABCDEF.gr7.eu-west-1.eks.amazonaws.com")
 
 	// Assert
 	if !strings.Contains(kubeconfig, expectedClusterName) {
@@ -23,4 +23,23 @@ func TestGenerateKubeconfig(t *testing.T) {
 	if !strings.Contains(kubeconfig, expectedEndpoint) {
 		t.Errorf("Expected kubeconfig to contain endpoint %s", expectedEndpoint)
 	}
+
+	if !strings.Contains(kubeconfig, "    certificate-authority-data: Q0EtREFUQQ==\n    tls-server-name: ABCDEF.gr7.eu-west-1.eks.amazonaws.com\n") {
+		t.Errorf("Expected kubeconfig to verify the cluster certificate, got:\n%s", kubeconfig)
+	}
+
+	if strings.Contains(kubeconfig, "insecure-skip-tls-verify") {
+		t.Errorf("Expected kubeconfig not to skip TLS verification")
+	}
+}
+
+func TestGenerateKubeconfigWithProxy(t *testing.T) {
+	kubeconfig := kubectl.GenerateKubeconfigWithProxy("test-cluster", "https://ABCDEF.gr7.eu-west-1.eks.amazonaws.com", "Q0EtREFUQQ==", "socks5://127.0.0.1:1080")
+
+	if !strings.Contains(kubeconfig, "    server: https://ABCDEF.gr7.eu-west-1.eks.amazonaws.com\n    certificate-authority-data: Q0EtREFUQQ==\n    proxy-url: socks5://127.0.0.1:1080\n") {
+		t.Errorf("Expected kubeconfig to contain server and proxy-url, got:\n%s", kubeconfig)
+	}
+	if strings.Contains(kubectl.GenerateKubeconfig("test-cluster", "https://localhost:9443", "Q0EtREFUQQ==", "ABCDEF.gr7.eu-west-1.eks.amazonaws.com"), "proxy-url") {
+		t.Errorf("Expected kubeconfig without proxy to omit proxy-url")
+	}
 }
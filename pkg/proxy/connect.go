@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cloudopsy/ekssm/internal/logging"
+)
+
+// ConnectShim is an HTTP CONNECT proxy on a loopback port that relays every
+// authorised CONNECT request to a tunnel listening on a Unix socket,
+// whatever the requested destination. kubectl cannot dial Unix sockets, but
+// reaches the tunnel through a kubeconfig proxy-url carrying the shim's
+// credentials; other local users, who cannot read the kubeconfig, are refused.
+type ConnectShim struct {
+	LocalPort  string
+	SocketPath string
+	Username   string
+	Password   string
+
+	listener net.Listener
+	ready    chan struct{}
+	done     chan struct{}
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+const (
+	// ConnectShimUser is the user name sessions give their CONNECT shim.
+	ConnectShimUser = "ekssm"
+
+	connectHandshakeTimeout = 10 * time.Second
+)
+
+func NewConnectShim(localPort, socketPath, username, password string) *ConnectShim {
+	return &ConnectShim{
+		LocalPort:  localPort,
+		SocketPath: socketPath,
+		Username:   username,
+		Password:   password,
+		ready:      make(chan struct{}),
+		done:       make(chan struct{}),
+		conns:      make(map[net.Conn]struct{}),
+	}
+}
+
+// ConnectShimURL returns the kubeconfig proxy-url of a shim on localPort,
+// credentials included.
+func ConnectShimURL(localPort, username, password string) string {
+	return fmt.Sprintf("http://%s:%s@%s", username, password, net.JoinHostPort("127.0.0.1", localPort))
+}
+
+func (p *ConnectShim) Start(ctx context.Context) error {
+	if p.SocketPath == "" {
+		return fmt.Errorf("socketPath is required")
+	}
+	if p.Password == "" {
+		return fmt.Errorf("password is required")
+	}
+
+	listener, err := listenLocal(p.LocalPort, "")
+	if err != nil {
+		return err
+	}
+	p.listener = listener
+	logging.Debugf("CONNECT shim listening on %s for %s", p.LocalAddr(), p.SocketPath)
+
+	p.wg.Add(1)
+	go p.serve()
+
+	close(p.ready)
+	return nil
+}
+
+func (p *ConnectShim) Ready() <-chan struct{} {
+	return p.ready
+}
+
+func (p *ConnectShim) Done() <-chan struct{} {
+	return p.done
+}
+
+func (p *ConnectShim) LocalAddr() string {
+	return localAddr(p.LocalPort, "")
+}
+
+// Health reports an error once the shim has stopped. The socket behind it
+// is checked by the tunnel serving it.
+func (p *ConnectShim) Health(ctx context.Context) error {
+	select {
+	case <-p.done:
+		return fmt.Errorf("CONNECT shim stopped")
+	default:
+		return nil
+	}
+}
+
+func (p *ConnectShim) Stop() error {
+	p.stopOnce.Do(func() {
+		if p.listener != nil {
+			_ = p.listener.Close()
+		}
+		p.mu.Lock()
+		for conn := range p.conns {
+			conn.Close()
+		}
+		p.mu.Unlock()
+		p.wg.Wait()
+	})
+	return nil
+}
+
+func (p *ConnectShim) serve() {
+	defer p.wg.Done()
+	defer close(p.done)
+
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logging.Warnf("CONNECT shim stopped accepting connections: %v", err)
+			}
+			return
+		}
+
+		p.mu.Lock()
+		p.conns[conn] = struct{}{}
+		p.mu.Unlock()
+
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			defer func() {
+				p.mu.Lock()
+				delete(p.conns, conn)
+				p.mu.Unlock()
+			}()
+			p.handle(conn)
+		}()
+	}
+}
+
+func (p *ConnectShim) handle(conn net.Conn) {
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(connectHandshakeTimeout))
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		logging.Debugf("CONNECT shim: bad request: %v", err)
+		return
+	}
+
+	if req.Method != http.MethodConnect {
+		_, _ = io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\nConnection: close\r\n\r\n")
+		return
+	}
+	if !p.authorized(req.Header.Get("Proxy-Authorization")) {
+		logging.Warnf("CONNECT shim: refused unauthenticated request from %s", conn.RemoteAddr())
+		_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"ekssm\"\r\nConnection: close\r\n\r\n")
+		return
+	}
+
+	upstream, err := net.DialTimeout("unix", p.SocketPath, connectHandshakeTimeout)
+	if err != nil {
+		logging.Warnf("CONNECT shim: failed to reach %s: %v", p.SocketPath, err)
+		_, _ = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\n\r\n")
+		return
+	}
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		upstream.Close()
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	// Bytes the client sent straight after the request are already buffered.
+	if n := reader.Buffered(); n > 0 {
+		buffered, _ := reader.Peek(n)
+		if _, err := upstream.Write(buffered); err != nil {
+			upstream.Close()
+			return
+		}
+	}
+	pipe(conn, upstream)
+}
+
+func (p *ConnectShim) authorized(header string) bool {
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte(p.Username+":"+p.Password))
+	return subtle.ConstantTimeCompare([]byte(header), []byte(want)) == 1
+}
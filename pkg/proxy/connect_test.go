@@ -0,0 +1,86 @@
+package proxy_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudopsy/ekssm/internal/util"
+	"github.com/cloudopsy/ekssm/pkg/proxy"
+)
+
+func TestConnectShimRelaysToSocketTunnel(t *testing.T) {
+	host, remotePort, err := net.SplitHostPort(startLineServer(t))
+	require.NoError(t, err)
+
+	// Unix socket paths are limited to about 100 bytes, which t.TempDir can exceed.
+	dir, err := os.MkdirTemp("", "ekssm")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socketPath := filepath.Join(dir, "sockets", "session.sock")
+
+	tunnel, err := proxy.NewSocketTunnel(proxy.BackendDirect, "", socketPath, host, remotePort)
+	require.NoError(t, err)
+	require.NoError(t, tunnel.Start(context.Background()))
+	defer tunnel.Stop()
+	assert.Equal(t, socketPath, tunnel.LocalAddr())
+
+	info, err := os.Stat(socketPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	port, err := util.FindAvailablePort()
+	require.NoError(t, err)
+	shim := proxy.NewConnectShim(port, socketPath, proxy.ConnectShimUser, "s3cret")
+	require.NoError(t, shim.Start(context.Background()))
+	defer shim.Stop()
+
+	connect := func(credentials string) (*bufio.Reader, net.Conn, string) {
+		conn, err := net.DialTimeout("tcp", shim.LocalAddr(), time.Second)
+		require.NoError(t, err)
+		require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+		fmt.Fprintf(conn, "CONNECT api.example.com:443 HTTP/1.1\r\nHost: api.example.com:443\r\n")
+		if credentials != "" {
+			fmt.Fprintf(conn, "Proxy-Authorization: Basic %s\r\n", base64.StdEncoding.EncodeToString([]byte(credentials)))
+		}
+		fmt.Fprintf(conn, "\r\n")
+		reader := bufio.NewReader(conn)
+		status, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		return reader, conn, status
+	}
+
+	_, conn, status := connect("")
+	conn.Close()
+	assert.Equal(t, "HTTP/1.1 407 Proxy Authentication Required\r\n", status)
+
+	_, conn, status = connect("ekssm:wrong")
+	conn.Close()
+	assert.Equal(t, "HTTP/1.1 407 Proxy Authentication Required\r\n", status)
+
+	reader, conn, status := connect("ekssm:s3cret")
+	defer conn.Close()
+	assert.Equal(t, "HTTP/1.1 200 Connection Established\r\n", status)
+	blank, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "\r\n", blank)
+
+	fmt.Fprintf(conn, "hello\n")
+	reply, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "echo: hello\n", reply)
+}
+
+func TestSocketTunnelRejectsPluginBackend(t *testing.T) {
+	_, err := proxy.NewSocketTunnel(proxy.BackendPlugin, "i-0123456789abcdef0", "/tmp/ekssm.sock", "example.com", "443")
+	assert.Error(t, err)
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cloudopsy/ekssm/internal/logging"
+)
+
+// DirectProxy forwards a local port straight to the remote host over TCP. It
+// suits clusters with a public endpoint, where no bastion is needed but the
+// session and kubeconfig handling is still wanted.
+type DirectProxy struct {
+	LocalPort  string
+	RemoteHost string
+	RemotePort string
+	// SocketPath, when set, listens on this Unix socket instead of LocalPort.
+	SocketPath string
+
+	listener net.Listener
+	ready    chan struct{}
+	done     chan struct{}
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func NewDirectProxy(localPort, remoteHost, remotePort string) *DirectProxy {
+	if remotePort == "" {
+		remotePort = "443"
+	}
+	return &DirectProxy{
+		LocalPort:  localPort,
+		RemoteHost: remoteHost,
+		RemotePort: remotePort,
+		ready:      make(chan struct{}),
+		done:       make(chan struct{}),
+		conns:      make(map[net.Conn]struct{}),
+	}
+}
+
+func (p *DirectProxy) Start(ctx context.Context) error {
+	if p.RemoteHost == "" {
+		return fmt.Errorf("remoteHost (EKS endpoint) is required")
+	}
+
+	logging.Debugf("Starting direct forwarding from %s to %s", p.LocalAddr(), p.remoteAddr())
+
+	listener, err := listenLocal(p.LocalPort, p.SocketPath)
+	if err != nil {
+		return err
+	}
+	p.listener = listener
+
+	p.wg.Add(1)
+	go p.serve()
+
+	close(p.ready)
+	return nil
+}
+
+func (p *DirectProxy) Ready() <-chan struct{} {
+	return p.ready
+}
+
+func (p *DirectProxy) Done() <-chan struct{} {
+	return p.done
+}
+
+func (p *DirectProxy) LocalAddr() string {
+	return localAddr(p.LocalPort, p.SocketPath)
+}
+
+// Health checks that the remote endpoint is still reachable.
+func (p *DirectProxy) Health(ctx context.Context) error {
+	select {
+	case <-p.done:
+		return fmt.Errorf("direct proxy stopped")
+	default:
+	}
+	return probeAddr(ctx, p.remoteAddr())
+}
+
+func (p *DirectProxy) Stop() error {
+	p.stopOnce.Do(func() {
+		if p.listener != nil {
+			_ = p.listener.Close()
+		}
+		p.mu.Lock()
+		for conn := range p.conns {
+			conn.Close()
+		}
+		p.mu.Unlock()
+		p.wg.Wait()
+	})
+	return nil
+}
+
+func (p *DirectProxy) remoteAddr() string {
+	return net.JoinHostPort(p.RemoteHost, p.RemotePort)
+}
+
+func (p *DirectProxy) serve() {
+	defer p.wg.Done()
+	defer close(p.done)
+
+	var conns sync.WaitGroup
+	defer conns.Wait()
+
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logging.Warnf("Failed to accept connection on local port %s: %v", p.LocalPort, err)
+			}
+			return
+		}
+
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			p.handle(conn)
+		}()
+	}
+}
+
+func (p *DirectProxy) handle(conn net.Conn) {
+	remote, err := net.DialTimeout("tcp", p.remoteAddr(), 10*time.Second)
+	if err != nil {
+		logging.Warnf("Failed to connect to %s: %v", p.remoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	p.track(conn, remote)
+	defer p.untrack(conn, remote)
+	pipe(conn, remote)
+}
+
+func (p *DirectProxy) track(conns ...net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range conns {
+		p.conns[c] = struct{}{}
+	}
+}
+
+func (p *DirectProxy) untrack(conns ...net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range conns {
+		delete(p.conns, c)
+	}
+}
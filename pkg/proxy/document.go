@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// PortForwardingDocument is the SSM document port forwarding sessions are
+// started with unless another is configured.
+const PortForwardingDocument = "AWS-StartPortForwardingSessionToRemoteHost"
+
+// portForwardingParameters are the document parameters ekssm sets itself on
+// every port forwarding session.
+var portForwardingParameters = []string{"host", "portNumber", "localPortNumber"}
+
+// Document is the SSM document port forwarding sessions are started with.
+// A custom document, such as an organization's copy of the AWS one with
+// session logging enabled, must accept the same host, portNumber and
+// localPortNumber parameters. The zero Document is PortForwardingDocument.
+type Document struct {
+	Name string
+	// Parameters are passed to the document alongside the ones ekssm sets.
+	Parameters map[string]string
+}
+
+// DocumentName returns the name of the document, defaulting to
+// PortForwardingDocument.
+func (d Document) DocumentName() string {
+	if d.Name == "" {
+		return PortForwardingDocument
+	}
+	return d.Name
+}
+
+// Custom reports whether the document or its parameters differ from the
+// default.
+func (d Document) Custom() bool {
+	return d.DocumentName() != PortForwardingDocument || len(d.Parameters) > 0
+}
+
+func (d Document) String() string {
+	if len(d.Parameters) == 0 {
+		return d.DocumentName()
+	}
+	return fmt.Sprintf("%s (%s)", d.DocumentName(), FormatDocumentParams(d.Parameters))
+}
+
+// sessionParameters returns the StartSession parameters for forwarding to
+// host:port. localPort is informational and may be empty.
+func (d Document) sessionParameters(host, port, localPort string) map[string][]string {
+	parameters := make(map[string][]string, len(d.Parameters)+3)
+	for key, value := range d.Parameters {
+		parameters[key] = []string{value}
+	}
+	parameters["host"] = []string{host}
+	parameters["portNumber"] = []string{port}
+	if localPort != "" {
+		parameters["localPortNumber"] = []string{localPort}
+	}
+	return parameters
+}
+
+// ParseDocumentParams parses key=value document parameters. Later values
+// for a key replace earlier ones.
+func ParseDocumentParams(specs []string) (map[string]string, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	params := make(map[string]string, len(specs))
+	for _, spec := range specs {
+		key, value, ok := strings.Cut(spec, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid document parameter %q, expected key=value", spec)
+		}
+		params[key] = value
+	}
+	return params, nil
+}
+
+// FormatDocumentParams formats document parameters as comma-separated
+// key=value pairs, sorted by key.
+func FormatDocumentParams(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = key + "=" + params[key]
+	}
+	return strings.Join(pairs, ",")
+}
+
+// DocumentAPI is the subset of the SSM API needed to validate a document.
+type DocumentAPI interface {
+	DescribeDocument(ctx context.Context, params *ssm.DescribeDocumentInput, optFns ...func(*ssm.Options)) (*ssm.DescribeDocumentOutput, error)
+}
+
+// ValidateDocument checks doc against its description in SSM: it must be a
+// Session document that accepts the parameters ekssm sets and every one in
+// doc.Parameters, and every parameter it requires must be given.
+func ValidateDocument(ctx context.Context, api DocumentAPI, doc Document) error {
+	name := doc.DocumentName()
+	for key := range doc.Parameters {
+		if setByEkssm(key) {
+			return fmt.Errorf("document parameter %s is set by ekssm and cannot be overridden", key)
+		}
+	}
+
+	output, err := api.DescribeDocument(ctx, &ssm.DescribeDocumentInput{Name: aws.String(name)})
+	if err != nil {
+		return fmt.Errorf("failed to describe SSM document %s: %w", name, err)
+	}
+	if output.Document == nil {
+		return fmt.Errorf("received no description of SSM document %s", name)
+	}
+	if output.Document.DocumentType != types.DocumentTypeSession {
+		return fmt.Errorf("SSM document %s is a %s document, not a Session document", name, output.Document.DocumentType)
+	}
+
+	declared := make(map[string]types.DocumentParameter, len(output.Document.Parameters))
+	for _, parameter := range output.Document.Parameters {
+		declared[aws.ToString(parameter.Name)] = parameter
+	}
+	for _, key := range portForwardingParameters {
+		if _, ok := declared[key]; !ok {
+			return fmt.Errorf("SSM document %s has no %s parameter, so it cannot forward ports like %s", name, key, PortForwardingDocument)
+		}
+	}
+
+	var unknown, missing []string
+	for key := range doc.Parameters {
+		if _, ok := declared[key]; !ok {
+			unknown = append(unknown, key)
+		}
+	}
+	for key, parameter := range declared {
+		if parameter.DefaultValue != nil {
+			continue
+		}
+		if _, ok := doc.Parameters[key]; ok || setByEkssm(key) {
+			continue
+		}
+		missing = append(missing, key)
+	}
+	sort.Strings(unknown)
+	sort.Strings(missing)
+	if len(unknown) > 0 {
+		return fmt.Errorf("SSM document %s has no parameter %s", name, strings.Join(unknown, ", "))
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("SSM document %s requires parameter %s; set it with --document-param key=value", name, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func setByEkssm(key string) bool {
+	for _, k := range portForwardingParameters {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// WithDocument makes tunnel start its SSM sessions with doc. Tunnels that do
+// not start SSM sessions are returned unchanged.
+func WithDocument(tunnel Tunnel, doc Document) Tunnel {
+	switch t := tunnel.(type) {
+	case *NativeSSMProxy:
+		t.Document = doc
+	case *SSMProxy:
+		t.Document = doc
+	case *SOCKSProxy:
+		t.Document = doc
+	}
+	return tunnel
+}
@@ -0,0 +1,121 @@
+package proxy_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudopsy/ekssm/internal/ssmtest"
+	"github.com/cloudopsy/ekssm/internal/util"
+	"github.com/cloudopsy/ekssm/pkg/proxy"
+)
+
+// loggedDocument is an organization's copy of the port forwarding document
+// that also needs the bucket its session logs go to.
+func loggedDocument(name string) *types.DocumentDescription {
+	doc := *ssmtest.PortForwardingDocument
+	doc.Name = aws.String(name)
+	doc.Parameters = append(append([]types.DocumentParameter(nil), doc.Parameters...),
+		types.DocumentParameter{Name: aws.String("s3BucketName"), Type: types.DocumentParameterTypeString},
+		types.DocumentParameter{Name: aws.String("cloudWatchEncryptionEnabled"), Type: types.DocumentParameterTypeString, DefaultValue: aws.String("true")},
+	)
+	return &doc
+}
+
+func TestParseDocumentParams(t *testing.T) {
+	params, err := proxy.ParseDocumentParams([]string{"s3BucketName=logs", "reason=a=b", "s3BucketName=audit"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"s3BucketName": "audit", "reason": "a=b"}, params)
+	assert.Equal(t, "reason=a=b,s3BucketName=audit", proxy.FormatDocumentParams(params))
+
+	_, err = proxy.ParseDocumentParams([]string{"novalue"})
+	assert.Error(t, err)
+	_, err = proxy.ParseDocumentParams([]string{"=value"})
+	assert.Error(t, err)
+}
+
+func TestValidateDocument(t *testing.T) {
+	agent := ssmtest.NewAgent(t, "127.0.0.1:1")
+	agent.Documents = map[string]*types.DocumentDescription{
+		"Org-PortForwarding": loggedDocument("Org-PortForwarding"),
+		"Org-Shell": {
+			Name:         aws.String("Org-Shell"),
+			DocumentType: types.DocumentTypeSession,
+			Parameters:   []types.DocumentParameter{{Name: aws.String("shellProfile"), DefaultValue: aws.String("")}},
+		},
+		"Org-Command": {Name: aws.String("Org-Command"), DocumentType: types.DocumentTypeCommand},
+	}
+	ctx := context.Background()
+
+	assert.NoError(t, proxy.ValidateDocument(ctx, agent, proxy.Document{}))
+	assert.NoError(t, proxy.ValidateDocument(ctx, agent, proxy.Document{
+		Name:       "Org-PortForwarding",
+		Parameters: map[string]string{"s3BucketName": "audit-logs"},
+	}))
+
+	tests := map[string]struct {
+		doc  proxy.Document
+		want string
+	}{
+		"missing required parameter": {
+			doc:  proxy.Document{Name: "Org-PortForwarding"},
+			want: "requires parameter s3BucketName",
+		},
+		"unknown parameter": {
+			doc:  proxy.Document{Name: "Org-PortForwarding", Parameters: map[string]string{"s3BucketName": "audit-logs", "reason": "x"}},
+			want: "has no parameter reason",
+		},
+		"overridden parameter": {
+			doc:  proxy.Document{Parameters: map[string]string{"host": "example.com"}},
+			want: "set by ekssm",
+		},
+		"not port forwarding": {
+			doc:  proxy.Document{Name: "Org-Shell"},
+			want: "has no host parameter",
+		},
+		"not a session document": {
+			doc:  proxy.Document{Name: "Org-Command"},
+			want: "not a Session document",
+		},
+		"unknown document": {
+			doc:  proxy.Document{Name: "Org-Missing"},
+			want: "failed to describe SSM document Org-Missing",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := proxy.ValidateDocument(ctx, agent, tt.doc)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.want)
+		})
+	}
+}
+
+func TestNativeSSMProxyUsesDocument(t *testing.T) {
+	agent := ssmtest.NewAgent(t, startLineServer(t))
+
+	port, err := util.FindAvailablePort()
+	require.NoError(t, err)
+
+	doc := proxy.Document{Name: "Org-PortForwarding", Parameters: map[string]string{"s3BucketName": "audit-logs"}}
+	p := proxy.WithDocument(proxy.NewNativeSSMProxy("i-0123456789abcdef0", port, "ABCDEF.gr7.eu-west-1.eks.amazonaws.com", "443"), doc).(*proxy.NativeSSMProxy)
+	p.API = agent
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, p.Start(ctx))
+	defer p.Stop()
+
+	input := agent.LastStartSessionInput()
+	require.NotNil(t, input)
+	assert.Equal(t, "Org-PortForwarding", *input.DocumentName)
+	assert.Equal(t, []string{"audit-logs"}, input.Parameters["s3BucketName"])
+	assert.Equal(t, []string{"ABCDEF.gr7.eu-west-1.eks.amazonaws.com"}, input.Parameters["host"])
+	assert.Equal(t, []string{"443"}, input.Parameters["portNumber"])
+	assert.Equal(t, []string{port}, input.Parameters["localPortNumber"])
+}
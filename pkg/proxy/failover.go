@@ -0,0 +1,387 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+
+	"github.com/cloudopsy/ekssm/internal/logging"
+	awsclient "github.com/cloudopsy/ekssm/pkg/aws"
+	"github.com/cloudopsy/ekssm/pkg/datachannel"
+)
+
+// InstanceInfoAPI is the subset of the SSM API used to check bastion health.
+type InstanceInfoAPI interface {
+	DescribeInstanceInformation(ctx context.Context, params *ssm.DescribeInstanceInformationInput, optFns ...func(*ssm.Options)) (*ssm.DescribeInstanceInformationOutput, error)
+}
+
+// Bastions is an ordered list of bastion targets a tunnel may go through.
+// Instances whose SSM agent reports Online are tried first, in the
+// configured order, followed by the rest in case the ping status is stale.
+type Bastions struct {
+	// InstanceIDs are the targets, in any form ValidateTarget accepts. ECS
+	// services are resolved to one of their running tasks for every tunnel,
+	// so replaced tasks are picked up.
+	InstanceIDs []string
+	// Tag, as key=value, discovers the bastions instead of InstanceIDs: the
+	// Online instances carrying the tag, newest SSM agent first. The tag is
+	// resolved again for every tunnel, so replaced instances are picked up.
+	Tag string
+
+	// API overrides the SSM client built from the default AWS configuration.
+	API InstanceInfoAPI
+	// ECS overrides the ECS client built from the default AWS configuration.
+	ECS ECSAPI
+	// OnSelect is called with the instance each new tunnel went through.
+	OnSelect func(instanceID string)
+
+	mu      sync.Mutex
+	current string
+}
+
+// NewBastions returns the bastions to try, in order of preference. Bastions
+// may be shared by several tunnels.
+func NewBastions(instanceIDs []string) *Bastions {
+	return &Bastions{InstanceIDs: instanceIDs}
+}
+
+// ParseBastionTag splits a key=value bastion tag.
+func ParseBastionTag(tag string) (key, value string, err error) {
+	key, value, ok := strings.Cut(tag, "=")
+	if !ok || key == "" || value == "" {
+		return "", "", fmt.Errorf("invalid bastion tag %q (expected key=value)", tag)
+	}
+	return key, value, nil
+}
+
+// Current returns the instance the latest tunnel went through.
+func (b *Bastions) Current() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.current
+}
+
+func (b *Bastions) selected(instanceID string) {
+	b.mu.Lock()
+	b.current = instanceID
+	b.mu.Unlock()
+	if b.OnSelect != nil {
+		b.OnSelect(instanceID)
+	}
+}
+
+// Order returns the targets in the order they should be tried. With a
+// single instance, or when the ping status cannot be read, the configured
+// order is kept. ECS tasks have no ping status; they keep their place among
+// the Online instances. With a Tag, it fails if no Online instance carries
+// the tag.
+func (b *Bastions) Order(ctx context.Context) ([]string, error) {
+	if b.Tag != "" {
+		return b.discover(ctx)
+	}
+	targets, err := b.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var instances []string
+	for _, target := range targets {
+		if isInstanceTarget(target) {
+			instances = append(instances, target)
+		}
+	}
+	if len(targets) < 2 || len(instances) == 0 {
+		return targets, nil
+	}
+
+	infos, err := b.describe(ctx, types.InstanceInformationStringFilter{
+		Key: aws.String("InstanceIds"), Values: instances,
+	})
+	if err != nil {
+		logging.Warnf("Could not check bastion ping status, trying them in order: %v", err)
+		return targets, nil
+	}
+	online := make(map[string]bool, len(infos))
+	for _, info := range infos {
+		if info.InstanceId != nil && info.PingStatus == types.PingStatusOnline {
+			online[*info.InstanceId] = true
+		}
+	}
+
+	ordered := make([]string, 0, len(targets))
+	for _, id := range targets {
+		if online[id] || !isInstanceTarget(id) {
+			ordered = append(ordered, id)
+		}
+	}
+	for _, id := range targets {
+		if !online[id] && isInstanceTarget(id) {
+			logging.Debugf("Bastion %s is not reported Online by SSM", id)
+			ordered = append(ordered, id)
+		}
+	}
+	return ordered, nil
+}
+
+// resolve returns InstanceIDs with every ECS service replaced by the target
+// of one of its running tasks. Services without a usable task are skipped,
+// unless that leaves no target at all.
+func (b *Bastions) resolve(ctx context.Context) ([]string, error) {
+	targets := make([]string, 0, len(b.InstanceIDs))
+	var errs []error
+	for _, target := range b.InstanceIDs {
+		service, ok, err := ParseECSService(target)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			targets = append(targets, target)
+			continue
+		}
+		api, err := b.ecsAPI(ctx)
+		if err != nil {
+			return nil, err
+		}
+		resolved, err := ResolveECSTarget(ctx, api, service)
+		if err != nil {
+			logging.Warnf("Skipping bastion %s: %v", target, err)
+			errs = append(errs, err)
+			continue
+		}
+		targets = append(targets, resolved)
+	}
+	if len(targets) == 0 && len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return targets, nil
+}
+
+func (b *Bastions) ecsAPI(ctx context.Context) (ECSAPI, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ECS == nil {
+		client, err := awsclient.NewClient(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create AWS client: %w", err)
+		}
+		b.ECS = client.ECS
+	}
+	return b.ECS, nil
+}
+
+// discover returns the Online instances carrying Tag, newest agent first.
+func (b *Bastions) discover(ctx context.Context) ([]string, error) {
+	key, value, err := ParseBastionTag(b.Tag)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := b.describe(ctx, types.InstanceInformationStringFilter{
+		Key: aws.String("tag:" + key), Values: []string{value},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	online := make([]types.InstanceInformation, 0, len(infos))
+	for _, info := range infos {
+		if info.InstanceId != nil && info.PingStatus == types.PingStatusOnline {
+			online = append(online, info)
+		}
+	}
+	if len(online) == 0 {
+		return nil, fmt.Errorf("no Online SSM-managed instance is tagged %s", b.Tag)
+	}
+	sort.SliceStable(online, func(i, j int) bool {
+		return datachannel.CompareVersions(aws.ToString(online[i].AgentVersion), aws.ToString(online[j].AgentVersion)) > 0
+	})
+
+	ids := make([]string, len(online))
+	for i, info := range online {
+		ids[i] = *info.InstanceId
+	}
+	logging.Debugf("Bastions tagged %s: %v", b.Tag, ids)
+	return ids, nil
+}
+
+// describe lists the SSM-managed instances matching filter.
+func (b *Bastions) describe(ctx context.Context, filter types.InstanceInformationStringFilter) ([]types.InstanceInformation, error) {
+	b.mu.Lock()
+	if b.API == nil {
+		client, err := awsclient.NewClient(ctx)
+		if err != nil {
+			b.mu.Unlock()
+			return nil, fmt.Errorf("failed to create AWS client: %w", err)
+		}
+		b.API = client.SSM
+	}
+	api := b.API
+	b.mu.Unlock()
+
+	var infos []types.InstanceInformation
+	input := &ssm.DescribeInstanceInformationInput{
+		Filters: []types.InstanceInformationStringFilter{filter},
+	}
+	for {
+		output, err := api.DescribeInstanceInformation(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe instance information: %w", err)
+		}
+		infos = append(infos, output.InstanceInformationList...)
+		if aws.ToString(output.NextToken) == "" {
+			return infos, nil
+		}
+		input.NextToken = output.NextToken
+	}
+}
+
+// NewBastionTunnel builds the tunnel for backend. Backends that go through
+// an SSM target fail over across bastions; the others are built directly.
+func NewBastionTunnel(backend string, bastions *Bastions, build func(instanceID string) (Tunnel, error)) (Tunnel, error) {
+	if !RequiresInstance(backend) {
+		return build("")
+	}
+	return NewFailoverTunnel(bastions, build), nil
+}
+
+// FailoverTunnel starts a tunnel through the first bastion that accepts it
+// and then behaves as that tunnel. A supervisor that builds a new
+// FailoverTunnel for each attempt moves to another bastion when the one in
+// use stops working.
+type FailoverTunnel struct {
+	Bastions *Bastions
+	// NewTunnel builds the tunnel through a single instance.
+	NewTunnel func(instanceID string) (Tunnel, error)
+
+	mu         sync.Mutex
+	tunnel     Tunnel
+	instanceID string
+
+	ready    chan struct{}
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// NewFailoverTunnel returns a tunnel that goes through one of bastions.
+func NewFailoverTunnel(bastions *Bastions, newTunnel func(instanceID string) (Tunnel, error)) *FailoverTunnel {
+	return &FailoverTunnel{
+		Bastions:  bastions,
+		NewTunnel: newTunnel,
+		ready:     make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// Start tries each bastion in turn until a tunnel starts through one of them.
+func (f *FailoverTunnel) Start(ctx context.Context) error {
+	candidates, err := f.Bastions.Order(ctx)
+	if err != nil {
+		return err
+	}
+	if len(candidates) == 0 {
+		return fmt.Errorf("no bastion target configured")
+	}
+
+	var errs []error
+	for _, instanceID := range candidates {
+		tunnel, err := f.NewTunnel(instanceID)
+		if err != nil {
+			return err
+		}
+		if err := tunnel.Start(ctx); err != nil {
+			_ = tunnel.Stop()
+			// Another bastion would not help with a local problem.
+			var pluginErr *PluginError
+			if ctx.Err() != nil || errors.As(err, &pluginErr) {
+				return err
+			}
+			logging.Warnf("Tunnel through %s failed: %v", instanceID, err)
+			errs = append(errs, fmt.Errorf("%s: %w", instanceID, err))
+			continue
+		}
+
+		f.mu.Lock()
+		f.tunnel = tunnel
+		f.instanceID = instanceID
+		f.mu.Unlock()
+
+		if len(candidates) > 1 {
+			logging.Infof("Using bastion %s", instanceID)
+		}
+		f.Bastions.selected(instanceID)
+		go func() {
+			<-tunnel.Done()
+			f.closeDone()
+		}()
+		close(f.ready)
+		return nil
+	}
+	return fmt.Errorf("no bastion could be reached: %w", errors.Join(errs...))
+}
+
+// InstanceID returns the bastion the tunnel goes through.
+func (f *FailoverTunnel) InstanceID() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.instanceID
+}
+
+// Ready is closed once a tunnel through one of the bastions is up.
+func (f *FailoverTunnel) Ready() <-chan struct{} {
+	return f.ready
+}
+
+// Done is closed when the tunnel has stopped.
+func (f *FailoverTunnel) Done() <-chan struct{} {
+	return f.done
+}
+
+// Health reports the health of the tunnel in use.
+func (f *FailoverTunnel) Health(ctx context.Context) error {
+	tunnel := f.current()
+	if tunnel == nil {
+		return fmt.Errorf("tunnel is not connected")
+	}
+	return tunnel.Health(ctx)
+}
+
+// LocalAddr returns the local address of the tunnel in use.
+func (f *FailoverTunnel) LocalAddr() string {
+	tunnel := f.current()
+	if tunnel == nil {
+		return ""
+	}
+	return tunnel.LocalAddr()
+}
+
+// Busy reports whether the tunnel in use is busy carrying a connection.
+func (f *FailoverTunnel) Busy() bool {
+	tunnel := f.current()
+	return tunnel != nil && tunnelBusy(tunnel)
+}
+
+// Stop tears down the tunnel in use.
+func (f *FailoverTunnel) Stop() error {
+	defer f.closeDone()
+	tunnel := f.current()
+	if tunnel == nil {
+		return nil
+	}
+	return tunnel.Stop()
+}
+
+func (f *FailoverTunnel) current() Tunnel {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.tunnel
+}
+
+func (f *FailoverTunnel) closeDone() {
+	f.doneOnce.Do(func() { close(f.done) })
+}
@@ -0,0 +1,140 @@
+package proxy_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudopsy/ekssm/internal/ssmtest"
+	"github.com/cloudopsy/ekssm/internal/util"
+	"github.com/cloudopsy/ekssm/pkg/proxy"
+)
+
+func TestBastionsOrderPrefersOnlineInstances(t *testing.T) {
+	agent := ssmtest.NewAgent(t, startLineServer(t))
+	agent.Offline = []string{"i-aaaaaaaaaaaaaaaaa"}
+
+	bastions := proxy.NewBastions([]string{"i-aaaaaaaaaaaaaaaaa", "i-bbbbbbbbbbbbbbbbb", "i-ccccccccccccccccc"})
+	bastions.API = agent
+
+	order, err := bastions.Order(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"i-bbbbbbbbbbbbbbbbb", "i-ccccccccccccccccc", "i-aaaaaaaaaaaaaaaaa"}, order)
+}
+
+func TestBastionsDiscoverByTag(t *testing.T) {
+	agent := ssmtest.NewAgent(t, startLineServer(t))
+	bastion := map[string]string{"Role": "bastion"}
+	agent.Instances = []ssmtest.Instance{
+		{ID: "i-aaaaaaaaaaaaaaaaa", AgentVersion: "3.2.582.0", Tags: bastion},
+		{ID: "i-bbbbbbbbbbbbbbbbb", AgentVersion: "3.3.40.0", Tags: bastion},
+		{ID: "i-ccccccccccccccccc", AgentVersion: "3.3.131.0", Tags: bastion},
+		{ID: "i-ddddddddddddddddd", AgentVersion: "3.3.200.0", Tags: map[string]string{"Role": "worker"}},
+	}
+	agent.Offline = []string{"i-ccccccccccccccccc"}
+
+	bastions := proxy.NewBastions(nil)
+	bastions.Tag = "Role=bastion"
+	bastions.API = agent
+
+	order, err := bastions.Order(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"i-bbbbbbbbbbbbbbbbb", "i-aaaaaaaaaaaaaaaaa"}, order)
+
+	bastions.Tag = "Role=jumphost"
+	_, err = bastions.Order(context.Background())
+	assert.EqualError(t, err, "no Online SSM-managed instance is tagged Role=jumphost")
+
+	bastions.Tag = "Role"
+	_, err = bastions.Order(context.Background())
+	assert.Error(t, err)
+}
+
+// staleInstanceInfo reports every instance Online, like a ping status that
+// has not caught up with a bastion going away.
+type staleInstanceInfo struct{}
+
+func (staleInstanceInfo) DescribeInstanceInformation(_ context.Context, params *ssm.DescribeInstanceInformationInput, _ ...func(*ssm.Options)) (*ssm.DescribeInstanceInformationOutput, error) {
+	output := &ssm.DescribeInstanceInformationOutput{}
+	for _, id := range params.Filters[0].Values {
+		output.InstanceInformationList = append(output.InstanceInformationList, types.InstanceInformation{
+			InstanceId: aws.String(id),
+			PingStatus: types.PingStatusOnline,
+		})
+	}
+	return output, nil
+}
+
+func TestFailoverTunnelMovesToNextBastion(t *testing.T) {
+	agent := ssmtest.NewAgent(t, startLineServer(t))
+	agent.Offline = []string{"i-aaaaaaaaaaaaaaaaa"}
+
+	port, err := util.FindAvailablePort()
+	require.NoError(t, err)
+
+	var selected []string
+	bastions := proxy.NewBastions([]string{"i-aaaaaaaaaaaaaaaaa", "i-bbbbbbbbbbbbbbbbb"})
+	bastions.API = staleInstanceInfo{}
+	bastions.OnSelect = func(id string) { selected = append(selected, id) }
+
+	tunnel := proxy.NewFailoverTunnel(bastions, func(instanceID string) (proxy.Tunnel, error) {
+		p := proxy.NewNativeSSMProxy(instanceID, port, "ABCDEF.gr7.eu-west-1.eks.amazonaws.com", "443")
+		p.API = agent
+		return p, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, tunnel.Start(ctx))
+	defer tunnel.Stop()
+
+	assert.Equal(t, "echo: hello\n", roundTrip(t, port, "hello"))
+	assert.Equal(t, "i-bbbbbbbbbbbbbbbbb", tunnel.InstanceID())
+	assert.Equal(t, "i-bbbbbbbbbbbbbbbbb", bastions.Current())
+	assert.Equal(t, []string{"i-bbbbbbbbbbbbbbbbb"}, selected)
+	assert.Equal(t, "i-bbbbbbbbbbbbbbbbb", aws.ToString(agent.LastStartSessionInput().Target))
+}
+
+func TestFailoverTunnelReportsEveryBastionError(t *testing.T) {
+	agent := ssmtest.NewAgent(t, startLineServer(t))
+	agent.Offline = []string{"i-aaaaaaaaaaaaaaaaa", "i-bbbbbbbbbbbbbbbbb"}
+
+	port, err := util.FindAvailablePort()
+	require.NoError(t, err)
+
+	bastions := proxy.NewBastions([]string{"i-aaaaaaaaaaaaaaaaa", "i-bbbbbbbbbbbbbbbbb"})
+	bastions.API = agent
+	tunnel := proxy.NewFailoverTunnel(bastions, func(instanceID string) (proxy.Tunnel, error) {
+		p := proxy.NewNativeSSMProxy(instanceID, port, "ABCDEF.gr7.eu-west-1.eks.amazonaws.com", "443")
+		p.API = agent
+		return p, nil
+	})
+
+	err = tunnel.Start(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "i-aaaaaaaaaaaaaaaaa")
+	assert.Contains(t, err.Error(), "i-bbbbbbbbbbbbbbbbb")
+}
+
+func TestFailoverTunnelStopsOnPluginError(t *testing.T) {
+	t.Setenv(proxy.PluginPathEnv, filepath.Join(t.TempDir(), "missing"))
+
+	var tried []string
+	bastions := proxy.NewBastions([]string{"i-aaaaaaaaaaaaaaaaa", "i-bbbbbbbbbbbbbbbbb"})
+	bastions.API = staleInstanceInfo{}
+	tunnel := proxy.NewFailoverTunnel(bastions, func(instanceID string) (proxy.Tunnel, error) {
+		tried = append(tried, instanceID)
+		return proxy.NewSSMProxy(instanceID, "8443", "ABCDEF.gr7.eu-west-1.eks.amazonaws.com", "443"), nil
+	})
+
+	err := tunnel.Start(context.Background())
+	require.ErrorIs(t, err, proxy.ErrPluginNotFound)
+	assert.Len(t, tried, 1)
+}
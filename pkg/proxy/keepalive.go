@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/cloudopsy/ekssm/internal/logging"
+)
+
+// Keepalive targets accepted by Keepalive.
+const (
+	KeepaliveTLS   = "tls"   // TLS handshake with the forwarded API server
+	KeepaliveLivez = "livez" // GET /livez against the forwarded API server
+	KeepaliveTCP   = "tcp"   // plain TCP connect, for forwards to arbitrary services
+	KeepaliveNone  = "none"  // no keepalive traffic
+
+	DefaultKeepaliveTarget   = KeepaliveTLS
+	DefaultKeepaliveInterval = 5 * time.Minute
+)
+
+// KeepaliveTargets lists the supported keepalive targets.
+var KeepaliveTargets = []string{KeepaliveTLS, KeepaliveLivez, KeepaliveTCP, KeepaliveNone}
+
+const keepaliveTimeout = 30 * time.Second
+
+// ErrTunnelBusy is returned by Ping when the tunnel is carrying another
+// connection and cannot take the keepalive without waiting.
+var ErrTunnelBusy = errors.New("tunnel is busy relaying a connection")
+
+// Keepalive periodically sends harmless traffic through a tunnel so that SSM
+// does not close the session for being idle. On tunnels that carry one
+// connection at a time the keepalive is skipped while a connection is being
+// relayed, rather than queueing behind it, and lazy tunnels are not woken.
+type Keepalive struct {
+	Tunnel   Tunnel
+	Target   string
+	Interval time.Duration
+	// ServerName is the TLS server name of the forwarded API server.
+	ServerName string
+
+	// OnSuccess is called with the time of each successful keepalive.
+	OnSuccess func(at time.Time)
+}
+
+// ValidateKeepaliveTarget returns an error for unknown keepalive targets.
+func ValidateKeepaliveTarget(target string) error {
+	for _, t := range KeepaliveTargets {
+		if target == t {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown keepalive target %q (supported: %v)", target, KeepaliveTargets)
+}
+
+// Run sends keepalives until ctx is cancelled. It returns immediately if the
+// target is "none" or the interval is not positive.
+func (k *Keepalive) Run(ctx context.Context) {
+	if k.Target == KeepaliveNone || k.Interval <= 0 {
+		logging.Debugf("Keepalive disabled")
+		return
+	}
+
+	ticker := time.NewTicker(k.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := k.Ping(ctx); err != nil {
+				if errors.Is(err, ErrTunnelBusy) || errors.Is(err, ErrTunnelIdle) {
+					logging.Debugf("Keepalive via %s skipped: %v", k.Tunnel.LocalAddr(), err)
+					continue
+				}
+				if ctx.Err() == nil {
+					logging.Warnf("Keepalive (%s) via %s failed: %v", k.Target, k.Tunnel.LocalAddr(), err)
+				}
+				continue
+			}
+			logging.Debugf("Keepalive (%s) via %s succeeded", k.Target, k.Tunnel.LocalAddr())
+			if k.OnSuccess != nil {
+				k.OnSuccess(time.Now())
+			}
+		}
+	}
+}
+
+// Ping sends a single keepalive through the tunnel.
+func (k *Keepalive) Ping(ctx context.Context) error {
+	if tunnelIdle(k.Tunnel) {
+		return ErrTunnelIdle
+	}
+	addr := k.Tunnel.LocalAddr()
+	if addr == "" {
+		return fmt.Errorf("tunnel is not connected")
+	}
+	if tunnelBusy(k.Tunnel) {
+		return ErrTunnelBusy
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, keepaliveTimeout)
+	defer cancel()
+
+	// Only traffic through the tunnel matters here; the API server's
+	// certificate is not verified because it is not issued for the local address.
+	tlsConfig := &tls.Config{
+		ServerName:         k.ServerName,
+		InsecureSkipVerify: true, //nolint:gosec
+	}
+
+	switch k.Target {
+	case KeepaliveTCP:
+		// Connecting is enough: the backend opens a stream to the remote
+		// port for every accepted connection.
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, LocalNetwork(addr), addr)
+		if err != nil {
+			return fmt.Errorf("TCP connect failed: %w", err)
+		}
+		return conn.Close()
+	case KeepaliveTLS, "":
+		dialer := &tls.Dialer{Config: tlsConfig}
+		conn, err := dialer.DialContext(ctx, LocalNetwork(addr), addr)
+		if err != nil {
+			return fmt.Errorf("TLS handshake failed: %w", err)
+		}
+		return conn.Close()
+	case KeepaliveLivez:
+		var dialer net.Dialer
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig:   tlsConfig,
+				DisableKeepAlives: true,
+				// Always dial the tunnel, which may be a Unix socket.
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, LocalNetwork(addr), addr)
+				},
+			},
+		}
+		host := k.ServerName
+		if host == "" {
+			host = "localhost"
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+host+"/livez", nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("GET /livez failed: %w", err)
+		}
+		defer resp.Body.Close()
+		_, _ = io.Copy(io.Discard, resp.Body)
+		// Any response proves the tunnel carried traffic; anonymous access to
+		// /livez may legitimately be refused.
+		return nil
+	default:
+		return ValidateKeepaliveTarget(k.Target)
+	}
+}
@@ -0,0 +1,83 @@
+package proxy_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudopsy/ekssm/internal/ssmtest"
+	"github.com/cloudopsy/ekssm/internal/util"
+	"github.com/cloudopsy/ekssm/pkg/proxy"
+)
+
+func TestKeepalivePingsThroughTunnel(t *testing.T) {
+	var livez atomic.Int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/livez" {
+			livez.Add(1)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	host, port, err := net.SplitHostPort(serverURL.Host)
+	require.NoError(t, err)
+
+	localPort, err := util.FindAvailablePort()
+	require.NoError(t, err)
+	tunnel := proxy.NewDirectProxy(localPort, host, port)
+	require.NoError(t, tunnel.Start(context.Background()))
+	defer tunnel.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	k := &proxy.Keepalive{Tunnel: tunnel, Target: proxy.KeepaliveTLS}
+	require.NoError(t, k.Ping(ctx))
+
+	k.Target = proxy.KeepaliveLivez
+	require.NoError(t, k.Ping(ctx))
+	assert.Equal(t, int32(1), livez.Load())
+
+	k.Target = proxy.KeepaliveTCP
+	require.NoError(t, k.Ping(ctx))
+
+	k.Target = "bogus"
+	assert.Error(t, k.Ping(ctx))
+}
+
+func TestKeepaliveSkipsBusySerialTunnel(t *testing.T) {
+	agent := ssmtest.NewAgent(t, startLineServer(t))
+	agent.AgentVersion = ssmtest.BasicAgentVersion
+
+	port, err := util.FindAvailablePort()
+	require.NoError(t, err)
+
+	p := proxy.NewNativeSSMProxy("i-0123456789abcdef0", port, "ABCDEF.gr7.eu-west-1.eks.amazonaws.com", "443")
+	p.API = agent
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, p.Start(ctx))
+	defer p.Stop()
+
+	held, err := net.DialTimeout("tcp", "127.0.0.1:"+port, time.Second)
+	require.NoError(t, err)
+	require.Eventually(t, p.Busy, 2*time.Second, 10*time.Millisecond)
+
+	k := &proxy.Keepalive{Tunnel: p, Target: proxy.KeepaliveTLS}
+	assert.ErrorIs(t, k.Ping(ctx), proxy.ErrTunnelBusy)
+
+	held.Close()
+	assert.Eventually(t, func() bool { return !p.Busy() }, 2*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cloudopsy/ekssm/internal/logging"
+)
+
+// DefaultIdleTimeout is how long a lazy tunnel stays up after its last
+// connection closes.
+const DefaultIdleTimeout = 15 * time.Minute
+
+// ErrTunnelIdle is returned by Ping when a lazy tunnel is down because
+// nothing has used it; keeping it open is not wanted.
+var ErrTunnelIdle = errors.New("tunnel is idle")
+
+// acquirer is implemented by tunnels that start on demand. A relay acquires
+// the tunnel for each connection it carries and releases it afterwards.
+type acquirer interface {
+	Acquire() error
+	Release()
+}
+
+// idleReporter is implemented by tunnels that can be down while idle.
+type idleReporter interface {
+	Idle() bool
+}
+
+func tunnelIdle(t Tunnel) bool {
+	i, ok := t.(idleReporter)
+	return ok && i.Idle()
+}
+
+// LazyTunnel starts the tunnel NewTunnel builds only once a connection
+// needs it, and stops it when no connection has used it for IdleTimeout.
+// The next connection starts a new one, so the local listener in front of
+// it, and everything configured to use it, keeps working throughout.
+//
+// Put a Relay in front of a LazyTunnel: the relay holds the local address
+// and acquires the tunnel for every connection.
+type LazyTunnel struct {
+	// NewTunnel builds the tunnel each time one is needed.
+	NewTunnel   func() (Tunnel, error)
+	IdleTimeout time.Duration
+
+	// OnStart is called when a tunnel has started, OnIdle when one has been
+	// stopped for being idle.
+	OnStart func()
+	OnIdle  func()
+
+	// startMu serialises starting and stopping the tunnel, so a new one
+	// never races the old one for the same local address.
+	startMu sync.Mutex
+
+	mu        sync.Mutex
+	current   Tunnel
+	users     int
+	idleTimer *time.Timer
+	stopped   bool
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	ready    chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewLazyTunnel returns a lazy tunnel that stops after idleTimeout without
+// connections.
+func NewLazyTunnel(newTunnel func() (Tunnel, error), idleTimeout time.Duration) *LazyTunnel {
+	return &LazyTunnel{
+		NewTunnel:   newTunnel,
+		IdleTimeout: idleTimeout,
+		ready:       make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// Start only prepares the tunnel; nothing is connected until Acquire.
+func (l *LazyTunnel) Start(ctx context.Context) error {
+	if l.NewTunnel == nil {
+		return fmt.Errorf("NewTunnel is required")
+	}
+	if l.IdleTimeout <= 0 {
+		return fmt.Errorf("idle timeout must be positive")
+	}
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+	close(l.ready)
+	return nil
+}
+
+func (l *LazyTunnel) Ready() <-chan struct{} {
+	return l.ready
+}
+
+func (l *LazyTunnel) Done() <-chan struct{} {
+	return l.done
+}
+
+// Acquire starts the tunnel unless it is already up, and keeps it up until
+// the matching Release.
+func (l *LazyTunnel) Acquire() error {
+	l.startMu.Lock()
+	defer l.startMu.Unlock()
+
+	l.mu.Lock()
+	if l.stopped {
+		l.mu.Unlock()
+		return fmt.Errorf("tunnel stopped")
+	}
+	l.users++
+	if l.idleTimer != nil {
+		l.idleTimer.Stop()
+		l.idleTimer = nil
+	}
+	current := l.current
+	l.mu.Unlock()
+	if current != nil {
+		return nil
+	}
+
+	logging.Infof("Starting tunnel on demand")
+	tunnel, err := l.NewTunnel()
+	if err == nil {
+		if err = tunnel.Start(l.ctx); err != nil {
+			_ = tunnel.Stop()
+		}
+	}
+
+	l.mu.Lock()
+	if err == nil && l.stopped {
+		_ = tunnel.Stop()
+		err = fmt.Errorf("tunnel stopped")
+	}
+	if err != nil {
+		l.users--
+		l.mu.Unlock()
+		return err
+	}
+	l.current = tunnel
+	l.mu.Unlock()
+
+	if l.OnStart != nil {
+		l.OnStart()
+	}
+	return nil
+}
+
+// Release ends a use of the tunnel. Once nothing uses it, the tunnel is
+// stopped after IdleTimeout unless it is acquired again first.
+func (l *LazyTunnel) Release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.users--
+	if l.users == 0 && l.current != nil && !l.stopped {
+		l.idleTimer = time.AfterFunc(l.IdleTimeout, l.idle)
+	}
+}
+
+func (l *LazyTunnel) idle() {
+	l.startMu.Lock()
+	defer l.startMu.Unlock()
+
+	l.mu.Lock()
+	if l.users > 0 || l.current == nil || l.stopped {
+		l.mu.Unlock()
+		return
+	}
+	tunnel := l.current
+	l.current = nil
+	l.idleTimer = nil
+	l.mu.Unlock()
+
+	logging.Infof("Tunnel idle for %s, stopping it until the next connection", l.IdleTimeout)
+	if err := tunnel.Stop(); err != nil {
+		logging.Warnf("Failed to stop idle tunnel cleanly: %v", err)
+	}
+	if l.OnIdle != nil {
+		l.OnIdle()
+	}
+}
+
+// Idle reports whether the tunnel is down for want of connections.
+func (l *LazyTunnel) Idle() bool {
+	return l.running() == nil
+}
+
+// Health reports the health of the tunnel while it is up. An idle tunnel is
+// healthy: it starts when needed.
+func (l *LazyTunnel) Health(ctx context.Context) error {
+	tunnel := l.running()
+	if tunnel == nil {
+		return nil
+	}
+	return tunnel.Health(ctx)
+}
+
+// LocalAddr returns the local address of the tunnel, or "" while idle.
+func (l *LazyTunnel) LocalAddr() string {
+	tunnel := l.running()
+	if tunnel == nil {
+		return ""
+	}
+	return tunnel.LocalAddr()
+}
+
+// Busy reports whether the tunnel is up and busy carrying a connection.
+func (l *LazyTunnel) Busy() bool {
+	tunnel := l.running()
+	return tunnel != nil && tunnelBusy(tunnel)
+}
+
+// Stop abandons any start in progress and stops the tunnel if it is up.
+func (l *LazyTunnel) Stop() error {
+	var err error
+	l.stopOnce.Do(func() {
+		defer close(l.done)
+
+		l.mu.Lock()
+		l.stopped = true
+		if l.idleTimer != nil {
+			l.idleTimer.Stop()
+			l.idleTimer = nil
+		}
+		l.mu.Unlock()
+		if l.cancel != nil {
+			l.cancel()
+		}
+
+		l.startMu.Lock()
+		defer l.startMu.Unlock()
+		l.mu.Lock()
+		tunnel := l.current
+		l.current = nil
+		l.mu.Unlock()
+		if tunnel != nil {
+			err = tunnel.Stop()
+		}
+	})
+	return err
+}
+
+func (l *LazyTunnel) running() Tunnel {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.current
+}
@@ -0,0 +1,92 @@
+package proxy_test
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudopsy/ekssm/internal/util"
+	"github.com/cloudopsy/ekssm/pkg/proxy"
+)
+
+func TestLazyTunnelStartsOnDemandAndStopsWhenIdle(t *testing.T) {
+	host, remotePort, err := net.SplitHostPort(startLineServer(t))
+	require.NoError(t, err)
+
+	upstreamPort, err := util.FindAvailablePort()
+	require.NoError(t, err)
+	port, err := util.FindAvailablePort()
+	require.NoError(t, err)
+
+	var started, idled atomic.Int32
+	lazy := proxy.NewLazyTunnel(func() (proxy.Tunnel, error) {
+		return proxy.NewDirectProxy(upstreamPort, host, remotePort), nil
+	}, 100*time.Millisecond)
+	lazy.OnStart = func() { started.Add(1) }
+	lazy.OnIdle = func() { idled.Add(1) }
+
+	relay := proxy.NewRelay(port, "", lazy, nil)
+	require.NoError(t, relay.Start(context.Background()))
+	defer relay.Stop()
+
+	// The local port is bound straight away, but nothing behind it is.
+	assert.True(t, lazy.Idle())
+	assert.Equal(t, "", lazy.LocalAddr())
+	assert.NoError(t, lazy.Health(context.Background()))
+	_, err = net.DialTimeout("tcp", "127.0.0.1:"+upstreamPort, time.Second)
+	assert.Error(t, err)
+
+	assert.Equal(t, "echo: hello\n", roundTrip(t, port, "hello"))
+	assert.Equal(t, int32(1), started.Load())
+
+	require.Eventually(t, func() bool { return idled.Load() == 1 }, 2*time.Second, 10*time.Millisecond)
+	assert.True(t, lazy.Idle())
+
+	// The next connection brings the tunnel back on the same local port.
+	assert.Equal(t, "echo: again\n", roundTrip(t, port, "again"))
+	assert.Equal(t, int32(2), started.Load())
+}
+
+func TestLazyTunnelStaysUpWhileConnectionsAreOpen(t *testing.T) {
+	host, remotePort, err := net.SplitHostPort(startLineServer(t))
+	require.NoError(t, err)
+
+	upstreamPort, err := util.FindAvailablePort()
+	require.NoError(t, err)
+	port, err := util.FindAvailablePort()
+	require.NoError(t, err)
+
+	lazy := proxy.NewLazyTunnel(func() (proxy.Tunnel, error) {
+		return proxy.NewDirectProxy(upstreamPort, host, remotePort), nil
+	}, 50*time.Millisecond)
+	relay := proxy.NewRelay(port, "", lazy, nil)
+	require.NoError(t, relay.Start(context.Background()))
+	defer relay.Stop()
+
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:"+port, time.Second)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return !lazy.Idle() }, 2*time.Second, 10*time.Millisecond)
+
+	time.Sleep(200 * time.Millisecond)
+	assert.False(t, lazy.Idle())
+
+	conn.Close()
+	require.Eventually(t, lazy.Idle, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestKeepaliveSkipsIdleLazyTunnel(t *testing.T) {
+	lazy := proxy.NewLazyTunnel(func() (proxy.Tunnel, error) {
+		t.Fatal("keepalive must not start an idle tunnel")
+		return nil, nil
+	}, time.Minute)
+	require.NoError(t, lazy.Start(context.Background()))
+	defer lazy.Stop()
+
+	k := &proxy.Keepalive{Tunnel: lazy, Target: proxy.KeepaliveTCP, Interval: time.Minute}
+	assert.ErrorIs(t, k.Ping(context.Background()), proxy.ErrTunnelIdle)
+}
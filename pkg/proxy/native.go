@@ -0,0 +1,417 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+
+	"github.com/cloudopsy/ekssm/internal/logging"
+	"github.com/cloudopsy/ekssm/internal/smux"
+	awsclient "github.com/cloudopsy/ekssm/pkg/aws"
+	"github.com/cloudopsy/ekssm/pkg/datachannel"
+)
+
+// SessionAPI is the subset of the SSM API needed to run a port forwarding session.
+type SessionAPI interface {
+	StartSession(ctx context.Context, params *ssm.StartSessionInput, optFns ...func(*ssm.Options)) (*ssm.StartSessionOutput, error)
+	TerminateSession(ctx context.Context, params *ssm.TerminateSessionInput, optFns ...func(*ssm.Options)) (*ssm.TerminateSessionOutput, error)
+}
+
+// NativeSSMProxy forwards a local port to a remote host through an SSM port
+// forwarding session, speaking the data channel protocol in-process instead of
+// running session-manager-plugin.
+//
+// Agents that multiplex port sessions carry every local connection as its own
+// smux stream, so connections are served concurrently. Older agents only
+// support the basic protocol, which carries one TCP stream at a time; there
+// local connections are served one after another.
+type NativeSSMProxy struct {
+	InstanceID string
+	LocalPort  string
+	RemoteHost string
+	RemotePort string
+	SessionID  string
+	// SocketPath, when set, listens on this Unix socket instead of LocalPort.
+	SocketPath string
+	// Document is the SSM document the session is started with.
+	Document Document
+
+	// API overrides the SSM client built from the default AWS configuration.
+	API SessionAPI
+
+	listener net.Listener
+	session  *portSession
+	ready    chan struct{}
+	done     chan struct{}
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+func NewNativeSSMProxy(instanceID, localPort, remoteHost, remotePort string) *NativeSSMProxy {
+	if remotePort == "" {
+		remotePort = "443"
+	}
+	return &NativeSSMProxy{
+		InstanceID: instanceID,
+		LocalPort:  localPort,
+		RemoteHost: remoteHost,
+		RemotePort: remotePort,
+		ready:      make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// Start opens the SSM session and begins accepting connections on the local
+// port. The port is only bound once the data channel handshake has completed,
+// so a successful connection to it means the tunnel is usable.
+func (p *NativeSSMProxy) Start(ctx context.Context) error {
+	if p.InstanceID == "" {
+		return fmt.Errorf("instanceID is required")
+	}
+	if p.LocalPort == "" && p.SocketPath == "" {
+		return fmt.Errorf("localPort is required")
+	}
+	if p.RemoteHost == "" {
+		return fmt.Errorf("remoteHost (EKS endpoint) is required")
+	}
+	if p.RemotePort == "" {
+		return fmt.Errorf("remotePort is required")
+	}
+
+	logging.Debugf("Starting native SSM port forwarding to remote host %s:%s via instance %s on %s",
+		p.RemoteHost, p.RemotePort, p.InstanceID, p.LocalAddr())
+
+	if p.API == nil {
+		client, err := awsclient.NewClient(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to create AWS client: %w", err)
+		}
+		p.API = client.SSM
+	}
+
+	session, err := startPortSession(ctx, p.API, p.Document, p.InstanceID, p.RemoteHost, p.RemotePort, p.LocalPort)
+	if err != nil {
+		return err
+	}
+	p.SessionID = session.id
+	p.session = session
+
+	listener, err := listenLocal(p.LocalPort, p.SocketPath)
+	if err != nil {
+		session.close()
+		p.terminateSession()
+		return err
+	}
+	p.listener = listener
+
+	p.wg.Add(1)
+	go p.serve()
+
+	close(p.ready)
+	return nil
+}
+
+// Ready is closed once the local port is accepting connections.
+func (p *NativeSSMProxy) Ready() <-chan struct{} {
+	return p.ready
+}
+
+// LocalAddr returns the address the proxy listens on.
+func (p *NativeSSMProxy) LocalAddr() string {
+	return localAddr(p.LocalPort, p.SocketPath)
+}
+
+// Health reports an error once the data channel or its stream multiplexer
+// has closed, or the local listener has stopped accepting connections. It
+// deliberately does not dial the local port: every accepted connection opens
+// a connection to the remote host from the bastion.
+func (p *NativeSSMProxy) Health(ctx context.Context) error {
+	if p.session == nil {
+		return fmt.Errorf("SSM tunnel not started")
+	}
+	select {
+	case <-p.done:
+		return fmt.Errorf("SSM tunnel stopped")
+	default:
+	}
+	return p.session.health()
+}
+
+// Busy reports whether the tunnel is carrying a connection and cannot take
+// another one straight away, which only happens on the basic protocol.
+func (p *NativeSSMProxy) Busy() bool {
+	return p.session != nil && p.session.busy()
+}
+
+// Done is closed when the tunnel stops, whether through Stop or because the
+// SSM session ended.
+func (p *NativeSSMProxy) Done() <-chan struct{} {
+	return p.done
+}
+
+// Err returns why the data channel closed, if it has.
+func (p *NativeSSMProxy) Err() error {
+	if p.session == nil {
+		return nil
+	}
+	return p.session.channel.Err()
+}
+
+func (p *NativeSSMProxy) Stop() error {
+	var firstErr error
+
+	p.stopOnce.Do(func() {
+		if p.listener != nil {
+			_ = p.listener.Close()
+		}
+		if p.session != nil {
+			p.session.close()
+		}
+		p.wg.Wait()
+		firstErr = p.terminateSession()
+	})
+
+	return firstErr
+}
+
+func (p *NativeSSMProxy) terminateSession() error {
+	if p.API == nil || p.SessionID == "" {
+		return nil
+	}
+	if err := terminateSession(p.API, p.SessionID); err != nil {
+		return err
+	}
+	p.SessionID = ""
+	return nil
+}
+
+func (p *NativeSSMProxy) serve() {
+	defer p.wg.Done()
+	defer close(p.done)
+
+	var conns sync.WaitGroup
+	defer conns.Wait()
+
+	// Stop accepting as soon as the session goes away so clients get a
+	// refused connection instead of hanging.
+	go func() {
+		<-p.session.done()
+		_ = p.listener.Close()
+	}()
+
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logging.Warnf("Failed to accept connection on local port %s: %v", p.LocalPort, err)
+			}
+			return
+		}
+		logging.Debugf("Accepted connection from %s on local port %s", conn.RemoteAddr(), p.LocalPort)
+
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			p.session.relay(conn)
+		}()
+	}
+}
+
+// portSession is an open SSM port forwarding session to a single remote
+// address. On multiplexing agents each connection gets its own smux stream;
+// on older agents connections take turns on the raw data channel.
+type portSession struct {
+	id      string
+	remote  string
+	channel *datachannel.Channel
+	mux     *smux.Session // nil on the basic protocol
+
+	serial sync.Mutex // held while a connection uses the basic protocol
+	active atomic.Int32
+}
+
+// startPortSession starts a port forwarding session to host:port through
+// target with doc and opens its data channel. localPort is informational and
+// may be empty.
+func startPortSession(ctx context.Context, api SessionAPI, doc Document, target, host, port, localPort string) (*portSession, error) {
+	result, err := api.StartSession(ctx, &ssm.StartSessionInput{
+		Target:       aws.String(target),
+		DocumentName: aws.String(doc.DocumentName()),
+		Parameters:   doc.sessionParameters(host, port, localPort),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start SSM session: %w", err)
+	}
+	sessionID := aws.ToString(result.SessionId)
+	logging.Debugf("Started SSM session %s to %s:%s", sessionID, host, port)
+
+	channel, err := datachannel.Open(ctx, aws.ToString(result.StreamUrl), aws.ToString(result.TokenValue))
+	if err != nil {
+		_ = terminateSession(api, sessionID)
+		return nil, fmt.Errorf("failed to open SSM data channel: %w", err)
+	}
+
+	session := &portSession{id: sessionID, remote: net.JoinHostPort(host, port), channel: channel}
+	if channel.Multiplexed() {
+		logging.Debugf("SSM session %s multiplexes connections (agent %s)", sessionID, channel.AgentVersion())
+		session.mux = smux.Client(channel)
+		go session.watchFlags()
+	} else {
+		logging.Debugf("SSM session %s carries one connection at a time (agent %s)", sessionID, channel.AgentVersion())
+	}
+	return session, nil
+}
+
+// relay carries conn over the session until either side closes it, and
+// reports whether the session is still usable afterwards.
+func (s *portSession) relay(conn net.Conn) bool {
+	s.active.Add(1)
+	defer s.active.Add(-1)
+
+	if s.mux == nil {
+		s.serial.Lock()
+		defer s.serial.Unlock()
+		return relayConn(conn, s.channel, s.remote)
+	}
+
+	stream, err := s.mux.OpenStream()
+	if err != nil {
+		logging.Warnf("Failed to open stream to %s: %v", s.remote, err)
+		conn.Close()
+		return false
+	}
+	pipe(conn, stream)
+	return s.health() == nil
+}
+
+// busy reports whether a connection holds the session on the basic protocol.
+func (s *portSession) busy() bool {
+	return s.mux == nil && s.active.Load() > 0
+}
+
+func (s *portSession) health() error {
+	select {
+	case <-s.channel.Done():
+		return fmt.Errorf("SSM data channel closed: %w", s.channel.Err())
+	default:
+	}
+	if s.mux != nil {
+		select {
+		case <-s.mux.Done():
+			return fmt.Errorf("SSM stream multiplexer closed: %w", s.mux.Err())
+		default:
+		}
+	}
+	return nil
+}
+
+// done is closed when the session can no longer carry connections.
+func (s *portSession) done() <-chan struct{} {
+	if s.mux != nil {
+		return s.mux.Done()
+	}
+	return s.channel.Done()
+}
+
+// close closes the data channel; the SSM session itself is ended with
+// terminateSession.
+func (s *portSession) close() {
+	if s.mux != nil {
+		_ = s.mux.Close()
+	}
+	_ = s.channel.Close()
+}
+
+// watchFlags logs connection failures the agent reports while multiplexing.
+func (s *portSession) watchFlags() {
+	for {
+		select {
+		case flag := <-s.channel.Flags():
+			if flag == datachannel.ConnectToPortError {
+				logging.Warnf("Agent failed to connect to %s", s.remote)
+			}
+		case <-s.channel.Done():
+			return
+		}
+	}
+}
+
+func terminateSession(api SessionAPI, sessionID string) error {
+	_, err := api.TerminateSession(context.Background(), &ssm.TerminateSessionInput{
+		SessionId: aws.String(sessionID),
+	})
+	if err != nil {
+		logging.Warnf("Failed to terminate SSM session %s via API: %v", sessionID, err)
+		return fmt.Errorf("failed to terminate SSM session API call: %w", err)
+	}
+	return nil
+}
+
+// relayConn relays a single local connection over the data channel of a
+// basic-protocol session until either side closes it, then tells the agent to
+// drop its connection to the remote host so the channel can carry the next
+// one. It reports whether the channel is still usable.
+func relayConn(conn net.Conn, channel *datachannel.Channel, remote string) bool {
+	// Discard anything left over from a previous connection.
+	for drained := false; !drained; {
+		select {
+		case <-channel.Output():
+		case <-channel.Flags():
+		default:
+			drained = true
+		}
+	}
+
+	finished := make(chan struct{})
+	var relay sync.WaitGroup
+	relay.Add(1)
+	go func() {
+		defer relay.Done()
+		for {
+			select {
+			case data := <-channel.Output():
+				if _, err := conn.Write(data); err != nil {
+					logging.Debugf("Failed to write to local connection: %v", err)
+					conn.Close()
+					return
+				}
+			case flag := <-channel.Flags():
+				if flag == datachannel.ConnectToPortError {
+					logging.Warnf("Agent failed to connect to %s", remote)
+					conn.Close()
+					return
+				}
+			case <-channel.Done():
+				conn.Close()
+				return
+			case <-finished:
+				return
+			}
+		}
+	}()
+
+	if _, err := io.Copy(channel, conn); err != nil {
+		logging.Debugf("Local connection closed: %v", err)
+	}
+	close(finished)
+	relay.Wait()
+	conn.Close()
+
+	select {
+	case <-channel.Done():
+		return false
+	default:
+	}
+	if err := channel.SendFlag(datachannel.DisconnectToPort); err != nil {
+		logging.Warnf("Failed to send disconnect flag: %v", err)
+		return false
+	}
+	return true
+}
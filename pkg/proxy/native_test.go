@@ -0,0 +1,145 @@
+package proxy_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudopsy/ekssm/internal/ssmtest"
+	"github.com/cloudopsy/ekssm/internal/util"
+	"github.com/cloudopsy/ekssm/pkg/datachannel"
+	"github.com/cloudopsy/ekssm/pkg/proxy"
+)
+
+// startLineServer answers every line it receives with "echo: <line>".
+func startLineServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					fmt.Fprintf(conn, "echo: %s\n", scanner.Text())
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func roundTrip(t *testing.T, port, line string) string {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:"+port, time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	_, err = fmt.Fprintf(conn, "%s\n", line)
+	require.NoError(t, err)
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	return reply
+}
+
+func TestNativeSSMProxyForwardsConnections(t *testing.T) {
+	agent := ssmtest.NewAgent(t, startLineServer(t))
+	agent.AgentVersion = ssmtest.BasicAgentVersion
+
+	port, err := util.FindAvailablePort()
+	require.NoError(t, err)
+
+	p := proxy.NewNativeSSMProxy("i-0123456789abcdef0", port, "ABCDEF.gr7.eu-west-1.eks.amazonaws.com", "443")
+	p.API = agent
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, p.Start(ctx))
+
+	input := agent.LastStartSessionInput()
+	require.NotNil(t, input)
+	assert.Equal(t, "i-0123456789abcdef0", *input.Target)
+	assert.Equal(t, "AWS-StartPortForwardingSessionToRemoteHost", *input.DocumentName)
+	assert.Equal(t, []string{"ABCDEF.gr7.eu-west-1.eks.amazonaws.com"}, input.Parameters["host"])
+	assert.Equal(t, []string{port}, input.Parameters["localPortNumber"])
+
+	sessionID := p.SessionID
+
+	// Connections are served one after another over the same session.
+	assert.Equal(t, "echo: hello\n", roundTrip(t, port, "hello"))
+	assert.Equal(t, "echo: again\n", roundTrip(t, port, "again"))
+
+	assert.Eventually(t, func() bool {
+		for _, flag := range agent.Flags() {
+			if flag == datachannel.DisconnectToPort {
+				return true
+			}
+		}
+		return false
+	}, 2*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, p.Stop())
+	assert.Equal(t, []string{sessionID}, agent.TerminatedSessions())
+
+	select {
+	case <-p.Done():
+	case <-time.After(time.Second):
+		t.Fatal("proxy did not report completion after Stop")
+	}
+}
+
+func TestNativeSSMProxyMultiplexesConcurrentConnections(t *testing.T) {
+	agent := ssmtest.NewAgent(t, startLineServer(t))
+
+	port, err := util.FindAvailablePort()
+	require.NoError(t, err)
+
+	p := proxy.NewNativeSSMProxy("i-0123456789abcdef0", port, "ABCDEF.gr7.eu-west-1.eks.amazonaws.com", "443")
+	p.API = agent
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, p.Start(ctx))
+	defer p.Stop()
+
+	// Hold one connection open, like a "kubectl logs -f", while others are served.
+	held, err := net.DialTimeout("tcp", "127.0.0.1:"+port, time.Second)
+	require.NoError(t, err)
+	defer held.Close()
+	require.NoError(t, held.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err = fmt.Fprintf(held, "held\n")
+	require.NoError(t, err)
+	heldReader := bufio.NewReader(held)
+	reply, err := heldReader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "echo: held\n", reply)
+
+	assert.False(t, p.Busy())
+	assert.Equal(t, "echo: hello\n", roundTrip(t, port, "hello"))
+	assert.Equal(t, "echo: again\n", roundTrip(t, port, "again"))
+
+	// The held connection still works after the others have finished.
+	_, err = fmt.Fprintf(held, "still here\n")
+	require.NoError(t, err)
+	reply, err = heldReader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "echo: still here\n", reply)
+
+	assert.Equal(t, 3, agent.Streams())
+	assert.Empty(t, agent.Flags())
+	assert.NoError(t, p.Health(ctx))
+}
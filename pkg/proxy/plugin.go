@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/cloudopsy/ekssm/internal/logging"
+	"github.com/cloudopsy/ekssm/pkg/datachannel"
+)
+
+const (
+	// PluginPathEnv overrides where the session-manager-plugin is found.
+	PluginPathEnv = "EKSSM_PLUGIN_PATH"
+
+	// MinPluginVersion is the first session-manager-plugin release that
+	// supports AWS-StartPortForwardingSessionToRemoteHost.
+	MinPluginVersion = "1.2.285.0"
+
+	pluginInstallURL     = "https://docs.aws.amazon.com/systems-manager/latest/userguide/session-manager-working-with-install-plugin.html"
+	pluginVersionTimeout = 10 * time.Second
+)
+
+var (
+	// ErrPluginNotFound is returned when no session-manager-plugin is installed.
+	ErrPluginNotFound = errors.New("session-manager-plugin not found")
+	// ErrPluginTooOld is returned when the installed plugin cannot forward
+	// to a remote host.
+	ErrPluginTooOld = errors.New("session-manager-plugin is too old")
+)
+
+var pluginVersionPattern = regexp.MustCompile(`\d+(\.\d+)+`)
+
+// PluginError reports a session-manager-plugin that cannot be used, with
+// guidance on installing one. It wraps ErrPluginNotFound, ErrPluginTooOld or
+// the failure to run the plugin.
+type PluginError struct {
+	// Path is the plugin that was found, if any.
+	Path string
+	// Version is the version it reported, if any.
+	Version string
+	Err     error
+}
+
+func (e *PluginError) Error() string {
+	var msg string
+	switch {
+	case errors.Is(e.Err, ErrPluginNotFound) && e.Path != "":
+		msg = fmt.Sprintf("%v at %s, set by $%s", e.Err, e.Path, PluginPathEnv)
+	case errors.Is(e.Err, ErrPluginNotFound):
+		msg = fmt.Sprintf("%v in $PATH or the usual install locations", e.Err)
+	case errors.Is(e.Err, ErrPluginTooOld):
+		msg = fmt.Sprintf("%s is version %s; remote host port forwarding needs %s or later", e.Path, e.Version, MinPluginVersion)
+	default:
+		msg = fmt.Sprintf("cannot use session-manager-plugin at %s: %v", e.Path, e.Err)
+	}
+	return fmt.Sprintf("%s. Install or update it (%s), point $%s at it, or use --backend %s, which needs no plugin",
+		msg, pluginInstallURL, PluginPathEnv, BackendSSM)
+}
+
+func (e *PluginError) Unwrap() error {
+	return e.Err
+}
+
+// pluginName is the plugin's executable name.
+func pluginName() string {
+	if runtime.GOOS == "windows" {
+		return "session-manager-plugin.exe"
+	}
+	return "session-manager-plugin"
+}
+
+// pluginInstallPaths are where the official installers put the plugin, for
+// when it is not on $PATH.
+func pluginInstallPaths() []string {
+	if runtime.GOOS == "windows" {
+		return []string{
+			filepath.Join(os.Getenv("ProgramFiles"), "Amazon", "SessionManagerPlugin", "bin", pluginName()),
+		}
+	}
+	return []string{
+		"/usr/local/bin/session-manager-plugin",
+		"/usr/local/sessionmanagerplugin/bin/session-manager-plugin",
+		"/opt/homebrew/bin/session-manager-plugin",
+		"/usr/bin/session-manager-plugin",
+	}
+}
+
+// FindPlugin returns the path of the session-manager-plugin: $EKSSM_PLUGIN_PATH
+// when set, otherwise the first one on $PATH or in a usual install location.
+func FindPlugin() (string, error) {
+	if path := os.Getenv(PluginPathEnv); path != "" {
+		if _, err := os.Stat(path); err != nil {
+			return "", &PluginError{Path: path, Err: ErrPluginNotFound}
+		}
+		return path, nil
+	}
+	if path, err := exec.LookPath(pluginName()); err == nil {
+		return path, nil
+	}
+	for _, path := range pluginInstallPaths() {
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path, nil
+		}
+	}
+	return "", &PluginError{Err: ErrPluginNotFound}
+}
+
+// PluginVersion runs the plugin at path with --version and returns the
+// version it reports.
+func PluginVersion(ctx context.Context, path string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, pluginVersionTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, path, "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to run %s --version: %w", path, err)
+	}
+	version := pluginVersionPattern.FindString(strings.TrimSpace(string(output)))
+	if version == "" {
+		return "", fmt.Errorf("unrecognised %s --version output %q", path, strings.TrimSpace(string(output)))
+	}
+	return version, nil
+}
+
+// CheckPlugin finds the session-manager-plugin and checks that it supports
+// remote host port forwarding, returning its path. Problems are reported as
+// a *PluginError.
+func CheckPlugin(ctx context.Context) (string, error) {
+	path, err := FindPlugin()
+	if err != nil {
+		return "", err
+	}
+	version, err := PluginVersion(ctx, path)
+	if err != nil {
+		return "", &PluginError{Path: path, Err: err}
+	}
+	if datachannel.CompareVersions(version, MinPluginVersion) < 0 {
+		return "", &PluginError{Path: path, Version: version, Err: ErrPluginTooOld}
+	}
+	logging.Debugf("Using session-manager-plugin %s at %s", version, path)
+	return path, nil
+}
@@ -0,0 +1,76 @@
+package proxy_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudopsy/ekssm/pkg/proxy"
+)
+
+// fakePlugin writes a session-manager-plugin stand-in that prints output
+// for --version.
+func fakePlugin(t *testing.T, output string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake plugin is a shell script")
+	}
+	path := filepath.Join(t.TempDir(), "session-manager-plugin")
+	require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\necho '"+output+"'\n"), 0700))
+	return path
+}
+
+func TestCheckPlugin(t *testing.T) {
+	path := fakePlugin(t, "1.2.650.0")
+	t.Setenv(proxy.PluginPathEnv, path)
+
+	found, err := proxy.CheckPlugin(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, path, found)
+}
+
+func TestCheckPluginTooOld(t *testing.T) {
+	path := fakePlugin(t, "1.1.61.0")
+	t.Setenv(proxy.PluginPathEnv, path)
+
+	_, err := proxy.CheckPlugin(context.Background())
+	require.ErrorIs(t, err, proxy.ErrPluginTooOld)
+	var pluginErr *proxy.PluginError
+	require.True(t, errors.As(err, &pluginErr))
+	assert.Equal(t, "1.1.61.0", pluginErr.Version)
+	assert.Contains(t, err.Error(), proxy.MinPluginVersion)
+	assert.Contains(t, err.Error(), "--backend ssm")
+}
+
+func TestCheckPluginMissingOverride(t *testing.T) {
+	t.Setenv(proxy.PluginPathEnv, filepath.Join(t.TempDir(), "missing"))
+
+	_, err := proxy.CheckPlugin(context.Background())
+	require.ErrorIs(t, err, proxy.ErrPluginNotFound)
+	assert.Contains(t, err.Error(), proxy.PluginPathEnv)
+}
+
+func TestCheckPluginUnrecognisedVersion(t *testing.T) {
+	t.Setenv(proxy.PluginPathEnv, fakePlugin(t, "not a version"))
+
+	_, err := proxy.CheckPlugin(context.Background())
+	var pluginErr *proxy.PluginError
+	require.True(t, errors.As(err, &pluginErr))
+	assert.ErrorContains(t, err, "unrecognised")
+}
+
+func TestSSMProxyChecksPluginBeforeStartingSession(t *testing.T) {
+	t.Setenv(proxy.PluginPathEnv, filepath.Join(t.TempDir(), "missing"))
+
+	// No AWS configuration is needed: the plugin is checked first.
+	p := proxy.NewSSMProxy("i-0123456789abcdef0", "8443", "ABCDEF.gr7.eu-west-1.eks.amazonaws.com", "443")
+	err := p.Start(context.Background())
+	require.ErrorIs(t, err, proxy.ErrPluginNotFound)
+	assert.Empty(t, p.SessionID)
+}
@@ -0,0 +1,255 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudopsy/ekssm/internal/logging"
+)
+
+// TrafficStats counts the traffic relays carry. It is safe for concurrent
+// use, and a session's relays share one so their traffic adds up.
+type TrafficStats struct {
+	connections  atomic.Int64
+	active       atomic.Int64
+	bytesIn      atomic.Int64
+	bytesOut     atomic.Int64
+	lastActivity atomic.Int64 // unix nanoseconds
+}
+
+// Traffic is a snapshot of TrafficStats. BytesIn counts bytes received from
+// local clients and sent into the tunnel, BytesOut the bytes sent back.
+type Traffic struct {
+	Connections       int64
+	ActiveConnections int64
+	BytesIn           int64
+	BytesOut          int64
+	// LastActivity is when bytes last moved in either direction, or zero.
+	LastActivity time.Time
+}
+
+// Snapshot returns the current counters.
+func (s *TrafficStats) Snapshot() Traffic {
+	t := Traffic{
+		Connections:       s.connections.Load(),
+		ActiveConnections: s.active.Load(),
+		BytesIn:           s.bytesIn.Load(),
+		BytesOut:          s.bytesOut.Load(),
+	}
+	if last := s.lastActivity.Load(); last != 0 {
+		t.LastActivity = time.Unix(0, last)
+	}
+	return t
+}
+
+func (s *TrafficStats) transferred(counter *atomic.Int64, n int) {
+	counter.Add(int64(n))
+	s.lastActivity.Store(time.Now().UnixNano())
+}
+
+// Relay owns a session's local listener and relays every connection to the
+// local address of an upstream tunnel, counting the traffic as it goes. The
+// upstream listens on an internal address only the relay uses, so the
+// traffic is counted whatever the backend, including the session manager
+// plugin, which binds its own port. Traffic the process sends itself, such
+// as keepalives, goes to the upstream directly and is not counted.
+type Relay struct {
+	LocalPort  string
+	SocketPath string
+	Upstream   Tunnel
+	Stats      *TrafficStats
+
+	listener net.Listener
+	ready    chan struct{}
+	done     chan struct{}
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// NewRelay returns a relay listening on the Unix socket at socketPath when
+// set, otherwise on localPort. A nil stats gets a fresh TrafficStats.
+func NewRelay(localPort, socketPath string, upstream Tunnel, stats *TrafficStats) *Relay {
+	if stats == nil {
+		stats = &TrafficStats{}
+	}
+	return &Relay{
+		LocalPort:  localPort,
+		SocketPath: socketPath,
+		Upstream:   upstream,
+		Stats:      stats,
+		ready:      make(chan struct{}),
+		done:       make(chan struct{}),
+		conns:      make(map[net.Conn]struct{}),
+	}
+}
+
+// Start starts the upstream tunnel, then listens locally.
+func (r *Relay) Start(ctx context.Context) error {
+	if r.Upstream == nil {
+		return fmt.Errorf("upstream tunnel is required")
+	}
+	if err := r.Upstream.Start(ctx); err != nil {
+		return err
+	}
+
+	listener, err := listenLocal(r.LocalPort, r.SocketPath)
+	if err != nil {
+		_ = r.Upstream.Stop()
+		return err
+	}
+	r.listener = listener
+	logging.Debugf("Relay listening on %s", r.LocalAddr())
+
+	r.wg.Add(1)
+	go r.serve()
+
+	close(r.ready)
+	return nil
+}
+
+func (r *Relay) Ready() <-chan struct{} {
+	return r.ready
+}
+
+func (r *Relay) Done() <-chan struct{} {
+	return r.done
+}
+
+func (r *Relay) LocalAddr() string {
+	return localAddr(r.LocalPort, r.SocketPath)
+}
+
+// Health reports an error once the relay has stopped, otherwise the health
+// of the upstream tunnel.
+func (r *Relay) Health(ctx context.Context) error {
+	select {
+	case <-r.done:
+		return fmt.Errorf("relay stopped")
+	default:
+	}
+	return r.Upstream.Health(ctx)
+}
+
+// Busy reports whether the upstream tunnel is busy carrying a connection.
+func (r *Relay) Busy() bool {
+	return tunnelBusy(r.Upstream)
+}
+
+// Stop closes the local listener and every relayed connection and stops the
+// upstream tunnel, abandoning any start of it still in progress.
+func (r *Relay) Stop() error {
+	var err error
+	r.stopOnce.Do(func() {
+		if r.listener != nil {
+			_ = r.listener.Close()
+		}
+		r.mu.Lock()
+		for conn := range r.conns {
+			conn.Close()
+		}
+		r.mu.Unlock()
+		if r.Upstream != nil {
+			err = r.Upstream.Stop()
+		}
+		r.wg.Wait()
+	})
+	return err
+}
+
+func (r *Relay) serve() {
+	defer r.wg.Done()
+	defer close(r.done)
+
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logging.Warnf("Relay stopped accepting connections on %s: %v", r.LocalAddr(), err)
+			}
+			return
+		}
+
+		r.mu.Lock()
+		r.conns[conn] = struct{}{}
+		r.mu.Unlock()
+
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			defer func() {
+				r.mu.Lock()
+				delete(r.conns, conn)
+				r.mu.Unlock()
+			}()
+			r.handle(conn)
+		}()
+	}
+}
+
+func (r *Relay) handle(conn net.Conn) {
+	r.Stats.connections.Add(1)
+	r.Stats.active.Add(1)
+	defer r.Stats.active.Add(-1)
+
+	// A lazy upstream is started by the connections that need it.
+	if a, ok := r.Upstream.(acquirer); ok {
+		if err := a.Acquire(); err != nil {
+			logging.Warnf("Relay on %s: failed to start tunnel: %v", r.LocalAddr(), err)
+			conn.Close()
+			return
+		}
+		defer a.Release()
+	}
+
+	// While a supervised upstream reconnects it has no address.
+	addr := r.Upstream.LocalAddr()
+	if addr == "" {
+		logging.Debugf("Relay on %s: tunnel is reconnecting, dropping connection", r.LocalAddr())
+		conn.Close()
+		return
+	}
+	upstream, err := net.DialTimeout(LocalNetwork(addr), addr, 10*time.Second)
+	if err != nil {
+		logging.Warnf("Relay on %s: failed to reach tunnel at %s: %v", r.LocalAddr(), addr, err)
+		conn.Close()
+		return
+	}
+	pipe(&countedConn{Conn: conn, stats: r.Stats}, upstream)
+}
+
+// countedConn counts the bytes read from and written to a local client.
+type countedConn struct {
+	net.Conn
+	stats *TrafficStats
+}
+
+func (c *countedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.stats.transferred(&c.stats.bytesIn, n)
+	}
+	return n, err
+}
+
+func (c *countedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.stats.transferred(&c.stats.bytesOut, n)
+	}
+	return n, err
+}
+
+func (c *countedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,97 @@
+package proxy_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudopsy/ekssm/internal/util"
+	"github.com/cloudopsy/ekssm/pkg/proxy"
+)
+
+func TestRelayCountsTraffic(t *testing.T) {
+	host, remotePort, err := net.SplitHostPort(startLineServer(t))
+	require.NoError(t, err)
+
+	upstreamPort, err := util.FindAvailablePort()
+	require.NoError(t, err)
+	port, err := util.FindAvailablePort()
+	require.NoError(t, err)
+
+	stats := &proxy.TrafficStats{}
+	relay := proxy.NewRelay(port, "", proxy.NewDirectProxy(upstreamPort, host, remotePort), stats)
+	require.NoError(t, relay.Start(context.Background()))
+	defer relay.Stop()
+	assert.Equal(t, "127.0.0.1:"+port, relay.LocalAddr())
+
+	assert.Equal(t, proxy.Traffic{}, stats.Snapshot())
+
+	before := time.Now()
+	assert.Equal(t, "echo: hello\n", roundTrip(t, port, "hello"))
+	assert.Equal(t, "echo: hi\n", roundTrip(t, port, "hi"))
+
+	// The relay finishes counting once both sides of a connection close.
+	require.Eventually(t, func() bool {
+		return stats.Snapshot().ActiveConnections == 0
+	}, 2*time.Second, 10*time.Millisecond)
+
+	traffic := stats.Snapshot()
+	assert.Equal(t, int64(2), traffic.Connections)
+	assert.Equal(t, int64(len("hello\n")+len("hi\n")), traffic.BytesIn)
+	assert.Equal(t, int64(len("echo: hello\n")+len("echo: hi\n")), traffic.BytesOut)
+	assert.False(t, traffic.LastActivity.Before(before))
+}
+
+func TestRelaySharesStatsAndSkipsUpstreamTraffic(t *testing.T) {
+	host, remotePort, err := net.SplitHostPort(startLineServer(t))
+	require.NoError(t, err)
+
+	stats := &proxy.TrafficStats{}
+	var ports []string
+	for i := 0; i < 2; i++ {
+		upstreamPort, err := util.FindAvailablePort()
+		require.NoError(t, err)
+		port, err := util.FindAvailablePort()
+		require.NoError(t, err)
+
+		relay := proxy.NewRelay(port, "", proxy.NewDirectProxy(upstreamPort, host, remotePort), stats)
+		require.NoError(t, relay.Start(context.Background()))
+		defer relay.Stop()
+		ports = append(ports, port)
+
+		// Connections made straight to the upstream, as keepalives are, are
+		// not counted.
+		assert.Equal(t, "echo: keepalive\n", roundTrip(t, upstreamPort, "keepalive"))
+	}
+	for _, port := range ports {
+		assert.Equal(t, "echo: x\n", roundTrip(t, port, "x"))
+	}
+
+	traffic := stats.Snapshot()
+	assert.Equal(t, int64(2), traffic.Connections)
+	assert.Equal(t, int64(2*len("x\n")), traffic.BytesIn)
+}
+
+func TestRelayStopStopsUpstream(t *testing.T) {
+	host, remotePort, err := net.SplitHostPort(startLineServer(t))
+	require.NoError(t, err)
+
+	upstreamPort, err := util.FindAvailablePort()
+	require.NoError(t, err)
+	port, err := util.FindAvailablePort()
+	require.NoError(t, err)
+
+	upstream := proxy.NewDirectProxy(upstreamPort, host, remotePort)
+	relay := proxy.NewRelay(port, "", upstream, nil)
+	require.NoError(t, relay.Start(context.Background()))
+	require.NoError(t, relay.Health(context.Background()))
+
+	require.NoError(t, relay.Stop())
+	<-relay.Done()
+	<-upstream.Done()
+	assert.Error(t, relay.Health(context.Background()))
+}
@@ -0,0 +1,431 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cloudopsy/ekssm/internal/logging"
+	awsclient "github.com/cloudopsy/ekssm/pkg/aws"
+)
+
+const (
+	socksVersion = 5
+
+	socksAuthNone         = 0x00
+	socksAuthUnacceptable = 0xff
+
+	socksCmdConnect = 0x01
+
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+
+	socksReplySucceeded           = 0x00
+	socksReplyHostUnreachable     = 0x04
+	socksReplyCommandNotSupported = 0x07
+	socksReplyAddressNotSupported = 0x08
+
+	socksHandshakeTimeout = 10 * time.Second
+	// maxIdleStreams caps the idle basic-protocol SSM sessions kept per
+	// destination.
+	maxIdleStreams = 2
+)
+
+// SOCKSProxy is a local SOCKS5 server that reaches each requested destination
+// from the bastion. With the ssm backend every destination gets its own SSM
+// port forwarding session, opened on demand and kept for reuse once the
+// client connection closes; on multiplexing agents that session is shared by
+// all connections to the destination. With the direct backend connections
+// are dialled from this machine.
+type SOCKSProxy struct {
+	Backend    string
+	InstanceID string
+	LocalPort  string
+	// Document is the SSM document sessions are started with.
+	Document Document
+
+	// API overrides the SSM client built from the default AWS configuration.
+	API SessionAPI
+
+	listener net.Listener
+	ready    chan struct{}
+	done     chan struct{}
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	idle     map[string][]*portSession
+	sessions map[*portSession]struct{}
+}
+
+func NewSOCKSProxy(backend, instanceID, localPort string) *SOCKSProxy {
+	if backend == "" {
+		backend = BackendSSM
+	}
+	return &SOCKSProxy{
+		Backend:    backend,
+		InstanceID: instanceID,
+		LocalPort:  localPort,
+		ready:      make(chan struct{}),
+		done:       make(chan struct{}),
+		conns:      make(map[net.Conn]struct{}),
+		idle:       make(map[string][]*portSession),
+		sessions:   make(map[*portSession]struct{}),
+	}
+}
+
+// ValidateSOCKSBackend returns an error if backend cannot serve SOCKS mode.
+// The plugin backend is excluded because it needs a local port per destination.
+func ValidateSOCKSBackend(backend string) error {
+	switch backend {
+	case BackendSSM, BackendDirect, "":
+		return nil
+	default:
+		return fmt.Errorf("SOCKS mode is not supported by the %s backend (use %s or %s)", backend, BackendSSM, BackendDirect)
+	}
+}
+
+func (p *SOCKSProxy) Start(ctx context.Context) error {
+	if err := ValidateSOCKSBackend(p.Backend); err != nil {
+		return err
+	}
+	if p.LocalPort == "" {
+		return fmt.Errorf("localPort is required")
+	}
+	if p.Backend == BackendSSM {
+		if p.InstanceID == "" {
+			return fmt.Errorf("instanceID is required")
+		}
+		if p.API == nil {
+			client, err := awsclient.NewClient(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to create AWS client: %w", err)
+			}
+			p.API = client.SSM
+		}
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", p.LocalPort))
+	if err != nil {
+		return fmt.Errorf("failed to listen on local port %s: %w", p.LocalPort, err)
+	}
+	p.listener = listener
+	logging.Debugf("SOCKS5 proxy listening on %s (backend %s)", p.LocalAddr(), p.Backend)
+
+	p.wg.Add(1)
+	go p.serve()
+
+	close(p.ready)
+	return nil
+}
+
+func (p *SOCKSProxy) Ready() <-chan struct{} {
+	return p.ready
+}
+
+func (p *SOCKSProxy) Done() <-chan struct{} {
+	return p.done
+}
+
+func (p *SOCKSProxy) LocalAddr() string {
+	return net.JoinHostPort("127.0.0.1", p.LocalPort)
+}
+
+// URL returns the proxy URL clients should be configured with.
+func (p *SOCKSProxy) URL() string {
+	return "socks5://" + p.LocalAddr()
+}
+
+// Health reports an error once the SOCKS server has stopped. Destinations are
+// reached on demand, so there is no single upstream to check.
+func (p *SOCKSProxy) Health(ctx context.Context) error {
+	select {
+	case <-p.done:
+		return fmt.Errorf("SOCKS proxy stopped")
+	default:
+		return nil
+	}
+}
+
+func (p *SOCKSProxy) Stop() error {
+	var firstErr error
+	p.stopOnce.Do(func() {
+		if p.listener != nil {
+			_ = p.listener.Close()
+		}
+		p.mu.Lock()
+		for conn := range p.conns {
+			conn.Close()
+		}
+		p.mu.Unlock()
+		p.wg.Wait()
+
+		p.mu.Lock()
+		sessions := p.sessions
+		p.sessions = make(map[*portSession]struct{})
+		p.idle = make(map[string][]*portSession)
+		p.mu.Unlock()
+		for session := range sessions {
+			if err := p.closeSession(session); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	})
+	return firstErr
+}
+
+func (p *SOCKSProxy) serve() {
+	defer p.wg.Done()
+	defer close(p.done)
+
+	var conns sync.WaitGroup
+	defer conns.Wait()
+
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logging.Warnf("Failed to accept connection on local port %s: %v", p.LocalPort, err)
+			}
+			return
+		}
+
+		p.track(conn)
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			defer p.untrack(conn)
+			p.handle(conn)
+		}()
+	}
+}
+
+func (p *SOCKSProxy) handle(conn net.Conn) {
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	host, port, err := socksHandshake(conn)
+	if err != nil {
+		logging.Debugf("SOCKS handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	dest := net.JoinHostPort(host, port)
+	logging.Debugf("SOCKS CONNECT to %s from %s", dest, conn.RemoteAddr())
+
+	if p.Backend == BackendDirect {
+		remote, err := net.DialTimeout("tcp", dest, 10*time.Second)
+		if err != nil {
+			logging.Warnf("Failed to connect to %s: %v", dest, err)
+			_ = socksReply(conn, socksReplyHostUnreachable)
+			return
+		}
+		p.track(remote)
+		defer p.untrack(remote)
+		if err := socksReply(conn, socksReplySucceeded); err != nil {
+			remote.Close()
+			return
+		}
+		pipe(conn, remote)
+		return
+	}
+
+	session, err := p.acquire(dest, host, port)
+	if err != nil {
+		logging.Warnf("Failed to open SSM stream to %s: %v", dest, err)
+		_ = socksReply(conn, socksReplyHostUnreachable)
+		return
+	}
+	if err := socksReply(conn, socksReplySucceeded); err != nil {
+		p.release(dest, session, true)
+		return
+	}
+	p.release(dest, session, session.relay(conn))
+}
+
+// acquire returns a session to dest that can take a connection, starting a
+// new SSM session if none is available. Multiplexed sessions stay in the
+// pool while in use, since they carry any number of connections.
+func (p *SOCKSProxy) acquire(dest, host, port string) (*portSession, error) {
+	p.mu.Lock()
+	for len(p.idle[dest]) > 0 {
+		sessions := p.idle[dest]
+		session := sessions[len(sessions)-1]
+
+		if session.health() != nil {
+			p.idle[dest] = sessions[:len(sessions)-1]
+			delete(p.sessions, session)
+			p.mu.Unlock()
+			_ = p.closeSession(session)
+			p.mu.Lock()
+			continue
+		}
+		if session.mux == nil {
+			p.idle[dest] = sessions[:len(sessions)-1]
+		}
+		p.mu.Unlock()
+		logging.Debugf("Reusing SSM session %s for %s", session.id, dest)
+		return session, nil
+	}
+	p.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	session, err := startPortSession(ctx, p.API, p.Document, p.InstanceID, host, port, "")
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.done:
+		go p.closeSession(session)
+		return nil, fmt.Errorf("SOCKS proxy stopped")
+	default:
+	}
+	p.sessions[session] = struct{}{}
+	if session.mux != nil {
+		p.idle[dest] = append(p.idle[dest], session)
+	}
+	return session, nil
+}
+
+// release hands a session back after a connection is done with it. Basic
+// sessions return to the idle pool unless they are no longer usable or the
+// pool for dest is full; unusable sessions are closed.
+func (p *SOCKSProxy) release(dest string, session *portSession, usable bool) {
+	p.mu.Lock()
+	_, tracked := p.sessions[session]
+	if tracked && usable {
+		if session.mux != nil {
+			p.mu.Unlock()
+			return
+		}
+		if len(p.idle[dest]) < maxIdleStreams {
+			p.idle[dest] = append(p.idle[dest], session)
+			p.mu.Unlock()
+			return
+		}
+	}
+	delete(p.sessions, session)
+	p.idle[dest] = removeSession(p.idle[dest], session)
+	p.mu.Unlock()
+	_ = p.closeSession(session)
+}
+
+func (p *SOCKSProxy) closeSession(session *portSession) error {
+	session.close()
+	return terminateSession(p.API, session.id)
+}
+
+func removeSession(sessions []*portSession, session *portSession) []*portSession {
+	for i, s := range sessions {
+		if s == session {
+			return append(sessions[:i], sessions[i+1:]...)
+		}
+	}
+	return sessions
+}
+
+func (p *SOCKSProxy) track(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conns[conn] = struct{}{}
+}
+
+func (p *SOCKSProxy) untrack(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.conns, conn)
+}
+
+// socksHandshake negotiates a SOCKS5 CONNECT request without authentication
+// and returns the requested destination.
+func socksHandshake(conn net.Conn) (string, string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", "", err
+	}
+	if header[0] != socksVersion {
+		return "", "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", "", err
+	}
+	method := byte(socksAuthUnacceptable)
+	for _, m := range methods {
+		if m == socksAuthNone {
+			method = socksAuthNone
+			break
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", "", err
+	}
+	if method == socksAuthUnacceptable {
+		return "", "", fmt.Errorf("client does not offer unauthenticated access")
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", "", err
+	}
+	if request[0] != socksVersion {
+		return "", "", fmt.Errorf("unsupported SOCKS version %d", request[0])
+	}
+	if request[1] != socksCmdConnect {
+		_ = socksReply(conn, socksReplyCommandNotSupported)
+		return "", "", fmt.Errorf("unsupported SOCKS command %d", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		size := net.IPv4len
+		if request[3] == socksAddrIPv6 {
+			size = net.IPv6len
+		}
+		addr := make([]byte, size)
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return "", "", err
+		}
+		host = net.IP(addr).String()
+	case socksAddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", "", err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", "", err
+		}
+		host = string(name)
+	default:
+		_ = socksReply(conn, socksReplyAddressNotSupported)
+		return "", "", fmt.Errorf("unsupported SOCKS address type %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", "", err
+	}
+	return host, strconv.Itoa(int(binary.BigEndian.Uint16(port))), nil
+}
+
+// socksReply sends a reply with an unspecified bound address; clients do not
+// use it for CONNECT.
+func socksReply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{socksVersion, code, 0x00, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
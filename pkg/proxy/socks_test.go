@@ -0,0 +1,106 @@
+package proxy_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudopsy/ekssm/internal/ssmtest"
+	"github.com/cloudopsy/ekssm/internal/util"
+	"github.com/cloudopsy/ekssm/pkg/proxy"
+)
+
+// socksConnect opens a SOCKS5 CONNECT to host:port through the proxy on port.
+func socksConnect(t *testing.T, port, host string, destPort uint16) net.Conn {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:"+port, time.Second)
+	require.NoError(t, err)
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	_, err = conn.Write([]byte{5, 1, 0})
+	require.NoError(t, err)
+	method := make([]byte, 2)
+	_, err = io.ReadFull(conn, method)
+	require.NoError(t, err)
+	require.Equal(t, []byte{5, 0}, method)
+
+	request := append([]byte{5, 1, 0, 3, byte(len(host))}, host...)
+	request = binary.BigEndian.AppendUint16(request, destPort)
+	_, err = conn.Write(request)
+	require.NoError(t, err)
+	reply := make([]byte, 10)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	require.Equal(t, byte(0), reply[1], "SOCKS reply code")
+	return conn
+}
+
+func TestSOCKSProxyOpensSSMStreamPerDestination(t *testing.T) {
+	agent := ssmtest.NewAgent(t, startLineServer(t))
+	agent.AgentVersion = ssmtest.BasicAgentVersion
+
+	port, err := util.FindAvailablePort()
+	require.NoError(t, err)
+
+	p := proxy.NewSOCKSProxy(proxy.BackendSSM, "i-0123456789abcdef0", port)
+	p.API = agent
+	require.NoError(t, p.Start(context.Background()))
+
+	for i, line := range []string{"first", "second"} {
+		conn := socksConnect(t, port, "db.internal.example.com", 5432)
+		_, err := fmt.Fprintf(conn, "%s\n", line)
+		require.NoError(t, err)
+		reply, err := bufio.NewReader(conn).ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "echo: "+line+"\n", reply)
+		conn.Close()
+
+		// Wait for the stream to be handed back before reusing it.
+		require.Eventually(t, func() bool { return len(agent.Flags()) == i+1 }, 2*time.Second, 10*time.Millisecond)
+	}
+
+	input := agent.LastStartSessionInput()
+	require.NotNil(t, input)
+	assert.Equal(t, []string{"db.internal.example.com"}, input.Parameters["host"])
+	assert.Equal(t, []string{"5432"}, input.Parameters["portNumber"])
+
+	require.NoError(t, p.Stop())
+	// Both connections were carried by the same, reused SSM session.
+	assert.Len(t, agent.TerminatedSessions(), 1)
+}
+
+func TestSOCKSProxySharesMultiplexedSession(t *testing.T) {
+	agent := ssmtest.NewAgent(t, startLineServer(t))
+
+	port, err := util.FindAvailablePort()
+	require.NoError(t, err)
+
+	p := proxy.NewSOCKSProxy(proxy.BackendSSM, "i-0123456789abcdef0", port)
+	p.API = agent
+	require.NoError(t, p.Start(context.Background()))
+
+	// Two connections open at the same time share one SSM session.
+	first := socksConnect(t, port, "db.internal.example.com", 5432)
+	defer first.Close()
+	second := socksConnect(t, port, "db.internal.example.com", 5432)
+	defer second.Close()
+	for _, conn := range []net.Conn{first, second} {
+		_, err := fmt.Fprintf(conn, "ping\n")
+		require.NoError(t, err)
+		reply, err := bufio.NewReader(conn).ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "echo: ping\n", reply)
+	}
+
+	assert.Equal(t, 2, agent.Streams())
+	require.NoError(t, p.Stop())
+	assert.Len(t, agent.TerminatedSessions(), 1)
+}
@@ -1,13 +1,13 @@
 package proxy
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"os/exec"
-	"runtime"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -18,15 +18,34 @@ import (
 	awsclient "github.com/cloudopsy/ekssm/pkg/aws"
 )
 
+// pluginStderrTailSize bounds the plugin's stderr kept for reporting why it
+// failed.
+const pluginStderrTailSize = 8 << 10
+
+// SSMProxy forwards a local port through an SSM port forwarding session
+// handled by the external session-manager-plugin process.
 type SSMProxy struct {
 	InstanceID string
 	LocalPort  string
 	RemoteHost string
 	RemotePort string
-	cmd        *exec.Cmd
-	SessionID  string
-	ctx        context.Context
-	client     *awsclient.Client
+	// Document is the SSM document the session is started with.
+	Document Document
+	// Stdout and Stderr receive the plugin's output. Stdout defaults to
+	// os.Stdout; the end of stderr is also kept to report why the plugin
+	// failed.
+	Stdout    io.Writer
+	Stderr    io.Writer
+	cmd       *exec.Cmd
+	SessionID string
+	// Client overrides the AWS client built from the default AWS
+	// configuration.
+	Client  *awsclient.Client
+	ctx     context.Context
+	stderr  *util.TailBuffer
+	ready   chan struct{}
+	done    chan struct{}
+	waitErr error
 }
 
 func NewSSMProxy(instanceID, localPort, remoteHost, remotePort string) *SSMProxy {
@@ -39,48 +58,56 @@ func NewSSMProxy(instanceID, localPort, remoteHost, remotePort string) *SSMProxy
 		RemoteHost: remoteHost,
 		RemotePort: remotePort,
 		ctx:        context.Background(),
+		ready:      make(chan struct{}),
+		done:       make(chan struct{}),
 	}
 }
 
-func (p *SSMProxy) StartBackground() (int, error) {
+// Start starts the SSM session and the plugin, and waits for the plugin to
+// open the local port.
+func (p *SSMProxy) Start(ctx context.Context) error {
 	if p.InstanceID == "" {
-		return -1, fmt.Errorf("instanceID is required")
+		return fmt.Errorf("instanceID is required")
 	}
 	if p.LocalPort == "" {
-		return -1, fmt.Errorf("localPort is required")
+		return fmt.Errorf("localPort is required")
 	}
 	if p.RemoteHost == "" {
-		return -1, fmt.Errorf("remoteHost (EKS endpoint) is required")
+		return fmt.Errorf("remoteHost (EKS endpoint) is required")
 	}
 	if p.RemotePort == "" {
-		return -1, fmt.Errorf("remotePort is required")
+		return fmt.Errorf("remotePort is required")
 	}
 
 	logging.Debugf("Starting SSM port forwarding to remote host %s:%s via instance %s on local port %s",
 		p.RemoteHost, p.RemotePort, p.InstanceID, p.LocalPort)
 
-	var err error
-	p.client, err = awsclient.NewClient(p.ctx)
+	// A missing or outdated plugin is reported before a session is started
+	// that nothing would connect to.
+	pluginPath, err := CheckPlugin(ctx)
 	if err != nil {
-		logging.Errorf("Failed to create AWS client: %v", err)
-		return -1, fmt.Errorf("failed to create AWS client: %w", err)
+		return err
 	}
 
-	documentName := "AWS-StartPortForwardingSessionToRemoteHost"
-	parameters := map[string][]string{
-		"localPortNumber": {p.LocalPort},
-		"host":            {p.RemoteHost},
-		"portNumber":      {p.RemotePort},
+	if p.Client == nil {
+		p.Client, err = awsclient.NewClient(ctx)
+		if err != nil {
+			logging.Errorf("Failed to create AWS client: %v", err)
+			return fmt.Errorf("failed to create AWS client: %w", err)
+		}
 	}
 
-	result, err := p.client.SSM.StartSession(p.ctx, &ssm.StartSessionInput{
+	documentName := p.Document.DocumentName()
+	parameters := p.Document.sessionParameters(p.RemoteHost, p.RemotePort, p.LocalPort)
+
+	result, err := p.Client.SSM.StartSession(ctx, &ssm.StartSessionInput{
 		Target:       aws.String(p.InstanceID),
 		DocumentName: aws.String(documentName),
 		Parameters:   parameters,
 	})
 	if err != nil {
 		logging.Errorf("Failed to start SSM session via API: %v", err)
-		return -1, fmt.Errorf("failed to start SSM session: %w", err)
+		return fmt.Errorf("failed to start SSM session: %w", err)
 	}
 
 	p.SessionID = *result.SessionId
@@ -88,57 +115,118 @@ func (p *SSMProxy) StartBackground() (int, error) {
 	sessionInput, err := createSessionInput(result, p.InstanceID, parameters, documentName)
 	if err != nil {
 		logging.Errorf("Failed to create session-manager-plugin input JSON: %v", err)
-		return -1, fmt.Errorf("failed to create session input: %w", err)
+		_ = p.Stop()
+		return fmt.Errorf("failed to create session input: %w", err)
 	}
 
-	pluginPath := getPluginPath()
-	var stderrBuf bytes.Buffer
-	region := p.client.Region
+	region := p.Client.Region
 	if region == "" {
 		logging.Errorf("AWS region not found in AWS client configuration")
-		return -1, fmt.Errorf("AWS region not set for session-manager-plugin invocation")
+		_ = p.Stop()
+		return fmt.Errorf("AWS region not set for session-manager-plugin invocation")
 	}
 	args := []string{sessionInput, region, "StartSession"}
 	p.cmd = exec.Command(pluginPath, args...)
 	p.cmd.Stdout = os.Stdout
-	p.cmd.Stderr = &stderrBuf
+	if p.Stdout != nil {
+		p.cmd.Stdout = p.Stdout
+	}
+	// Only the end of stderr is kept, so that a plugin that keeps writing
+	// to it for a long-lived session does not grow without bound.
+	p.stderr = &util.TailBuffer{Size: pluginStderrTailSize}
+	p.cmd.Stderr = p.stderr
+	if p.Stderr != nil {
+		p.cmd.Stderr = io.MultiWriter(p.stderr, p.Stderr)
+	}
 
 	err = p.cmd.Start()
 	if err != nil {
-		if errMsg := stderrBuf.String(); errMsg != "" {
-			logging.Errorf("session-manager-plugin stderr on start: %s", errMsg)
-		}
 		logging.Errorf("Failed to start session-manager-plugin process: %v", err)
-		return -1, fmt.Errorf("failed to start session-manager-plugin: %w", err)
+		p.cmd = nil
+		_ = p.Stop()
+		return fmt.Errorf("failed to start session-manager-plugin: %w", err)
 	}
 
-	timeout := 30 * time.Second
-	if err := util.WaitForPort(p.LocalPort, timeout); err != nil {
-		errMsg := stderrBuf.String()
-		if errMsg != "" {
-			logging.Errorf("Session-manager-plugin stderr during port wait: %s", errMsg)
+	go func() {
+		p.waitErr = p.cmd.Wait()
+		close(p.done)
+	}()
+
+	portReady := make(chan error, 1)
+	go func() {
+		portReady <- util.WaitForPort(p.LocalPort, 30*time.Second)
+	}()
+
+	select {
+	case err := <-portReady:
+		if err != nil {
+			logging.Errorf("Timed out waiting for local port %s: %v", p.LocalPort, err)
+			_ = p.Stop()
+			if errMsg := p.stderr.String(); errMsg != "" {
+				logging.Errorf("Session-manager-plugin stderr during port wait: %s", errMsg)
+			}
+			return fmt.Errorf("timed out waiting for port %s: %w - check plugin logs, permissions, network, and SSM agent status", p.LocalPort, err)
 		}
-		logging.Errorf("Timed out waiting for local port %s: %v", p.LocalPort, err)
+	case <-p.done:
 		_ = p.Stop()
-		return -1, fmt.Errorf("timed out waiting for port %s: %w - check plugin logs, permissions, network, and SSM agent status", p.LocalPort, err)
+		if errMsg := p.stderr.String(); errMsg != "" {
+			logging.Errorf("Session-manager-plugin stderr: %s", errMsg)
+		}
+		return fmt.Errorf("session-manager-plugin exited before opening port %s: %v", p.LocalPort, p.waitErr)
 	}
 
-	return p.cmd.Process.Pid, nil
+	close(p.ready)
+	return nil
+}
+
+// Ready is closed once the plugin accepts connections on the local port.
+func (p *SSMProxy) Ready() <-chan struct{} {
+	return p.ready
+}
+
+// Done is closed when the plugin process exits.
+func (p *SSMProxy) Done() <-chan struct{} {
+	return p.done
+}
+
+// LocalAddr returns the address the plugin listens on.
+func (p *SSMProxy) LocalAddr() string {
+	return net.JoinHostPort("localhost", p.LocalPort)
+}
+
+// Health reports an error if the plugin has exited or its port refuses connections.
+func (p *SSMProxy) Health(ctx context.Context) error {
+	select {
+	case <-p.done:
+		return fmt.Errorf("session-manager-plugin exited: %v", p.waitErr)
+	default:
+	}
+	return probeAddr(ctx, p.LocalAddr())
 }
 
 func (p *SSMProxy) Stop() error {
 	var firstErr error
 
 	if p.cmd != nil && p.cmd.Process != nil {
-		if err := p.cmd.Process.Signal(os.Interrupt); err != nil {
-			logging.Errorf("Failed to send interrupt signal to session-manager-plugin process: %v", err)
-			firstErr = fmt.Errorf("failed to send interrupt signal to plugin process: %w", err)
+		select {
+		case <-p.done:
+		default:
+			if err := p.cmd.Process.Signal(os.Interrupt); err != nil {
+				logging.Errorf("Failed to send interrupt signal to session-manager-plugin process: %v", err)
+				firstErr = fmt.Errorf("failed to send interrupt signal to plugin process: %w", err)
+			}
+		}
+		select {
+		case <-p.done:
+		case <-time.After(5 * time.Second):
+			logging.Warnf("session-manager-plugin did not exit after interrupt, killing it")
+			_ = p.cmd.Process.Kill()
+			<-p.done
 		}
-		_ = p.cmd.Wait()
 	}
 
-	if p.client != nil && p.SessionID != "" {
-		_, err := p.client.SSM.TerminateSession(p.ctx, &ssm.TerminateSessionInput{
+	if p.Client != nil && p.SessionID != "" {
+		_, err := p.Client.SSM.TerminateSession(p.ctx, &ssm.TerminateSessionInput{
 			SessionId: aws.String(p.SessionID),
 		})
 		if err != nil {
@@ -149,7 +237,6 @@ func (p *SSMProxy) Stop() error {
 		}
 	}
 
-	p.cmd = nil
 	p.SessionID = ""
 
 	return firstErr
@@ -181,12 +268,3 @@ func createSessionInput(session *ssm.StartSessionOutput, instanceID string, para
 
 	return string(jsonBytes), nil
 }
-
-func getPluginPath() string {
-	switch runtime.GOOS {
-	case "windows":
-		return "session-manager-plugin.exe"
-	default:
-		return "session-manager-plugin"
-	}
-}
@@ -0,0 +1,278 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cloudopsy/ekssm/internal/logging"
+)
+
+const (
+	defaultInitialBackoff = 1 * time.Second
+	defaultMaxBackoff     = 1 * time.Minute
+	defaultCheckInterval  = 15 * time.Second
+	healthCheckTimeout    = 5 * time.Second
+)
+
+// Supervisor keeps a tunnel up. When the tunnel stops or fails a health check
+// it builds a new one with NewTunnel and retries with exponential backoff
+// until it succeeds or the supervisor is stopped. Tunnels built by NewTunnel
+// are expected to reuse the same local port, so clients and kubeconfigs keep
+// working across reconnects.
+//
+// Supervisor itself implements Tunnel.
+type Supervisor struct {
+	// NewTunnel builds a fresh tunnel for every connection attempt.
+	NewTunnel func() (Tunnel, error)
+
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// CheckInterval is how often the current tunnel's Health is checked.
+	CheckInterval time.Duration
+
+	// OnDisconnect is called when a running tunnel is found to be down.
+	OnDisconnect func(err error)
+	// OnReconnectError is called when a reconnect attempt fails, before
+	// waiting to retry.
+	OnReconnectError func(attempt int, err error, retryIn time.Duration)
+	// OnReconnect is called after the tunnel has been re-established, with
+	// the total number of successful reconnects so far.
+	OnReconnect func(reconnects int)
+
+	mu         sync.Mutex
+	current    Tunnel
+	reconnects int
+	cancel     context.CancelFunc // set by Start once run is launched
+	stopped    bool
+
+	ready    chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewSupervisor returns a supervisor using the default backoff and health
+// check intervals.
+func NewSupervisor(newTunnel func() (Tunnel, error)) *Supervisor {
+	return &Supervisor{
+		NewTunnel:      newTunnel,
+		InitialBackoff: defaultInitialBackoff,
+		MaxBackoff:     defaultMaxBackoff,
+		CheckInterval:  defaultCheckInterval,
+		ready:          make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+}
+
+// Start establishes the first tunnel. Failures here are returned rather than
+// retried, so misconfiguration is reported straight away. If Stop is called
+// while Start is still connecting, the new tunnel is torn down and Start
+// returns an error.
+func (s *Supervisor) Start(ctx context.Context) error {
+	tunnel, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		_ = tunnel.Stop()
+		return fmt.Errorf("supervisor stopped while starting")
+	}
+	runCtx, cancel := context.WithCancel(context.Background())
+	s.current = tunnel
+	s.cancel = cancel
+	s.mu.Unlock()
+
+	go s.run(runCtx)
+
+	close(s.ready)
+	return nil
+}
+
+// Ready is closed once the first tunnel is up.
+func (s *Supervisor) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Done is closed once the supervisor has been stopped.
+func (s *Supervisor) Done() <-chan struct{} {
+	return s.done
+}
+
+// Health reports the health of the current tunnel.
+func (s *Supervisor) Health(ctx context.Context) error {
+	tunnel := s.Current()
+	if tunnel == nil {
+		return fmt.Errorf("tunnel is reconnecting")
+	}
+	return tunnel.Health(ctx)
+}
+
+// LocalAddr returns the local address of the current tunnel.
+func (s *Supervisor) LocalAddr() string {
+	tunnel := s.Current()
+	if tunnel == nil {
+		return ""
+	}
+	return tunnel.LocalAddr()
+}
+
+// Busy reports whether the current tunnel is busy carrying a connection.
+func (s *Supervisor) Busy() bool {
+	tunnel := s.Current()
+	return tunnel != nil && tunnelBusy(tunnel)
+}
+
+// Current returns the tunnel in use, or nil while reconnecting.
+func (s *Supervisor) Current() Tunnel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.current
+}
+
+// Reconnects returns how many times the tunnel has been re-established.
+func (s *Supervisor) Reconnects() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reconnects
+}
+
+// Stop stops supervising and tears down the current tunnel.
+func (s *Supervisor) Stop() error {
+	var err error
+	s.stopOnce.Do(func() {
+		s.mu.Lock()
+		s.stopped = true
+		cancel := s.cancel
+		s.mu.Unlock()
+
+		// Without a cancel func run was never launched, and Start will not
+		// launch it now that stopped is set.
+		if cancel == nil {
+			close(s.done)
+			return
+		}
+		cancel()
+		<-s.done
+
+		s.mu.Lock()
+		tunnel := s.current
+		s.current = nil
+		s.mu.Unlock()
+		if tunnel != nil {
+			err = tunnel.Stop()
+		}
+	})
+	return err
+}
+
+func (s *Supervisor) connect(ctx context.Context) (Tunnel, error) {
+	tunnel, err := s.NewTunnel()
+	if err != nil {
+		return nil, err
+	}
+	if err := tunnel.Start(ctx); err != nil {
+		_ = tunnel.Stop()
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+func (s *Supervisor) run(ctx context.Context) {
+	defer close(s.done)
+
+	for {
+		err := s.watch(ctx, s.Current())
+		if ctx.Err() != nil {
+			return
+		}
+
+		logging.Warnf("Tunnel went down: %v", err)
+		if s.OnDisconnect != nil {
+			s.OnDisconnect(err)
+		}
+
+		s.mu.Lock()
+		old := s.current
+		s.current = nil
+		s.mu.Unlock()
+		if stopErr := old.Stop(); stopErr != nil {
+			logging.Debugf("Failed to stop dead tunnel cleanly: %v", stopErr)
+		}
+
+		tunnel, ok := s.reconnect(ctx)
+		if !ok {
+			return
+		}
+
+		s.mu.Lock()
+		s.current = tunnel
+		s.reconnects++
+		reconnects := s.reconnects
+		s.mu.Unlock()
+
+		logging.Infof("Tunnel re-established on %s (reconnect #%d)", tunnel.LocalAddr(), reconnects)
+		if s.OnReconnect != nil {
+			s.OnReconnect(reconnects)
+		}
+	}
+}
+
+// watch blocks until the tunnel stops or fails a health check, and returns why.
+func (s *Supervisor) watch(ctx context.Context, tunnel Tunnel) error {
+	ticker := time.NewTicker(s.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tunnel.Done():
+			if err := tunnel.Health(ctx); err != nil {
+				return err
+			}
+			return fmt.Errorf("tunnel closed")
+		case <-ticker.C:
+			checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			err := tunnel.Health(checkCtx)
+			cancel()
+			if err != nil && ctx.Err() == nil {
+				return err
+			}
+		}
+	}
+}
+
+// reconnect retries connect with exponential backoff until it succeeds or
+// ctx is cancelled.
+func (s *Supervisor) reconnect(ctx context.Context) (Tunnel, bool) {
+	backoff := s.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		logging.Infof("Reconnecting tunnel (attempt %d)...", attempt)
+		tunnel, err := s.connect(ctx)
+		if err == nil {
+			return tunnel, true
+		}
+		if ctx.Err() != nil {
+			return nil, false
+		}
+
+		logging.Warnf("Reconnect attempt %d failed: %v (retrying in %s)", attempt, err, backoff)
+		if s.OnReconnectError != nil {
+			s.OnReconnectError(attempt, err, backoff)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, false
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > s.MaxBackoff {
+			backoff = s.MaxBackoff
+		}
+	}
+}
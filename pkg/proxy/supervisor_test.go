@@ -0,0 +1,117 @@
+package proxy_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudopsy/ekssm/internal/util"
+	"github.com/cloudopsy/ekssm/pkg/proxy"
+)
+
+func TestSupervisorReconnectsOnSamePort(t *testing.T) {
+	port, err := util.FindAvailablePort()
+	require.NoError(t, err)
+	remote := startLineServer(t)
+	host, remotePort, err := net.SplitHostPort(remote)
+	require.NoError(t, err)
+
+	var (
+		mu       sync.Mutex
+		tunnels  []proxy.Tunnel
+		attempts int
+	)
+	s := proxy.NewSupervisor(func() (proxy.Tunnel, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		// Fail the first reconnect attempt to exercise the backoff path.
+		if attempts == 2 {
+			return nil, errors.New("bastion unavailable")
+		}
+		tunnel := proxy.NewDirectProxy(port, host, remotePort)
+		tunnels = append(tunnels, tunnel)
+		return tunnel, nil
+	})
+	s.InitialBackoff = 10 * time.Millisecond
+	s.CheckInterval = 10 * time.Millisecond
+
+	var (
+		eventsMu   sync.Mutex
+		failures   []error
+		reconnects int
+	)
+	s.OnReconnectError = func(_ int, err error, _ time.Duration) {
+		eventsMu.Lock()
+		defer eventsMu.Unlock()
+		failures = append(failures, err)
+	}
+	s.OnReconnect = func(n int) {
+		eventsMu.Lock()
+		defer eventsMu.Unlock()
+		reconnects = n
+	}
+
+	require.NoError(t, s.Start(context.Background()))
+	defer s.Stop()
+	assert.Equal(t, "echo: first\n", roundTrip(t, port, "first"))
+
+	// Simulate the tunnel dying underneath the supervisor.
+	mu.Lock()
+	require.NoError(t, tunnels[0].Stop())
+	mu.Unlock()
+
+	require.Eventually(t, func() bool { return s.Reconnects() == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "echo: second\n", roundTrip(t, port, "second"))
+
+	eventsMu.Lock()
+	assert.Equal(t, 1, reconnects)
+	require.Len(t, failures, 1)
+	assert.EqualError(t, failures[0], "bastion unavailable")
+	eventsMu.Unlock()
+
+	require.NoError(t, s.Stop())
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("supervisor did not report completion after Stop")
+	}
+}
+
+func TestSupervisorStopDuringStartTearsDownTunnel(t *testing.T) {
+	port, err := util.FindAvailablePort()
+	require.NoError(t, err)
+	remote := startLineServer(t)
+	host, remotePort, err := net.SplitHostPort(remote)
+	require.NoError(t, err)
+
+	building := make(chan struct{})
+	proceed := make(chan struct{})
+	var tunnel proxy.Tunnel
+	s := proxy.NewSupervisor(func() (proxy.Tunnel, error) {
+		close(building)
+		<-proceed
+		tunnel = proxy.NewDirectProxy(port, host, remotePort)
+		return tunnel, nil
+	})
+
+	started := make(chan error, 1)
+	go func() { started <- s.Start(context.Background()) }()
+
+	<-building
+	require.NoError(t, s.Stop())
+	close(proceed)
+
+	assert.Error(t, <-started)
+	select {
+	case <-tunnel.Done():
+	case <-time.After(time.Second):
+		t.Fatal("tunnel started after Stop was not torn down")
+	}
+}
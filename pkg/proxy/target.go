@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+
+	"github.com/cloudopsy/ekssm/internal/logging"
+)
+
+// ecsTargetPrefix starts the SSM target of an ECS task container, and of an
+// ECS service to look a task up in.
+const ecsTargetPrefix = "ecs:"
+
+var (
+	ec2TargetPattern     = regexp.MustCompile(`^i-[0-9a-f]{8}([0-9a-f]{9})?$`)
+	managedTargetPattern = regexp.MustCompile(`^mi-[0-9a-f]{17}$`)
+	ecsTargetPattern     = regexp.MustCompile(`^ecs:[A-Za-z0-9_-]+_[0-9a-f]{32}_[0-9a-f]+(-[0-9]+)?$`)
+	ecsNamePattern       = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+// ValidateTarget checks that target is something an SSM session can be
+// started through: an EC2 instance (i-...), a hybrid managed node (mi-...),
+// an ECS task container with ECS Exec (ecs:<cluster>_<taskId>_<runtimeId>),
+// or an ECS service whose running task is looked up for every tunnel
+// (ecs:<cluster>/<service>/<container>).
+func ValidateTarget(target string) error {
+	if _, ok, err := ParseECSService(target); ok {
+		return err
+	}
+	if ec2TargetPattern.MatchString(target) || managedTargetPattern.MatchString(target) || ecsTargetPattern.MatchString(target) {
+		return nil
+	}
+	return fmt.Errorf("invalid target %q (expected i-<id>, mi-<id>, ecs:<cluster>_<taskId>_<runtimeId> or ecs:<cluster>/<service>/<container>)", target)
+}
+
+// isInstanceTarget reports whether target is an EC2 instance or managed node,
+// whose ping status DescribeInstanceInformation reports.
+func isInstanceTarget(target string) bool {
+	return strings.HasPrefix(target, "i-") || strings.HasPrefix(target, "mi-")
+}
+
+// ECSService names a container of an ECS service. A tunnel through it goes
+// through that container of one of the service's running tasks.
+type ECSService struct {
+	Cluster   string
+	Service   string
+	Container string
+}
+
+func (s ECSService) String() string {
+	return ecsTargetPrefix + s.Cluster + "/" + s.Service + "/" + s.Container
+}
+
+// ParseECSService parses an ecs:<cluster>/<service>/<container> target. ok is
+// false for targets of any other form.
+func ParseECSService(target string) (service ECSService, ok bool, err error) {
+	spec, found := strings.CutPrefix(target, ecsTargetPrefix)
+	if !found || !strings.Contains(spec, "/") {
+		return ECSService{}, false, nil
+	}
+	parts := strings.Split(spec, "/")
+	if len(parts) != 3 {
+		return ECSService{}, true, fmt.Errorf("invalid ECS service target %q (expected ecs:<cluster>/<service>/<container>)", target)
+	}
+	for _, part := range parts {
+		if !ecsNamePattern.MatchString(part) {
+			return ECSService{}, true, fmt.Errorf("invalid ECS service target %q (expected ecs:<cluster>/<service>/<container>)", target)
+		}
+	}
+	return ECSService{Cluster: parts[0], Service: parts[1], Container: parts[2]}, true, nil
+}
+
+// ECSAPI is the subset of the ECS API used to find a service's tasks.
+type ECSAPI interface {
+	ListTasks(ctx context.Context, params *ecs.ListTasksInput, optFns ...func(*ecs.Options)) (*ecs.ListTasksOutput, error)
+	DescribeTasks(ctx context.Context, params *ecs.DescribeTasksInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTasksOutput, error)
+}
+
+// ResolveECSTarget returns the SSM target of the service's container in one
+// of its running tasks whose ECS Exec agent is running.
+func ResolveECSTarget(ctx context.Context, api ECSAPI, service ECSService) (string, error) {
+	var taskARNs []string
+	input := &ecs.ListTasksInput{
+		Cluster:       aws.String(service.Cluster),
+		ServiceName:   aws.String(service.Service),
+		DesiredStatus: ecstypes.DesiredStatusRunning,
+	}
+	for {
+		output, err := api.ListTasks(ctx, input)
+		if err != nil {
+			return "", fmt.Errorf("failed to list tasks of ECS service %s in cluster %s: %w", service.Service, service.Cluster, err)
+		}
+		taskARNs = append(taskARNs, output.TaskArns...)
+		if aws.ToString(output.NextToken) == "" {
+			break
+		}
+		input.NextToken = output.NextToken
+	}
+	if len(taskARNs) == 0 {
+		return "", fmt.Errorf("ECS service %s in cluster %s has no running task", service.Service, service.Cluster)
+	}
+
+	// DescribeTasks takes at most 100 tasks at a time.
+	for start := 0; start < len(taskARNs); start += 100 {
+		end := min(start+100, len(taskARNs))
+		output, err := api.DescribeTasks(ctx, &ecs.DescribeTasksInput{
+			Cluster: aws.String(service.Cluster),
+			Tasks:   taskARNs[start:end],
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to describe tasks of ECS service %s in cluster %s: %w", service.Service, service.Cluster, err)
+		}
+		for _, task := range output.Tasks {
+			if target, ok := ecsTaskTarget(service, task); ok {
+				logging.Debugf("ECS service %s resolved to %s", service, target)
+				return target, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no running task of ECS service %s in cluster %s has container %s with ECS Exec running", service.Service, service.Cluster, service.Container)
+}
+
+// ecsTaskTarget returns the SSM target of the service's container in task,
+// if the task is running and ECS Exec is running in the container.
+func ecsTaskTarget(service ECSService, task ecstypes.Task) (string, bool) {
+	if aws.ToString(task.LastStatus) != "RUNNING" || !task.EnableExecuteCommand {
+		return "", false
+	}
+	arn := aws.ToString(task.TaskArn)
+	taskID := arn[strings.LastIndex(arn, "/")+1:]
+	for _, container := range task.Containers {
+		if aws.ToString(container.Name) != service.Container || aws.ToString(container.RuntimeId) == "" {
+			continue
+		}
+		for _, agent := range container.ManagedAgents {
+			if agent.Name == ecstypes.ManagedAgentNameExecuteCommandAgent && aws.ToString(agent.LastStatus) == "RUNNING" {
+				return fmt.Sprintf("%s%s_%s_%s", ecsTargetPrefix, service.Cluster, taskID, aws.ToString(container.RuntimeId)), true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,133 @@
+package proxy_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudopsy/ekssm/internal/ssmtest"
+	"github.com/cloudopsy/ekssm/pkg/proxy"
+)
+
+const (
+	bastionTaskID    = "0123456789abcdef0123456789abcdef"
+	bastionRuntimeID = "0123456789abcdef0123456789abcdef-1234567890"
+)
+
+// fakeECS runs the tasks of one service in cluster "tools".
+type fakeECS struct {
+	tasks []ecstypes.Task
+}
+
+func (f *fakeECS) ListTasks(_ context.Context, params *ecs.ListTasksInput, _ ...func(*ecs.Options)) (*ecs.ListTasksOutput, error) {
+	output := &ecs.ListTasksOutput{}
+	if aws.ToString(params.Cluster) != "tools" || aws.ToString(params.ServiceName) != "bastion" {
+		return output, nil
+	}
+	for _, task := range f.tasks {
+		output.TaskArns = append(output.TaskArns, aws.ToString(task.TaskArn))
+	}
+	return output, nil
+}
+
+func (f *fakeECS) DescribeTasks(_ context.Context, params *ecs.DescribeTasksInput, _ ...func(*ecs.Options)) (*ecs.DescribeTasksOutput, error) {
+	output := &ecs.DescribeTasksOutput{}
+	for _, task := range f.tasks {
+		for _, arn := range params.Tasks {
+			if aws.ToString(task.TaskArn) == arn {
+				output.Tasks = append(output.Tasks, task)
+			}
+		}
+	}
+	return output, nil
+}
+
+func bastionTask(taskID, runtimeID, agentStatus string) ecstypes.Task {
+	return ecstypes.Task{
+		TaskArn:              aws.String("arn:aws:ecs:eu-west-1:123456789012:task/tools/" + taskID),
+		LastStatus:           aws.String("RUNNING"),
+		EnableExecuteCommand: true,
+		Containers: []ecstypes.Container{
+			{Name: aws.String("sidecar"), RuntimeId: aws.String(taskID + "-1")},
+			{
+				Name:      aws.String("ssm"),
+				RuntimeId: aws.String(runtimeID),
+				ManagedAgents: []ecstypes.ManagedAgent{
+					{Name: ecstypes.ManagedAgentNameExecuteCommandAgent, LastStatus: aws.String(agentStatus)},
+				},
+			},
+		},
+	}
+}
+
+func TestValidateTarget(t *testing.T) {
+	for _, target := range []string{
+		"i-0123456789abcdef0",
+		"i-01234567",
+		"mi-0123456789abcdef0",
+		"ecs:tools_" + bastionTaskID + "_" + bastionRuntimeID,
+		"ecs:my_cluster_" + bastionTaskID + "_" + bastionRuntimeID,
+		"ecs:tools/bastion/ssm",
+	} {
+		assert.NoError(t, proxy.ValidateTarget(target), target)
+	}
+	for _, target := range []string{
+		"",
+		"bastion",
+		"i-xyz",
+		"mi-0123",
+		"ecs:tools",
+		"ecs:tools/bastion",
+		"ecs:tools/bastion/ssm/extra",
+		"ecs:tools//ssm",
+	} {
+		assert.Error(t, proxy.ValidateTarget(target), target)
+	}
+}
+
+func TestResolveECSTarget(t *testing.T) {
+	const startingTaskID = "fedcba9876543210fedcba9876543210"
+	api := &fakeECS{tasks: []ecstypes.Task{
+		bastionTask(startingTaskID, startingTaskID+"-1", "PENDING"),
+		bastionTask(bastionTaskID, bastionRuntimeID, "RUNNING"),
+	}}
+
+	target, err := proxy.ResolveECSTarget(context.Background(), api, proxy.ECSService{Cluster: "tools", Service: "bastion", Container: "ssm"})
+	require.NoError(t, err)
+	assert.Equal(t, "ecs:tools_"+bastionTaskID+"_"+bastionRuntimeID, target)
+	assert.NoError(t, proxy.ValidateTarget(target))
+
+	_, err = proxy.ResolveECSTarget(context.Background(), api, proxy.ECSService{Cluster: "tools", Service: "bastion", Container: "app"})
+	assert.ErrorContains(t, err, "has container app with ECS Exec running")
+
+	_, err = proxy.ResolveECSTarget(context.Background(), api, proxy.ECSService{Cluster: "tools", Service: "web", Container: "ssm"})
+	assert.ErrorContains(t, err, "has no running task")
+}
+
+func TestBastionsOrderResolvesECSServices(t *testing.T) {
+	agent := ssmtest.NewAgent(t, startLineServer(t))
+	agent.Offline = []string{"i-aaaaaaaaaaaaaaaaa"}
+
+	bastions := proxy.NewBastions([]string{"i-aaaaaaaaaaaaaaaaa", "ecs:tools/bastion/ssm", "mi-bbbbbbbbbbbbbbbbb"})
+	bastions.API = agent
+	bastions.ECS = &fakeECS{tasks: []ecstypes.Task{bastionTask(bastionTaskID, bastionRuntimeID, "RUNNING")}}
+
+	order, err := bastions.Order(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ecs:tools_" + bastionTaskID + "_" + bastionRuntimeID, "mi-bbbbbbbbbbbbbbbbb", "i-aaaaaaaaaaaaaaaaa"}, order)
+
+	// A service without a usable task is skipped while other bastions remain.
+	bastions.ECS = &fakeECS{}
+	order, err = bastions.Order(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"mi-bbbbbbbbbbbbbbbbb", "i-aaaaaaaaaaaaaaaaa"}, order)
+
+	bastions.InstanceIDs = []string{"ecs:tools/bastion/ssm"}
+	_, err = bastions.Order(context.Background())
+	assert.ErrorContains(t, err, "has no running task")
+}
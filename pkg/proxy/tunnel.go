@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	awsclient "github.com/cloudopsy/ekssm/pkg/aws"
+)
+
+// Backend names accepted by NewTunnel.
+const (
+	BackendSSM    = "ssm"    // built-in SSM data channel client
+	BackendPlugin = "plugin" // external session-manager-plugin
+	BackendDirect = "direct" // plain TCP to a publicly reachable endpoint
+
+	// DefaultBackend stays on the plugin, which multiplexes connections on
+	// every agent version; the built-in client is opt-in.
+	DefaultBackend = BackendPlugin
+)
+
+// Backends lists the supported tunnel backends.
+var Backends = []string{BackendSSM, BackendPlugin, BackendDirect}
+
+// Tunnel is a local listener that forwards connections to a remote host.
+type Tunnel interface {
+	// Start establishes the tunnel and returns once it is ready for use.
+	Start(ctx context.Context) error
+	// Ready is closed once the local address accepts connections.
+	Ready() <-chan struct{}
+	// Done is closed when the tunnel has stopped, for whatever reason.
+	Done() <-chan struct{}
+	// Health reports an error if the tunnel can no longer carry traffic.
+	Health(ctx context.Context) error
+	// LocalAddr returns the host:port clients connect to, or the socket path
+	// for tunnels listening on a Unix socket.
+	LocalAddr() string
+	// Stop tears the tunnel down and releases its remote resources.
+	Stop() error
+}
+
+// busyReporter is implemented by tunnels that can only carry one connection
+// at a time. Busy reports whether a new connection would have to wait.
+type busyReporter interface {
+	Busy() bool
+}
+
+// tunnelBusy reports whether tunnel is busy carrying another connection.
+func tunnelBusy(tunnel Tunnel) bool {
+	b, ok := tunnel.(busyReporter)
+	return ok && b.Busy()
+}
+
+var (
+	_ Tunnel = (*SSMProxy)(nil)
+	_ Tunnel = (*NativeSSMProxy)(nil)
+	_ Tunnel = (*DirectProxy)(nil)
+	_ Tunnel = (*ConnectShim)(nil)
+)
+
+// NewTunnel returns the tunnel implementation for the named backend.
+func NewTunnel(backend, instanceID, localPort, remoteHost, remotePort string) (Tunnel, error) {
+	switch backend {
+	case BackendSSM:
+		return NewNativeSSMProxy(instanceID, localPort, remoteHost, remotePort), nil
+	case BackendPlugin, "":
+		return NewSSMProxy(instanceID, localPort, remoteHost, remotePort), nil
+	case BackendDirect:
+		return NewDirectProxy(localPort, remoteHost, remotePort), nil
+	default:
+		return nil, ValidateBackend(backend)
+	}
+}
+
+// WithAWS makes tunnel call AWS through client instead of a client built
+// from the default AWS configuration, and returns it.
+func WithAWS(tunnel Tunnel, client *awsclient.Client) Tunnel {
+	switch t := tunnel.(type) {
+	case *NativeSSMProxy:
+		t.API = client.SSM
+	case *SSMProxy:
+		t.Client = client
+	case *SOCKSProxy:
+		t.API = client.SSM
+	}
+	return tunnel
+}
+
+// NewSocketTunnel returns a tunnel for the named backend that listens on the
+// Unix socket at socketPath instead of a TCP port. The plugin backend always
+// binds a TCP port itself, so it cannot serve a socket.
+func NewSocketTunnel(backend, instanceID, socketPath, remoteHost, remotePort string) (Tunnel, error) {
+	if err := ValidateSocketBackend(backend); err != nil {
+		return nil, err
+	}
+	switch backend {
+	case BackendDirect:
+		p := NewDirectProxy("", remoteHost, remotePort)
+		p.SocketPath = socketPath
+		return p, nil
+	default:
+		p := NewNativeSSMProxy(instanceID, "", remoteHost, remotePort)
+		p.SocketPath = socketPath
+		return p, nil
+	}
+}
+
+// ValidateSocketBackend returns an error if backend cannot listen on a Unix socket.
+func ValidateSocketBackend(backend string) error {
+	switch backend {
+	case BackendSSM, BackendDirect:
+		return nil
+	default:
+		return fmt.Errorf("Unix socket listeners are not supported by the %s backend (use %s or %s)", backend, BackendSSM, BackendDirect)
+	}
+}
+
+// ValidateBackend returns an error for unknown backend names.
+func ValidateBackend(backend string) error {
+	for _, b := range Backends {
+		if backend == b {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown backend %q (supported: %v)", backend, Backends)
+}
+
+// RequiresInstance reports whether the backend tunnels through an SSM target.
+func RequiresInstance(backend string) bool {
+	return backend != BackendDirect
+}
+
+// LocalNetwork returns the network to dial a tunnel's LocalAddr on: "unix"
+// for socket paths, "tcp" for host:port addresses.
+func LocalNetwork(addr string) string {
+	if filepath.IsAbs(addr) {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// listenLocal binds a tunnel's local listener: the Unix socket at socketPath
+// when set, otherwise 127.0.0.1:localPort. The socket's directory and the
+// socket itself are accessible to the owner only.
+func listenLocal(localPort, socketPath string) (net.Listener, error) {
+	if socketPath == "" {
+		if localPort == "" {
+			return nil, fmt.Errorf("localPort is required")
+		}
+		listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", localPort))
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on local port %s: %w", localPort, err)
+		}
+		return listener, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	// A socket left behind by a process that was killed would make the
+	// listen fail; nothing can be listening on it any more.
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale socket %s: %w", socketPath, err)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on socket %s: %w", socketPath, err)
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict socket %s: %w", socketPath, err)
+	}
+	return listener, nil
+}
+
+// localAddr returns the LocalAddr of a tunnel listening as listenLocal does.
+func localAddr(localPort, socketPath string) string {
+	if socketPath != "" {
+		return socketPath
+	}
+	return net.JoinHostPort("127.0.0.1", localPort)
+}
+
+// probeAddr checks that addr accepts TCP connections.
+func probeAddr(ctx context.Context, addr string) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("%s is not accepting connections: %w", addr, err)
+	}
+	return conn.Close()
+}
+
+// closeWriter is implemented by connections that support half-close, such as
+// *net.TCPConn and smux streams.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// pipe copies data in both directions until either side is done, then closes both.
+func pipe(a, b io.ReadWriteCloser) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyAndClose := func(dst, src io.ReadWriteCloser) {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+		if cw, ok := dst.(closeWriter); ok {
+			_ = cw.CloseWrite()
+		} else {
+			_ = dst.Close()
+		}
+	}
+	go copyAndClose(a, b)
+	go copyAndClose(b, a)
+	wg.Wait()
+	a.Close()
+	b.Close()
+}